@@ -0,0 +1,332 @@
+package indigo
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// Decision is a tamper-evident record of an evaluation: what was evaluated,
+// against which input, and the outcome. See Result.SignedRecord.
+type Decision struct {
+	// The SHA-256 hash of the input data, in hex
+	InputHash string `json:"input_hash"`
+	// The SHA-256 hash of the rule tree, in hex. The hash covers the rule IDs,
+	// expressions, result types, evaluator tags, schemas, outputs, messages and
+	// child rules.
+	RuleHash string `json:"rule_hash"`
+	// The result of the evaluation, as produced by Result.ToJSON
+	Outcome json.RawMessage `json:"outcome"`
+}
+
+// SignedDecision is a Decision and the signature of its JSON encoding.
+type SignedDecision struct {
+	Decision  Decision `json:"decision"`
+	Signature []byte   `json:"signature"`
+}
+
+// SignedRecord creates a record of the decision made by the evaluation that
+// produced the result, and signs it with the signer. The data must be the data
+// passed to Eval; it is hashed with the type of each value, and data that
+// can't be hashed unambiguously, such as structs with unexported fields, is
+// an error. Use Verify to check that the record has not been altered.
+//
+// ECDSA and RSA signers sign the SHA-256 hash of the record (RSA using
+// PKCS #1 v1.5); Ed25519 signers sign the record itself.
+func (u *Result) SignedRecord(signer crypto.Signer, data map[string]interface{}) (SignedDecision, error) {
+	if u == nil || u.Rule == nil {
+		return SignedDecision{}, fmt.Errorf("result is nil or has no rule")
+	}
+
+	outcome, err := u.ToJSON()
+	if err != nil {
+		return SignedDecision{}, err
+	}
+
+	inputHash, err := hashData(data)
+	if err != nil {
+		return SignedDecision{}, fmt.Errorf("hashing input: %w", err)
+	}
+
+	d := Decision{
+		InputHash: inputHash,
+		RuleHash:  hashRule(u.Rule),
+		Outcome:   outcome,
+	}
+
+	record, err := json.Marshal(d)
+	if err != nil {
+		return SignedDecision{}, err
+	}
+
+	var sig []byte
+	switch signer.Public().(type) {
+	case ed25519.PublicKey:
+		sig, err = signer.Sign(rand.Reader, record, crypto.Hash(0))
+	default:
+		digest := sha256.Sum256(record)
+		sig, err = signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	}
+	if err != nil {
+		return SignedDecision{}, fmt.Errorf("signing decision: %w", err)
+	}
+
+	return SignedDecision{Decision: d, Signature: sig}, nil
+}
+
+// Verify checks that the signed decision was signed by the private key
+// belonging to the public key, and that the decision has not been altered.
+// The public key must be an *ecdsa.PublicKey, *rsa.PublicKey or
+// ed25519.PublicKey.
+func Verify(pub crypto.PublicKey, sd SignedDecision) error {
+	record, err := json.Marshal(sd.Decision)
+	if err != nil {
+		return err
+	}
+	digest := sha256.Sum256(record)
+
+	switch k := pub.(type) {
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(k, digest[:], sd.Signature) {
+			return fmt.Errorf("invalid signature")
+		}
+	case *rsa.PublicKey:
+		if err := rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sd.Signature); err != nil {
+			return fmt.Errorf("invalid signature: %w", err)
+		}
+	case ed25519.PublicKey:
+		if !ed25519.Verify(k, record, sd.Signature) {
+			return fmt.Errorf("invalid signature")
+		}
+	default:
+		return fmt.Errorf("unsupported public key type %T", pub)
+	}
+	return nil
+}
+
+// hashData hashes the data, with the keys in sorted order. Each value is
+// hashed with its type, so that values CEL treats differently, such as
+// int64(1) and float64(1), have different hashes. Protocol buffer messages
+// are hashed in their deterministic binary encoding. Values that can't be
+// hashed unambiguously, such as structs with unexported fields, are an
+// error.
+func hashData(data map[string]interface{}) (string, error) {
+	h := sha256.New()
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		writeField(h, k)
+		if err := writeValue(h, reflect.ValueOf(data[k]), 0); err != nil {
+			return "", fmt.Errorf("key %s: %w", k, err)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// maxValueDepth limits how deeply nested a value hashed by writeValue can
+// be, so that a value that refers to itself is an error rather than a stack
+// overflow
+const maxValueDepth = 1000
+
+// writeValue writes the value and its type to the hash, recursively
+func writeValue(w io.Writer, v reflect.Value, depth int) error {
+	if depth > maxValueDepth {
+		return fmt.Errorf("value nested more than %d levels deep", maxValueDepth)
+	}
+	if !v.IsValid() {
+		writeField(w, "<nil>")
+		return nil
+	}
+	writeField(w, v.Type().String())
+
+	if m, ok := v.Interface().(proto.Message); ok && v.Kind() != reflect.Interface {
+		b, err := proto.MarshalOptions{Deterministic: true}.Marshal(m)
+		if err != nil {
+			return err
+		}
+		writeField(w, string(b))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64, reflect.Complex64, reflect.Complex128, reflect.String:
+		writeField(w, fmt.Sprintf("%v", v))
+	case reflect.Interface, reflect.Pointer:
+		if v.IsNil() {
+			writeField(w, "<nil>")
+			return nil
+		}
+		return writeValue(w, v.Elem(), depth+1)
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8 {
+			writeField(w, string(v.Bytes()))
+			return nil
+		}
+		writeField(w, strconv.Itoa(v.Len()))
+		for i := 0; i < v.Len(); i++ {
+			if err := writeValue(w, v.Index(i), depth+1); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		// Write the entries in the order of their encoded keys
+		entries := make([][2]string, 0, v.Len())
+		for it := v.MapRange(); it.Next(); {
+			var k, e strings.Builder
+			if err := writeValue(&k, it.Key(), depth+1); err != nil {
+				return err
+			}
+			if err := writeValue(&e, it.Value(), depth+1); err != nil {
+				return err
+			}
+			entries = append(entries, [2]string{k.String(), e.String()})
+		}
+		sort.Slice(entries, func(i, j int) bool { return entries[i][0] < entries[j][0] })
+		writeField(w, strconv.Itoa(len(entries)))
+		for _, e := range entries {
+			writeField(w, e[0])
+			writeField(w, e[1])
+		}
+	case reflect.Struct:
+		// Structs that encode themselves, such as time.Time, use their
+		// encoding; other structs must have only exported fields, since
+		// the unexported fields can't be read
+		if m, ok := v.Interface().(json.Marshaler); ok {
+			b, err := m.MarshalJSON()
+			if err != nil {
+				return err
+			}
+			writeField(w, string(b))
+			return nil
+		}
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			if !t.Field(i).IsExported() {
+				return fmt.Errorf("%v has unexported field %s", t, t.Field(i).Name)
+			}
+			writeField(w, t.Field(i).Name)
+			if err := writeValue(w, v.Field(i), depth+1); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("values of type %v can't be hashed", v.Type())
+	}
+	return nil
+}
+
+// hashRule hashes the rule and its children, with the children in
+// order of their IDs
+func hashRule(r *Rule) string {
+	h := sha256.New()
+	writeRule(h, r, false)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// writeRule writes the rule and its children to the hash. If options is
+// set, the serializable EvalOptions of the rules are included.
+//
+// The fields added to Rule and DataElement over time, such as the evaluator
+// tag and the message, are only written if they are set, so adding a field
+// doesn't change the hashes of the rules that don't use it.
+func writeRule(h hash.Hash, r *Rule, options bool) {
+	if r == nil {
+		writeField(h, "<nil>")
+		return
+	}
+	writeField(h, r.ID)
+	writeField(h, r.Expr)
+	writeField(h, fmt.Sprintf("%v", r.ResultType))
+	if r.Evaluator != "" {
+		writeField(h, "evaluator="+r.Evaluator)
+	}
+	writeField(h, r.Schema.ID)
+	for _, e := range r.Schema.Elements {
+		writeField(h, e.Name)
+		writeField(h, fmt.Sprintf("%v", e.Type))
+		if e.Alias != "" {
+			writeField(h, "alias="+e.Alias)
+		}
+		if e.Default != nil {
+			writeField(h, fmt.Sprintf("default=%T:%v", e.Default, e.Default))
+		}
+	}
+	outputs := make([]string, 0, len(r.Outputs))
+	for name := range r.Outputs {
+		outputs = append(outputs, name)
+	}
+	sort.Strings(outputs)
+	writeField(h, fmt.Sprintf("%d", len(outputs)))
+	for _, name := range outputs {
+		writeField(h, name)
+		writeField(h, r.Outputs[name])
+	}
+	if r.Message != "" {
+		writeField(h, "message="+r.Message)
+	}
+	if r.Priority != 0 {
+		writeField(h, fmt.Sprintf("priority=%d", r.Priority))
+	}
+	if r.ShardCondition != "" {
+		writeField(h, "shard="+r.ShardCondition)
+	}
+	if len(r.Order) > 0 {
+		writeField(h, fmt.Sprintf("order=%d", len(r.Order)))
+		for _, id := range r.Order {
+			writeField(h, id)
+		}
+	}
+	if r.ResultKey != "" {
+		writeField(h, "resultkey="+r.ResultKey)
+	}
+	if r.EffectiveFrom != nil {
+		writeField(h, "from="+r.EffectiveFrom.UTC().Format(time.RFC3339Nano))
+	}
+	if r.EffectiveTo != nil {
+		writeField(h, "to="+r.EffectiveTo.UTC().Format(time.RFC3339Nano))
+	}
+	// A nil list allows all fields, and an empty one none
+	if r.AllowedFields != nil {
+		writeField(h, fmt.Sprintf("allowed=%d", len(r.AllowedFields)))
+		for _, f := range r.AllowedFields {
+			writeField(h, f)
+		}
+	}
+	if options {
+		// The fields that can't be serialized, such as SortFunc, are
+		// excluded from the JSON encoding, so encoding doesn't fail
+		b, _ := json.Marshal(r.EvalOptions)
+		writeField(h, string(b))
+	}
+	writeField(h, fmt.Sprintf("%d", len(r.Rules)))
+	for _, k := range r.sortedChildKeys() {
+		writeRule(h, r.Rules[k], options)
+	}
+}
+
+// writeField writes the length of the string followed by the string, so that
+// the boundaries between fields are unambiguous
+func writeField(w io.Writer, s string) {
+	fmt.Fprintf(w, "%d:%s", len(s), s)
+}
@@ -0,0 +1,79 @@
+package indigo_test
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+
+	"github.com/ezachrisen/indigo"
+	"github.com/matryer/is"
+)
+
+// Test that a signed decision record verifies, and that altering it
+// invalidates the signature
+func TestSignedRecord(t *testing.T) {
+	is := is.New(t)
+
+	e := indigo.NewEngine(newMockEvaluator())
+	r := makeRule()
+	is.NoErr(e.Compile(r))
+
+	data := map[string]interface{}{"customer": "a", "amount": 100}
+	u, err := e.Eval(context.Background(), r, data)
+	is.NoErr(err)
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	is.NoErr(err)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	is.NoErr(err)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	is.NoErr(err)
+
+	for _, signer := range []crypto.Signer{ecKey, rsaKey, edKey} {
+		sd, err := u.SignedRecord(signer, data)
+		is.NoErr(err)
+		is.NoErr(indigo.Verify(signer.Public(), sd))
+
+		// The same input gives the same input hash; different input, a different hash
+		sd2, err := u.SignedRecord(signer, map[string]interface{}{"amount": 100, "customer": "a"})
+		is.NoErr(err)
+		is.Equal(sd.Decision.InputHash, sd2.Decision.InputHash)
+		is.Equal(sd.Decision.RuleHash, sd2.Decision.RuleHash)
+
+		altered := sd
+		altered.Decision.InputHash = sd2.Decision.RuleHash
+		is.True(indigo.Verify(signer.Public(), altered) != nil)
+
+		altered = sd
+		altered.Decision.Outcome = []byte(`{"rule_id":"rule1","pass":true}`)
+		is.True(indigo.Verify(signer.Public(), altered) != nil)
+	}
+
+	// A changed rule tree has a different hash
+	sd, err := u.SignedRecord(ecKey, data)
+	is.NoErr(err)
+	r.Rules["B"].Expr = "true"
+	u, err = e.Eval(context.Background(), r, data)
+	is.NoErr(err)
+	sd2, err := u.SignedRecord(ecKey, data)
+	is.NoErr(err)
+	is.True(sd.Decision.RuleHash != sd2.Decision.RuleHash)
+
+	// Values of different types have different input hashes, even if they
+	// encode the same way
+	sd, err = u.SignedRecord(ecKey, map[string]interface{}{"amount": int64(100)})
+	is.NoErr(err)
+	sd2, err = u.SignedRecord(ecKey, map[string]interface{}{"amount": float64(100)})
+	is.NoErr(err)
+	is.True(sd.Decision.InputHash != sd2.Decision.InputHash)
+
+	// A record signed by another key doesn't verify
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	is.NoErr(err)
+	is.True(indigo.Verify(otherKey.Public(), sd) != nil)
+}
@@ -0,0 +1,120 @@
+package indigo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// EvalBatch evaluates the rule against each of the data items, calling onResult
+// with the index of the item and the result or error of evaluating it. Unlike
+// calling Eval in a loop and collecting the results, the caller decides what to
+// keep, which bounds the memory used for very large batches.
+//
+// By default the items are evaluated one at a time, and onResult is called in
+// item order. With the BatchWorkers option, items are evaluated concurrently
+// and onResult is called in the order the evaluations finish. Calls to
+// onResult are never concurrent.
+//
+// If the context is canceled, EvalBatch stops evaluating items and returns the
+// context's error; onResult is not called for the items not yet evaluated.
+// Each item is evaluated with its own copy of the data map, so the data items
+// are not modified and the rule's Self object is not shared between items.
+func (e *DefaultEngine) EvalBatch(ctx context.Context, r *Rule, data []map[string]interface{},
+	onResult func(i int, u *Result, err error), opts ...EvalOption) error {
+
+	switch {
+	case r == nil:
+		return fmt.Errorf("rule is nil")
+	case e == nil:
+		return fmt.Errorf("engine is nil")
+	case e.e == nil:
+		return fmt.Errorf("evaluator is nil")
+	case onResult == nil:
+		return fmt.Errorf("onResult is nil")
+	}
+
+	o := e.evalOptions(r, opts...)
+
+	if o.BatchWorkers <= 1 {
+		for i := range data {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			u, err := e.Eval(ctx, r, copyData(data[i]), opts...)
+			onResult(i, u, err)
+		}
+		return nil
+	}
+
+	items := make(chan int)
+	var mu sync.Mutex // serializes calls to onResult
+	var wg sync.WaitGroup
+
+	for w := 0; w < o.BatchWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range items {
+				u, err := e.Eval(ctx, r, copyData(data[i]), opts...)
+				mu.Lock()
+				onResult(i, u, err)
+				mu.Unlock()
+			}
+		}()
+	}
+
+dispatch:
+	for i := range data {
+		select {
+		case <-ctx.Done():
+			break dispatch
+		case items <- i:
+		}
+	}
+	close(items)
+	wg.Wait()
+
+	return ctx.Err()
+}
+
+// EvalRecords evaluates the rule against each of the data records and returns
+// the results in the order of the records. It is a convenience for EvalBatch
+// when all the results are needed; use the ParallelRecords option to evaluate
+// the records concurrently.
+//
+// If evaluating a record fails, its result is nil, and the error, prefixed
+// with the index of the record, is included in the returned error. The errors
+// of all the failed records are joined with errors.Join, in record order.
+func (e *DefaultEngine) EvalRecords(ctx context.Context, r *Rule, records []map[string]interface{},
+	opts ...EvalOption) ([]*Result, error) {
+
+	results := make([]*Result, len(records))
+	// Indexed by record, since with BatchWorkers the records finish in any order
+	errs := make([]error, len(records))
+
+	err := e.EvalBatch(ctx, r, records, func(i int, u *Result, err error) {
+		if err != nil {
+			errs[i] = fmt.Errorf("record %d: %w", i, err)
+			return
+		}
+		results[i] = u
+	}, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return results, errors.Join(errs...)
+}
+
+// copyData returns a shallow copy of the data
+func copyData(d map[string]interface{}) map[string]interface{} {
+	if d == nil {
+		return nil
+	}
+	c := make(map[string]interface{}, len(d))
+	for k, v := range d {
+		c[k] = v
+	}
+	return c
+}
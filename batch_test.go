@@ -0,0 +1,177 @@
+package indigo_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/ezachrisen/indigo"
+	"github.com/ezachrisen/indigo/cel"
+	"github.com/matryer/is"
+)
+
+// makeBatchData returns n data items, half of which pass the rule x % 2 == 0
+func makeBatchData(n int) []map[string]interface{} {
+	data := make([]map[string]interface{}, n)
+	for i := range data {
+		data[i] = map[string]interface{}{"x": i}
+	}
+	return data
+}
+
+func makeBatchRule() *indigo.Rule {
+	return &indigo.Rule{
+		ID:     "even",
+		Expr:   "x % 2 == 0",
+		Schema: indigo.Schema{Elements: []indigo.DataElement{{Name: "x", Type: indigo.Int{}}}},
+	}
+}
+
+// Test that the callback is called once per item, in order
+func TestEvalBatch(t *testing.T) {
+	is := is.New(t)
+
+	e := indigo.NewEngine(cel.NewEvaluator())
+	r := makeBatchRule()
+	is.NoErr(e.Compile(r))
+
+	var seen []int
+	err := e.EvalBatch(context.Background(), r, makeBatchData(100), func(i int, u *indigo.Result, err error) {
+		is.NoErr(err)
+		is.Equal(u.ExpressionPass, i%2 == 0)
+		seen = append(seen, i)
+	})
+	is.NoErr(err)
+	is.Equal(len(seen), 100)
+	for i := range seen {
+		is.Equal(seen[i], i)
+	}
+}
+
+// Test that every item is evaluated exactly once with concurrent workers
+func TestEvalBatchWorkers(t *testing.T) {
+	is := is.New(t)
+
+	e := indigo.NewEngine(cel.NewEvaluator())
+	r := makeBatchRule()
+	is.NoErr(e.Compile(r))
+
+	seen := map[int]int{}
+	err := e.EvalBatch(context.Background(), r, makeBatchData(100), func(i int, u *indigo.Result, err error) {
+		is.NoErr(err)
+		is.Equal(u.ExpressionPass, i%2 == 0)
+		seen[i]++ // calls to the callback are serialized
+	}, indigo.BatchWorkers(8))
+	is.NoErr(err)
+	is.Equal(len(seen), 100)
+	for _, n := range seen {
+		is.Equal(n, 1)
+	}
+}
+
+// Test that the batch stops when the context is canceled
+func TestEvalBatchCancel(t *testing.T) {
+	is := is.New(t)
+
+	e := indigo.NewEngine(cel.NewEvaluator())
+	r := makeBatchRule()
+	is.NoErr(e.Compile(r))
+
+	for _, workers := range []int{0, 4} {
+		ctx, cancel := context.WithCancel(context.Background())
+		calls := 0
+		err := e.EvalBatch(ctx, r, makeBatchData(100), func(i int, u *indigo.Result, err error) {
+			calls++
+			if calls == 10 {
+				cancel()
+			}
+		}, indigo.BatchWorkers(workers))
+		is.True(errors.Is(err, context.Canceled))
+		is.True(calls < 100)
+		cancel()
+	}
+}
+
+// Test that the results are returned in record order, and that the records
+// are not modified
+func TestEvalRecords(t *testing.T) {
+	is := is.New(t)
+
+	e := indigo.NewEngine(cel.NewEvaluator())
+	r := makeBatchRule()
+	r.Self = 1
+	is.NoErr(e.Compile(r))
+
+	records := makeBatchData(50)
+	records[49] = records[0] // the same map may appear more than once
+
+	for _, workers := range []int{0, 8} {
+		results, err := e.EvalRecords(context.Background(), r, records, indigo.ParallelRecords(workers))
+		is.NoErr(err)
+		is.Equal(len(results), 50)
+		for i, u := range results[:49] {
+			is.Equal(u.ExpressionPass, i%2 == 0)
+		}
+		is.True(results[49].ExpressionPass)
+	}
+
+	for _, d := range records {
+		_, ok := d["self"]
+		is.True(!ok) // the engine evaluated a copy of the record
+	}
+
+	// Records that fail are reported with their index
+	records[3] = map[string]interface{}{"x": "three"}
+	results, err := e.EvalRecords(context.Background(), r, records)
+	is.True(err != nil)
+	is.True(strings.HasPrefix(err.Error(), "record 3: "))
+	is.True(results[3] == nil)
+	is.True(results[4] != nil)
+
+	// The errors are reported in record order, even when the records are
+	// evaluated concurrently
+	records[40] = map[string]interface{}{"x": "forty"}
+	for i := 0; i < 10; i++ {
+		_, err = e.EvalRecords(context.Background(), r, records, indigo.ParallelRecords(8))
+		is.True(strings.HasPrefix(err.Error(), "record 3: "))
+		is.True(strings.Contains(err.Error(), "\nrecord 40: "))
+	}
+
+	// A nil engine is an error
+	var ne *indigo.DefaultEngine
+	_, err = ne.EvalRecords(context.Background(), r, records)
+	is.True(err != nil)
+	err = ne.EvalBatch(context.Background(), r, records, func(int, *indigo.Result, error) {})
+	is.Equal(err.Error(), "engine is nil")
+}
+
+func BenchmarkEvalRecords(b *testing.B) {
+	e := indigo.NewEngine(cel.NewEvaluator())
+	r := makeBatchRule()
+	if err := e.Compile(r); err != nil {
+		b.Fatal(err)
+	}
+	records := makeBatchData(1000)
+
+	b.Run("loop", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, d := range records {
+				if _, err := e.Eval(context.Background(), r, d); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+
+	for _, workers := range []int{0, 4} {
+		b.Run(fmt.Sprintf("records-%d-workers", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := e.EvalRecords(context.Background(), r, records, indigo.BatchWorkers(workers)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
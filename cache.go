@@ -0,0 +1,107 @@
+package indigo
+
+import (
+	"fmt"
+	"sync"
+)
+
+// ResultCache memoizes the values of rule expressions, so that evaluating a
+// rule again with the same data doesn't call the evaluator. Use it when the
+// same rules are evaluated repeatedly with the same data, such as within a
+// request; see the WithResultCache option.
+//
+// Values are cached by the rule's Hash, computed when the rule is compiled,
+// and a fingerprint of the data the rule is evaluated with, including the
+// rule's Self. The data is hashed like the input of Result.SignedRecord;
+// rules evaluated with data that can't be hashed are not cached. Hashing the
+// data for every rule has a cost, so only use a cache if the evaluator is
+// slower than hashing the data.
+//
+// Only the expression's value is cached: child rules, outputs and messages
+// are evaluated as usual. Errors, and results of partial evaluation, are not
+// cached. The expressions must be deterministic: the same data must always
+// produce the same value.
+//
+// A ResultCache is safe for concurrent use, and can be shared by concurrent
+// evaluations. It is never emptied; create a new cache for each request.
+type ResultCache struct {
+	mu      sync.Mutex
+	entries map[resultCacheKey]resultCacheEntry
+	hits    int
+	misses  int
+}
+
+// resultCacheKey identifies the evaluation of a rule with some data
+type resultCacheKey struct {
+	rule        string // see Rule.Hash
+	data        string // see hashData
+	diagnostics bool   // whether the diagnostics were returned
+}
+
+// resultCacheEntry is the value of a rule's expression and its diagnostics
+type resultCacheEntry struct {
+	val         interface{}
+	diagnostics *Diagnostics
+}
+
+// NewResultCache creates an empty ResultCache
+func NewResultCache() *ResultCache {
+	return &ResultCache{
+		entries: map[resultCacheKey]resultCacheEntry{},
+	}
+}
+
+// Len returns the number of values in the cache
+func (c *ResultCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+// Stats returns the number of times a value was found in the cache, and the
+// number of times it was not
+func (c *ResultCache) Stats() (hits, misses int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hits, c.misses
+}
+
+// key returns the cache key for the evaluation of the rule with the data,
+// or false if the data can't be hashed
+func (c *ResultCache) key(r *Rule, d map[string]interface{}, diagnostics bool) (resultCacheKey, bool) {
+	h := r.hash
+	if h == "" {
+		h = r.Hash()
+	}
+	dh, err := hashData(d)
+	if err != nil {
+		return resultCacheKey{}, false
+	}
+	return resultCacheKey{rule: h, data: dh, diagnostics: diagnostics}, true
+}
+
+// get returns the cached value for the key
+func (c *ResultCache) get(k resultCacheKey) (resultCacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v, ok := c.entries[k]
+	if ok {
+		c.hits++
+	} else {
+		c.misses++
+	}
+	return v, ok
+}
+
+// put stores the value for the key
+func (c *ResultCache) put(k resultCacheKey, v resultCacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[k] = v
+}
+
+// String returns the size of the cache and the hit and miss counts
+func (c *ResultCache) String() string {
+	hits, misses := c.Stats()
+	return fmt.Sprintf("ResultCache{len: %d, hits: %d, misses: %d}", c.Len(), hits, misses)
+}
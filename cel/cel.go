@@ -1,6 +1,8 @@
 package cel
 
 import (
+	"context"
+	"errors"
 	"fmt" // required by CEL to construct a proto from an expression
 	"strings"
 	"sync"
@@ -8,7 +10,18 @@ import (
 	"github.com/ezachrisen/indigo"
 
 	celgo "github.com/google/cel-go/cel"
+	"github.com/google/cel-go/checker/decls"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	"github.com/google/cel-go/common/types/traits"
+	"github.com/google/cel-go/ext"
+	"github.com/google/cel-go/interpreter"
+	gexpr "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
 	"google.golang.org/protobuf/types/dynamicpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 // Evaluator implements the indigo.ExpressionEvaluator and indigo.ExpressionCompiler interfaces.
@@ -17,7 +30,39 @@ type Evaluator struct {
 	// See the [FixedSchema] option
 	fixedSchema *indigo.Schema
 	fixedEnv    *celgo.Env
+	fixedErr    error
 	fixedOnce   sync.Once
+
+	// See the [FixedSchemas] option
+	namedSchemas map[string]*namedEnv
+
+	// See the [WithExtensions] option
+	envOptions []celgo.EnvOption
+
+	// See the [CostLimit] option
+	costLimit *uint64
+
+	// Options for the programs generated by Compile, such as the
+	// [RegexExtensions] option's regex optimization
+	programOptions []celgo.ProgramOption
+
+	// See the [ExpressionRewriter] option
+	rewriter func(expr string) (string, error)
+
+	// See the [RequireSetFields] option
+	requireSetFields bool
+
+	// See the [AutoNow] option
+	autoNow bool
+
+	// Whether functions were added with the [ContextFunction] option
+	contextFunctions bool
+
+	// The environments built during the compile sessions in progress, by
+	// schema signature; see BeginCompile
+	sessionMu   sync.Mutex
+	sessions    int
+	sessionEnvs map[string]*celgo.Env
 }
 
 // celProgram holds a compiled CEL Program and
@@ -51,6 +96,186 @@ func FixedSchema(schema *indigo.Schema) CelOption {
 	}
 }
 
+// FixedSchemas registers a set of schemas, keyed by schema ID, and mandates that
+// each rule is compiled and evaluated with the registered schema matching the ID
+// of the rule's schema. Like FixedSchema, the CEL environment for each schema is
+// created only once, the first time it is used. Compilation fails if the ID of
+// the rule's schema is not registered.
+// If FixedSchema is also set, FixedSchema takes precedence.
+func FixedSchemas(schemas map[string]*indigo.Schema) CelOption {
+	return func(e *Evaluator) {
+		e.namedSchemas = make(map[string]*namedEnv, len(schemas))
+		for id, s := range schemas {
+			e.namedSchemas[id] = &namedEnv{schema: s}
+		}
+	}
+}
+
+// namedEnv holds the CEL environment for a schema registered with FixedSchemas
+type namedEnv struct {
+	schema *indigo.Schema
+	env    *celgo.Env
+	err    error
+	once   sync.Once
+}
+
+// CostLimit limits the cost of evaluating an expression. CEL assigns a cost to
+// each operation, such as a comparison or an iteration of a comprehension; if
+// the total cost of evaluating an expression exceeds the limit, the evaluation
+// stops and returns an error wrapping indigo.ErrCostLimitExceeded. Use it to
+// protect against expensive expressions written by untrusted rule authors.
+func CostLimit(limit uint64) CelOption {
+	return func(e *Evaluator) {
+		e.costLimit = &limit
+	}
+}
+
+// RequireSetFields makes selecting a protocol buffer field that is not set an
+// evaluation error, instead of returning the field's default value. For
+// example, with the option set, "student.gpa >= 3.6" fails with an error for a
+// student without a GPA, rather than evaluating to false. Use has() to check
+// whether a field is set: "has(student.gpa) && student.gpa >= 3.6".
+//
+// Field presence follows the protocol buffer rules: fields of proto3 messages
+// that are not marked optional, as well as repeated and map fields, are not
+// set if they have the default value (0, "", false, empty). With the option
+// set, a GPA of 0.0 is therefore an error. Message fields, and proto3 fields
+// marked optional, are set if they were assigned, even a default value.
+// The errors wrap indigo.ErrMissingData, so they can be treated as unknown
+// with the indigo.UnknownOnMissingData option.
+func RequireSetFields(b bool) CelOption {
+	return func(e *Evaluator) {
+		e.requireSetFields = b
+	}
+}
+
+// AutoNow provides the current time as "now" to expressions whose schema
+// declares a Timestamp element named "now", if the data has no "now" value.
+// The time is taken when each expression is evaluated, so the rules in a
+// tree may see slightly different times; use the indigo.InjectNow option to
+// give all the rules the same time.
+func AutoNow() CelOption {
+	return func(e *Evaluator) {
+		e.autoNow = true
+	}
+}
+
+// ExpressionRewriter sets a function that rewrites rule expressions before
+// they are compiled, for example to expand a shorthand such as AGE(student)
+// to student.age. The rewritten expression is compiled and evaluated; the
+// rule's Expr is not changed. Positions in compilation errors refer to the
+// rewritten expression. An error returned by the function fails the
+// compilation of the rule.
+func ExpressionRewriter(fn func(expr string) (string, error)) CelOption {
+	return func(e *Evaluator) {
+		e.rewriter = fn
+	}
+}
+
+// OptionalTypes enables CEL optional values and the optional selection
+// syntax, such as student.?nickname.orValue("none") and
+// grades[?"math"].hasValue(). An expression producing an optional value
+// returns the contained value; an expression of type optional(T) matches the
+// result type T. If the value is absent, the evaluation fails with an error
+// wrapping indigo.ErrMissingData, which the indigo.UnknownOnMissingData
+// option turns into an unknown result. Absent values inside lists and maps
+// are nil.
+func OptionalTypes() CelOption {
+	return WithExtensions(celgo.OptionalTypes())
+}
+
+// WithExtensions adds CEL environment options to the environment used to
+// compile expressions. Use it to enable cel-go extension libraries, or to
+// declare custom functions.
+func WithExtensions(opts ...celgo.EnvOption) CelOption {
+	return func(e *Evaluator) {
+		e.envOptions = append(e.envOptions, opts...)
+	}
+}
+
+// AnyTypes registers protocol buffer message types that may be packed in
+// google.protobuf.Any fields. The concrete type of an Any field is only known
+// when the data is evaluated, so it cannot be registered from the schema;
+// without this option, evaluating an expression that selects a field of an
+// Any value holding a message declared in another file fails.
+func AnyTypes(msgs ...proto.Message) CelOption {
+	types := make([]interface{}, 0, len(msgs))
+	files := []interface{}{}
+	seen := map[protoreflect.FullName]bool{}
+	for _, m := range msgs {
+		types = append(types, m)
+		files = append(files, protoFiles(m.ProtoReflect().Descriptor(), seen)...)
+	}
+	return WithExtensions(celgo.Types(types...), celgo.TypeDescs(files...))
+}
+
+// AutoNumericCoercion allows the ordering operators <, <=, > and >= to
+// compare ints, uints and doubles with each other, such as student.age > 15.5,
+// without converting them with int(), uint() or double(). Values are compared
+// by their numeric value, not converted, so an int compared with a double
+// isn't rounded first.
+//
+// Only the ordering comparisons are affected: == and !=, and arithmetic such
+// as student.age + 0.5, still require operands of the same type. Doubles
+// can't represent all decimal fractions exactly, so a literal such as 0.1 is
+// not exactly one tenth, and a computed double may be slightly above or below
+// the expected value; don't rely on comparisons at the boundary.
+func AutoNumericCoercion(enabled bool) CelOption {
+	return WithExtensions(celgo.CrossTypeNumericComparisons(enabled))
+}
+
+// EnumAlias declares shortName as a constant holding the value of a protocol
+// buffer enum, given by its full CEL name, so that expressions can use the
+// short name:
+//
+//	cel.EnumAlias("PROBATION", "testdata.school.Student.status_type.PROBATION")
+//
+// lets an expression say student.status == PROBATION. The enum must be
+// linked into the program, which is the case if its generated Go package is
+// imported. An unknown enum or value makes compilation fail.
+func EnumAlias(shortName string, fullEnumValue string) CelOption {
+	return WithExtensions(func(env *celgo.Env) (*celgo.Env, error) {
+		n, err := enumNumber(fullEnumValue)
+		if err != nil {
+			return nil, fmt.Errorf("enum alias %s: %w", shortName, err)
+		}
+		c := &gexpr.Constant{ConstantKind: &gexpr.Constant_Int64Value{Int64Value: int64(n)}}
+		return celgo.Declarations(decls.NewConst(shortName, decls.Int, c))(env)
+	})
+}
+
+// enumNumber returns the number of the enum value with the full name, such as
+// "testdata.school.Student.status_type.PROBATION"
+func enumNumber(fullName string) (protoreflect.EnumNumber, error) {
+	i := strings.LastIndex(fullName, ".")
+	if i < 0 {
+		return 0, fmt.Errorf("%q is not a full enum value name", fullName)
+	}
+	et, err := protoregistry.GlobalTypes.FindEnumByName(protoreflect.FullName(fullName[:i]))
+	if err != nil {
+		return 0, fmt.Errorf("finding enum %s: %w", fullName[:i], err)
+	}
+	v := et.Descriptor().Values().ByName(protoreflect.Name(fullName[i+1:]))
+	if v == nil {
+		return 0, fmt.Errorf("enum %s has no value %s", fullName[:i], fullName[i+1:])
+	}
+	return v.Number(), nil
+}
+
+// StringExtensions enables the cel-go string extension library, which adds
+// functions such as charAt, indexOf, replace and split.
+// See https://pkg.go.dev/github.com/google/cel-go/ext#Strings.
+func StringExtensions() CelOption {
+	return WithExtensions(ext.Strings())
+}
+
+// MathExtensions enables the cel-go math extension library, which adds the
+// math.greatest and math.least macros.
+// See https://pkg.go.dev/github.com/google/cel-go/ext#Math.
+func MathExtensions() CelOption {
+	return WithExtensions(ext.Math())
+}
+
 // Compile checks a rule, prepares a compiled CELProgram, and stores the program
 // in rule.Program. CELProgram contains the compiled program used to evaluate the rules,
 // and if we're collecting diagnostics, CELProgram also contains the CEL AST to provide
@@ -64,79 +289,302 @@ func (e *Evaluator) Compile(expr string, s indigo.Schema, resultType indigo.Type
 		return nil, nil
 	}
 
+	env, err := e.env(s)
+	if err != nil {
+		return nil, err
+	}
+
+	ast, c, err := e.check(env, expr)
+	if err != nil {
+		return nil, withSuggestions(err, e.schema(s))
+	}
+
+	if err := doTypesMatch(c.ResultType(), resultType); err != nil {
+		return nil, fmt.Errorf("result type mismatch: %w", err)
+	}
+
 	prog := celProgram{}
-	var err error
+	if collectDiagnostics {
+		prog.ast = ast
+	}
+
+	// Partial evaluation only changes the evaluation of partial activations,
+	// see EvaluatePartial
+	options := []celgo.ProgramOption{celgo.EvalOptions(celgo.OptPartialEval)}
+	if collectDiagnostics {
+		options = []celgo.ProgramOption{celgo.EvalOptions(celgo.OptTrackState, celgo.OptPartialEval)}
+	}
+	if e.costLimit != nil {
+		options = append(options, celgo.CostLimit(*e.costLimit))
+	}
+	options = append(options, e.programOptions...)
+	prog.program, err = env.Program(c, options...)
+	if err != nil {
+		return nil, fmt.Errorf("generating program: %w", err)
+	}
+
+	return prog, nil
+}
+
+// env returns the CEL environment to compile expressions in. If the
+// FixedSchema option is set, the environment for the fixed schema is used;
+// if the FixedSchemas option is set, the environment for the schema with the
+// same ID as the schema provided is used. Otherwise a new environment is
+// created from the schema provided.
+func (e *Evaluator) env(s indigo.Schema) (*celgo.Env, error) {
+
+	if e.fixedSchema == nil && e.namedSchemas != nil {
+		n, ok := e.namedSchemas[s.ID]
+		if !ok {
+			return nil, fmt.Errorf("schema %q is not registered with the evaluator", s.ID)
+		}
+		n.once.Do(func() {
+			n.env, n.err = celEnv(*n.schema, e.requireSetFields, e.envOptions...)
+		})
+		if n.err != nil {
+			return nil, fmt.Errorf("converting evaluator schema %s: %w", s.ID, n.err)
+		}
+		return n.env, nil
+	}
 
 	e.fixedOnce.Do(func() {
 		if e.fixedSchema == nil {
 			return
 		}
-		env, errx := celEnv(*e.fixedSchema)
-		if errx != nil {
-			err = errx
-			return
-		}
-		e.fixedEnv = env
-		return
+		e.fixedEnv, e.fixedErr = celEnv(*e.fixedSchema, e.requireSetFields, e.envOptions...)
 	})
 
-	if err != nil {
-		return nil, fmt.Errorf("converting evaluator schema: %w", err)
+	if e.fixedErr != nil {
+		return nil, fmt.Errorf("converting evaluator schema: %w", e.fixedErr)
 	}
 
-	var env *celgo.Env
-	if e.fixedEnv == nil {
-		env, err = celEnv(s)
-		if err != nil {
-			return nil, err
+	if e.fixedEnv != nil {
+		return e.fixedEnv, nil
+	}
+
+	return e.sessionEnv(s)
+}
+
+// BeginCompile begins a compile session: until the returned function is
+// called, the environment built for a schema is reused by the rules with the
+// same schema. The engine calls BeginCompile when compiling a rule tree, so
+// that sibling rules sharing a schema don't each build an environment.
+func (e *Evaluator) BeginCompile() (end func()) {
+	e.sessionMu.Lock()
+	defer e.sessionMu.Unlock()
+	e.sessions++
+	if e.sessionEnvs == nil {
+		e.sessionEnvs = map[string]*celgo.Env{}
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			e.sessionMu.Lock()
+			defer e.sessionMu.Unlock()
+			e.sessions--
+			if e.sessions == 0 {
+				e.sessionEnvs = nil
+			}
+		})
+	}
+}
+
+// sessionEnv returns the environment for the schema, reusing the environment
+// built for the same schema in a compile session, if one is in progress
+func (e *Evaluator) sessionEnv(s indigo.Schema) (*celgo.Env, error) {
+	e.sessionMu.Lock()
+	active := e.sessions > 0
+	var key string
+	if active {
+		key = schemaSignature(s)
+		if env, ok := e.sessionEnvs[key]; ok {
+			e.sessionMu.Unlock()
+			return env, nil
 		}
-	} else {
-		env = e.fixedEnv
+	}
+	e.sessionMu.Unlock()
+
+	env, err := celEnv(s, e.requireSetFields, e.envOptions...)
+	if err != nil {
+		return nil, err
 	}
 
 	if env == nil {
 		return nil, fmt.Errorf("no valid CEL environment")
 	}
 
+	if active {
+		e.sessionMu.Lock()
+		if e.sessionEnvs != nil {
+			e.sessionEnvs[key] = env
+		}
+		e.sessionMu.Unlock()
+	}
+	return env, nil
+}
+
+// schemaSignature returns a string identifying the CEL environment built for
+// the schema: the names and types of the elements, including the Go types of
+// proto messages
+func schemaSignature(s indigo.Schema) string {
+	b := strings.Builder{}
+	for _, el := range s.Elements {
+		fmt.Fprintf(&b, "%d:%s %s", len(el.Name), el.Name, indigo.TypeString(el.Type))
+		if el.Alias != "" {
+			fmt.Fprintf(&b, " alias %d:%s", len(el.Alias), el.Alias)
+		}
+		if p, ok := el.Type.(indigo.Proto); ok {
+			fmt.Fprintf(&b, " %T", p.Message)
+		}
+		b.WriteString(";")
+	}
+	return b.String()
+}
+
+// schema returns the schema the evaluator uses in place of the schema
+// provided, according to the FixedSchema and FixedSchemas options
+func (e *Evaluator) schema(s indigo.Schema) indigo.Schema {
+	switch {
+	case e.fixedSchema != nil:
+		return *e.fixedSchema
+	case e.namedSchemas[s.ID] != nil:
+		return *e.namedSchemas[s.ID].schema
+	default:
+		return s
+	}
+}
+
+// withAliases returns the data with the value of each schema element that
+// has an alias also stored under the alias, so that expressions can refer to
+// either name. The data is copied only if the schema has aliases.
+func withAliases(data map[string]interface{}, s indigo.Schema) map[string]interface{} {
+	var aliased map[string]interface{}
+	for _, el := range s.Elements {
+		if el.Alias == "" {
+			continue
+		}
+		v, ok := data[el.Name]
+		if !ok {
+			continue
+		}
+		if _, ok := data[el.Alias]; ok {
+			continue
+		}
+		if aliased == nil {
+			aliased = make(map[string]interface{}, len(data)+1)
+			for k, v := range data {
+				aliased[k] = v
+			}
+		}
+		aliased[el.Alias] = v
+	}
+	if aliased == nil {
+		return data
+	}
+	return aliased
+}
+
+// withNow returns the data with the current time under the "now" key, if
+// the AutoNow option is set, the schema declares "now" as a Timestamp and
+// the data has no value for it
+func (e *Evaluator) withNow(data map[string]interface{}, s indigo.Schema) map[string]interface{} {
+	if !e.autoNow {
+		return data
+	}
+	if _, ok := data["now"]; ok {
+		return data
+	}
+	for _, el := range s.Elements {
+		if _, ok := el.Type.(indigo.Timestamp); ok && el.Name == "now" {
+			withNow := make(map[string]interface{}, len(data)+1)
+			for k, v := range data {
+				withNow[k] = v
+			}
+			withNow["now"] = timestamppb.Now()
+			return withNow
+		}
+	}
+	return data
+}
+
+// aliasOf returns the input name, such as "student.gpa", with the schema
+// element it refers to replaced by the element's alias, or false if the
+// element has no alias
+func aliasOf(name string, s indigo.Schema) (string, bool) {
+	var match indigo.DataElement
+	for _, el := range s.Elements {
+		if (name == el.Name || strings.HasPrefix(name, el.Name+".")) && len(el.Name) > len(match.Name) {
+			match = el
+		}
+	}
+	if match.Alias == "" {
+		return "", false
+	}
+	return match.Alias + strings.TrimPrefix(name, match.Name), true
+}
+
+// parseAndCheck parses the expression and type-checks it against the
+// declarations in the environment, returning both the parsed and the checked
+// AST.
+func parseAndCheck(env *celgo.Env, expr string) (*celgo.Ast, *celgo.Ast, error) {
 	// Parse the rule expression to an AST
 	ast, iss := env.Parse(expr)
 	if iss != nil && iss.Err() != nil {
-		// Remove some wonky formatting from CEL's error message.
-		return nil, fmt.Errorf("parsing rule:\n%s", strings.ReplaceAll(fmt.Sprintf("%s", iss.Err()), "<input>:", ""))
+		return nil, nil, issuesError("parsing rule", iss)
 	}
 
 	// Type-check the parsed AST against the declarations
 	c, iss := env.Check(ast)
 	if iss != nil && iss.Err() != nil {
-		return nil, fmt.Errorf("checking rule:\n%w", iss.Err())
-	}
-
-	if err := doTypesMatch(c.ResultType(), resultType); err != nil {
-		return nil, fmt.Errorf("result type mismatch: %w", err)
+		return nil, nil, issuesError("checking rule", iss)
 	}
+	return ast, c, nil
+}
 
-	if collectDiagnostics {
-		prog.ast = ast
+// check rewrites the expression with the ExpressionRewriter, if set, and
+// parses and checks the result; see parseAndCheck.
+func (e *Evaluator) check(env *celgo.Env, expr string) (*celgo.Ast, *celgo.Ast, error) {
+	if e.rewriter != nil {
+		rewritten, err := e.rewriter(expr)
+		if err != nil {
+			return nil, nil, fmt.Errorf("rewriting expression: %w", err)
+		}
+		expr = rewritten
 	}
+	return parseAndCheck(env, expr)
+}
 
-	options := celgo.EvalOptions()
-	if collectDiagnostics {
-		options = celgo.EvalOptions(celgo.OptTrackState)
+// issuesError converts the issues reported by CEL to an indigo.IssuesError,
+// which lets the engine relate the issue positions to the rule's source.
+func issuesError(stage string, iss *celgo.Issues) error {
+	ie := &indigo.IssuesError{
+		Stage: stage,
 	}
-	prog.program, err = env.Program(c, options)
-	if err != nil {
-		return nil, fmt.Errorf("generating program: %w", err)
+	for _, e := range iss.Errors() {
+		ie.Issues = append(ie.Issues, indigo.Issue{
+			Line:    e.Location.Line(),
+			Col:     e.Location.Column() + 1, // CEL columns are 0-based
+			Message: e.Message,
+		})
 	}
-
-	return prog, nil
+	return ie
 }
 
-func celEnv(schema indigo.Schema) (*celgo.Env, error) {
+// celEnv creates a CEL environment with the declarations in the schema and
+// any additional environment options. If requireSetFields is true, selecting
+// an unset protocol buffer field is an error; see RequireSetFields.
+func celEnv(schema indigo.Schema, requireSetFields bool, extra ...celgo.EnvOption) (*celgo.Env, error) {
 
 	opts, err := convertIndigoSchemaToDeclarations(schema)
 	if err != nil {
 		return nil, err
 	}
+	if requireSetFields {
+		// The type provider must be replaced before types are registered
+		opts = append([]celgo.EnvOption{presenceTypeProvider()}, opts...)
+	}
+	opts = append(opts, extra...)
 
 	env, err := celgo.NewEnv(opts...)
 	if err != nil {
@@ -147,8 +595,114 @@ func celEnv(schema indigo.Schema) (*celgo.Env, error) {
 }
 
 // Evaluate a rule against the input data.
-// Called by indigo.Engine.Evaluate for the rule and its children.
-func (*Evaluator) Evaluate(data map[string]interface{}, expr string, _ indigo.Schema, _ interface{},
+// Functions added with the ContextFunction option get a background context.
+func (e *Evaluator) Evaluate(data map[string]interface{}, expr string, s indigo.Schema, self interface{},
+	evalData interface{}, expectedResultType indigo.Type, returnDiagnostics bool) (interface{}, *indigo.Diagnostics, error) {
+	return e.EvaluateContext(context.Background(), data, expr, s, self, evalData, expectedResultType, returnDiagnostics)
+}
+
+// EvaluateContext evaluates a rule against the input data, passing the
+// context to the functions added with the ContextFunction option.
+// Called by indigo.Engine.Eval for the rule and its children.
+func (e *Evaluator) EvaluateContext(ctx context.Context, data map[string]interface{}, expr string, s indigo.Schema, _ interface{},
+	evalData interface{}, expectedResultType indigo.Type, returnDiagnostics bool) (interface{}, *indigo.Diagnostics, error) {
+	s = e.schema(s)
+	data = withAliases(e.withNow(data, s), s)
+
+	missing := missingElements(data, s)
+	if len(missing) == 0 {
+		return evaluate(e.withContext(ctx, data), data, expr, evalData, expectedResultType, returnDiagnostics)
+	}
+
+	// The missing elements are unknown, so an expression that depends on
+	// them evaluates to an unknown value, while one that doesn't, such as
+	// "y > 1 || x > 1" with y = 2, still has a value
+	vars, err := celgo.PartialVars(e.withContext(ctx, data), unknownPatterns(missing, s)...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("creating partial activation: %w", err)
+	}
+	val, d, err := evaluate(vars, data, expr, evalData, expectedResultType, returnDiagnostics)
+	if _, ok := val.(types.Unknown); ok {
+		return nil, d, fmt.Errorf("evaluating rule: %w: no value for %s", indigo.ErrMissingData, strings.Join(missing, ", "))
+	}
+	return val, d, err
+}
+
+// EvaluatePartial evaluates a rule against the input data, treating the
+// inputs named in unknowns as not yet known. If the result depends on an
+// unknown input, unknown is true; otherwise the value is returned as by
+// Evaluate. For example, with student.gpa unknown, "student.gpa > 3.0 &&
+// isSummer" is unknown if isSummer is true, and false if isSummer is false.
+// Schema elements missing from the data are unknown too.
+func (e *Evaluator) EvaluatePartial(data map[string]interface{}, expr string, s indigo.Schema, _ interface{},
+	evalData interface{}, expectedResultType indigo.Type, returnDiagnostics bool, unknowns []string) (interface{}, bool, *indigo.Diagnostics, error) {
+
+	s = e.schema(s)
+	data = withAliases(e.withNow(data, s), s)
+
+	names := append(append([]string{}, unknowns...), missingElements(data, s)...)
+	patterns := unknownPatterns(names, s)
+	vars, err := celgo.PartialVars(e.withContext(context.Background(), data), patterns...)
+	if err != nil {
+		return nil, false, nil, fmt.Errorf("creating partial activation: %w", err)
+	}
+
+	val, d, err := evaluate(vars, data, expr, evalData, expectedResultType, returnDiagnostics)
+	if _, ok := val.(types.Unknown); ok {
+		return nil, true, d, err
+	}
+	return val, false, d, err
+}
+
+// missingElements returns the names of the schema elements that are not in
+// the data
+func missingElements(data map[string]interface{}, s indigo.Schema) []string {
+	var missing []string
+	for _, el := range s.Elements {
+		if _, ok := data[el.Name]; !ok {
+			missing = append(missing, el.Name)
+		}
+	}
+	return missing
+}
+
+// unknownPatterns returns the patterns matching the input names, and their
+// aliases
+func unknownPatterns(names []string, s indigo.Schema) []*interpreter.AttributePattern {
+	patterns := make([]*interpreter.AttributePattern, 0, len(names))
+	for _, n := range names {
+		patterns = append(patterns, attributePattern(n, s))
+		if a, ok := aliasOf(n, s); ok {
+			patterns = append(patterns, attributePattern(a, s))
+		}
+	}
+	return patterns
+}
+
+// attributePattern returns the pattern matching the input name, such as
+// "student.gpa". Schema element names may contain dots, so the pattern's
+// variable is the longest schema element name the input name starts with, and
+// the rest of the input name are field qualifiers.
+func attributePattern(name string, s indigo.Schema) *interpreter.AttributePattern {
+	variable := strings.SplitN(name, ".", 2)[0]
+	for _, el := range s.Elements {
+		if (name == el.Name || strings.HasPrefix(name, el.Name+".")) && len(el.Name) > len(variable) {
+			variable = el.Name
+		}
+	}
+
+	p := celgo.AttributePattern(variable)
+	if rest := strings.TrimPrefix(name, variable); rest != "" {
+		for _, q := range strings.Split(strings.TrimPrefix(rest, "."), ".") {
+			p = p.QualString(q)
+		}
+	}
+	return p
+}
+
+// evaluate evaluates the program in evalData with the activation, which holds the
+// data. The data is used to collect diagnostics.
+func evaluate(vars interface{}, data map[string]interface{}, expr string,
 	evalData interface{}, expectedResultType indigo.Type, returnDiagnostics bool) (interface{}, *indigo.Diagnostics, error) {
 
 	program, ok := evalData.(celProgram)
@@ -164,7 +718,7 @@ func (*Evaluator) Evaluate(data map[string]interface{}, expr string, _ indigo.Sc
 		return nil, nil, fmt.Errorf("missing program")
 	}
 
-	rawValue, details, err := program.program.Eval(data)
+	rawValue, details, err := program.program.Eval(vars)
 
 	// Do not check the error yet. Grab the diagnostics first
 	var diagnostics *indigo.Diagnostics
@@ -177,17 +731,39 @@ func (*Evaluator) Evaluate(data map[string]interface{}, expr string, _ indigo.Sc
 	}
 
 	if err != nil {
+		if missingData(err) {
+			return nil, diagnostics, fmt.Errorf("evaluating rule: %w: %w", indigo.ErrMissingData, err)
+		}
+		var ce interpreter.EvalCancelledError
+		if errors.As(err, &ce) && ce.Cause == interpreter.CostLimitExceeded {
+			return nil, diagnostics, fmt.Errorf("evaluating rule: %w: %w", indigo.ErrCostLimitExceeded, err)
+		}
 		return nil, diagnostics, fmt.Errorf("evaluating rule: %w", err)
 	}
 
 	if rawValue == nil {
 		return nil, diagnostics, nil
 	}
+
+	// Only returned by a partial evaluation, see EvaluatePartial
+	if types.IsUnknown(rawValue) {
+		return rawValue, diagnostics, nil
+	}
+	// Optional values, see OptionalTypes, are unwrapped; an absent value is
+	// missing data, so a rule over data that wasn't provided doesn't pass
+	if o, ok := rawValue.(*types.Optional); ok {
+		if !o.HasValue() {
+			return nil, diagnostics, fmt.Errorf("evaluating rule: %w: optional value is absent", indigo.ErrMissingData)
+		}
+		rawValue = o.GetValue()
+	}
+
 	//	fmt.Println("Before returning", expr, "diagnostics = ", diagnostics)
 	// The output from CEL evaluation is a ref.Val.
 	// The underlying Go value is returned by .Value()
-	// One type requires special handling: protocol buffers dynamically constructed
-	// by CEL in the expression.
+	// Some types require special handling: protocol buffers dynamically constructed
+	// by CEL in the expression, and lists and maps, whose underlying values
+	// may be CEL values.
 	switch rawValue.Value().(type) {
 	case *dynamicpb.Message:
 		// If CEL returns a protocol buffer, attempt to convert it to the
@@ -195,6 +771,66 @@ func (*Evaluator) Evaluate(data map[string]interface{}, expr string, _ indigo.Sc
 		pb, err := convertDynamicMessageToProto(rawValue, expectedResultType)
 		return pb, diagnostics, err
 	default:
-		return rawValue.Value(), diagnostics, err
+		return nativeValue(rawValue), diagnostics, err
+	}
+}
+
+// nativeValue returns the Go value of the CEL value. Lists are converted to
+// []interface{}, and maps to map[string]interface{}, or, if the map has keys
+// that aren't strings, to map[interface{}]interface{}. The elements of lists
+// and maps are converted in the same way. Optional values are unwrapped, with
+// absent values converted to nil.
+func nativeValue(v ref.Val) interface{} {
+	switch x := v.(type) {
+	case *types.Optional:
+		if !x.HasValue() {
+			return nil
+		}
+		return nativeValue(x.GetValue())
+	case traits.Lister:
+		n, _ := x.Size().(types.Int)
+		list := make([]interface{}, 0, int(n))
+		for i := types.Int(0); i < n; i++ {
+			list = append(list, nativeValue(x.Get(i)))
+		}
+		return list
+	case traits.Mapper:
+		strs := map[string]interface{}{}
+		var others map[interface{}]interface{}
+		it := x.Iterator()
+		for it.HasNext() == types.True {
+			k := it.Next()
+			val := nativeValue(x.Get(k))
+			if others != nil {
+				others[k.Value()] = val
+				continue
+			}
+			if ks, ok := k.Value().(string); ok {
+				strs[ks] = val
+				continue
+			}
+			others = make(map[interface{}]interface{}, len(strs)+1)
+			for ks, sv := range strs {
+				others[ks] = sv
+			}
+			others[k.Value()] = val
+		}
+		if others != nil {
+			return others
+		}
+		return strs
+	default:
+		return v.Value()
 	}
 }
+
+// missingData reports whether the CEL evaluation error was caused by the
+// expression referring to a map key missing from the input data, or to an
+// unset field (see RequireSetFields). Variables missing from the data are
+// detected before the evaluation, see EvaluateContext. CEL turns the errors
+// of evaluating an expression into values carrying only the error message,
+// so the messages are matched; TestMissingData pins them.
+func missingData(err error) bool {
+	msg := err.Error()
+	return strings.HasPrefix(msg, "no such key") || strings.HasPrefix(msg, unsetField)
+}
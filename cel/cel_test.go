@@ -1,9 +1,16 @@
 package cel_test
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"math"
+	"math/rand"
+	"regexp"
+	"runtime"
 	"strings"
 	"testing"
 	"time"
@@ -11,8 +18,19 @@ import (
 	"github.com/ezachrisen/indigo"
 	"github.com/ezachrisen/indigo/cel"
 	"github.com/ezachrisen/indigo/testdata/school"
+	celgo "github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types"
 	"github.com/google/cel-go/common/types/pb"
+	"github.com/google/cel-go/common/types/ref"
 	"github.com/matryer/is"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+	"google.golang.org/protobuf/types/known/anypb"
 	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
@@ -287,632 +305,3452 @@ func TestCompileErrors(t *testing.T) {
 	is.True(strings.Contains(err.Error(), "1:40: found no matching overload for '_>_' applied to '(string, double)'"))
 }
 
-func TestProtoMessage(t *testing.T) {
+// Make sure that compile error positions are moved by the rule's source offset
+func TestCompileErrorsWithSourceOffset(t *testing.T) {
 	is := is.New(t)
+
 	e := indigo.NewEngine(cel.NewEvaluator())
+	r := makeEducationRulesWithIncorrectTypes()
+	r.Rules["a"].SourceOffset = indigo.SourceOffset{Line: 9, Col: 4}
+	r.Rules["a"].Expr = "student.GPA != \"3.6\" &&\n  student.Status > 2.0"
 
-	r := makeEducationProtoRules("student_actions")
 	err := e.Compile(r)
-	is.NoErr(err)
+	if err == nil {
+		is.Fail() // expected compile error here
+	}
+	is.True(strings.Contains(err.Error(), "10:17: found no matching overload for '_!=_' applied to '(double, string)'"))
+	is.True(strings.Contains(err.Error(), "11:18: found no matching overload for '_>_' applied to '(string, double)'"))
+
+	var ie *indigo.IssuesError
+	is.True(errors.As(err, &ie))
+	is.Equal(len(ie.Issues), 2)
+	is.Equal(ie.Issues[0].Line, 10)
+	is.Equal(ie.Issues[0].Col, 17)
+}
 
-	results, err := e.Eval(context.Background(), r, makeStudentProtoData())
-	is.NoErr(err)
-	is.Equal(len(results.Results), 3)
-	for _, v := range results.Results {
-		is.Equal(v.Rule.Meta, v.ExpressionPass)
+// Make sure that compile errors for all failing rules are returned, with
+// rule IDs and positions
+func TestStructuredCompileErrors(t *testing.T) {
+	is := is.New(t)
+
+	e := indigo.NewEngine(cel.NewEvaluator())
+	r := makeEducationRulesWithIncorrectTypes()
+	r.Rules["b"] = &indigo.Rule{
+		ID:     "parse_error",
+		Expr:   `student.GPA >`,
+		Schema: makeEducationSchema(),
+	}
+	r.Rules["c"] = &indigo.Rule{
+		ID:     "ok",
+		Expr:   `student.GPA > 3.0`,
+		Schema: makeEducationSchema(),
+	}
+
+	err := e.Compile(r)
+	if err == nil {
+		is.Fail() // expected compile errors here
+	}
+
+	var ce *indigo.CompileError
+	is.True(errors.As(err, &ce))
+
+	errs := indigo.CompileErrors(err)
+	is.Equal(len(errs), 2)
+
+	byRule := map[string]*indigo.CompileError{}
+	for _, ce := range errs {
+		byRule[ce.RuleID] = ce
 	}
+
+	ce = byRule["honors_student"]
+	is.True(ce != nil)
+	is.Equal(len(ce.Issues), 2)
+	is.Equal(ce.Issues[0].Line, 1)
+	is.Equal(ce.Issues[0].Col, 13)
+	is.Equal(ce.Issues[0].Message, "found no matching overload for '_!=_' applied to '(double, string)'")
+	is.Equal(ce.Issues[1].Line, 1)
+	is.Equal(ce.Issues[1].Col, 40)
+
+	ce = byRule["parse_error"]
+	is.True(ce != nil)
+	is.Equal(len(ce.Issues), 1)
+	is.Equal(ce.Issues[0].Line, 1)
+	is.Equal(ce.Issues[0].Col, 14)
+
+	is.True(r.Rules["c"].Program != nil) // the valid rule was compiled
 }
 
-func TestDiagnosticOptions(t *testing.T) {
+// Make sure that only the schema elements used in an expression are reported
+func TestReferencedVariables(t *testing.T) {
 	is := is.New(t)
+
 	e := indigo.NewEngine(cel.NewEvaluator())
-	r2 := makeEducationProtoRules("student_actions")
-	err := e.Compile(r2, indigo.CollectDiagnostics(true))
+	r := &indigo.Rule{
+		ID: "honors",
+		Schema: indigo.Schema{
+			Elements: []indigo.DataElement{
+				{Name: "student", Type: indigo.Proto{Message: &school.Student{}}},
+				{Name: "honors", Type: indigo.Proto{Message: &school.HonorsConfiguration{}}},
+				{Name: "now", Type: indigo.Timestamp{}},
+			},
+		},
+		Expr: `student.gpa < honors.Minimum_GPA && student.grades.all(g, g > 1.0) && duration("4320h") > duration("1h")`,
+	}
+
+	names, err := e.ReferencedVariables(r)
 	is.NoErr(err)
+	is.Equal(names, []string{"honors", "student"})
 
-	u, err := e.Eval(context.Background(), r2, makeStudentProtoData(), indigo.ReturnDiagnostics(true))
+	// Elements with dotted names are reported with their full name
+	r = &indigo.Rule{
+		ID:     "at_risk",
+		Schema: makeEducationSchema(),
+		Expr:   `student.GPA < 2.5 || student.Status == "Probation"`,
+	}
+	names, err = e.ReferencedVariables(r)
 	is.NoErr(err)
-	//	fmt.Println(r2)
-	//	fmt.Println(indigo.DiagnosticsReport(u, makeStudentProtoData()))
-	//	fmt.Println(u.Diagnostics.String())
-	for _, c := range u.Results {
-		if c.Diagnostics == nil {
-			t.Errorf("Wanted diagnostics for rule %s", c.Rule.ID)
-		} // else {
-		// 	fmt.Println(u)
-		// 	fmt.Println(c.Diagnostics)
-		// }
+	is.Equal(names, []string{"student.GPA", "student.Status"})
+
+	// The rule's other expressions are included
+	r.ShardCondition = `student.Status != "Graduated"`
+	r.Message = `"GPA " + string(student.GPA)`
+	names, err = e.ReferencedVariables(r)
+	is.NoErr(err)
+	is.Equal(names, []string{"student.GPA", "student.Status"})
+
+	r.Expr = `true`
+	names, err = e.ReferencedVariables(r)
+	is.NoErr(err)
+	is.Equal(names, []string{"student.GPA", "student.Status"})
+
+	r.Expr = `student.GPA < "2.5"`
+	_, err = e.ReferencedVariables(r)
+	is.True(err != nil) // expected a compile error
+}
+
+// Test that schema elements no rule in the tree refers to are reported
+func TestUnusedSchemaElements(t *testing.T) {
+	is := is.New(t)
+
+	schema := indigo.Schema{
+		Elements: []indigo.DataElement{
+			{Name: "student", Type: indigo.Proto{Message: &school.Student{}}},
+			{Name: "honors", Type: indigo.Proto{Message: &school.HonorsConfiguration{}}},
+			{Name: "now", Type: indigo.Timestamp{}},
+			{Name: "unused", Type: indigo.String{}},
+		},
+	}
+
+	r := &indigo.Rule{
+		ID:     "root",
+		Schema: schema,
+		Expr:   `student.gpa > 2.0`,
+		Rules: map[string]*indigo.Rule{
+			"a": {
+				ID:     "a",
+				Schema: schema,
+				Rules: map[string]*indigo.Rule{
+					"b": {
+						ID:     "b",
+						Schema: schema,
+						Expr:   `student.gpa >= honors.Minimum_GPA`,
+					},
+				},
+			},
+		},
 	}
+
+	e := indigo.NewEngine(cel.NewEvaluator())
+	names, err := e.UnusedSchemaElements(r)
+	is.NoErr(err)
+	is.Equal(names, []string{"now", "unused"})
+
+	// Outputs expressions count as references
+	r.Rules["a"].Outputs = map[string]string{"now": "now"}
+	names, err = e.UnusedSchemaElements(r)
+	is.NoErr(err)
+	is.Equal(names, []string{"unused"})
+
+	// So do ShardCondition and Message expressions
+	r.Rules["a"].ShardCondition = `unused != ""`
+	names, err = e.UnusedSchemaElements(r)
+	is.NoErr(err)
+	is.Equal(len(names), 0)
+
+	r.Rules["a"].ShardCondition = ""
+	r.Rules["a"].Message = `"missing " + unused`
+	names, err = e.UnusedSchemaElements(r)
+	is.NoErr(err)
+	is.Equal(len(names), 0)
+
+	r.Rules["a"].Rules["b"].Expr = `student.gpa >= "3.0"`
+	_, err = e.UnusedSchemaElements(r)
+	is.True(err != nil) // expected a compile error
 }
 
-func TestDiagnosticsWithEmptyRule(t *testing.T) {
+// Test that a rule may only refer to the schema elements in its allow-list
+func TestAllowedFields(t *testing.T) {
 	is := is.New(t)
+
 	e := indigo.NewEngine(cel.NewEvaluator())
-	d := map[string]interface{}{"a": "a"} // dummy data, not important
+	r := &indigo.Rule{
+		ID:     "root",
+		Schema: makeEducationSchema(),
+		Rules: map[string]*indigo.Rule{
+			"allowed": {
+				ID:            "allowed",
+				Schema:        makeEducationSchema(),
+				Expr:          `student.GPA < 2.5`,
+				AllowedFields: []string{"student.GPA", "student.Status"},
+			},
+			"disallowed": {
+				ID:            "disallowed",
+				Schema:        makeEducationSchema(),
+				Expr:          `student.GPA < 2.5 && student.ID == "12312"`,
+				AllowedFields: []string{"student.GPA", "student.Status"},
+			},
+		},
+	}
+
+	err := e.Compile(r)
+	is.True(err != nil)
+	errs := indigo.CompileErrors(err)
+	is.Equal(len(errs), 1)
+	is.Equal(errs[0].RuleID, "disallowed")
+	is.True(strings.Contains(err.Error(), "student.ID"))
+	is.True(r.Rules["disallowed"].Program == nil)
+	is.True(r.Rules["allowed"].Program != nil)
+
+	// An empty allow-list permits no schema elements
+	r.Rules["allowed"].AllowedFields = []string{}
+	delete(r.Rules, "disallowed")
+	is.True(e.Compile(r) != nil)
+
+	r.Rules["allowed"].Expr = "true"
+	is.NoErr(e.Compile(r))
+}
+
+// Test that a rule's value is available to its descendants under its ResultKey
+func TestResultKey(t *testing.T) {
+	is := is.New(t)
+
+	schema := indigo.Schema{
+		Elements: []indigo.DataElement{
+			{Name: "student", Type: indigo.Proto{Message: &school.Student{}}},
+			{Name: "adjusted", Type: indigo.Float{}},
+		},
+	}
 
 	r := &indigo.Rule{
 		ID: "root",
+		Rules: map[string]*indigo.Rule{
+			"adjust": {
+				ID:         "adjust",
+				Schema:     schema,
+				ResultType: indigo.Float{},
+				Expr:       "student.gpa * 2.0",
+				ResultKey:  "adjusted",
+				Rules: map[string]*indigo.Rule{
+					"high": {
+						ID:     "high",
+						Schema: schema,
+						Expr:   "adjusted > 5.0",
+						Rules: map[string]*indigo.Rule{
+							"very_high": {
+								ID:     "very_high",
+								Schema: schema,
+								Expr:   "adjusted > 7.0",
+							},
+						},
+					},
+				},
+			},
+		},
 	}
 
-	err := e.Compile(r)
+	e := indigo.NewEngine(cel.NewEvaluator())
+	is.NoErr(e.Compile(r))
+
+	data := map[string]interface{}{
+		"student": &school.Student{Gpa: 3.0},
+	}
+
+	u, err := e.Eval(context.Background(), r, data)
 	is.NoErr(err)
+	is.Equal(u.Results["adjust"].Value, 6.0)
+	is.True(u.Results["adjust"].Results["high"].ExpressionPass)
+	is.True(!u.Results["adjust"].Results["high"].Results["very_high"].ExpressionPass)
 
-	u, err := e.Eval(context.Background(), r, d)
+	_, ok := data["adjusted"]
+	is.True(!ok) // the caller's data is not modified
+}
+
+// Make sure that the value of a sub-expression, identified by the ID in the
+// diagnostics, can be retrieved
+func TestEvalSubexpr(t *testing.T) {
+	is := is.New(t)
+
+	e := indigo.NewEngine(cel.NewEvaluator())
+	r := &indigo.Rule{
+		ID:     "at_risk",
+		Schema: makeEducationSchema(),
+		Expr:   `student.GPA < 2.5`,
+	}
+	err := e.Compile(r, indigo.CollectDiagnostics(true))
 	is.NoErr(err)
-	is.Equal(u.Diagnostics, nil)
+
+	u, err := e.Eval(context.Background(), r, makeStudentData(), indigo.ReturnDiagnostics(true))
+	is.NoErr(err)
+	is.True(u.Diagnostics != nil)
+
+	var id int64 = -1
+	for _, c := range u.Diagnostics.Children {
+		if c.Expr == "student.GPA" {
+			id = c.ID
+		}
+	}
+	is.True(id != -1) // student.GPA not found in diagnostics
+
+	v, err := e.EvalSubexpr(r, makeStudentData(), id)
+	is.NoErr(err)
+	is.Equal(v, 2.2)
+
+	v, err = e.EvalSubexpr(r, makeStudentData(), u.Diagnostics.ID)
+	is.NoErr(err)
+	is.Equal(v, true)
+
+	// Without diagnostics, the expression is compiled again with state tracking
+	err = e.Compile(r)
+	is.NoErr(err)
+	v, err = e.EvalSubexpr(r, makeStudentData(), id)
+	is.NoErr(err)
+	is.Equal(v, 2.2)
+
+	_, err = e.EvalSubexpr(r, makeStudentData(), 9999)
+	is.True(err != nil) // no such sub-expression
 }
 
-func TestRuleResultTypes(t *testing.T) {
+// Make sure that extension functions are only available when enabled
+func TestExtensions(t *testing.T) {
+	is := is.New(t)
+
 	cases := []struct {
-		rule indigo.Rule
-		err  error
+		expr string
+		opt  cel.CelOption
 	}{
-		{
-			indigo.Rule{
-				ID:         "shouldBeBool",
-				Schema:     makeEducationProtoSchema(),
-				ResultType: indigo.Bool{},
-				Expr:       `student.gpa >= 3.6`,
-			},
-			nil,
+		{`"abc".charAt(1) == "b"`, cel.StringExtensions()},
+		{`"abc".indexOf("c") == 2`, cel.StringExtensions()},
+		{`math.greatest(1, 5, 3) == 5`, cel.MathExtensions()},
+	}
+
+	for _, c := range cases {
+		r := indigo.NewRule("ext", c.expr)
+
+		e := indigo.NewEngine(cel.NewEvaluator())
+		err := e.Compile(r)
+		is.True(err != nil) // extension is not enabled
+
+		e = indigo.NewEngine(cel.NewEvaluator(c.opt))
+		err = e.Compile(r)
+		is.NoErr(err)
+		u, err := e.Eval(context.Background(), r, map[string]interface{}{})
+		is.NoErr(err)
+		is.True(u.ExpressionPass)
+	}
+}
+
+// Test the rounding policies on edge values
+func TestRoundingFunctions(t *testing.T) {
+	is := is.New(t)
+
+	cases := []struct {
+		expr    string
+		want    int64
+		wantErr bool
+	}{
+		{expr: `roundHalfUp(2.5)`, want: 3},
+		{expr: `roundHalfUp(2.4999)`, want: 2},
+		{expr: `roundHalfUp(-2.5)`, want: -2},
+		{expr: `roundHalfUp(-2.5001)`, want: -3},
+		{expr: `roundHalfUp(0.49999999999999994)`, want: 0},
+		{expr: `truncate(2.9)`, want: 2},
+		{expr: `truncate(-2.9)`, want: -2},
+		{expr: `truncate(-0.5)`, want: 0},
+		{expr: `ceil(2.1)`, want: 3},
+		{expr: `ceil(-2.9)`, want: -2},
+		{expr: `ceil(3.0)`, want: 3},
+		{expr: `int(2.9)`, want: 2}, // CEL's default
+		{expr: `int(-2.9)`, want: -2},
+		{expr: `ceil(1.0e19)`, wantErr: true},
+		{expr: `truncate(-1.0e19)`, wantErr: true},
+	}
+
+	e := indigo.NewEngine(cel.NewEvaluator(cel.RoundingFunctions()))
+	for _, c := range cases {
+		r := &indigo.Rule{
+			ID:         "round",
+			Expr:       c.expr,
+			ResultType: indigo.Int{},
+		}
+		err := e.Compile(r)
+		is.NoErr(err)
+
+		u, err := e.Eval(context.Background(), r, map[string]interface{}{})
+		if c.wantErr {
+			is.True(err != nil) // expected overflow error
+			continue
+		}
+		is.NoErr(err)
+		is.Equal(u.Value, c.want)
+	}
+}
+
+// Test the set functions on lists of strings and ints, including empty lists
+func TestRegexExtensions(t *testing.T) {
+	is := is.New(t)
+
+	schema := indigo.Schema{
+		Elements: []indigo.DataElement{
+			{Name: "email", Type: indigo.String{}},
+			{Name: "pattern", Type: indigo.String{}},
 		},
-		{
-			indigo.Rule{
-				ID:         "shouldBeBFloat",
-				Schema:     makeEducationProtoSchema(),
-				ResultType: indigo.Float{},
-				Expr:       `student.gpa + 1.0`,
-			},
-			nil,
+	}
+
+	e := indigo.NewEngine(cel.NewEvaluator(cel.RegexExtensions()))
+	eval := func(expr string, data map[string]interface{}) (interface{}, error) {
+		r := &indigo.Rule{ID: "capture", Schema: schema, Expr: expr, ResultType: indigo.String{}}
+		if err := e.Compile(r); err != nil {
+			return nil, err
+		}
+		return e.EvalValue(context.Background(), r, data)
+	}
+
+	data := map[string]interface{}{"email": "ada@example.com", "pattern": `@(?P<domain>.+)$`}
+
+	v, err := eval(`capture(email, "@(?P<domain>.+)$", "domain")`, data)
+	is.NoErr(err)
+	is.Equal(v, "example.com")
+
+	v, err = eval(`capture(email, "^(?P<user>[^@]+)@", "user")`, data)
+	is.NoErr(err)
+	is.Equal(v, "ada")
+
+	// A regex that isn't a literal is compiled when evaluated
+	v, err = eval(`capture(email, pattern, "domain")`, data)
+	is.NoErr(err)
+	is.Equal(v, "example.com")
+
+	// No match
+	v, err = eval(`capture(email, "@(?P<domain>.+)$", "domain")`, map[string]interface{}{"email": "nobody", "pattern": ""})
+	is.NoErr(err)
+	is.Equal(v, "")
+
+	// An invalid literal regex, or a missing group, is a compilation error
+	err = e.Compile(&indigo.Rule{ID: "bad", Schema: schema, Expr: `capture(email, "(?P<x", "x") == ""`})
+	is.True(err != nil)
+	is.Equal(len(indigo.CompileErrors(err)), 1)
+	err = e.Compile(&indigo.Rule{ID: "bad", Schema: schema, Expr: `capture(email, "(?P<x>a)", "y") == ""`})
+	is.True(err != nil)
+	is.True(strings.Contains(err.Error(), `no group named "y"`))
+
+	// An invalid regex from the data is an evaluation error
+	_, err = eval(`capture(email, pattern, "x")`, map[string]interface{}{"email": "a", "pattern": "(?P<x"})
+	is.True(err != nil)
+	is.True(strings.Contains(err.Error(), "capture"))
+}
+
+func TestSetOperations(t *testing.T) {
+	is := is.New(t)
+
+	schema := indigo.Schema{
+		Elements: []indigo.DataElement{
+			{Name: "tags", Type: indigo.List{ValueType: indigo.String{}}},
+			{Name: "allowed", Type: indigo.List{ValueType: indigo.String{}}},
+			{Name: "codes", Type: indigo.List{ValueType: indigo.Int{}}},
+			{Name: "none", Type: indigo.List{ValueType: indigo.Int{}}},
 		},
-		{
-			indigo.Rule{
-				ID:         "shouldBeInt",
-				Schema:     makeEducationProtoSchema(),
+	}
+
+	data := map[string]interface{}{
+		"tags":    []string{"red", "blue"},
+		"allowed": []string{"red", "blue", "green"},
+		"codes":   []int64{1, 2, 2},
+		"none":    []int64{},
+	}
+
+	cases := []struct {
+		expr string
+		want bool
+	}{
+		{expr: `intersects(tags, allowed)`, want: true},
+		{expr: `intersects(tags, ["yellow"])`, want: false},
+		{expr: `subset(tags, allowed)`, want: true},
+		{expr: `subset(allowed, tags)`, want: false},
+		{expr: `unique(tags)`, want: true},
+		{expr: `intersects(codes, [2, 3])`, want: true},
+		{expr: `intersects(codes, [4])`, want: false},
+		{expr: `subset(codes, [1, 2])`, want: true},
+		{expr: `subset(codes, [1])`, want: false},
+		{expr: `unique(codes)`, want: false},
+		{expr: `intersects(none, codes)`, want: false},
+		{expr: `intersects(codes, none)`, want: false},
+		{expr: `subset(none, codes)`, want: true},
+		{expr: `subset(codes, none)`, want: false},
+		{expr: `unique(none)`, want: true},
+		// Numbers of different types are equal if they have the same value, as with ==
+		{expr: `dyn(1) == dyn(1.0)`, want: true},
+		{expr: `intersects(codes, dyn([1.0]))`, want: true},
+		{expr: `intersects(codes, dyn([1.5, 3u]))`, want: false},
+		{expr: `subset(dyn([1u, 2.0]), codes)`, want: true},
+		{expr: `unique([dyn(1), dyn(1.0)])`, want: false},
+		{expr: `unique([dyn(1), dyn(1u)])`, want: false},
+		{expr: `unique([dyn(-1), dyn(18446744073709551615u), dyn(-1.0)])`, want: false},
+		{expr: `unique([dyn(0.5), dyn(1), dyn(18446744073709551615u)])`, want: true},
+	}
+
+	e := indigo.NewEngine(cel.NewEvaluator(cel.SetOperations()))
+	for _, c := range cases {
+		r := &indigo.Rule{
+			ID:     "set",
+			Expr:   c.expr,
+			Schema: schema,
+		}
+		err := e.Compile(r)
+		is.NoErr(err)
+
+		u, err := e.Eval(context.Background(), r, data)
+		is.NoErr(err)
+		if u.ExpressionPass != c.want {
+			t.Errorf("%s: got %t, wanted %t", c.expr, u.ExpressionPass, c.want)
+		}
+	}
+
+	// Lists of different types are rejected by the type checker
+	r := &indigo.Rule{
+		ID:     "mixed",
+		Expr:   `intersects(tags, codes)`,
+		Schema: schema,
+	}
+	is.True(e.Compile(r) != nil)
+
+	// The functions are only available with the option
+	r = &indigo.Rule{
+		ID:     "noext",
+		Expr:   `unique(tags)`,
+		Schema: schema,
+	}
+	is.True(indigo.NewEngine(cel.NewEvaluator()).Compile(r) != nil)
+}
+
+// Test that timestamp functions use the evaluator's default time zone
+func TestDefaultTimeZone(t *testing.T) {
+	is := is.New(t)
+
+	ny, err := time.LoadLocation("America/New_York")
+	is.NoErr(err)
+
+	r := &indigo.Rule{
+		ID: "dow",
+		Schema: indigo.Schema{
+			Elements: []indigo.DataElement{{Name: "t", Type: indigo.Timestamp{}}},
+		},
+		ResultType: indigo.Int{},
+		Expr:       "t.getDayOfWeek()",
+		Rules: map[string]*indigo.Rule{
+			"utc": {
+				ID:         "utc",
 				ResultType: indigo.Int{},
-				Expr:       `4`,
+				Expr:       `t.getDayOfWeek("UTC")`,
 			},
-			nil,
 		},
-		{
-			indigo.Rule{
-				ID:         "shouldBeIntList",
-				Schema:     makeEducationProtoSchema(),
-				ResultType: indigo.List{ValueType: indigo.Int{}},
-				Expr:       `[1,2,3]`,
+	}
+	r.Rules["utc"].Schema = r.Schema
+
+	// 01:30 UTC on Saturday is 21:30 on Friday in New York
+	data := map[string]interface{}{
+		"t": timestamppb.New(time.Date(2022, 1, 8, 1, 30, 0, 0, time.UTC)),
+	}
+
+	e := indigo.NewEngine(cel.NewEvaluator())
+	is.NoErr(e.Compile(r))
+	u, err := e.Eval(context.Background(), r, data)
+	is.NoErr(err)
+	is.Equal(u.Value, int64(time.Saturday))
+
+	e = indigo.NewEngine(cel.NewEvaluator(cel.DefaultTimeZone(ny)))
+	is.NoErr(e.Compile(r))
+	u, err = e.Eval(context.Background(), r, data)
+	is.NoErr(err)
+	is.Equal(u.Value, int64(time.Friday))
+	is.Equal(u.Results["utc"].Value, int64(time.Saturday)) // explicit time zone wins
+}
+
+// Test that function calls and field selections are renamed, including inside
+// macros, and that the rewritten expression compiles
+func TestRewrite(t *testing.T) {
+	is := is.New(t)
+
+	ev := cel.NewEvaluator(cel.RoundingFunctions())
+
+	out, err := ev.Rewrite(`roundUp(student.gpa) >= 3 && student.grade_list.all(g, roundUp(g) > 1)`,
+		[]cel.RewriteRule{
+			{Kind: cel.RenameFunction, From: "roundUp", To: "roundHalfUp"},
+			{Kind: cel.RenameField, From: "grade_list", To: "grades"},
+		})
+	is.NoErr(err)
+	is.Equal(out, `roundHalfUp(student.gpa) >= 3 && student.grades.all(g, roundHalfUp(g) > 1)`)
+
+	r := &indigo.Rule{
+		ID:   "honors",
+		Expr: out,
+		Schema: indigo.Schema{
+			Elements: []indigo.DataElement{
+				{Name: "student", Type: indigo.Proto{Message: &school.Student{}}},
 			},
-			nil,
 		},
-		{
-			indigo.Rule{
-				ID:         "shouldBeAnyList",
-				Schema:     makeEducationProtoSchema(),
-				ResultType: indigo.List{ValueType: indigo.Any{}},
-				Expr:       `[1,"2",3]`,
-			},
-			nil,
+	}
+	e := indigo.NewEngine(ev)
+	is.NoErr(e.Compile(r))
+
+	u, err := e.Eval(context.Background(), r, map[string]interface{}{
+		"student": &school.Student{Gpa: 2.5, Grades: []float64{1.5, 2.0}},
+	})
+	is.NoErr(err)
+	is.True(u.Pass)
+
+	_, err = ev.Rewrite(`roundUp(`, nil)
+	is.True(err != nil) // parse error
+}
+
+// Test that each rule is compiled with the registered schema matching
+// its schema ID
+func TestFixedSchemas(t *testing.T) {
+	is := is.New(t)
+
+	students := &indigo.Schema{
+		ID:       "students",
+		Elements: []indigo.DataElement{{Name: "student", Type: indigo.Proto{Message: &school.Student{}}}},
+	}
+	honors := &indigo.Schema{
+		ID:       "honors",
+		Elements: []indigo.DataElement{{Name: "honors", Type: indigo.Proto{Message: &school.HonorsConfiguration{}}}},
+	}
+
+	e := indigo.NewEngine(cel.NewEvaluator(cel.FixedSchemas(map[string]*indigo.Schema{
+		"students": students,
+		"honors":   honors,
+	})))
+
+	// The rules only carry the schema ID; the elements come from the evaluator
+	r := &indigo.Rule{
+		ID: "root",
+		Rules: map[string]*indigo.Rule{
+			"gpa":     {ID: "gpa", Schema: indigo.Schema{ID: "students"}, Expr: "student.gpa > 3.0"},
+			"minimum": {ID: "minimum", Schema: indigo.Schema{ID: "honors"}, Expr: "honors.Minimum_GPA > 3.0"},
 		},
-		{
-			indigo.Rule{
-				ID:         "shouldBeList",
-				Schema:     makeEducationProtoSchema(),
-				ResultType: indigo.List{ValueType: indigo.Float{}},
-				Expr:       `student.grades`,
-			},
-			nil,
+	}
+	r.Schema.ID = "students"
+	is.NoErr(e.Compile(r))
+
+	u, err := e.Eval(context.Background(), r, map[string]interface{}{
+		"student": &school.Student{Gpa: 3.5},
+		"honors":  &school.HonorsConfiguration{Minimum_GPA: 3.2},
+	})
+	is.NoErr(err)
+	is.True(u.Pass)
+
+	// A rule can't refer to the elements of another schema
+	r.Rules["gpa"].Expr = "student.gpa > honors.Minimum_GPA"
+	err = e.Compile(r)
+	is.True(err != nil)
+	is.True(strings.Contains(err.Error(), "undeclared reference to 'honors'"))
+
+	// The schema must be registered
+	r.Rules["gpa"].Expr = "student.gpa > 3.0"
+	r.Rules["gpa"].Schema.ID = "teachers"
+	err = e.Compile(r)
+	is.True(err != nil)
+	is.True(strings.Contains(err.Error(), `schema "teachers" is not registered`))
+}
+
+// Test that a custom random function gives the same outcome for the same seed
+func TestSeed(t *testing.T) {
+	is := is.New(t)
+
+	sample := celgo.Function("sample",
+		celgo.Overload("sample_int_double", []*celgo.Type{celgo.IntType, celgo.DoubleType}, celgo.BoolType,
+			celgo.BinaryBinding(func(seed, rate ref.Val) ref.Val {
+				rnd := rand.New(rand.NewSource(int64(seed.(types.Int))))
+				return types.Bool(rnd.Float64() < float64(rate.(types.Double)))
+			})))
+
+	schema := indigo.Schema{
+		Elements: []indigo.DataElement{
+			{Name: "seed", Type: indigo.Int{}},
 		},
-		{
-			indigo.Rule{
-				ID:         "shouldBeMap",
-				Schema:     makeEducationProtoSchema(),
-				ResultType: indigo.Map{KeyType: indigo.String{}, ValueType: indigo.Int{}},
-				Expr:       `{'blue': 1, 'red': 2}`,
-			},
-			nil,
+	}
+
+	r := indigo.NewRule("root", "")
+	for i := 0; i < 20; i++ {
+		id := fmt.Sprintf("sample%d", i)
+		r.Rules[id] = &indigo.Rule{
+			ID:     id,
+			Schema: schema,
+			Expr:   fmt.Sprintf("sample(seed + %d, 0.5)", i),
+		}
+	}
+
+	e := indigo.NewEngine(cel.NewEvaluator(cel.WithExtensions(sample)))
+	is.NoErr(e.Compile(r))
+
+	outcomes := func(seed int64) map[string]bool {
+		u, err := e.Eval(context.Background(), r, map[string]interface{}{}, indigo.WithSeed(seed))
+		is.NoErr(err)
+		m := map[string]bool{}
+		for id, c := range u.Results {
+			m[id] = c.ExpressionPass
+		}
+		return m
+	}
+
+	is.Equal(outcomes(42), outcomes(42))
+	is.True(fmt.Sprint(outcomes(42)) != fmt.Sprint(outcomes(7)))
+
+	// Without a seed, the expression refers to missing data
+	_, err := e.Eval(context.Background(), r, map[string]interface{}{})
+	is.True(errors.Is(err, indigo.ErrMissingData))
+
+	// The seed doesn't replace a value in the data
+	_, err = e.Eval(context.Background(), r, map[string]interface{}{"seed": 7}, indigo.WithSeed(42))
+	is.True(err != nil)
+	is.True(strings.Contains(err.Error(), `the data has a value for "seed"`))
+	_, err = e.EvalValue(context.Background(), r.Rules["sample0"], map[string]interface{}{"seed": 7}, indigo.WithSeed(42))
+	is.True(err != nil)
+}
+
+// Test that evaluation stops when an expression costs more than the limit
+func TestCostLimit(t *testing.T) {
+	is := is.New(t)
+
+	r := &indigo.Rule{
+		ID:   "expensive",
+		Expr: "xs.all(a, xs.all(b, a + b >= 0))",
+		Schema: indigo.Schema{
+			Elements: []indigo.DataElement{{Name: "xs", Type: indigo.List{ValueType: indigo.Int{}}}},
 		},
+	}
 
-		{
-			indigo.Rule{
-				ID:         "shouldBeStudent",
-				Schema:     makeEducationProtoSchema(),
-				ResultType: indigo.Proto{Message: &school.Student{}},
-				Expr:       `testdata.school.Student { gpa: 1.2 }`,
+	xs := make([]int, 1000)
+	for i := range xs {
+		xs[i] = i
+	}
+	data := map[string]interface{}{"xs": xs}
+
+	e := indigo.NewEngine(cel.NewEvaluator(cel.CostLimit(10000)))
+	is.NoErr(e.Compile(r))
+	_, err := e.Eval(context.Background(), r, data)
+	is.True(errors.Is(err, indigo.ErrCostLimitExceeded))
+	is.True(strings.HasPrefix(err.Error(), "rule expensive: "))
+
+	// A cheap evaluation of the same rule is within the limit
+	u, err := e.Eval(context.Background(), r, map[string]interface{}{"xs": xs[:10]})
+	is.NoErr(err)
+	is.True(u.Pass)
+
+	e = indigo.NewEngine(cel.NewEvaluator())
+	is.NoErr(e.Compile(r))
+	u, err = e.Eval(context.Background(), r, data)
+	is.NoErr(err)
+	is.True(u.Pass)
+}
+
+// Test that a schema element missing from the data takes its default value
+func TestDataElementDefault(t *testing.T) {
+	is := is.New(t)
+
+	r := &indigo.Rule{
+		ID:   "winter_heating",
+		Expr: "!isSummer && temperature < 10.0",
+		Schema: indigo.Schema{
+			Elements: []indigo.DataElement{
+				{Name: "isSummer", Type: indigo.Bool{}, Default: false},
+				{Name: "temperature", Type: indigo.Float{}},
 			},
-			nil,
 		},
-		{
-			indigo.Rule{
-				ID:         "shouldBeTimestamp",
-				Schema:     makeEducationProtoSchema(),
-				ResultType: indigo.Timestamp{},
-				Expr:       `now`,
-			},
-			nil,
+	}
+
+	e := indigo.NewEngine(cel.NewEvaluator())
+	is.NoErr(e.Compile(r))
+
+	data := map[string]interface{}{"temperature": 5.0}
+	u, err := e.Eval(context.Background(), r, data)
+	is.NoErr(err)
+	is.True(u.Pass)
+	is.Equal(len(data), 1) // the caller's data is unchanged
+
+	// The value in the data takes precedence over the default
+	u, err = e.Eval(context.Background(), r, map[string]interface{}{"temperature": 5.0, "isSummer": true})
+	is.NoErr(err)
+	is.True(!u.Pass)
+
+	// Elements without a default are still required
+	_, err = e.Eval(context.Background(), r, map[string]interface{}{})
+	is.True(err != nil)
+
+	// The default must be assignable to the element's type
+	r.Schema.Elements[0].Default = "no"
+	err = e.Compile(r)
+	is.True(err != nil)
+	is.True(strings.Contains(err.Error(), "not assignable to bool"))
+}
+
+// Make sure that the input values that would make failing comparisons pass
+// are suggested
+func TestCounterfactual(t *testing.T) {
+	is := is.New(t)
+
+	e := indigo.NewEngine(cel.NewEvaluator())
+	r := makeEducationRules1()
+	honors := r.Rules["student_actions"].Rules["honors_student"]
+
+	m, err := e.Counterfactual(honors, makeStudentData())
+	is.NoErr(err)
+	is.Equal(m, map[string]interface{}{"student.GPA": 3.6})
+
+	cases := []struct {
+		expr string
+		want map[string]interface{}
+	}{
+		{`student.GPA > 3.6`, map[string]interface{}{"student.GPA": math.Nextafter(3.6, 4.0)}},
+		{`3.0 <= student.GPA && student.Age > 17`, map[string]interface{}{"student.GPA": 3.0, "student.Age": int64(18)}},
+		{`student.Age > 10 && student.GPA < 2.0`, map[string]interface{}{"student.GPA": math.Nextafter(2.0, 1.0)}},
+		{`student.GPA < 2.5`, map[string]interface{}{}}, // passes
+		{`student.GPA > 3.0 || student.Age > 17`, map[string]interface{}{}},
+	}
+
+	for _, c := range cases {
+		r := &indigo.Rule{
+			ID:     "cf",
+			Schema: makeEducationSchema(),
+			Expr:   c.expr,
+		}
+		m, err := e.Counterfactual(r, makeStudentData())
+		is.NoErr(err)
+		is.Equal(m, c.want)
+	}
+
+	// Proto fields are reported with their full path
+	r = &indigo.Rule{
+		ID:     "proto",
+		Schema: makeEducationProtoSchema(),
+		Expr:   `student.gpa >= 3.9`,
+	}
+	m, err = e.Counterfactual(r, makeStudentProtoData())
+	is.NoErr(err)
+	is.Equal(m, map[string]interface{}{"student.gpa": 3.9})
+
+	// No value passes a comparison with the largest or smallest value
+	schema := indigo.Schema{Elements: []indigo.DataElement{
+		{Name: "x", Type: indigo.Int{}},
+		{Name: "limit", Type: indigo.Int{}, Default: int64(10)},
+		{Name: "now", Type: indigo.Timestamp{}},
+	}}
+	for _, expr := range []string{`x > 9223372036854775807`, `x < -9223372036854775808`} {
+		m, err = e.Counterfactual(&indigo.Rule{ID: "max", Schema: schema, Expr: expr}, map[string]interface{}{"x": 1})
+		is.NoErr(err)
+		is.Equal(m, map[string]interface{}{})
+	}
+
+	// The data is prepared as in Eval, with the schema's defaults and "now"
+	r = &indigo.Rule{
+		ID:     "prepared",
+		Schema: schema,
+		Expr:   `now > timestamp("2000-01-01T00:00:00Z") && limit > 20 && x > 5`,
+	}
+	want := map[string]interface{}{"limit": int64(21), "x": int64(6)}
+	m, err = e.Counterfactual(r, map[string]interface{}{"x": 1}, indigo.InjectNow(time.Now()))
+	is.NoErr(err)
+	is.Equal(m, want)
+
+	auto := indigo.NewEngine(cel.NewEvaluator(cel.AutoNow()))
+	m, err = auto.Counterfactual(r, map[string]interface{}{"x": 1})
+	is.NoErr(err)
+	is.Equal(m, want)
+}
+
+// Make sure that EvalValue returns the value of the expression only
+func TestEvalValue(t *testing.T) {
+	is := is.New(t)
+
+	e := indigo.NewEngine(cel.NewEvaluator())
+	data := makeStudentProtoData()
+
+	// The rule is compiled if needed; child rules are not evaluated
+	r := &indigo.Rule{
+		ID:         "risk_factor",
+		Schema:     makeEducationProtoSchema(),
+		Expr:       `student.gpa < 3.0 ? 8.0 : 2.0`,
+		ResultType: indigo.Float{},
+		Rules: map[string]*indigo.Rule{
+			"broken": {ID: "broken", Expr: `this is not CEL`},
 		},
-		{
-			indigo.Rule{
-				ID:         "shouldBeDuration",
+	}
+	v, err := e.EvalValue(context.Background(), r, data)
+	is.NoErr(err)
+	is.Equal(v, 2.0)
+	is.True(r.Program != nil)
+	is.Equal(r.Rules["broken"].Program, nil)
+
+	r = &indigo.Rule{
+		ID:         "grades",
+		Schema:     makeEducationProtoSchema(),
+		Expr:       `student.grades.filter(g, g >= 4.0)`,
+		ResultType: indigo.List{ValueType: indigo.Float{}},
+	}
+	v, err = e.EvalValue(context.Background(), r, data)
+	is.NoErr(err)
+	is.Equal(v, []interface{}{4.0, 4.0})
+
+	r = &indigo.Rule{
+		ID:         "probation",
+		Schema:     makeEducationProtoSchema(),
+		Expr:       `testdata.school.Student{gpa: 1.2, status: testdata.school.Student.status_type.PROBATION}`,
+		ResultType: indigo.Proto{Message: &school.Student{}},
+	}
+	v, err = e.EvalValue(context.Background(), r, data)
+	is.NoErr(err)
+	s, ok := v.(*school.Student)
+	is.True(ok)
+	is.Equal(s.Gpa, 1.2)
+	is.Equal(s.Status, school.Student_PROBATION)
+
+	// Compilation errors are reported
+	r = &indigo.Rule{ID: "bad", Schema: makeEducationProtoSchema(), Expr: `student.nope`}
+	_, err = e.EvalValue(context.Background(), r, data)
+	var ce *indigo.CompileError
+	is.True(errors.As(err, &ce))
+	is.Equal(ce.RuleID, "bad")
+}
+
+// Make sure that result values are emitted as JSON, not as Go strings
+func TestResultToJSON(t *testing.T) {
+	is := is.New(t)
+
+	e := indigo.NewEngine(cel.NewEvaluator())
+	r := &indigo.Rule{
+		ID:         "root",
+		Schema:     makeEducationProtoSchema(),
+		Expr:       `testdata.school.Student{gpa: 1.2, status: testdata.school.Student.status_type.PROBATION}`,
+		ResultType: indigo.Proto{Message: &school.Student{}},
+		Rules: map[string]*indigo.Rule{
+			"tenure": {
+				ID:         "tenure",
 				Schema:     makeEducationProtoSchema(),
+				Expr:       `duration("90m")`,
 				ResultType: indigo.Duration{},
-				Expr:       `duration("12h")`,
 			},
-			nil,
 		},
+	}
+	is.NoErr(e.Compile(r))
 
-		{
-			indigo.Rule{
-				ID:         "NEGATIVEshouldBeBFloat",
-				Schema:     makeEducationProtoSchema(),
-				ResultType: indigo.Bool{},
-				Expr:       `student.gpa + 1.0`,
-			},
-			fmt.Errorf("Should be an error"),
+	u, err := e.Eval(context.Background(), r, makeStudentProtoData())
+	is.NoErr(err)
+
+	b, err := u.ToJSON()
+	is.NoErr(err)
+
+	var got struct {
+		RuleID         string `json:"rule_id"`
+		Pass           bool   `json:"pass"`
+		ExpressionPass bool   `json:"expression_pass"`
+		EvalCount      int    `json:"eval_count"`
+		Value          struct {
+			Type  string          `json:"type"`
+			Value json.RawMessage `json:"value"`
+		} `json:"value"`
+		Results map[string]struct {
+			Value struct {
+				Type  string `json:"type"`
+				Value string `json:"value"`
+			} `json:"value"`
+		} `json:"results"`
+	}
+	is.NoErr(json.Unmarshal(b, &got))
+
+	is.Equal(got.RuleID, "root")
+	is.True(got.Pass)
+	is.Equal(got.EvalCount, 2)
+	is.Equal(got.Value.Type, "proto(testdata.school.Student)")
+
+	var student school.Student
+	is.NoErr(protojson.Unmarshal(got.Value.Value, &student))
+	is.Equal(student.Gpa, 1.2)
+	is.Equal(student.Status, school.Student_PROBATION)
+
+	is.Equal(got.Results["tenure"].Value.Type, "duration")
+	is.Equal(got.Results["tenure"].Value.Value, "1h30m0s")
+}
+
+// Make sure that the documentation for a rule tree includes the rules,
+// schemas and annotations
+func TestGenerateDocs(t *testing.T) {
+	is := is.New(t)
+
+	r := makeEducationRules1()
+	sa := r.Rules["student_actions"]
+	sa.Annotations = map[string]string{
+		"owner":       "registrar@example.edu",
+		"description": "Actions to take | based on student performance",
+	}
+	sc := makeEducationSchema()
+	sc.ID = "education"
+	sc.Description = "Student records"
+	sa.Rules["honors_student"].Schema = sc
+
+	docs, err := indigo.GenerateDocs(r)
+	is.NoErr(err)
+
+	for _, want := range []string{
+		"# Rule `root`",
+		"## Rule `student_actions`",
+		"### Rule `honors_student`",
+		"#### Rule `risk_factor`",
+		"student.GPA >= 3.6 && student.Status!=\"Probation\"",
+		"| owner | registrar@example.edu |",
+		"| description | Actions to take \\| based on student performance |",
+		"Schema: `education`",
+		"## Schema `education`",
+		"Student records",
+		"| student.GPA | `float` |  |",
+		"Result type: `float`",
+		"Options: StopFirstPositiveChild",
+	} {
+		is.True(strings.Contains(docs, want)) // missing content in docs
+	}
+
+	_, err = indigo.GenerateDocs(nil)
+	is.True(err != nil)
+}
+
+// Test that a rule referring to missing data is unknown, and that the
+// parent aggregates unknown children according to the UnknownChildren option
+// Test the errors reported as missing data, which depend on how cel-go
+// reports them
+func TestMissingData(t *testing.T) {
+	is := is.New(t)
+
+	schema := indigo.Schema{
+		Elements: []indigo.DataElement{
+			{Name: "x", Type: indigo.Int{}, Alias: "ex"},
+			{Name: "y", Type: indigo.Int{}},
+			{Name: "m", Type: indigo.Map{KeyType: indigo.String{}, ValueType: indigo.Int{}}},
+			{Name: "student", Type: indigo.Proto{Message: &school.Student{}}},
+		},
+	}
+	data := map[string]interface{}{
+		"y":       2,
+		"m":       map[string]int{"a": 1},
+		"student": &school.Student{},
+	}
+
+	cases := []struct {
+		expr    string
+		missing bool
+		pass    bool
+	}{
+		{expr: `x > 1`, missing: true},
+		{expr: `ex > 1`, missing: true},      // the alias of a missing element
+		{expr: `y > 1 || x > 1`, pass: true}, // the missing element doesn't matter
+		{expr: `y > 5 && x > 1`, pass: false},
+		{expr: `m["b"] > 0`, missing: true},
+		{expr: `m["a"] > 0`, pass: true},
+		{expr: `y / 0 > 1`, missing: false},
+	}
+
+	e := indigo.NewEngine(cel.NewEvaluator())
+	for _, c := range cases {
+		r := &indigo.Rule{ID: "r", Schema: schema, Expr: c.expr}
+		is.NoErr(e.Compile(r))
+		u, err := e.Eval(context.Background(), r, data)
+		is.Equal(errors.Is(err, indigo.ErrMissingData), c.missing)
+		if err == nil {
+			is.Equal(u.Pass, c.pass)
+		}
+	}
+
+	r := &indigo.Rule{ID: "r", Schema: schema, Expr: `x > 1`}
+	is.NoErr(e.Compile(r))
+	_, err := e.Eval(context.Background(), r, data)
+	is.True(strings.HasSuffix(err.Error(), "missing data: no value for x"))
+
+	// Unset fields, with the RequireSetFields option
+	e = indigo.NewEngine(cel.NewEvaluator(cel.RequireSetFields(true)))
+	r = &indigo.Rule{ID: "r", Schema: schema, Expr: `student.gpa > 3.0`}
+	is.NoErr(e.Compile(r))
+	_, err = e.Eval(context.Background(), r, data)
+	is.True(errors.Is(err, indigo.ErrMissingData))
+}
+
+func TestUnknownOnMissingData(t *testing.T) {
+	is := is.New(t)
+
+	schema := indigo.Schema{
+		Elements: []indigo.DataElement{
+			{Name: "x", Type: indigo.Int{}},
+			{Name: "y", Type: indigo.Int{}},
+		},
+	}
+
+	r := &indigo.Rule{
+		ID:     "root",
+		Schema: schema,
+		Rules: map[string]*indigo.Rule{
+			"x": {ID: "x", Schema: schema, Expr: "x > 1"},
+			"y": {ID: "y", Schema: schema, Expr: "y > 1"},
+		},
+	}
+
+	e := indigo.NewEngine(cel.NewEvaluator())
+	is.NoErr(e.Compile(r))
+
+	data := map[string]interface{}{"y": 2}
+
+	// Without the option, missing data is an error
+	_, err := e.Eval(context.Background(), r, data)
+	is.True(errors.Is(err, indigo.ErrMissingData))
+
+	u, err := e.Eval(context.Background(), r, data, indigo.UnknownOnMissingData(true))
+	is.NoErr(err)
+	is.Equal(u.Results["x"].State, indigo.StateUnknown)
+	is.True(!u.Results["x"].Pass)
+	is.Equal(u.Results["y"].State, indigo.StatePass)
+	is.Equal(u.State, indigo.StateUnknown)
+	is.True(!u.Pass)
+
+	cases := map[indigo.UnknownAction]indigo.ResultState{
+		indigo.UnknownIsUnknown: indigo.StateUnknown,
+		indigo.UnknownIsPass:    indigo.StatePass,
+		indigo.UnknownIsFail:    indigo.StateFail,
+	}
+
+	for action, want := range cases {
+		u, err := e.Eval(context.Background(), r, data, indigo.UnknownOnMissingData(true), indigo.UnknownChildren(action))
+		is.NoErr(err)
+		is.Equal(u.Results["x"].State, indigo.StateUnknown) // the child itself is still unknown
+		is.Equal(u.State, want)
+		is.Equal(u.Pass, want == indigo.StatePass)
+	}
+
+	// A failed child decides the outcome, regardless of unknown children
+	u, err = e.Eval(context.Background(), r, map[string]interface{}{"y": 0}, indigo.UnknownOnMissingData(true))
+	is.NoErr(err)
+	is.Equal(u.State, indigo.StateFail)
+
+	// With TrueIfAny, a passed child decides the outcome
+	r.EvalOptions.TrueIfAny = true
+	u, err = e.Eval(context.Background(), r, data, indigo.UnknownOnMissingData(true))
+	is.NoErr(err)
+	is.Equal(u.State, indigo.StatePass)
+
+	u, err = e.Eval(context.Background(), r, map[string]interface{}{"y": 0}, indigo.UnknownOnMissingData(true))
+	is.NoErr(err)
+	is.Equal(u.State, indigo.StateUnknown)
+}
+
+// Make sure that with the CollectErrors option, the errors of all the rules
+// are recorded in their results, and the evaluation continues
+func TestCollectErrors(t *testing.T) {
+	is := is.New(t)
+
+	schema := indigo.Schema{
+		Elements: []indigo.DataElement{
+			{Name: "self", Type: indigo.Proto{Message: &school.Student{}}},
+			{Name: "x", Type: indigo.Int{}},
+		},
+	}
+
+	r := &indigo.Rule{
+		ID:     "root",
+		Schema: schema,
+		Rules: map[string]*indigo.Rule{
+			"a": {ID: "a", Schema: schema, Expr: "self.gpa > 3.0"},
+			"b": {ID: "b", Schema: schema, Expr: `self.status == testdata.school.Student.status_type.ENROLLED`},
+			"c": {ID: "c", Schema: schema, Expr: "x > 1"},
+			"d": {
+				ID:     "d",
+				Schema: schema,
+				Expr:   "self.gpa > 3.0",
+				Rules: map[string]*indigo.Rule{
+					"d1": {ID: "d1", Schema: schema, Expr: "x > 1"},
+				},
+			},
+			"e": {ID: "e", Schema: schema, Expr: "self.gpa > 3.0", Self: &school.Student{Gpa: 3.5}},
+		},
+	}
+
+	e := indigo.NewEngine(cel.NewEvaluator())
+	is.NoErr(e.Compile(r))
+
+	data := map[string]interface{}{"x": 2}
+
+	// Without the option, the first error stops the evaluation
+	_, err := e.Eval(context.Background(), r, data)
+	is.True(err != nil)
+
+	u, err := e.Eval(context.Background(), r, data, indigo.CollectErrors(true))
+	is.NoErr(err)
+	is.True(!u.Pass)
+	is.NoErr(u.Error)
+
+	for _, id := range []string{"a", "b", "d"} {
+		res := u.Results[id]
+		is.True(res.Error != nil)
+		is.True(strings.HasPrefix(res.Error.Error(), "rule "+id+":"))
+		is.True(errors.Is(res.Error, indigo.ErrMissingData))
+		is.True(!res.Pass)
+		is.True(!res.ExpressionPass)
+	}
+	is.Equal(len(u.Results["d"].Results), 0) // children of a failed rule are not evaluated
+
+	is.NoErr(u.Results["c"].Error)
+	is.True(u.Results["c"].Pass)
+	is.NoErr(u.Results["e"].Error)
+	is.True(u.Results["e"].Pass)
+
+	is.Equal(u.SLOMetrics().ErrorCount, 3)
+}
+
+// Make sure that lists and maps are returned as Go lists and maps
+func TestListAndMapResults(t *testing.T) {
+	is := is.New(t)
+
+	schema := indigo.Schema{
+		Elements: []indigo.DataElement{
+			{Name: "grades", Type: indigo.List{ValueType: indigo.Float{}}},
+		},
+	}
+
+	e := indigo.NewEngine(cel.NewEvaluator())
+	eval := func(expr string, resultType indigo.Type) *indigo.Result {
+		r := &indigo.Rule{ID: "r", Schema: schema, Expr: expr, ResultType: resultType}
+		is.NoErr(e.Compile(r))
+		u, err := e.Eval(context.Background(), r, map[string]interface{}{"grades": []float64{3.5, 4.0}})
+		is.NoErr(err)
+		return u
+	}
+
+	u := eval(`[1,2,3]`, indigo.List{ValueType: indigo.Int{}})
+	l, ok := u.AsList()
+	is.True(ok)
+	is.Equal(l, []interface{}{int64(1), int64(2), int64(3)})
+	_, ok = u.AsMap()
+	is.True(!ok)
+
+	u = eval(`{'a':1}`, indigo.Map{KeyType: indigo.String{}, ValueType: indigo.Int{}})
+	m, ok := u.AsMap()
+	is.True(ok)
+	is.Equal(m, map[string]interface{}{"a": int64(1)})
+	_, ok = u.AsList()
+	is.True(!ok)
+
+	// Nested lists and maps, and lists from the input data, are converted too
+	u = eval(`{'a': [grades, {'b': true}]}`, indigo.Map{KeyType: indigo.String{}, ValueType: indigo.List{ValueType: indigo.Any{}}})
+	m, ok = u.AsMap()
+	is.True(ok)
+	is.Equal(m, map[string]interface{}{"a": []interface{}{[]interface{}{3.5, 4.0}, map[string]interface{}{"b": true}}})
+
+	// Maps with keys that aren't strings are not returned by AsMap
+	u = eval(`{1: 'a'}`, indigo.Map{KeyType: indigo.Int{}, ValueType: indigo.String{}})
+	_, ok = u.AsMap()
+	is.True(!ok)
+	is.Equal(u.Value, map[interface{}]interface{}{int64(1): "a"})
+}
+
+// Make sure that rules depending on inputs marked unknown have an unknown
+// outcome, and rules that don't are evaluated as usual
+func TestPartialEval(t *testing.T) {
+	is := is.New(t)
+
+	schema := indigo.Schema{
+		Elements: []indigo.DataElement{
+			{Name: "student", Type: indigo.Proto{Message: &school.Student{}}},
+			{Name: "isSummer", Type: indigo.Bool{}},
+		},
+	}
+
+	r := &indigo.Rule{
+		ID:     "root",
+		Schema: schema,
+		Rules: map[string]*indigo.Rule{
+			"honors":  {ID: "honors", Schema: schema, Expr: "student.gpa > 3.0 && isSummer"},
+			"never":   {ID: "never", Schema: schema, Expr: "false && student.gpa > 3.0"},
+			"summer":  {ID: "summer", Schema: schema, Expr: "isSummer"},
+			"student": {ID: "student", Schema: schema, Expr: "student.age > 18"},
+		},
+	}
+
+	e := indigo.NewEngine(cel.NewEvaluator())
+	is.NoErr(e.Compile(r, indigo.CollectDiagnostics(true)))
+
+	data := map[string]interface{}{
+		"student":  &school.Student{Age: 21},
+		"isSummer": true,
+	}
+
+	u, err := e.Eval(context.Background(), r, data, indigo.PartialEval("student.gpa"), indigo.ReturnDiagnostics(true))
+	is.NoErr(err)
+	is.Equal(u.Results["honors"].State, indigo.StateUnknown)
+	is.True(!u.Results["honors"].Pass)
+	is.Equal(u.Results["never"].State, indigo.StateFail)
+	is.Equal(u.Results["never"].Value, false)
+	is.Equal(u.Results["summer"].State, indigo.StatePass)
+	is.Equal(u.Results["student"].State, indigo.StatePass) // other fields are known
+	is.Equal(u.State, indigo.StateFail)                    // decided by "never"
+	is.Equal(u.SLOMetrics().ErrorCount, 0)
+
+	// With isSummer false, the outcome doesn't depend on the GPA
+	data["isSummer"] = false
+	u, err = e.Eval(context.Background(), r, data, indigo.PartialEval("student.gpa"))
+	is.NoErr(err)
+	is.Equal(u.Results["honors"].State, indigo.StateFail)
+	is.Equal(u.Results["honors"].Value, false)
+
+	// The whole student is unknown, and isn't in the data
+	delete(data, "student")
+	u, err = e.Eval(context.Background(), r, data, indigo.PartialEval("student"))
+	is.NoErr(err)
+	is.Equal(u.Results["student"].State, indigo.StateUnknown)
+	is.Equal(u.Results["honors"].State, indigo.StateFail)
+
+	// Without partial evaluation, the missing student is an error
+	_, err = e.Eval(context.Background(), r, data)
+	is.True(errors.Is(err, indigo.ErrMissingData))
+}
+
+// Make sure that rules can refer to a proto message in Self, in both
+// sequential and parallel evaluation
+func TestProtoSelf(t *testing.T) {
+	is := is.New(t)
+
+	schema := indigo.Schema{
+		Elements: []indigo.DataElement{
+			{Name: "student", Type: indigo.Proto{Message: &school.Student{}}},
+			{Name: "self", Type: indigo.Proto{Message: &school.Student{}}},
+		},
+	}
+
+	probation := &school.Student{Status: school.Student_PROBATION, Gpa: 2.1}
+	r := &indigo.Rule{
+		ID:     "root",
+		Schema: schema,
+		Expr:   "self.status == testdata.school.Student.status_type.PROBATION",
+		Self:   probation,
+		Rules:  map[string]*indigo.Rule{},
+	}
+
+	for i := 0; i < 10; i++ {
+		id := fmt.Sprintf("c%d", i)
+		r.Rules[id] = &indigo.Rule{
+			ID:     id,
+			Schema: schema,
+			Expr:   "self.status == testdata.school.Student.status_type.PROBATION && student.gpa < self.gpa",
+			Self:   &school.Student{Status: school.Student_PROBATION, Gpa: float64(i)},
+		}
+	}
+
+	e := indigo.NewEngine(cel.NewEvaluator())
+	is.NoErr(e.Compile(r))
+
+	data := map[string]interface{}{"student": &school.Student{Gpa: 4.5}}
+	for _, opts := range [][]indigo.EvalOption{
+		nil,
+		{indigo.ParallelOrdered(2, 2, 4)},
+	} {
+		u, err := e.Eval(context.Background(), r, data, opts...)
+		is.NoErr(err)
+		is.True(u.ExpressionPass)
+		for i := 0; i < 10; i++ {
+			is.Equal(u.Results[fmt.Sprintf("c%d", i)].ExpressionPass, i > 4)
+		}
+	}
+
+	// Self is not inherited by child rules
+	r.Rules["c9"].Self = nil
+	_, err := e.Eval(context.Background(), r, data)
+	is.True(errors.Is(err, indigo.ErrMissingData))
+}
+
+// Make sure that expressions are rewritten before they are compiled
+func TestExpressionRewriter(t *testing.T) {
+	is := is.New(t)
+
+	age := regexp.MustCompile(`AGE\((\w+)\)`)
+	rewriter := func(expr string) (string, error) {
+		if strings.Contains(expr, "GPA(") {
+			return "", fmt.Errorf("GPA is not supported")
+		}
+		return age.ReplaceAllString(expr, "$1.age"), nil
+	}
+
+	schema := indigo.Schema{
+		Elements: []indigo.DataElement{
+			{Name: "student", Type: indigo.Proto{Message: &school.Student{}}},
+		},
+	}
+
+	r := &indigo.Rule{
+		ID:     "adult",
+		Schema: schema,
+		Expr:   "AGE(student) >= 18",
+	}
+
+	e := indigo.NewEngine(cel.NewEvaluator(cel.ExpressionRewriter(rewriter)))
+	is.NoErr(e.Compile(r))
+	is.Equal(r.Expr, "AGE(student) >= 18") // the rule is unchanged
+
+	u, err := e.Eval(context.Background(), r, map[string]interface{}{"student": &school.Student{Age: 21}})
+	is.NoErr(err)
+	is.True(u.Pass)
+
+	u, err = e.Eval(context.Background(), r, map[string]interface{}{"student": &school.Student{Age: 16}})
+	is.NoErr(err)
+	is.True(!u.Pass)
+
+	vars, err := e.ReferencedVariables(r)
+	is.NoErr(err)
+	is.Equal(vars, []string{"student"})
+
+	// Without the rewriter, the shorthand doesn't compile
+	is.True(indigo.NewEngine(cel.NewEvaluator()).Compile(r) != nil)
+
+	r.Expr = "GPA(student) > 3.0"
+	err = e.Compile(r)
+	is.True(err != nil)
+	ce := indigo.CompileErrors(err)
+	is.Equal(len(ce), 1)
+	is.Equal(ce[0].RuleID, "adult")
+	is.True(strings.Contains(err.Error(), "GPA is not supported"))
+}
+
+// Make sure that JSON values are converted to the schema's types
+func TestEvalJSON(t *testing.T) {
+	is := is.New(t)
+
+	schema := indigo.Schema{
+		Elements: []indigo.DataElement{
+			{Name: "age", Type: indigo.Int{}},
+			{Name: "grades", Type: indigo.List{ValueType: indigo.Float{}}},
+			{Name: "credits", Type: indigo.Map{KeyType: indigo.String{}, ValueType: indigo.Int{}}},
+			{Name: "enrolled", Type: indigo.Timestamp{}},
+			{Name: "student", Type: indigo.Proto{Message: &school.Student{}}},
+		},
+	}
+
+	r := &indigo.Rule{
+		ID:     "json",
+		Schema: schema,
+		Expr: `age == 21 && grades[1] > 3.5 && credits["math"] == 10 &&
+			enrolled < timestamp("2020-01-01T00:00:00Z") && student.gpa > 3.0`,
+	}
+
+	e := indigo.NewEngine(cel.NewEvaluator())
+	is.NoErr(e.Compile(r))
+
+	data := `{
+		"age": 21,
+		"grades": [3.0, 3.9],
+		"credits": {"math": 10},
+		"enrolled": "2019-09-01T00:00:00Z",
+		"student": {"gpa": 3.5, "status": "PROBATION"},
+		"extra": 2
+	}`
+
+	u, err := e.EvalJSON(context.Background(), r, []byte(data))
+	is.NoErr(err)
+	is.True(u.Pass)
+
+	// An int in the schema must be an integer in the JSON
+	_, err = e.EvalJSON(context.Background(), r, []byte(`{"age": 21.5}`))
+	is.True(err != nil)
+	is.True(strings.HasPrefix(err.Error(), "decoding JSON data: key age:"))
+
+	_, err = e.EvalJSON(context.Background(), r, []byte(`[1, 2]`))
+	is.True(err != nil)
+
+	// A null value is missing data, not the zero value
+	null := `{"age": null, "grades": [3.0, 3.9], "credits": {"math": 10},
+		"enrolled": "2019-09-01T00:00:00Z", "student": {"gpa": 3.5}}`
+	_, err = e.EvalJSON(context.Background(), r, []byte(null))
+	is.True(errors.Is(err, indigo.ErrMissingData))
+
+	u, err = e.EvalJSON(context.Background(), r, []byte(null), indigo.UnknownOnMissingData(true))
+	is.NoErr(err)
+	is.Equal(u.State, indigo.StateUnknown)
+
+	// A null in a list or map is an error
+	_, err = e.EvalJSON(context.Background(), r, []byte(`{"grades": [3.0, null]}`))
+	is.True(err != nil)
+	is.True(strings.HasPrefix(err.Error(), "decoding JSON data: key grades: element 1: null"))
+}
+
+// Make sure that unset proto fields are errors with the RequireSetFields
+// option, and default values without it
+func TestRequireSetFields(t *testing.T) {
+	is := is.New(t)
+
+	schema := indigo.Schema{
+		Elements: []indigo.DataElement{
+			{Name: "student", Type: indigo.Proto{Message: &school.Student{}}},
+		},
+	}
+
+	r := &indigo.Rule{ID: "honors", Schema: schema, Expr: "student.gpa >= 3.6"}
+	noGPA := map[string]interface{}{"student": &school.Student{Age: 21}}
+
+	// By default, the unset GPA is 0.0
+	e := indigo.NewEngine(cel.NewEvaluator())
+	is.NoErr(e.Compile(r))
+	u, err := e.Eval(context.Background(), r, noGPA)
+	is.NoErr(err)
+	is.True(!u.Pass)
+
+	e = indigo.NewEngine(cel.NewEvaluator(cel.RequireSetFields(true)))
+	is.NoErr(e.Compile(r))
+	_, err = e.Eval(context.Background(), r, noGPA)
+	is.True(err != nil)
+	is.True(errors.Is(err, indigo.ErrMissingData))
+	is.True(strings.Contains(err.Error(), "unset field gpa of testdata.school.Student"))
+
+	u, err = e.Eval(context.Background(), r, map[string]interface{}{"student": &school.Student{Gpa: 3.8}})
+	is.NoErr(err)
+	is.True(u.Pass)
+
+	// has() still tests for presence
+	r.Expr = "has(student.gpa) && student.gpa >= 3.6"
+	is.NoErr(e.Compile(r))
+	u, err = e.Eval(context.Background(), r, noGPA)
+	is.NoErr(err)
+	is.True(!u.Pass)
+
+	// Missing fields are unknown with the UnknownOnMissingData option
+	r.Expr = "student.gpa >= 3.6"
+	is.NoErr(e.Compile(r))
+	u, err = e.Eval(context.Background(), r, noGPA, indigo.UnknownOnMissingData(true))
+	is.NoErr(err)
+	is.Equal(u.State, indigo.StateUnknown)
+}
+
+// Test that misspelled variables and fields get a suggestion
+func TestUndeclaredSuggestions(t *testing.T) {
+	is := is.New(t)
+
+	schema := indigo.Schema{
+		Elements: []indigo.DataElement{
+			{Name: "student", Type: indigo.Proto{Message: &school.Student{}}},
+			{Name: "now", Type: indigo.Timestamp{}},
+		},
+	}
+
+	cases := []struct {
+		expr string
+		want string
+	}{
+		{expr: `student.Gpa > 3.0`, want: "undefined field 'Gpa'; did you mean gpa?"},
+		{expr: `student.credit > 10`, want: "undefined field 'credit'; did you mean credits?"},
+		{expr: `student.off_campus.cty == "Chicago"`, want: "undefined field 'cty'; did you mean city?"},
+		{expr: `Student.gpa > 3.0`, want: "did you mean student?"},
+		{expr: `studnt.gpa > 3.0`, want: "did you mean student?"},
+	}
+
+	e := indigo.NewEngine(cel.NewEvaluator())
+	for _, c := range cases {
+		r := &indigo.Rule{ID: "typo", Schema: schema, Expr: c.expr}
+		err := e.Compile(r)
+		is.True(err != nil)
+		if !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%s: wanted %q in error, got %v", c.expr, c.want, err)
+		}
+		// The positions of the issues are kept
+		ce := indigo.CompileErrors(err)
+		is.Equal(len(ce), 1)
+		is.Equal(len(ce[0].Issues), 1)
+		is.Equal(ce[0].Issues[0].Line, 1)
+	}
+
+	// No suggestion is made for names that aren't close
+	r := &indigo.Rule{ID: "far", Schema: schema, Expr: `student.address == ""`}
+	err := e.Compile(r)
+	is.True(err != nil)
+	is.True(!strings.Contains(err.Error(), "did you mean"))
+}
+
+// Test optional selection on proto fields that may or may not be set
+func TestOptionalTypes(t *testing.T) {
+	is := is.New(t)
+
+	schema := indigo.Schema{
+		Elements: []indigo.DataElement{
+			{Name: "student", Type: indigo.Proto{Message: &school.Student{}}},
+		},
+	}
+
+	withCity := map[string]interface{}{
+		"student": &school.Student{
+			HousingAddress: &school.Student_OffCampus{
+				OffCampus: &school.Student_Address{City: "Chicago"},
+			},
+		},
+	}
+	noAddress := map[string]interface{}{"student": &school.Student{}}
+
+	// Optional syntax is only available with the option
+	r := &indigo.Rule{
+		ID:         "city",
+		Schema:     schema,
+		ResultType: indigo.String{},
+		Expr:       `student.?off_campus.?city.orValue("none")`,
+	}
+	is.True(indigo.NewEngine(cel.NewEvaluator()).Compile(r) != nil)
+
+	e := indigo.NewEngine(cel.NewEvaluator(cel.OptionalTypes()))
+	is.NoErr(e.Compile(r))
+
+	u, err := e.Eval(context.Background(), r, withCity)
+	is.NoErr(err)
+	is.Equal(u.Value, "Chicago")
+
+	u, err = e.Eval(context.Background(), r, noAddress)
+	is.NoErr(err)
+	is.Equal(u.Value, "none")
+
+	// An optional result is unwrapped, and missing data if absent
+	r.Expr = `student.?off_campus.?city`
+	is.NoErr(e.Compile(r))
+
+	u, err = e.Eval(context.Background(), r, withCity)
+	is.NoErr(err)
+	is.Equal(u.Value, "Chicago")
+
+	_, err = e.Eval(context.Background(), r, noAddress)
+	is.True(errors.Is(err, indigo.ErrMissingData))
+
+	// A boolean rule over an absent value doesn't pass
+	r = &indigo.Rule{
+		ID:     "flag",
+		Schema: indigo.Schema{Elements: []indigo.DataElement{{Name: "m", Type: indigo.Map{KeyType: indigo.String{}, ValueType: indigo.Bool{}}}}},
+		Expr:   `m[?"flag"]`,
+	}
+	is.NoErr(e.Compile(r))
+
+	u, err = e.Eval(context.Background(), r, map[string]interface{}{"m": map[string]bool{"flag": true}})
+	is.NoErr(err)
+	is.True(u.Pass)
+
+	_, err = e.Eval(context.Background(), r, map[string]interface{}{"m": map[string]bool{}})
+	is.True(errors.Is(err, indigo.ErrMissingData))
+
+	u, err = e.Eval(context.Background(), r, map[string]interface{}{"m": map[string]bool{}}, indigo.UnknownOnMissingData(true))
+	is.NoErr(err)
+	is.True(!u.Pass)
+	is.Equal(u.State, indigo.StateUnknown)
+
+	// Optional values can be tested for presence
+	r = &indigo.Rule{
+		ID:     "has_city",
+		Schema: schema,
+		Expr:   `student.?off_campus.?city.hasValue()`,
+	}
+	is.NoErr(e.Compile(r))
+
+	u, err = e.Eval(context.Background(), r, withCity)
+	is.NoErr(err)
+	is.True(u.Pass)
+
+	u, err = e.Eval(context.Background(), r, noAddress)
+	is.NoErr(err)
+	is.True(!u.Pass)
+}
+
+// Make sure that the rule's output expressions are evaluated with the rule
+func TestOutputs(t *testing.T) {
+	is := is.New(t)
+
+	schema := indigo.Schema{
+		Elements: []indigo.DataElement{
+			{Name: "student", Type: indigo.Proto{Message: &school.Student{}}},
+		},
+	}
+
+	r := &indigo.Rule{
+		ID:     "at_risk",
+		Schema: schema,
+		Expr:   "student.gpa < 2.5",
+		Outputs: map[string]string{
+			"risk": "student.gpa < 2.0 ? 0.8 : 0.4",
+			"tier": `student.credits > 30 ? "A" : "B"`,
+		},
+	}
+
+	e := indigo.NewEngine(cel.NewEvaluator())
+	is.NoErr(e.Compile(r))
+
+	u, err := e.Eval(context.Background(), r, map[string]interface{}{"student": &school.Student{Gpa: 1.9, Credits: 12}})
+	is.NoErr(err)
+	is.True(u.Pass)
+	is.Equal(u.Outputs, map[string]interface{}{"risk": 0.8, "tier": "B"})
+
+	j, err := u.ToJSON()
+	is.NoErr(err)
+	is.True(strings.Contains(string(j), `"outputs":{"risk":{"type":"float","value":0.8},"tier":{"type":"string","value":"B"}}`))
+
+	// Outputs are computed whether or not the rule passes
+	u, err = e.Eval(context.Background(), r, map[string]interface{}{"student": &school.Student{Gpa: 3.1, Credits: 40}})
+	is.NoErr(err)
+	is.True(!u.Pass)
+	is.Equal(u.Outputs, map[string]interface{}{"risk": 0.4, "tier": "A"})
+
+	r.Outputs["bad"] = "student.nickname"
+	err = e.Compile(r)
+	is.True(err != nil)
+	is.True(strings.Contains(err.Error(), "rule at_risk: output bad:"))
+}
+
+// Make sure that the rule's message is computed when the rule fails
+func TestMessage(t *testing.T) {
+	is := is.New(t)
+
+	schema := indigo.Schema{
+		Elements: []indigo.DataElement{
+			{Name: "student", Type: indigo.Proto{Message: &school.Student{}}},
+		},
+	}
+
+	selfSchema := indigo.Schema{
+		Elements: []indigo.DataElement{
+			{Name: "student", Type: indigo.Proto{Message: &school.Student{}}},
+			{Name: "self", Type: indigo.Proto{Message: &school.HonorsConfiguration{}}},
+		},
+	}
+
+	r := &indigo.Rule{
+		ID:      "honors",
+		Schema:  schema,
+		Expr:    "student.gpa >= 3.6",
+		Message: `"GPA too low: " + string(student.gpa)`,
+	}
+
+	e := indigo.NewEngine(cel.NewEvaluator())
+	is.NoErr(e.Compile(r))
+
+	u, err := e.Eval(context.Background(), r, map[string]interface{}{"student": &school.Student{Gpa: 3.1}})
+	is.NoErr(err)
+	is.True(!u.Pass)
+	is.Equal(u.Message, "GPA too low: 3.1")
+
+	j, err := u.ToJSON()
+	is.NoErr(err)
+	is.True(strings.Contains(string(j), `"message":"GPA too low: 3.1"`))
+
+	u, err = e.Eval(context.Background(), r, map[string]interface{}{"student": &school.Student{Gpa: 3.8}})
+	is.NoErr(err)
+	is.True(u.Pass)
+	is.Equal(u.Message, "")
+
+	// A rule that fails because of a child rule also gets a message
+	r.Rules = map[string]*indigo.Rule{
+		"credits": {ID: "credits", Schema: schema, Expr: "student.credits > 30"},
+	}
+	is.NoErr(e.Compile(r))
+	u, err = e.Eval(context.Background(), r, map[string]interface{}{"student": &school.Student{Gpa: 3.8, Credits: 10}})
+	is.NoErr(err)
+	is.True(!u.Pass)
+	is.Equal(u.Message, "GPA too low: 3.8")
+	is.Equal(u.Results["credits"].Message, "")
+
+	// The message sees the rule's own self, even after a child rule without
+	// a self has been evaluated
+	s := &indigo.Rule{
+		ID:      "minimum",
+		Schema:  selfSchema,
+		Self:    &school.HonorsConfiguration{Minimum_GPA: 3.7},
+		Expr:    "student.gpa >= self.Minimum_GPA",
+		Message: `"GPA below " + string(self.Minimum_GPA)`,
+		Rules: map[string]*indigo.Rule{
+			"credits": {ID: "credits", Schema: selfSchema, Expr: "student.credits > 30"},
+		},
+	}
+	is.NoErr(e.Compile(s))
+	u, err = e.Eval(context.Background(), s, map[string]interface{}{"student": &school.Student{Gpa: 3.1, Credits: 10}})
+	is.NoErr(err)
+	is.True(!u.Pass)
+	is.Equal(u.Message, "GPA below 3.7")
+
+	// The message must be a string
+	r.Message = "student.gpa"
+	err = e.Compile(r)
+	is.True(err != nil)
+	is.True(strings.Contains(err.Error(), "rule honors: message:"))
+}
+
+func TestProtoMessage(t *testing.T) {
+	is := is.New(t)
+	e := indigo.NewEngine(cel.NewEvaluator())
+
+	r := makeEducationProtoRules("student_actions")
+	err := e.Compile(r)
+	is.NoErr(err)
+
+	results, err := e.Eval(context.Background(), r, makeStudentProtoData())
+	is.NoErr(err)
+	is.Equal(len(results.Results), 3)
+	for _, v := range results.Results {
+		is.Equal(v.Rule.Meta, v.ExpressionPass)
+	}
+}
+
+func TestDiagnosticOptions(t *testing.T) {
+	is := is.New(t)
+	e := indigo.NewEngine(cel.NewEvaluator())
+	r2 := makeEducationProtoRules("student_actions")
+	err := e.Compile(r2, indigo.CollectDiagnostics(true))
+	is.NoErr(err)
+
+	u, err := e.Eval(context.Background(), r2, makeStudentProtoData(), indigo.ReturnDiagnostics(true))
+	is.NoErr(err)
+	//	fmt.Println(r2)
+	//	fmt.Println(indigo.DiagnosticsReport(u, makeStudentProtoData()))
+	//	fmt.Println(u.Diagnostics.String())
+	for _, c := range u.Results {
+		if c.Diagnostics == nil {
+			t.Errorf("Wanted diagnostics for rule %s", c.Rule.ID)
+		} // else {
+		// 	fmt.Println(u)
+		// 	fmt.Println(c.Diagnostics)
+		// }
+	}
+}
+
+// Test the compact, one-line-per-rule diagnostics report
+func TestCompactDiagnostics(t *testing.T) {
+	is := is.New(t)
+	e := indigo.NewEngine(cel.NewEvaluator())
+	r2 := makeEducationProtoRules("student_actions")
+	err := e.Compile(r2, indigo.CollectDiagnostics(true))
+	is.NoErr(err)
+
+	data := makeStudentProtoData()
+	u, err := e.Eval(context.Background(), r2, data, indigo.ReturnDiagnostics(true))
+	is.NoErr(err)
+
+	buf := bytes.Buffer{}
+	err = indigo.DiagnosticsReportTo(&buf, u, data, indigo.CompactDiagnostics())
+	is.NoErr(err)
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	is.Equal(len(lines), len(u.Flat())+1) // one line per rule, plus the input
+	is.True(strings.HasPrefix(lines[0], "student_actions "))
+	for i, c := range u.Flat()[1:] {
+		l := lines[i+1]
+		is.True(strings.HasPrefix(l, "  "+c.Rule.ID+" "+c.State.String()))
+		is.True(strings.Contains(l, "steps=["))
+	}
+	is.True(strings.HasPrefix(lines[len(lines)-1], "input: "))
+
+	// Without the option, the full report is written
+	buf.Reset()
+	err = indigo.DiagnosticsReportTo(&buf, u, data)
+	is.NoErr(err)
+	is.True(strings.Contains(buf.String(), "INDIGO EVALUATION DIAGNOSTIC REPORT"))
+
+	// Nil inputs are ok in both forms
+	buf.Reset()
+	err = indigo.DiagnosticsReportTo(&buf, nil, nil, indigo.CompactDiagnostics())
+	is.NoErr(err)
+	is.Equal(buf.String(), "no Result provided\n")
+
+	buf.Reset()
+	err = indigo.DiagnosticsReportTo(&buf, nil, nil)
+	is.NoErr(err)
+	is.Equal(buf.String(), indigo.DiagnosticsReport(nil, nil))
+}
+
+func TestDiagnosticsWithEmptyRule(t *testing.T) {
+	is := is.New(t)
+	e := indigo.NewEngine(cel.NewEvaluator())
+	d := map[string]interface{}{"a": "a"} // dummy data, not important
+
+	r := &indigo.Rule{
+		ID: "root",
+	}
+
+	err := e.Compile(r)
+	is.NoErr(err)
+
+	u, err := e.Eval(context.Background(), r, d)
+	is.NoErr(err)
+	is.Equal(u.Diagnostics, nil)
+}
+
+// Test that diagnostics capture the value of each part of a conjunction
+func TestDiagnosticSteps(t *testing.T) {
+	is := is.New(t)
+
+	r := &indigo.Rule{
+		ID:   "explain",
+		Expr: "a > b && c",
+		Schema: indigo.Schema{
+			Elements: []indigo.DataElement{
+				{Name: "a", Type: indigo.Int{}},
+				{Name: "b", Type: indigo.Int{}},
+				{Name: "c", Type: indigo.Bool{}},
+			},
+		},
+	}
+
+	e := indigo.NewEngine(cel.NewEvaluator())
+	is.NoErr(e.Compile(r, indigo.CollectDiagnostics(true)))
+
+	u, err := e.Eval(context.Background(), r, map[string]interface{}{"a": 3, "b": 1, "c": true}, indigo.ReturnDiagnostics(true))
+	is.NoErr(err)
+
+	type step struct {
+		Expr  string
+		Value interface{}
+	}
+	got := []step{}
+	ids := map[int64]bool{}
+	for _, s := range u.Diagnostics.Steps() {
+		got = append(got, step{s.Expr, s.Value})
+		ids[s.ID] = true
+	}
+
+	is.Equal(got, []step{
+		{"a", int64(3)},
+		{"b", int64(1)},
+		{">", true},
+		{"c", true},
+		{"&&", true},
+	})
+	is.Equal(len(ids), 5) // each part of the expression has its own ID
+
+	// No diagnostics, no steps
+	u, err = e.Eval(context.Background(), r, map[string]interface{}{"a": 3, "b": 1, "c": true})
+	is.NoErr(err)
+	is.Equal(len(u.Diagnostics.Steps()), 0)
+}
+
+func TestRuleResultTypes(t *testing.T) {
+	cases := []struct {
+		rule indigo.Rule
+		err  error
+	}{
+		{
+			indigo.Rule{
+				ID:         "shouldBeBool",
+				Schema:     makeEducationProtoSchema(),
+				ResultType: indigo.Bool{},
+				Expr:       `student.gpa >= 3.6`,
+			},
+			nil,
+		},
+		{
+			indigo.Rule{
+				ID:         "shouldBeBFloat",
+				Schema:     makeEducationProtoSchema(),
+				ResultType: indigo.Float{},
+				Expr:       `student.gpa + 1.0`,
+			},
+			nil,
+		},
+		{
+			indigo.Rule{
+				ID:         "shouldBeInt",
+				Schema:     makeEducationProtoSchema(),
+				ResultType: indigo.Int{},
+				Expr:       `4`,
+			},
+			nil,
+		},
+		{
+			indigo.Rule{
+				ID:         "shouldBeIntList",
+				Schema:     makeEducationProtoSchema(),
+				ResultType: indigo.List{ValueType: indigo.Int{}},
+				Expr:       `[1,2,3]`,
+			},
+			nil,
+		},
+		{
+			indigo.Rule{
+				ID:         "shouldBeAnyList",
+				Schema:     makeEducationProtoSchema(),
+				ResultType: indigo.List{ValueType: indigo.Any{}},
+				Expr:       `[1,"2",3]`,
+			},
+			nil,
+		},
+		{
+			indigo.Rule{
+				ID:         "shouldBeList",
+				Schema:     makeEducationProtoSchema(),
+				ResultType: indigo.List{ValueType: indigo.Float{}},
+				Expr:       `student.grades`,
+			},
+			nil,
+		},
+		{
+			indigo.Rule{
+				ID:         "shouldBeMap",
+				Schema:     makeEducationProtoSchema(),
+				ResultType: indigo.Map{KeyType: indigo.String{}, ValueType: indigo.Int{}},
+				Expr:       `{'blue': 1, 'red': 2}`,
+			},
+			nil,
+		},
+
+		{
+			indigo.Rule{
+				ID:         "shouldBeStudent",
+				Schema:     makeEducationProtoSchema(),
+				ResultType: indigo.Proto{Message: &school.Student{}},
+				Expr:       `testdata.school.Student { gpa: 1.2 }`,
+			},
+			nil,
+		},
+		{
+			indigo.Rule{
+				ID:         "shouldBeTimestamp",
+				Schema:     makeEducationProtoSchema(),
+				ResultType: indigo.Timestamp{},
+				Expr:       `now`,
+			},
+			nil,
+		},
+		{
+			indigo.Rule{
+				ID:         "shouldBeDuration",
+				Schema:     makeEducationProtoSchema(),
+				ResultType: indigo.Duration{},
+				Expr:       `duration("12h")`,
+			},
+			nil,
+		},
+
+		{
+			indigo.Rule{
+				ID:         "NEGATIVEshouldBeBFloat",
+				Schema:     makeEducationProtoSchema(),
+				ResultType: indigo.Bool{},
+				Expr:       `student.gpa + 1.0`,
+			},
+			fmt.Errorf("Should be an error"),
+		},
+		{
+			indigo.Rule{
+				ID:         "NEGATIVEshouldBeStudent",
+				Schema:     makeEducationProtoSchema(),
+				ResultType: indigo.Proto{Message: &school.HonorsConfiguration{}},
+				Expr:       `testdata.school.Student { gpa: 1.2 }`,
+			},
+			fmt.Errorf("Should be an error"),
+		},
+	}
+
+	for i := range cases {
+		for _, b := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s_fixed_schema_%t", cases[i].rule.ID, b), func(t *testing.T) {
+				var e *indigo.DefaultEngine
+				switch b {
+				case true:
+					s := makeEducationProtoSchema()
+					e = indigo.NewEngine(cel.NewEvaluator(cel.FixedSchema(&s)))
+				case false:
+					e = indigo.NewEngine(cel.NewEvaluator())
+				}
+
+				//		lc := c
+				//		fmt.Println("Case: ", cases[i].rule.ID)
+				err := e.Compile(&cases[i].rule)
+				if cases[i].err == nil && err != nil {
+					t.Errorf("compiling rule %s, wanted err = %v, got %v", cases[i].rule.ID, cases[i].err, err)
+				}
+
+				_, err = e.Eval(context.Background(), &cases[i].rule, makeStudentProtoData())
+
+				if err != nil && cases[i].err == nil {
+					t.Fatalf("For rule %s, wanted err = %v, got %v", cases[i].rule.ID, cases[i].err, err)
+				} /* else {
+						if res != nil {
+						 	fmt.Printf("%v\nn", res)
+						 }
+				} */
+			})
+		}
+	}
+}
+
+// Generate all diagnostics for both sets of rules to make sure
+// no panics
+func TestDiagnosticGeneration(t *testing.T) {
+	is := is.New(t)
+	e := indigo.NewEngine(cel.NewEvaluator())
+
+	red1 := makeEducationRules1()
+	err := e.Compile(red1, indigo.CollectDiagnostics(true))
+	is.NoErr(err)
+
+	u, err := e.Eval(context.Background(), red1, makeStudentData(), indigo.ReturnDiagnostics(true))
+	is.NoErr(err)
+	//	fmt.Println(indigo.DiagnosticsReport(u, nil))
+	_ = u.Diagnostics.String()
+
+	red2 := makeEducationProtoRules("red2")
+	err = e.Compile(red2, indigo.CollectDiagnostics(true))
+	is.NoErr(err)
+	u, err = e.Eval(context.Background(), red2, makeStudentProtoData(), indigo.ReturnDiagnostics(true))
+	is.NoErr(err)
+	_ = u.Diagnostics.String()
+	_ = indigo.DiagnosticsReport(u, makeStudentData())
+}
+
+// ------------------------------------------------------------------------------------------
+// BENCHMARKS
+//
+//
+//
+//
+//
+
+func BenchmarkSimpleRule(b *testing.B) {
+	education := makeEducationSchema()
+	data := makeStudentData()
+
+	r := indigo.Rule{
+		ID:     "student_actions",
+		Schema: education,
+		Rules: map[string]*indigo.Rule{
+			"a": {
+				ID:     "at_risk",
+				Schema: education,
+				Expr:   `student.GPA < 2.5 || student.Status == "Probation"`,
+			},
+		},
+	}
+	e := indigo.NewEngine(cel.NewEvaluator())
+	err := e.Compile(&r)
+	if err != nil {
+		b.Errorf("Error adding ruleset: %v", err)
+	}
+
+	for i := 0; i < b.N; i++ {
+		_, err := e.Eval(context.Background(), &r, data)
+		if err != nil {
+			b.Error(err)
+		}
+	}
+}
+
+func BenchmarkSimpleRuleWithDiagnostics(b *testing.B) {
+	e := indigo.NewEngine(cel.NewEvaluator())
+	education := makeEducationSchema()
+	data := makeStudentData()
+
+	r := indigo.Rule{
+		ID:     "student_actions",
+		Schema: education,
+		Rules: map[string]*indigo.Rule{
+			"a": {
+				ID:     "at_risk",
+				Schema: education,
+				Expr:   `student.GPA < 2.5 || student.Status == "Probation"`,
+			},
+		},
+	}
+
+	err := e.Compile(&r, indigo.CollectDiagnostics(true))
+	if err != nil {
+		b.Errorf("Error adding ruleset: %v", err)
+	}
+
+	for i := 0; i < b.N; i++ {
+		_, err := e.Eval(context.Background(), &r, data, indigo.ReturnDiagnostics(true))
+		if err != nil {
+			b.Error(err)
+		}
+	}
+}
+
+func BenchmarkRuleWithArray(b *testing.B) {
+	e := indigo.NewEngine(cel.NewEvaluator())
+
+	education := makeEducationSchema()
+
+	r := &indigo.Rule{
+		ID:     "student_actions",
+		Schema: education,
+		Rules: map[string]*indigo.Rule{
+			"a": {
+				ID:     "honors_student",
+				Schema: education,
+				Expr:   `student.GPA >= 3.6 && student.Status!="Probation" && !("C" in student.Grades)`,
+			},
+		},
+	}
+
+	err := e.Compile(r)
+	if err != nil {
+		b.Errorf("Error adding ruleset: %v", err)
+	}
+
+	data := makeStudentData()
+	for i := 0; i < b.N; i++ {
+		_, err := e.Eval(context.Background(), r, data)
+		if err != nil {
+			b.Error(err)
+		}
+
+	}
+}
+
+func BenchmarkProtoWithSelfX(b *testing.B) {
+	b.StopTimer()
+
+	_, err := pb.DefaultDb.RegisterMessage(&school.Student{})
+	if err != nil {
+		b.Error(err)
+	}
+
+	schema := indigo.Schema{
+		Elements: []indigo.DataElement{
+			{Name: "student", Type: indigo.Proto{Message: &school.Student{}}},
+			{Name: "now", Type: indigo.Timestamp{}},
+			{Name: "self", Type: indigo.Proto{Message: &school.HonorsConfiguration{}}},
+		},
+	}
+
+	e := indigo.NewEngine(cel.NewEvaluator())
+
+	r := &indigo.Rule{
+		ID:     "student_actions",
+		Schema: schema,
+		Rules: map[string]*indigo.Rule{
+			"a": {
+				ID:     "at_risk",
+				Expr:   `student.gpa < self.Minimum_GPA && student.status == testdata.school.Student.status_type.PROBATION`,
+				Self:   &school.HonorsConfiguration{Minimum_GPA: 3.7},
+				Schema: schema,
+				Meta:   false,
+			},
+		},
+	}
+
+	err = e.Compile(r)
+	if err != nil {
+		log.Fatalf("Error adding ruleset: %v", err)
+	}
+
+	s := school.Student{
+		Age:            16,
+		Gpa:            3,
+		Status:         school.Student_PROBATION,
+		Grades:         []float64{4.0, 4.0, 3.7},
+		Attrs:          map[string]string{"Nickname": "Joey"},
+		EnrollmentDate: &timestamppb.Timestamp{Seconds: time.Date(2010, 5, 1, 12, 12, 59, 0, time.FixedZone("UTC-8", -8*60*60)).Unix()},
+	}
+
+	data := map[string]interface{}{
+		"student": &s,
+		"now":     &timestamppb.Timestamp{Seconds: time.Now().Unix()},
+	}
+	b.StartTimer()
+
+	for i := 0; i < b.N; i++ {
+		_, err := e.Eval(context.Background(), r, data)
+		if err != nil {
+			b.Error(err)
+		}
+
+	}
+}
+
+func BenchmarkProtoWithoutSelf(b *testing.B) {
+	_, err := pb.DefaultDb.RegisterMessage(&school.Student{})
+	if err != nil {
+		b.Error(err)
+	}
+
+	schema := indigo.Schema{
+		Elements: []indigo.DataElement{
+			{Name: "student", Type: indigo.Proto{Message: &school.Student{}}},
+			{Name: "now", Type: indigo.Timestamp{}},
+		},
+	}
+	e := indigo.NewEngine(cel.NewEvaluator())
+
+	r := &indigo.Rule{
+		ID:     "student_actions",
+		Schema: schema,
+		Rules: map[string]*indigo.Rule{
+			"a": {
+				ID:     "at_risk",
+				Expr:   `student.gpa < 2.5 || student.status == testdata.school.Student.status_type.PROBATION`,
+				Schema: schema,
+				Meta:   false,
+			},
+		},
+	}
+
+	err = e.Compile(r)
+	if err != nil {
+		log.Fatalf("Error adding ruleset: %v", err)
+	}
+
+	s := school.Student{
+		Age:            16,
+		Gpa:            3.76,
+		Status:         school.Student_ENROLLED,
+		Grades:         []float64{4.0, 4.0, 3.7},
+		Attrs:          map[string]string{"Nickname": "Joey"},
+		EnrollmentDate: &timestamppb.Timestamp{Seconds: time.Date(2010, 5, 1, 12, 12, 59, 0, time.FixedZone("UTC-8", -8*60*60)).Unix()},
+	}
+
+	data := map[string]interface{}{
+		"student": &s,
+		"now":     &timestamppb.Timestamp{Seconds: time.Now().Unix()},
+	}
+
+	for i := 0; i < b.N; i++ {
+		_, err := e.Eval(context.Background(), r, data)
+		if err != nil {
+			b.Error(err)
+		}
+
+	}
+}
+
+func BenchmarkProtoCreation(b *testing.B) {
+	education := indigo.Schema{
+		Elements: []indigo.DataElement{
+			{Name: "student", Type: indigo.Proto{Message: &school.Student{}}},
+			{Name: "student_suspension", Type: indigo.Proto{Message: &school.Student_Suspension{}}},
+			{Name: "studentSummary", Type: indigo.Proto{Message: &school.StudentSummary{}}},
+		},
+	}
+
+	r := &indigo.Rule{
+		ID:         "create_summary",
+		Schema:     education,
+		ResultType: indigo.Proto{Message: &school.StudentSummary{}},
+		Expr: `
+			testdata.school.StudentSummary {
+				gpa: student.gpa,
+				risk_factor: 2.0 + 3.0,
+				tenure: duration("12h")
+			}`,
+	}
+
+	e := indigo.NewEngine(cel.NewEvaluator())
+	err := e.Compile(r)
+	if err != nil {
+		fmt.Printf("Error adding rule %v", err)
+		return
+	}
+
+	for i := 0; i < b.N; i++ {
+		_, err := e.Eval(context.Background(), r, makeStudentProtoData())
+		if err != nil {
+			b.Error(err)
+		}
+
+	}
+}
+
+func BenchmarkEval2000Rules(b *testing.B) {
+	b.StopTimer()
+	_, err := pb.DefaultDb.RegisterMessage(&school.Student{})
+	if err != nil {
+		b.Error(err)
+	}
+
+	schema := indigo.Schema{
+		Elements: []indigo.DataElement{
+			{Name: "student", Type: indigo.Proto{Message: &school.Student{}}},
+			{Name: "now", Type: indigo.Timestamp{}},
+			{Name: "self", Type: indigo.Proto{Message: &school.HonorsConfiguration{}}},
+		},
+	}
+
+	e := indigo.NewEngine(cel.NewEvaluator())
+
+	r := &indigo.Rule{
+		ID:     "student_actions",
+		Schema: schema,
+		Rules:  map[string]*indigo.Rule{},
+	}
+
+	for i := 0; i < 2_000; i++ {
+		cr := &indigo.Rule{
+			ID:     fmt.Sprintf("at_risk_%d", i),
+			Expr:   `student.gpa < self.Minimum_GPA && student.status == testdata.school.Student.status_type.PROBATION`,
+			Schema: schema,
+			Self:   &school.HonorsConfiguration{Minimum_GPA: 3.7},
+			Meta:   false,
+		}
+		r.Rules[cr.ID] = cr
+	}
+
+	err = e.Compile(r)
+	if err != nil {
+		log.Fatalf("Error adding ruleset: %v", err)
+	}
+
+	s := school.Student{
+		Age:            16,
+		Gpa:            3,
+		Status:         school.Student_PROBATION,
+		Grades:         []float64{2.0, 2.0, 3.7},
+		Attrs:          map[string]string{"Nickname": "Joey"},
+		EnrollmentDate: &timestamppb.Timestamp{Seconds: time.Date(2010, 5, 1, 12, 12, 59, 0, time.FixedZone("UTC-8", -8*60*60)).Unix()},
+	}
+
+	data := map[string]interface{}{
+		"student": &s,
+		"now":     &timestamppb.Timestamp{Seconds: time.Now().Unix()},
+	}
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := e.Eval(context.Background(), r, data)
+		if err != nil {
+			b.Error(err)
+		}
+
+	}
+}
+
+func BenchmarkEval2000RulesWithSort(b *testing.B) {
+	b.StopTimer()
+	_, err := pb.DefaultDb.RegisterMessage(&school.Student{})
+	if err != nil {
+		b.Error(err)
+	}
+
+	schema := indigo.Schema{
+		Elements: []indigo.DataElement{
+			{Name: "student", Type: indigo.Proto{Message: &school.Student{}}},
+			{Name: "now", Type: indigo.Timestamp{}},
+			{Name: "self", Type: indigo.Proto{Message: &school.HonorsConfiguration{}}},
+		},
+	}
+
+	e := indigo.NewEngine(cel.NewEvaluator())
+
+	r := &indigo.Rule{
+		ID:     "student_actions",
+		Schema: schema,
+		Rules:  map[string]*indigo.Rule{},
+	}
+	r.EvalOptions.SortFunc = indigo.SortRulesAlpha // <-- we'll sort all 2000 child rules alphabetically
+
+	for i := 0; i < 2_000; i++ {
+		cr := &indigo.Rule{
+			ID:     fmt.Sprintf("at_risk_%d", i),
+			Expr:   `student.gpa < self.Minimum_GPA && student.status == testdata.school.Student.status_type.PROBATION`,
+			Schema: schema,
+			Self:   &school.HonorsConfiguration{Minimum_GPA: 3.7},
+			Meta:   false,
+		}
+		r.Rules[cr.ID] = cr
+	}
+
+	err = e.Compile(r)
+	if err != nil {
+		log.Fatalf("Error adding ruleset: %v", err)
+	}
+
+	s := school.Student{
+		Age:            16,
+		Gpa:            3,
+		Status:         school.Student_PROBATION,
+		Grades:         []float64{2.0, 2.0, 3.7},
+		Attrs:          map[string]string{"Nickname": "Joey"},
+		EnrollmentDate: &timestamppb.Timestamp{Seconds: time.Date(2010, 5, 1, 12, 12, 59, 0, time.FixedZone("UTC-8", -8*60*60)).Unix()},
+	}
+
+	data := map[string]interface{}{
+		"student": &s,
+		"now":     &timestamppb.Timestamp{Seconds: time.Now().Unix()},
+	}
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := e.Eval(context.Background(), r, data)
+		if err != nil {
+			b.Error(err)
+		}
+
+	}
+}
+
+func BenchmarkCompileRule(b *testing.B) {
+	b.StopTimer()
+	is := is.New(b)
+	e := indigo.NewEngine(cel.NewEvaluator())
+	r := makeEducationProtoRules("rule")
+	b.StartTimer()
+	for i := 1; i < b.N; i++ {
+		err := e.Compile(r)
+		is.NoErr(err)
+	}
+}
+
+func BenchmarkCompileRuleWithFixedSchema(b *testing.B) {
+	b.StopTimer()
+	is := is.New(b)
+	r := makeEducationProtoRules("rule")
+	e := indigo.NewEngine(cel.NewEvaluator(cel.FixedSchema(&r.Schema)))
+	b.StartTimer()
+	for i := 1; i < b.N; i++ {
+		err := e.Compile(r)
+		is.NoErr(err)
+	}
+}
+
+// make2000RuleTree returns a rule with 2000 child rules sharing a schema
+func make2000RuleTree() *indigo.Rule {
+	schema := indigo.Schema{
+		Elements: []indigo.DataElement{
+			{Name: "student", Type: indigo.Proto{Message: &school.Student{}}},
+			{Name: "now", Type: indigo.Timestamp{}},
+			{Name: "self", Type: indigo.Proto{Message: &school.HonorsConfiguration{}}},
+		},
+	}
+
+	r := &indigo.Rule{
+		ID:     "student_actions",
+		Schema: schema,
+		Rules:  map[string]*indigo.Rule{},
+	}
+
+	for i := 0; i < 2_000; i++ {
+		cr := &indigo.Rule{
+			ID:     fmt.Sprintf("at_risk_%d", i),
+			Expr:   `student.gpa < self.Minimum_GPA && student.status == testdata.school.Student.status_type.PROBATION`,
+			Schema: schema,
+			Self:   &school.HonorsConfiguration{Minimum_GPA: 3.7},
+		}
+		r.Rules[cr.ID] = cr
+	}
+	return r
+}
+
+// Compiling with the engine reuses the environment for rules sharing a schema
+func BenchmarkCompile2000Rules(b *testing.B) {
+	is := is.New(b)
+	e := indigo.NewEngine(cel.NewEvaluator())
+	r := make2000RuleTree()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		is.NoErr(e.Compile(r))
+	}
+}
+
+// Compiling the rules concurrently; compare with BenchmarkCompile2000Rules
+func BenchmarkCompileParallel2000Rules(b *testing.B) {
+	is := is.New(b)
+	e := indigo.NewEngine(cel.NewEvaluator())
+	r := make2000RuleTree()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		is.NoErr(e.CompileParallel(r, runtime.GOMAXPROCS(0)))
+	}
+}
+
+// Compiling each rule on its own builds an environment per rule; compare
+// with BenchmarkCompile2000Rules
+func BenchmarkCompile2000RulesWithoutSession(b *testing.B) {
+	is := is.New(b)
+	ev := cel.NewEvaluator()
+	r := make2000RuleTree()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, cr := range r.Rules {
+			_, err := ev.Compile(cr.Expr, cr.Schema, indigo.Bool{}, false, false)
+			is.NoErr(err)
+		}
+	}
+}
+
+// Make sure that reusing environments during compilation doesn't change
+// the results, including for sibling rules with different schemas
+func TestCompileSession(t *testing.T) {
+	is := is.New(t)
+
+	r := make2000RuleTree()
+	other := indigo.Schema{
+		Elements: []indigo.DataElement{
+			{Name: "x", Type: indigo.Int{}},
+		},
+	}
+	r.Rules["other"] = &indigo.Rule{ID: "other", Schema: other, Expr: "x > 1"}
+
+	e := indigo.NewEngine(cel.NewEvaluator())
+	is.NoErr(e.Compile(r))
+
+	data := map[string]interface{}{
+		"student": &school.Student{Gpa: 3.0, Status: school.Student_PROBATION},
+		"x":       2,
+	}
+	u, err := e.Eval(context.Background(), r, data)
+	is.NoErr(err)
+	is.Equal(len(u.Results), 2001)
+	for id, c := range u.Results {
+		if !c.Pass {
+			t.Errorf("rule %s did not pass", id)
+		}
+	}
+
+	// A rule referring to a variable declared only in a sibling's schema
+	// still fails to compile
+	r.Rules["bad"] = &indigo.Rule{ID: "bad", Schema: other, Expr: "student.gpa > 1.0"}
+	err = e.Compile(r)
+	ce := indigo.CompileErrors(err)
+	is.Equal(len(ce), 1)
+	is.Equal(ce[0].RuleID, "bad")
+
+	// Compiling in parallel gives the same results
+	par := make2000RuleTree()
+	par.Rules["other"] = r.Rules["other"]
+	is.NoErr(e.CompileParallel(par, 8))
+	up, err := e.Eval(context.Background(), par, data)
+	is.NoErr(err)
+	is.Equal(len(up.Results), 2001)
+	is.Equal(up.Pass, u.Pass)
+
+	// Ending a session twice is harmless
+	ev := cel.NewEvaluator()
+	end := ev.BeginCompile()
+	end()
+	end()
+	is.NoErr(indigo.NewEngine(ev).Compile(r.Rules["other"]))
+}
+
+func TestProtoOneofAndAny(t *testing.T) {
+	is := is.New(t)
+
+	schema := indigo.Schema{
+		Elements: []indigo.DataElement{
+			{Name: "contact", Type: indigo.Proto{Message: &school.Contact{}}},
+		},
+	}
+
+	r := &indigo.Rule{
+		ID:     "contact",
+		Schema: schema,
+		Rules: map[string]*indigo.Rule{
+			"email": {
+				ID:     "email",
+				Expr:   `has(contact.email) && contact.email.address == "ada@example.com"`,
+				Schema: schema,
+			},
+			"phone": {
+				ID:     "phone",
+				Expr:   `has(contact.phone) && contact.phone.number == "555-0100"`,
+				Schema: schema,
+			},
+		},
+	}
+
+	e := indigo.NewEngine(cel.NewEvaluator())
+	is.NoErr(e.Compile(r))
+
+	cases := []struct {
+		contact *school.Contact
+		want    map[string]bool
+	}{
+		{
+			contact: &school.Contact{Method: &school.Contact_Email{Email: &school.EmailContact{Address: "ada@example.com"}}},
+			want:    map[string]bool{"email": true, "phone": false},
 		},
 		{
-			indigo.Rule{
-				ID:         "NEGATIVEshouldBeStudent",
-				Schema:     makeEducationProtoSchema(),
-				ResultType: indigo.Proto{Message: &school.HonorsConfiguration{}},
-				Expr:       `testdata.school.Student { gpa: 1.2 }`,
-			},
-			fmt.Errorf("Should be an error"),
+			contact: &school.Contact{Method: &school.Contact_Phone{Phone: &school.PhoneContact{Number: "555-0100"}}},
+			want:    map[string]bool{"email": false, "phone": true},
+		},
+		{
+			contact: &school.Contact{},
+			want:    map[string]bool{"email": false, "phone": false},
 		},
 	}
 
-	for i := range cases {
-		for _, b := range []bool{false, true} {
-			t.Run(fmt.Sprintf("%s_fixed_schema_%t", cases[i].rule.ID, b), func(t *testing.T) {
-				var e *indigo.DefaultEngine
-				switch b {
-				case true:
-					s := makeEducationProtoSchema()
-					e = indigo.NewEngine(cel.NewEvaluator(cel.FixedSchema(&s)))
-				case false:
-					e = indigo.NewEngine(cel.NewEvaluator())
-				}
+	for _, c := range cases {
+		u, err := e.Eval(context.Background(), r, map[string]interface{}{"contact": c.contact})
+		is.NoErr(err)
+		for id, want := range c.want {
+			is.Equal(u.Results[id].ExpressionPass, want)
+		}
+	}
 
-				//		lc := c
-				//		fmt.Println("Case: ", cases[i].rule.ID)
-				err := e.Compile(&cases[i].rule)
-				if cases[i].err == nil && err != nil {
-					t.Errorf("compiling rule %s, wanted err = %v, got %v", cases[i].rule.ID, cases[i].err, err)
-				}
+	// An Any holding a message declared in the same file as the schema's message
+	phone, err := anypb.New(&school.PhoneContact{Number: "555-0100"})
+	is.NoErr(err)
+	r = &indigo.Rule{ID: "details", Expr: `contact.details.number == "555-0100"`, Schema: schema}
+	is.NoErr(e.Compile(r))
+	u, err := e.Eval(context.Background(), r, map[string]interface{}{"contact": &school.Contact{Details: phone}})
+	is.NoErr(err)
+	is.True(u.ExpressionPass)
 
-				_, err = e.Eval(context.Background(), &cases[i].rule, makeStudentProtoData())
+	// An Any holding a message declared elsewhere must be registered
+	student, err := anypb.New(&school.Student{Gpa: 3.5})
+	is.NoErr(err)
+	data := map[string]interface{}{"contact": &school.Contact{Details: student}}
+	r = &indigo.Rule{ID: "details", Expr: `contact.details.gpa > 3.0`, Schema: schema}
+	is.NoErr(e.Compile(r))
+	_, err = e.Eval(context.Background(), r, data)
+	is.True(err != nil)
+
+	e = indigo.NewEngine(cel.NewEvaluator(cel.AnyTypes(&school.Student{})))
+	is.NoErr(e.Compile(r))
+	u, err = e.Eval(context.Background(), r, data)
+	is.NoErr(err)
+	is.True(u.ExpressionPass)
+}
 
-				if err != nil && cases[i].err == nil {
-					t.Fatalf("For rule %s, wanted err = %v, got %v", cases[i].rule.ID, cases[i].err, err)
-				} /* else {
-						if res != nil {
-						 	fmt.Printf("%v\nn", res)
-						 }
-				} */
-			})
+// makeTeamFiles returns three proto files, each declaring a message with a
+// field of the message declared in the previous file: Team.lead is a Person,
+// and Person.home an Address.
+func makeTeamFiles(t *testing.T) (team, person, address protoreflect.MessageDescriptor) {
+	t.Helper()
+	field := func(name string, n int32, typ descriptorpb.FieldDescriptorProto_Type, typeName string) *descriptorpb.FieldDescriptorProto {
+		f := &descriptorpb.FieldDescriptorProto{
+			Name:     proto.String(name),
+			JsonName: proto.String(name),
+			Number:   proto.Int32(n),
+			Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+			Type:     typ.Enum(),
+		}
+		if typeName != "" {
+			f.TypeName = proto.String(typeName)
+		}
+		return f
+	}
+	file := func(name, msg string, deps []string, fields ...*descriptorpb.FieldDescriptorProto) *descriptorpb.FileDescriptorProto {
+		return &descriptorpb.FileDescriptorProto{
+			Name:        proto.String(name),
+			Package:     proto.String("testdata.teams"),
+			Syntax:      proto.String("proto3"),
+			Dependency:  deps,
+			MessageType: []*descriptorpb.DescriptorProto{{Name: proto.String(msg), Field: fields}},
 		}
 	}
+
+	files := []*descriptorpb.FileDescriptorProto{
+		file("address.proto", "Address", nil,
+			field("city", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING, "")),
+		file("person.proto", "Person", []string{"address.proto"},
+			field("name", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING, ""),
+			field("home", 2, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, ".testdata.teams.Address")),
+		file("team.proto", "Team", []string{"person.proto"},
+			field("lead", 1, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, ".testdata.teams.Person")),
+	}
+
+	reg := &protoregistry.Files{}
+	var mds []protoreflect.MessageDescriptor
+	for _, fp := range files {
+		fd, err := protodesc.NewFile(fp, reg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := reg.RegisterFile(fd); err != nil {
+			t.Fatal(err)
+		}
+		mds = append(mds, fd.Messages().Get(0))
+	}
+	return mds[2], mds[1], mds[0]
 }
 
-// Generate all diagnostics for both sets of rules to make sure
-// no panics
-func TestDiagnosticGeneration(t *testing.T) {
+// Test that the messages of fields declared in other proto files than the
+// schema's message, and the messages of their fields in turn, are registered
+func TestProtoFieldsFromOtherFiles(t *testing.T) {
 	is := is.New(t)
-	e := indigo.NewEngine(cel.NewEvaluator())
 
-	red1 := makeEducationRules1()
-	err := e.Compile(red1, indigo.CollectDiagnostics(true))
-	is.NoErr(err)
+	teamMD, personMD, addressMD := makeTeamFiles(t)
+	is.True(teamMD.ParentFile().Path() != addressMD.ParentFile().Path())
 
-	u, err := e.Eval(context.Background(), red1, makeStudentData(), indigo.ReturnDiagnostics(true))
-	is.NoErr(err)
-	//	fmt.Println(indigo.DiagnosticsReport(u, nil))
-	_ = u.Diagnostics.String()
+	address := dynamicpb.NewMessage(addressMD)
+	address.Set(addressMD.Fields().ByName("city"), protoreflect.ValueOfString("Chicago"))
+	person := dynamicpb.NewMessage(personMD)
+	person.Set(personMD.Fields().ByName("name"), protoreflect.ValueOfString("Ada"))
+	person.Set(personMD.Fields().ByName("home"), protoreflect.ValueOfMessage(address))
+	team := dynamicpb.NewMessage(teamMD)
+	team.Set(teamMD.Fields().ByName("lead"), protoreflect.ValueOfMessage(person))
 
-	red2 := makeEducationProtoRules("red2")
-	err = e.Compile(red2, indigo.CollectDiagnostics(true))
-	is.NoErr(err)
-	u, err = e.Eval(context.Background(), red2, makeStudentProtoData(), indigo.ReturnDiagnostics(true))
+	r := &indigo.Rule{
+		ID: "chicago",
+		Schema: indigo.Schema{
+			Elements: []indigo.DataElement{
+				{Name: "team", Type: indigo.Proto{Message: dynamicpb.NewMessage(teamMD)}},
+			},
+		},
+		Expr: `team.lead.name == "Ada" && team.lead.home.city == "Chicago"`,
+	}
+
+	e := indigo.NewEngine(cel.NewEvaluator())
+	is.NoErr(e.Compile(r))
+
+	u, err := e.Eval(context.Background(), r, map[string]interface{}{"team": team})
 	is.NoErr(err)
-	_ = u.Diagnostics.String()
-	_ = indigo.DiagnosticsReport(u, makeStudentData())
+	is.True(u.ExpressionPass)
+
+	// Undefined fields of the messages in the other files are still errors
+	r.Expr = `team.lead.home.town == "Chicago"`
+	is.True(e.Compile(r) != nil)
 }
 
-// ------------------------------------------------------------------------------------------
-// BENCHMARKS
-//
-//
-//
-//
-//
+func TestAliases(t *testing.T) {
+	is := is.New(t)
 
-func BenchmarkSimpleRule(b *testing.B) {
-	education := makeEducationSchema()
-	data := makeStudentData()
+	schema := indigo.Schema{
+		Elements: []indigo.DataElement{
+			{Name: "student.Enrollment.Date", Type: indigo.Timestamp{}, Alias: "enrolled"},
+			{Name: "student", Type: indigo.Proto{Message: &school.Student{}}, Alias: "s"},
+		},
+	}
 
-	r := indigo.Rule{
-		ID:     "student_actions",
-		Schema: education,
+	r := &indigo.Rule{
+		ID:     "root",
+		Schema: schema,
+		Expr:   "true",
 		Rules: map[string]*indigo.Rule{
-			"a": {
-				ID:     "at_risk",
-				Schema: education,
-				Expr:   `student.GPA < 2.5 || student.Status == "Probation"`,
-			},
+			"alias":  {ID: "alias", Schema: schema, Expr: `enrolled < timestamp("2020-01-01T00:00:00Z") && s.gpa > 3.0`},
+			"name":   {ID: "name", Schema: schema, Expr: `student.gpa > 3.0`},
+			"either": {ID: "either", Schema: schema, Expr: `s.gpa == student.gpa`},
 		},
 	}
+
 	e := indigo.NewEngine(cel.NewEvaluator())
-	err := e.Compile(&r)
-	if err != nil {
-		b.Errorf("Error adding ruleset: %v", err)
-	}
+	is.NoErr(e.Compile(r))
 
-	for i := 0; i < b.N; i++ {
-		_, err := e.Eval(context.Background(), &r, data)
-		if err != nil {
-			b.Error(err)
-		}
+	// The data only has the real names
+	data := map[string]interface{}{
+		"student.Enrollment.Date": time.Date(2019, 9, 1, 0, 0, 0, 0, time.UTC),
+		"student":                 &school.Student{Gpa: 3.5},
 	}
+	u, err := e.Eval(context.Background(), r, data)
+	is.NoErr(err)
+	is.True(u.Results["alias"].Pass)
+	is.True(u.Results["name"].Pass)
+	is.True(u.Results["either"].Pass)
+	is.Equal(len(data), 2) // the data is not modified
+
+	// Variables are reported under the element's name
+	vars, err := cel.NewEvaluator().ReferencedVariables(r.Rules["alias"].Expr, schema)
+	is.NoErr(err)
+	is.Equal(vars, []string{"student", "student.Enrollment.Date"})
+
+	// A misspelled alias is suggested
+	err = e.Compile(&indigo.Rule{ID: "typo", Schema: schema, Expr: "enroled < now"})
+	is.True(err != nil)
+	is.True(strings.Contains(err.Error(), "did you mean enrolled?"))
 }
 
-func BenchmarkSimpleRuleWithDiagnostics(b *testing.B) {
-	e := indigo.NewEngine(cel.NewEvaluator())
-	education := makeEducationSchema()
-	data := makeStudentData()
+func TestValueString(t *testing.T) {
+	is := is.New(t)
 
-	r := indigo.Rule{
-		ID:     "student_actions",
-		Schema: education,
+	schema := indigo.Schema{
+		Elements: []indigo.DataElement{
+			{Name: "start", Type: indigo.Timestamp{}},
+		},
+	}
+
+	r := &indigo.Rule{
+		ID:     "root",
+		Schema: schema,
+		Expr:   "true",
 		Rules: map[string]*indigo.Rule{
-			"a": {
-				ID:     "at_risk",
-				Schema: education,
-				Expr:   `student.GPA < 2.5 || student.Status == "Probation"`,
+			"grace": {
+				ID:         "grace",
+				Schema:     schema,
+				Expr:       `duration("72h")`,
+				ResultType: indigo.Duration{},
+			},
+			"deadline": {
+				ID:         "deadline",
+				Schema:     schema,
+				Expr:       `start + duration("72h")`,
+				ResultType: indigo.Timestamp{},
 			},
 		},
 	}
 
-	err := e.Compile(&r, indigo.CollectDiagnostics(true))
-	if err != nil {
-		b.Errorf("Error adding ruleset: %v", err)
-	}
+	e := indigo.NewEngine(cel.NewEvaluator())
+	is.NoErr(e.Compile(r))
 
-	for i := 0; i < b.N; i++ {
-		_, err := e.Eval(context.Background(), &r, data, indigo.ReturnDiagnostics(true))
-		if err != nil {
-			b.Error(err)
-		}
-	}
+	u, err := e.Eval(context.Background(), r, map[string]interface{}{
+		"start": time.Date(2022, 3, 1, 9, 30, 0, 0, time.UTC),
+	})
+	is.NoErr(err)
+	is.Equal(u.Results["grace"].ValueString(), "72h0m0s")
+	is.Equal(u.Results["deadline"].ValueString(), "2022-03-04T09:30:00Z")
+	is.Equal(u.ValueString(), "true")
+
+	// The table uses the same formatting
+	out := u.Render(indigo.Columns("Rule", "Value"), indigo.Plain())
+	is.True(strings.Contains(out, "72h0m0s"))
+	is.True(strings.Contains(out, "2022-03-04T09:30:00Z"))
+	is.True(strings.Contains(u.Summary(), "2022-03-04T09:30:00Z"))
 }
 
-func BenchmarkRuleWithArray(b *testing.B) {
+func TestVerboseErrors(t *testing.T) {
+	is := is.New(t)
+
+	r := &indigo.Rule{
+		ID: "ratio",
+		Schema: indigo.Schema{
+			ID: "counts",
+			Elements: []indigo.DataElement{
+				{Name: "x", Type: indigo.Int{}},
+			},
+		},
+		Expr: "10 / x > 2",
+	}
+
 	e := indigo.NewEngine(cel.NewEvaluator())
+	is.NoErr(e.Compile(r))
+	data := map[string]interface{}{"x": 0}
+
+	// By default, the error doesn't include the expression
+	_, err := e.Eval(context.Background(), r, data)
+	is.True(err != nil)
+	is.True(strings.HasPrefix(err.Error(), "rule ratio: "))
+	is.True(!strings.Contains(err.Error(), "10 / x"))
+	is.True(!strings.Contains(err.Error(), "counts"))
+
+	_, err = e.Eval(context.Background(), r, data, indigo.VerboseErrors(true))
+	is.True(err != nil)
+	is.True(strings.HasPrefix(err.Error(), `rule ratio (schema "counts", expression "10 / x > 2"): `))
+	is.True(strings.Contains(err.Error(), "division by zero"))
+
+	_, err = e.EvalValue(context.Background(), r, data, indigo.VerboseErrors(true))
+	is.True(err != nil)
+	is.True(strings.Contains(err.Error(), `expression "10 / x > 2"`))
+}
 
-	education := makeEducationSchema()
+func TestEvalProto(t *testing.T) {
+	is := is.New(t)
+
+	schema := indigo.Schema{
+		Elements: []indigo.DataElement{
+			{Name: "gpa", Type: indigo.Float{}},
+			{Name: "credits", Type: indigo.Int{}},
+			{Name: "status", Type: indigo.Int{}},
+			{Name: "enrollment_date", Type: indigo.Timestamp{}},
+			{Name: "grades", Type: indigo.List{ValueType: indigo.Float{}}},
+			{Name: "attrs", Type: indigo.Map{KeyType: indigo.String{}, ValueType: indigo.String{}}},
+			{Name: "suspensions", Type: indigo.List{ValueType: indigo.Proto{Message: &school.Student_Suspension{}}}},
+		},
+	}
 
 	r := &indigo.Rule{
-		ID:     "student_actions",
-		Schema: education,
+		ID:     "root",
+		Schema: schema,
+		Expr:   "true",
 		Rules: map[string]*indigo.Rule{
-			"a": {
-				ID:     "honors_student",
-				Schema: education,
-				Expr:   `student.GPA >= 3.6 && student.Status!="Probation" && !("C" in student.Grades)`,
-			},
+			"honors":    {ID: "honors", Schema: schema, Expr: "gpa >= 3.6 && credits > 30"},
+			"probation": {ID: "probation", Schema: schema, Expr: "status == 1"},
+			"enrolled":  {ID: "enrolled", Schema: schema, Expr: `enrollment_date < timestamp("2020-01-01T00:00:00Z")`},
+			"grades":    {ID: "grades", Schema: schema, Expr: "grades.all(g, g >= 3.0)"},
+			"attrs":     {ID: "attrs", Schema: schema, Expr: `"major" in attrs && attrs["major"] == "math"`},
+			"clean":     {ID: "clean", Schema: schema, Expr: "size(suspensions) == 0"},
 		},
 	}
 
-	err := e.Compile(r)
-	if err != nil {
-		b.Errorf("Error adding ruleset: %v", err)
-	}
+	e := indigo.NewEngine(cel.NewEvaluator())
+	is.NoErr(e.Compile(r))
 
-	data := makeStudentData()
-	for i := 0; i < b.N; i++ {
-		_, err := e.Eval(context.Background(), r, data)
-		if err != nil {
-			b.Error(err)
+	s := &school.Student{
+		Gpa:            3.8,
+		Credits:        42,
+		Status:         school.Student_PROBATION,
+		EnrollmentDate: timestamppb.New(time.Date(2018, 9, 1, 0, 0, 0, 0, time.UTC)),
+		Grades:         []float64{3.5, 4.0},
+		Attrs:          map[string]string{"major": "math"},
+	}
+	u, err := e.EvalProto(context.Background(), r, s)
+	is.NoErr(err)
+	for id, c := range u.Results {
+		if !c.Pass {
+			t.Errorf("rule %s did not pass", id)
 		}
-
 	}
-}
 
-func BenchmarkProtoWithSelfX(b *testing.B) {
-	b.StopTimer()
+	// Unset fields have their default values
+	u, err = e.EvalProto(context.Background(), r, &school.Student{})
+	is.NoErr(err)
+	is.True(!u.Results["honors"].Pass)
+	is.True(!u.Results["probation"].Pass)
+	is.True(u.Results["clean"].Pass)
 
-	_, err := pb.DefaultDb.RegisterMessage(&school.Student{})
-	if err != nil {
-		b.Error(err)
-	}
+	_, err = e.EvalProto(context.Background(), r, nil)
+	is.True(err != nil)
+}
+
+func TestEnumAlias(t *testing.T) {
+	is := is.New(t)
 
 	schema := indigo.Schema{
 		Elements: []indigo.DataElement{
 			{Name: "student", Type: indigo.Proto{Message: &school.Student{}}},
-			{Name: "now", Type: indigo.Timestamp{}},
-			{Name: "self", Type: indigo.Proto{Message: &school.HonorsConfiguration{}}},
 		},
 	}
 
-	e := indigo.NewEngine(cel.NewEvaluator())
+	e := indigo.NewEngine(cel.NewEvaluator(
+		cel.EnumAlias("PROBATION", "testdata.school.Student.status_type.PROBATION"),
+		cel.EnumAlias("GRADUATED", "testdata.school.Student.status_type.GRADUATED"),
+	))
 
 	r := &indigo.Rule{
-		ID:     "student_actions",
+		ID:     "root",
 		Schema: schema,
+		Expr:   "true",
 		Rules: map[string]*indigo.Rule{
-			"a": {
-				ID:     "at_risk",
-				Expr:   `student.gpa < self.Minimum_GPA && student.status == testdata.school.Student.status_type.PROBATION`,
-				Self:   &school.HonorsConfiguration{Minimum_GPA: 3.7},
-				Schema: schema,
-				Meta:   false,
-			},
+			"alias": {ID: "alias", Schema: schema, Expr: "student.status == PROBATION"},
+			"full":  {ID: "full", Schema: schema, Expr: "student.status == testdata.school.Student.status_type.PROBATION"},
+			"other": {ID: "other", Schema: schema, Expr: "student.status != GRADUATED"},
 		},
 	}
+	is.NoErr(e.Compile(r))
+
+	u, err := e.Eval(context.Background(), r, map[string]interface{}{"student": &school.Student{Status: school.Student_PROBATION}})
+	is.NoErr(err)
+	is.True(u.Results["alias"].Pass)
+	is.True(u.Results["full"].Pass)
+	is.True(u.Results["other"].Pass)
+
+	u, err = e.Eval(context.Background(), r, map[string]interface{}{"student": &school.Student{Status: school.Student_GRADUATED}})
+	is.NoErr(err)
+	is.True(!u.Results["alias"].Pass)
+	is.True(!u.Results["full"].Pass)
+	is.True(!u.Results["other"].Pass)
+
+	// An enum value without an alias is undeclared
+	err = e.Compile(&indigo.Rule{ID: "undeclared", Schema: schema, Expr: "student.status == ENROLLED"})
+	is.True(err != nil)
+	is.True(strings.Contains(err.Error(), "undeclared reference to 'ENROLLED'"))
+
+	// An alias for an unknown enum value fails compilation
+	e = indigo.NewEngine(cel.NewEvaluator(cel.EnumAlias("EXPELLED", "testdata.school.Student.status_type.EXPELLED")))
+	err = e.Compile(&indigo.Rule{ID: "bad", Schema: schema, Expr: "student.status == 1"})
+	is.True(err != nil)
+	is.True(strings.Contains(err.Error(), "enum alias EXPELLED"))
+}
+
+func TestResultCounts(t *testing.T) {
+	is := is.New(t)
+
+	e := indigo.NewEngine(cel.NewEvaluator())
+	r := makeEducationProtoRules("student_actions")
+	is.NoErr(e.Compile(r))
+
+	u, err := e.Eval(context.Background(), r, makeStudentProtoData())
+	is.NoErr(err)
+
+	// honor_student and tenure_gt_6months pass; at_risk fails, and so
+	// does the root
+	sum := u.Counts()
+	is.Equal(sum.Total, 4)
+	is.Equal(sum.Passed, 2)
+	is.Equal(sum.Failed, 2)
+	is.Equal(sum.Unknown, 0)
+	is.Equal(sum.Categories, map[string]indigo.CategoryCounts{
+		"true":  {Pass: 2},
+		"false": {Fail: 1},
+	})
+
+	// Discarded results are not counted
+	u, err = e.Eval(context.Background(), r, makeStudentProtoData(), indigo.DiscardPass(true))
+	is.NoErr(err)
+	sum = u.Counts()
+	is.Equal(sum.Total, 2)
+	is.Equal(sum.Passed, 0)
+	is.Equal(sum.Failed, 2)
+	is.Equal(sum.Categories, map[string]indigo.CategoryCounts{"false": {Fail: 1}})
+	is.Equal(u.EvalCount, 4)
+}
+
+// Test iterating over the results that match a condition
+func TestFlatWhere(t *testing.T) {
+	is := is.New(t)
+
+	e := indigo.NewEngine(cel.NewEvaluator())
+	r := makeEducationProtoRules("student_actions")
+	is.NoErr(e.Compile(r))
+
+	u, err := e.Eval(context.Background(), r, makeStudentProtoData())
+	is.NoErr(err)
+
+	// The iterator is an iter.Seq; with Go 1.23, range over it instead
+	collect := func(seq func(yield func(*indigo.Result) bool)) []string {
+		var ids []string
+		seq(func(c *indigo.Result) bool {
+			ids = append(ids, c.Rule.ID)
+			return true
+		})
+		return ids
+	}
+
+	passed := func(c *indigo.Result) bool { return c.Pass }
+	is.Equal(collect(u.FlatWhere(passed)), []string{"honor_student", "tenure_gt_6months"})
+
+	tagged := func(c *indigo.Result) bool { return c.Rule.Meta == false }
+	is.Equal(collect(u.FlatWhere(tagged)), []string{"at_risk"})
+
+	// All the results, as listed by Flat
+	is.Equal(len(collect(u.FlatWhere(nil))), len(u.Flat()))
+
+	// The iteration stops when yield returns false
+	n := 0
+	u.FlatWhere(nil)(func(c *indigo.Result) bool {
+		n++
+		return n < 2
+	})
+	is.Equal(n, 2)
+}
+
+// Test evaluating a rule with a different expression, leaving the rule as it was
+func TestEvalWith(t *testing.T) {
+	is := is.New(t)
+
+	e := indigo.NewEngine(cel.NewEvaluator())
+	r := makeEducationProtoRules("student_actions")
+	is.NoErr(e.Compile(r))
+	atRisk := r.Rules["at_risk"]
+	prg := atRisk.Program
+
+	orig, err := e.Eval(context.Background(), atRisk, makeStudentProtoData())
+	is.NoErr(err)
+	is.True(!orig.Pass)
+
+	// The student's GPA is 3.76
+	u, err := e.EvalWith(context.Background(), atRisk, `student.gpa < 3.8`, makeStudentProtoData())
+	is.NoErr(err)
+	is.True(u.Pass)
+	is.Equal(u.Rule.Expr, `student.gpa < 3.8`)
+	is.Equal(u.Rule.ID, "at_risk")
+
+	// The rule is unchanged
+	is.Equal(atRisk.Expr, `student.gpa < 2.5 || student.status == testdata.school.Student.status_type.PROBATION`)
+	is.Equal(atRisk.Program, prg)
+	u, err = e.Eval(context.Background(), atRisk, makeStudentProtoData())
+	is.NoErr(err)
+	is.Equal(u.Pass, orig.Pass)
+
+	// The child rules are evaluated as compiled
+	u, err = e.EvalWith(context.Background(), r, `false`, makeStudentProtoData())
+	is.NoErr(err)
+	is.True(!u.ExpressionPass)
+	is.Equal(len(u.Results), 3)
+	is.True(u.Results["honor_student"].Pass)
+
+	// Cached results of the original expression are not used
+	cache := indigo.NewResultCache()
+	u, err = e.Eval(context.Background(), atRisk, makeStudentProtoData(), indigo.WithResultCache(cache))
+	is.NoErr(err)
+	is.True(!u.Pass)
+	u, err = e.EvalWith(context.Background(), atRisk, `true`, makeStudentProtoData(), indigo.WithResultCache(cache))
+	is.NoErr(err)
+	is.True(u.Pass)
 
-	err = e.Compile(r)
-	if err != nil {
-		log.Fatalf("Error adding ruleset: %v", err)
-	}
+	_, err = e.EvalWith(context.Background(), atRisk, `student.gpa < "3.8"`, makeStudentProtoData())
+	var ce *indigo.CompileError
+	is.True(errors.As(err, &ce))
+	is.Equal(ce.RuleID, "at_risk")
+}
 
-	s := school.Student{
-		Age:            16,
-		Gpa:            3,
-		Status:         school.Student_PROBATION,
-		Grades:         []float64{4.0, 4.0, 3.7},
-		Attrs:          map[string]string{"Nickname": "Joey"},
-		EnrollmentDate: &timestamppb.Timestamp{Seconds: time.Date(2010, 5, 1, 12, 12, 59, 0, time.FixedZone("UTC-8", -8*60*60)).Unix()},
-	}
+// Test evaluating rules referring to "now" without providing it in the data
+func TestInjectNow(t *testing.T) {
+	is := is.New(t)
 
-	data := map[string]interface{}{
-		"student": &s,
-		"now":     &timestamppb.Timestamp{Seconds: time.Now().Unix()},
-	}
-	b.StartTimer()
+	r := makeEducationProtoRules("student_actions")
+	tenure := r.Rules["tenure_gt_6months"]
+	d := makeStudentProtoData()
+	delete(d, "now")
 
-	for i := 0; i < b.N; i++ {
-		_, err := e.Eval(context.Background(), r, data)
-		if err != nil {
-			b.Error(err)
-		}
+	e := indigo.NewEngine(cel.NewEvaluator())
+	is.NoErr(e.Compile(r))
+	_, err := e.Eval(context.Background(), tenure, d)
+	is.True(err != nil) // now is missing
 
-	}
+	// The student enrolled on May 1, 2010
+	u, err := e.Eval(context.Background(), tenure, d, indigo.InjectNow(time.Date(2010, 6, 1, 0, 0, 0, 0, time.UTC)))
+	is.NoErr(err)
+	is.True(!u.Pass)
+
+	u, err = e.Eval(context.Background(), r, d, indigo.InjectNow(time.Date(2011, 1, 1, 0, 0, 0, 0, time.UTC)))
+	is.NoErr(err)
+	is.True(u.Results["tenure_gt_6months"].Pass)
+	_, ok := d["now"]
+	is.True(!ok) // the caller's data is not changed
+
+	// A time in the data takes precedence
+	d["now"] = cel.Time(time.Date(2010, 6, 1, 0, 0, 0, 0, time.UTC))
+	u, err = e.Eval(context.Background(), tenure, d, indigo.InjectNow(time.Now()))
+	is.NoErr(err)
+	is.True(!u.Pass)
+	delete(d, "now")
+
+	// The evaluator uses the current time
+	e = indigo.NewEngine(cel.NewEvaluator(cel.AutoNow()))
+	is.NoErr(e.Compile(r))
+	u, err = e.Eval(context.Background(), tenure, d)
+	is.NoErr(err)
+	is.True(u.Pass)
 }
 
-func BenchmarkProtoWithoutSelf(b *testing.B) {
-	_, err := pb.DefaultDb.RegisterMessage(&school.Student{})
-	if err != nil {
-		b.Error(err)
-	}
+func TestTimeConversions(t *testing.T) {
+	is := is.New(t)
+
+	now := time.Date(2022, 3, 1, 9, 30, 15, 500, time.FixedZone("UTC-8", -8*60*60))
+	ts := cel.Time(now)
+	is.True(cel.GoTime(ts).Equal(now))
+	is.Equal(cel.GoTime(ts).Location(), time.UTC)
+	is.Equal(cel.GoDur(cel.Dur(90*time.Minute)), 90*time.Minute)
+	is.True(cel.GoTime(nil).Equal(time.Unix(0, 0)))
+	is.Equal(cel.GoDur(nil), time.Duration(0))
 
 	schema := indigo.Schema{
 		Elements: []indigo.DataElement{
 			{Name: "student", Type: indigo.Proto{Message: &school.Student{}}},
 			{Name: "now", Type: indigo.Timestamp{}},
+			{Name: "grace", Type: indigo.Duration{}},
 		},
 	}
-	e := indigo.NewEngine(cel.NewEvaluator())
-
 	r := &indigo.Rule{
-		ID:     "student_actions",
+		ID:     "enrolled_long_ago",
 		Schema: schema,
-		Rules: map[string]*indigo.Rule{
-			"a": {
-				ID:     "at_risk",
-				Expr:   `student.gpa < 2.5 || student.status == testdata.school.Student.status_type.PROBATION`,
-				Schema: schema,
-				Meta:   false,
-			},
-		},
-	}
-
-	err = e.Compile(r)
-	if err != nil {
-		log.Fatalf("Error adding ruleset: %v", err)
+		Expr:   `now - student.enrollment_date > grace`,
 	}
 
-	s := school.Student{
-		Age:            16,
-		Gpa:            3.76,
-		Status:         school.Student_ENROLLED,
-		Grades:         []float64{4.0, 4.0, 3.7},
-		Attrs:          map[string]string{"Nickname": "Joey"},
-		EnrollmentDate: &timestamppb.Timestamp{Seconds: time.Date(2010, 5, 1, 12, 12, 59, 0, time.FixedZone("UTC-8", -8*60*60)).Unix()},
-	}
+	e := indigo.NewEngine(cel.NewEvaluator())
+	is.NoErr(e.Compile(r))
 
 	data := map[string]interface{}{
-		"student": &s,
-		"now":     &timestamppb.Timestamp{Seconds: time.Now().Unix()},
+		"student": &school.Student{EnrollmentDate: cel.Time(now.Add(-100 * time.Hour))},
+		"now":     cel.Time(now),
+		"grace":   cel.Dur(72 * time.Hour),
 	}
+	u, err := e.Eval(context.Background(), r, data)
+	is.NoErr(err)
+	is.True(u.Pass)
 
-	for i := 0; i < b.N; i++ {
-		_, err := e.Eval(context.Background(), r, data)
-		if err != nil {
-			b.Error(err)
-		}
-
-	}
+	data["grace"] = cel.Dur(200 * time.Hour)
+	u, err = e.Eval(context.Background(), r, data)
+	is.NoErr(err)
+	is.True(!u.Pass)
 }
 
-func BenchmarkProtoCreation(b *testing.B) {
-	education := indigo.Schema{
+func TestAutoNumericCoercion(t *testing.T) {
+	is := is.New(t)
+
+	schema := indigo.Schema{
 		Elements: []indigo.DataElement{
 			{Name: "student", Type: indigo.Proto{Message: &school.Student{}}},
-			{Name: "student_suspension", Type: indigo.Proto{Message: &school.Student_Suspension{}}},
-			{Name: "studentSummary", Type: indigo.Proto{Message: &school.StudentSummary{}}},
 		},
 	}
+	r := &indigo.Rule{ID: "older", Schema: schema, Expr: "student.age > 15.5 && student.gpa >= 3"}
 
-	r := &indigo.Rule{
-		ID:         "create_summary",
-		Schema:     education,
-		ResultType: indigo.Proto{Message: &school.StudentSummary{}},
-		Expr: `
-			testdata.school.StudentSummary {
-				gpa: student.gpa,
-				risk_factor: 2.0 + 3.0,
-				tenure: duration("12h")
-			}`,
-	}
+	// Without the option, the int and double can't be compared
+	err := indigo.NewEngine(cel.NewEvaluator()).Compile(r)
+	is.True(err != nil)
+	is.True(strings.Contains(err.Error(), "found no matching overload for '_>_' applied to '(int, double)'"))
 
-	e := indigo.NewEngine(cel.NewEvaluator())
-	err := e.Compile(r)
-	if err != nil {
-		fmt.Printf("Error adding rule %v", err)
-		return
-	}
+	e := indigo.NewEngine(cel.NewEvaluator(cel.AutoNumericCoercion(true)))
+	is.NoErr(e.Compile(r))
 
-	for i := 0; i < b.N; i++ {
-		_, err := e.Eval(context.Background(), r, makeStudentProtoData())
-		if err != nil {
-			b.Error(err)
-		}
+	u, err := e.Eval(context.Background(), r, map[string]interface{}{"student": &school.Student{Age: 16, Gpa: 3.2}})
+	is.NoErr(err)
+	is.True(u.Pass)
 
-	}
+	u, err = e.Eval(context.Background(), r, map[string]interface{}{"student": &school.Student{Age: 15, Gpa: 3.2}})
+	is.NoErr(err)
+	is.True(!u.Pass)
+
+	// Equality still requires the same types
+	err = e.Compile(&indigo.Rule{ID: "equal", Schema: schema, Expr: "student.age == 16.0"})
+	is.True(err != nil)
 }
 
-func BenchmarkEval2000Rules(b *testing.B) {
-	b.StopTimer()
-	_, err := pb.DefaultDb.RegisterMessage(&school.Student{})
-	if err != nil {
-		b.Error(err)
-	}
+// Test the structural differences between two versions of a rule tree
+func TestDiffRules(t *testing.T) {
+	is := is.New(t)
 
-	schema := indigo.Schema{
-		Elements: []indigo.DataElement{
-			{Name: "student", Type: indigo.Proto{Message: &school.Student{}}},
-			{Name: "now", Type: indigo.Timestamp{}},
-			{Name: "self", Type: indigo.Proto{Message: &school.HonorsConfiguration{}}},
-		},
+	old := makeEducationRules1()
+	is.Equal(len(indigo.DiffRules(old, makeEducationRules1())), 0)
+
+	r := makeEducationRules1()
+	actions := r.Rules["student_actions"]
+	actions.Rules["honors_student"].Expr = `student.GPA >= 3.8`
+	actions.Rules["honors_student"].EvalOptions.DiscardFail = indigo.Discard
+	actions.Rules["at_risk"].Rules["probation"] = &indigo.Rule{
+		ID:     "probation",
+		Expr:   `student.Status == "Probation"`,
+		Schema: makeEducationSchema(),
 	}
+	delete(actions.Rules, "timecheck")
+
+	changes := indigo.DiffRules(old, r)
+	is.Equal(changes, []indigo.RuleChange{
+		{ID: "probation", Ancestors: []string{"root", "student_actions", "at_risk"}, Type: indigo.RuleAdded},
+		{ID: "honors_student", Ancestors: []string{"root", "student_actions"}, Type: indigo.RuleModified, Fields: []string{"Expr", "EvalOptions"}},
+		{ID: "timecheck", Ancestors: []string{"root", "student_actions"}, Type: indigo.RuleRemoved},
+	})
+
+	// The schema is compared element by element
+	r = makeEducationRules1()
+	r.Rules["student_actions"].Rules["notsummer"].Schema.Elements[0].Alias = "s"
+	is.Equal(indigo.DiffRules(old, r), []indigo.RuleChange{
+		{ID: "notsummer", Ancestors: []string{"root", "student_actions"}, Type: indigo.RuleModified, Fields: []string{"Schema"}},
+	})
+
+	// Comparing with no tree adds or removes the whole tree
+	is.Equal(indigo.DiffRules(nil, old), []indigo.RuleChange{{ID: "root", Type: indigo.RuleAdded}})
+	is.Equal(indigo.DiffRules(old, nil), []indigo.RuleChange{{ID: "root", Type: indigo.RuleRemoved}})
+}
+
+// Test checking an expression without a rule
+func TestCheckExpression(t *testing.T) {
+	is := is.New(t)
 
 	e := indigo.NewEngine(cel.NewEvaluator())
+	schema := makeEducationSchema()
+
+	is.NoErr(e.CheckExpression(`student.GPA >= 3.6 && student.Status != "Probation"`, schema, nil))
+	is.NoErr(e.CheckExpression(`student.GPA * 2.0`, schema, indigo.Float{}))
+
+	err := e.CheckExpression(`student.GPA > "3.6"`, schema, nil)
+	is.True(err != nil)
+	var ce *indigo.CompileError
+	is.True(errors.As(err, &ce))
+	is.Equal(ce.RuleID, "")
+	is.Equal(len(ce.Issues), 1)
+	is.Equal(ce.Issues[0].Line, 1)
+	is.Equal(ce.Issues[0].Col, 13)
+	is.True(strings.Contains(err.Error(), "found no matching overload for '_>_' applied to '(double, string)'"))
+
+	// The expression must produce the result type
+	is.True(e.CheckExpression(`student.GPA`, schema, nil) != nil)
+
+	// The schema is not changed
+	is.Equal(schema, makeEducationSchema())
+}
 
-	r := &indigo.Rule{
-		ID:     "student_actions",
-		Schema: schema,
-		Rules:  map[string]*indigo.Rule{},
-	}
+// Test the conversion between Indigo types and CEL type names
+func TestCELTypeName(t *testing.T) {
+	is := is.New(t)
 
-	for i := 0; i < 2_000; i++ {
-		cr := &indigo.Rule{
-			ID:     fmt.Sprintf("at_risk_%d", i),
-			Expr:   `student.gpa < self.Minimum_GPA && student.status == testdata.school.Student.status_type.PROBATION`,
-			Schema: schema,
-			Self:   &school.HonorsConfiguration{Minimum_GPA: 3.7},
-			Meta:   false,
-		}
-		r.Rules[cr.ID] = cr
+	cases := []struct {
+		typ  indigo.Type
+		name string
+	}{
+		{indigo.String{}, "string"},
+		{indigo.Int{}, "int"},
+		{indigo.Float{}, "double"},
+		{indigo.Bool{}, "bool"},
+		{indigo.Duration{}, "google.protobuf.Duration"},
+		{indigo.Timestamp{}, "google.protobuf.Timestamp"},
+		{indigo.Any{}, "dyn"},
+		{indigo.Proto{Message: &school.Student{}}, "testdata.school.Student"},
+		{indigo.List{ValueType: indigo.Float{}}, "list(double)"},
+		{indigo.Map{KeyType: indigo.String{}, ValueType: indigo.Int{}}, "map(string, int)"},
+		{indigo.Map{
+			KeyType:   indigo.Int{},
+			ValueType: indigo.Map{KeyType: indigo.String{}, ValueType: indigo.List{ValueType: indigo.Proto{Message: &school.Student{}}}},
+		}, "map(int, map(string, list(testdata.school.Student)))"},
 	}
 
-	err = e.Compile(r)
-	if err != nil {
-		log.Fatalf("Error adding ruleset: %v", err)
-	}
+	for _, c := range cases {
+		name, err := cel.CELTypeName(c.typ)
+		is.NoErr(err)
+		is.Equal(name, c.name)
 
-	s := school.Student{
-		Age:            16,
-		Gpa:            3,
-		Status:         school.Student_PROBATION,
-		Grades:         []float64{2.0, 2.0, 3.7},
-		Attrs:          map[string]string{"Nickname": "Joey"},
-		EnrollmentDate: &timestamppb.Timestamp{Seconds: time.Date(2010, 5, 1, 12, 12, 59, 0, time.FixedZone("UTC-8", -8*60*60)).Unix()},
+		typ, err := cel.IndigoTypeFromCEL(name)
+		is.NoErr(err)
+		is.Equal(typ.String(), c.typ.String())
 	}
 
-	data := map[string]interface{}{
-		"student": &s,
-		"now":     &timestamppb.Timestamp{Seconds: time.Now().Unix()},
-	}
-	b.StartTimer()
-	for i := 0; i < b.N; i++ {
-		_, err := e.Eval(context.Background(), r, data)
-		if err != nil {
-			b.Error(err)
-		}
+	// The type checker's names for timestamps and durations
+	typ, err := cel.IndigoTypeFromCEL("map(string, timestamp)")
+	is.NoErr(err)
+	is.Equal(typ, indigo.Map{KeyType: indigo.String{}, ValueType: indigo.Timestamp{}})
 
+	for _, name := range []string{"uint", "bytes", "list(uint)", "map(string)", "testdata.school.Missing", ""} {
+		_, err := cel.IndigoTypeFromCEL(name)
+		is.True(err != nil)
 	}
+
+	_, err = cel.CELTypeName(indigo.Proto{})
+	is.True(err != nil)
 }
 
-func BenchmarkEval2000RulesWithSort(b *testing.B) {
-	b.StopTimer()
-	_, err := pb.DefaultDb.RegisterMessage(&school.Student{})
-	if err != nil {
-		b.Error(err)
-	}
+type tenantKey struct{}
+
+// Test functions reading values from the context passed to Eval
+func TestContextFunction(t *testing.T) {
+	is := is.New(t)
+
+	tenant := cel.ContextFunction("tenant", nil, celgo.StringType,
+		func(ctx context.Context, args ...ref.Val) ref.Val {
+			id, _ := ctx.Value(tenantKey{}).(string)
+			return types.String(id)
+		})
+	qualify := cel.ContextFunction("qualify", []*celgo.Type{celgo.StringType}, celgo.StringType,
+		func(ctx context.Context, args ...ref.Val) ref.Val {
+			id, _ := ctx.Value(tenantKey{}).(string)
+			return types.String(id + "/" + string(args[0].(types.String)))
+		})
 
 	schema := indigo.Schema{
 		Elements: []indigo.DataElement{
 			{Name: "student", Type: indigo.Proto{Message: &school.Student{}}},
-			{Name: "now", Type: indigo.Timestamp{}},
-			{Name: "self", Type: indigo.Proto{Message: &school.HonorsConfiguration{}}},
 		},
 	}
-
-	e := indigo.NewEngine(cel.NewEvaluator())
-
 	r := &indigo.Rule{
-		ID:     "student_actions",
+		ID:     "acme_honors",
 		Schema: schema,
-		Rules:  map[string]*indigo.Rule{},
-	}
-	r.EvalOptions.SortFunc = indigo.SortRulesAlpha // <-- we'll sort all 2000 child rules alphabetically
-
-	for i := 0; i < 2_000; i++ {
-		cr := &indigo.Rule{
-			ID:     fmt.Sprintf("at_risk_%d", i),
-			Expr:   `student.gpa < self.Minimum_GPA && student.status == testdata.school.Student.status_type.PROBATION`,
-			Schema: schema,
-			Self:   &school.HonorsConfiguration{Minimum_GPA: 3.7},
-			Meta:   false,
-		}
-		r.Rules[cr.ID] = cr
-	}
-
-	err = e.Compile(r)
-	if err != nil {
-		log.Fatalf("Error adding ruleset: %v", err)
+		Expr:   `tenant() == "acme" && student.gpa > 3.5`,
+		Rules: map[string]*indigo.Rule{
+			"name": {
+				ID:         "name",
+				Schema:     schema,
+				Expr:       `qualify(student.attrs["Nickname"])`,
+				ResultType: indigo.String{},
+			},
+		},
 	}
 
-	s := school.Student{
-		Age:            16,
-		Gpa:            3,
-		Status:         school.Student_PROBATION,
-		Grades:         []float64{2.0, 2.0, 3.7},
-		Attrs:          map[string]string{"Nickname": "Joey"},
-		EnrollmentDate: &timestamppb.Timestamp{Seconds: time.Date(2010, 5, 1, 12, 12, 59, 0, time.FixedZone("UTC-8", -8*60*60)).Unix()},
-	}
+	e := indigo.NewEngine(cel.NewEvaluator(tenant, qualify))
+	is.NoErr(e.Compile(r))
+	d := makeStudentProtoData()
 
-	data := map[string]interface{}{
-		"student": &s,
-		"now":     &timestamppb.Timestamp{Seconds: time.Now().Unix()},
-	}
-	b.StartTimer()
-	for i := 0; i < b.N; i++ {
-		_, err := e.Eval(context.Background(), r, data)
-		if err != nil {
-			b.Error(err)
-		}
+	acme := context.WithValue(context.Background(), tenantKey{}, "acme")
+	u, err := e.Eval(acme, r, d)
+	is.NoErr(err)
+	is.True(u.ExpressionPass)
+	is.Equal(u.Results["name"].Value, "acme/Joey")
 
-	}
-}
+	other := context.WithValue(context.Background(), tenantKey{}, "other")
+	u, err = e.Eval(other, r, d, indigo.PerRuleTimeout(time.Second))
+	is.NoErr(err)
+	is.True(!u.ExpressionPass)
+	is.Equal(u.Results["name"].Value, "other/Joey")
 
-func BenchmarkCompileRule(b *testing.B) {
-	b.StopTimer()
-	is := is.New(b)
-	e := indigo.NewEngine(cel.NewEvaluator())
-	r := makeEducationProtoRules("rule")
-	b.StartTimer()
-	for i := 1; i < b.N; i++ {
-		err := e.Compile(r)
-		is.NoErr(err)
-	}
-}
+	// Without the engine, the functions get a background context
+	ev := cel.NewEvaluator(tenant)
+	prg, err := ev.Compile(`tenant()`, schema, indigo.String{}, false, false)
+	is.NoErr(err)
+	v, _, err := ev.Evaluate(d, `tenant()`, schema, nil, prg, indigo.String{}, false)
+	is.NoErr(err)
+	is.Equal(v, "")
 
-func BenchmarkCompileRuleWithFixedSchema(b *testing.B) {
-	b.StopTimer()
-	is := is.New(b)
-	r := makeEducationProtoRules("rule")
-	e := indigo.NewEngine(cel.NewEvaluator(cel.FixedSchema(&r.Schema)))
-	b.StartTimer()
-	for i := 1; i < b.N; i++ {
-		err := e.Compile(r)
-		is.NoErr(err)
-	}
+	// The context is not a schema element
+	names, err := e.ReferencedVariables(r)
+	is.NoErr(err)
+	is.Equal(names, []string{"student"})
 }
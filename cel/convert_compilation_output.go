@@ -29,6 +29,11 @@ func doTypesMatch(cel *gexpr.Type, igo indigo.Type) error {
 		return fmt.Errorf("attempt to compare a nil indigo type with a CEL type %T", cel)
 	}
 
+	// Any type is acceptable
+	if _, ok := igo.(indigo.Any); ok {
+		return nil
+	}
+
 	celConverted, err := indigoType(cel)
 	if err != nil {
 		return err
@@ -85,6 +90,12 @@ func indigoType(t *gexpr.Type) (indigo.Type, error) {
 		}, nil
 	case *gexpr.Type_Dyn:
 		return indigo.Any{}, nil
+	case *gexpr.Type_AbstractType_:
+		// Optional values are unwrapped by the evaluator, see OptionalTypes
+		if v.AbstractType.Name == "optional" && len(v.AbstractType.ParameterTypes) == 1 {
+			return indigoType(v.AbstractType.ParameterTypes[0])
+		}
+		return nil, fmt.Errorf("unexpected abstract type %s", v.AbstractType.Name)
 	case *gexpr.Type_Primitive:
 		switch t.GetPrimitive() {
 		case gexpr.Type_BOOL:
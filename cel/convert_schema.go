@@ -14,6 +14,7 @@ import (
 	celgo "github.com/google/cel-go/cel"
 	"github.com/google/cel-go/checker/decls"
 	gexpr "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+	"google.golang.org/protobuf/reflect/protoreflect"
 )
 
 // convertIndigoSchemaToDeclarations converts an Indigo Schema to a list of CEL "EnvOption".
@@ -24,8 +25,11 @@ func convertIndigoSchemaToDeclarations(s indigo.Schema) ([]celgo.EnvOption, erro
 	declarations := []*gexpr.Decl{}
 
 	// for protocol buffer types we also have to register the type separately
-	// we'll collect them in types
+	// we'll collect them in types, and the files declaring the types of their
+	// fields in files
 	types := []interface{}{}
+	files := []interface{}{}
+	seen := map[protoreflect.FullName]bool{}
 
 	for _, d := range s.Elements {
 		typ, err := convertIndigoToExprType(d.Type)
@@ -34,15 +38,20 @@ func convertIndigoSchemaToDeclarations(s indigo.Schema) ([]celgo.EnvOption, erro
 			return nil, fmt.Errorf("converting element %s in schema %s: %v", s.Name, d.Name, err)
 		}
 		declarations = append(declarations, decls.NewVar(d.Name, typ))
+		if d.Alias != "" {
+			declarations = append(declarations, decls.NewVar(d.Alias, typ))
+		}
 
 		if v, ok := d.Type.(indigo.Proto); ok {
 			types = append(types, v.Message)
+			files = append(files, protoFiles(v.Message.ProtoReflect().Descriptor(), seen)...)
 		}
 	}
 
 	opts := []celgo.EnvOption{}
 	opts = append(opts, celgo.Declarations(declarations...))
 	opts = append(opts, celgo.Types(types...))
+	opts = append(opts, celgo.TypeDescs(files...))
 	if len(opts) == 0 {
 		return nil, fmt.Errorf("no valid schema")
 	}
@@ -50,6 +59,34 @@ func convertIndigoSchemaToDeclarations(s indigo.Schema) ([]celgo.EnvOption, erro
 	return opts, nil
 }
 
+// protoFiles returns the files declaring the message types referenced by the
+// fields of the message, including fields in a oneof, list elements and map
+// values, and the types referenced by those messages in turn. CEL only
+// registers the file declaring a message, so without this, expressions
+// selecting fields of messages declared in other files fail.
+//
+// The concrete type of a google.protobuf.Any field is not known until the
+// data is evaluated; use the AnyTypes option to register those types.
+func protoFiles(md protoreflect.MessageDescriptor, seen map[protoreflect.FullName]bool) []interface{} {
+	if seen[md.FullName()] {
+		return nil
+	}
+	seen[md.FullName()] = true
+
+	files := []interface{}{md.ParentFile()}
+	fields := md.Fields()
+	for i := 0; i < fields.Len(); i++ {
+		f := fields.Get(i)
+		if f.IsMap() {
+			f = f.MapValue()
+		}
+		if f.Message() != nil {
+			files = append(files, protoFiles(f.Message(), seen)...)
+		}
+	}
+	return files
+}
+
 // convertIndigoToExprType converts from an indigo type to a expr.Type,
 // which is used by CEL to represent types in its schema.
 func convertIndigoToExprType(t indigo.Type) (*gexpr.Type, error) {
@@ -0,0 +1,170 @@
+package cel
+
+// This file contains functions that suggest changes to the input data that
+// would make a failing rule pass.
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/ezachrisen/indigo"
+	celgo "github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/interpreter"
+	gexpr "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+)
+
+// Counterfactual evaluates the expression and, for each numeric comparison
+// that failed, suggests the value the input would need for the comparison to
+// pass. The result maps the name of the input (such as "student.GPA") to the
+// suggested value.
+//
+// Only comparisons (<, <=, >, >=, ==) between an input value and a numeric
+// constant are considered, and only if they're part of a conjunction (&&) at the
+// top level of the expression. For strict comparisons, the suggested value is
+// the closest value that passes: 1 more or less for ints, and the next
+// representable double for doubles.
+func (e *Evaluator) Counterfactual(data map[string]interface{}, expr string, s indigo.Schema) (map[string]interface{}, error) {
+
+	if expr == "" {
+		return map[string]interface{}{}, nil
+	}
+
+	env, err := e.env(s)
+	if err != nil {
+		return nil, err
+	}
+
+	_, c, err := e.check(env, expr)
+	if err != nil {
+		return nil, err
+	}
+
+	// Exhaustive evaluation ensures that every comparison is evaluated,
+	// even if an earlier one in the conjunction failed
+	prg, err := env.Program(c, celgo.EvalOptions(celgo.OptExhaustiveEval))
+	if err != nil {
+		return nil, fmt.Errorf("generating program: %w", err)
+	}
+
+	sc := e.schema(s)
+	_, details, err := prg.Eval(withAliases(e.withNow(data, sc), sc))
+	if err != nil {
+		return nil, fmt.Errorf("evaluating rule: %w", err)
+	}
+
+	suggestions := map[string]interface{}{}
+	counterfactuals(c.Expr(), details.State(), suggestions)
+	return suggestions, nil
+}
+
+// flipped gives the operator to use if the operands of a comparison are swapped
+var flipped = map[string]string{
+	"_<_":  "_>_",
+	"_<=_": "_>=_",
+	"_>_":  "_<_",
+	"_>=_": "_<=_",
+	"_==_": "_==_",
+}
+
+// counterfactuals walks the conjunctions in the expression, adding a suggested value
+// to the map for every failed comparison between an input and a constant
+func counterfactuals(ex *gexpr.Expr, state interpreter.EvalState, suggestions map[string]interface{}) {
+
+	call := ex.GetCallExpr()
+	if call == nil {
+		return
+	}
+
+	if call.GetFunction() == "_&&_" {
+		for _, a := range call.GetArgs() {
+			counterfactuals(a, state, suggestions)
+		}
+		return
+	}
+
+	op, ok := flipped[call.GetFunction()]
+	if !ok || len(call.GetArgs()) != 2 {
+		return
+	}
+
+	if v, ok := state.Value(ex.GetId()); ok && v == types.True {
+		return
+	}
+
+	input, constant := call.GetArgs()[0], call.GetArgs()[1]
+	if input.GetConstExpr() != nil {
+		input, constant = constant, input
+	} else {
+		op = call.GetFunction()
+	}
+
+	name := inputName(input)
+	if name == "" || constant.GetConstExpr() == nil {
+		return
+	}
+
+	if v, ok := suggestValue(op, constant.GetConstExpr()); ok {
+		suggestions[name] = v
+	}
+}
+
+// inputName returns the name of an identifier or a field selection,
+// such as student.gpa, or blank if the expression is neither.
+func inputName(ex *gexpr.Expr) string {
+	switch x := ex.GetExprKind().(type) {
+	case *gexpr.Expr_IdentExpr:
+		return x.IdentExpr.GetName()
+	case *gexpr.Expr_SelectExpr:
+		operand := inputName(x.SelectExpr.GetOperand())
+		if operand == "" {
+			return ""
+		}
+		return operand + "." + x.SelectExpr.GetField()
+	default:
+		return ""
+	}
+}
+
+// suggestValue returns the value closest to the constant that makes
+// "input op constant" true, or false if there is no such value, as for
+// "x > MaxInt64"
+func suggestValue(op string, c *gexpr.Constant) (interface{}, bool) {
+	switch k := c.GetConstantKind().(type) {
+	case *gexpr.Constant_Int64Value:
+		switch {
+		case op == "_<_" && k.Int64Value > math.MinInt64:
+			return k.Int64Value - 1, true
+		case op == "_>_" && k.Int64Value < math.MaxInt64:
+			return k.Int64Value + 1, true
+		case op == "_<_" || op == "_>_":
+			return nil, false
+		default:
+			return k.Int64Value, true
+		}
+	case *gexpr.Constant_Uint64Value:
+		switch {
+		case op == "_<_" && k.Uint64Value > 0:
+			return k.Uint64Value - 1, true
+		case op == "_<_":
+			return nil, false
+		case op == "_>_" && k.Uint64Value < math.MaxUint64:
+			return k.Uint64Value + 1, true
+		case op == "_>_":
+			return nil, false
+		default:
+			return k.Uint64Value, true
+		}
+	case *gexpr.Constant_DoubleValue:
+		switch op {
+		case "_<_":
+			return math.Nextafter(k.DoubleValue, math.Inf(-1)), true
+		case "_>_":
+			return math.Nextafter(k.DoubleValue, math.Inf(1)), true
+		default:
+			return k.DoubleValue, true
+		}
+	default:
+		return nil, false
+	}
+}
@@ -52,6 +52,7 @@ func printAST(ex *gexpr.Expr, n int, details *celgo.EvalDetails, ast *celgo.Ast,
 		return d, nil
 	}
 
+	d.ID = ex.Id
 	d.Source = indigo.Evaluated
 
 	// value, err := convertRefValToIndigo2(evaluatedValue)
@@ -96,6 +97,10 @@ func printAST(ex *gexpr.Expr, n int, details *celgo.EvalDetails, ast *celgo.Ast,
 			return d, fmt.Errorf("missing select operand")
 		}
 		d.Offset, d.Line, d.Column = getLocation(oper.Id, ast)
+		d.Expr = inputName(ex)
+		if d.Expr == "" {
+			d.Expr = i.SelectExpr.Field
+		}
 		// dottedName := operandName + "." + fieldName
 		// inputValue, ok := data[dottedName]
 
@@ -108,4 +108,21 @@
 //
 //  goDur := protodur.AsDuration()
 //
+// Converting Doubles to Ints
+//
+// CEL does not convert between ints and doubles implicitly; comparing an int field with a double
+// field requires an explicit conversion. CEL's built-in int(double) conversion truncates towards zero,
+// and returns an error if the value does not fit in an int:
+//
+//  int(2.9)   // 2
+//  int(-2.9)  // -2
+//
+// To control rounding explicitly, for example in financial or age calculations, create the
+// evaluator with the RoundingFunctions option:
+//
+//  roundHalfUp(2.5)  // 3
+//  roundHalfUp(-2.5) // -2
+//  truncate(-2.9)    // -2
+//  ceil(2.1)         // 3
+//
 package cel
@@ -193,7 +193,7 @@ func Example_map() {
 }
 
 // Demonstrates using the in operator on lists and maps
-func ExampleIn() {
+func Example_in() {
 
 	schema := indigo.Schema{
 		Elements: []indigo.DataElement{
@@ -357,7 +357,7 @@ func Example_protoOneof() {
 		"student": &school.Student{
 			Status: school.Student_ENROLLED,
 			HousingAddress: &school.Student_OnCampus{
-				&school.Student_CampusAddress{
+				OnCampus: &school.Student_CampusAddress{
 					Building: "Hershey",
 					Room:     "308",
 				},
@@ -0,0 +1,488 @@
+package cel
+
+// This file contains custom functions that can be made available to rule
+// expressions through evaluator options.
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sync"
+	"time"
+
+	celgo "github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common"
+	"github.com/google/cel-go/common/overloads"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	"github.com/google/cel-go/common/types/traits"
+	"github.com/google/cel-go/interpreter"
+	"github.com/google/cel-go/interpreter/functions"
+	"github.com/google/cel-go/parser"
+	gexpr "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+)
+
+// RoundingFunctions adds functions that convert a double to an int with an
+// explicit rounding policy:
+//
+//	roundHalfUp(double) -> int   // rounds to the nearest int; halves round towards positive infinity
+//	truncate(double) -> int      // rounds towards zero
+//	ceil(double) -> int          // rounds towards positive infinity
+//
+// CEL's built-in int(double) conversion truncates towards zero, like truncate.
+// All functions return an error if the value is NaN, infinite, or
+// outside the range of an int.
+func RoundingFunctions() CelOption {
+	return WithExtensions(
+		celgo.Function("roundHalfUp",
+			celgo.Overload("roundHalfUp_double", []*celgo.Type{celgo.DoubleType}, celgo.IntType,
+				celgo.UnaryBinding(roundingBinding(roundHalfUp)))),
+		celgo.Function("truncate",
+			celgo.Overload("truncate_double", []*celgo.Type{celgo.DoubleType}, celgo.IntType,
+				celgo.UnaryBinding(roundingBinding(math.Trunc)))),
+		celgo.Function("ceil",
+			celgo.Overload("ceil_double", []*celgo.Type{celgo.DoubleType}, celgo.IntType,
+				celgo.UnaryBinding(roundingBinding(math.Ceil)))),
+	)
+}
+
+// roundHalfUp rounds to the nearest integer, with halves rounding towards
+// positive infinity. Adding 0.5 before taking the floor is avoided, since the
+// addition itself can round (0.49999999999999994 + 0.5 == 1.0).
+func roundHalfUp(f float64) float64 {
+	fl := math.Floor(f)
+	if f-fl >= 0.5 {
+		return fl + 1
+	}
+	return fl
+}
+
+// roundingBinding returns a CEL function binding that rounds a double with
+// the rounding function and converts the result to an int
+func roundingBinding(round func(float64) float64) func(ref.Val) ref.Val {
+	return func(v ref.Val) ref.Val {
+		d, ok := v.(types.Double)
+		if !ok {
+			return types.MaybeNoSuchOverloadErr(v)
+		}
+		f := round(float64(d))
+		// -2^63 is the smallest int; 2^63 is one more than the largest
+		if math.IsNaN(f) || f < -9223372036854775808.0 || f >= 9223372036854775808.0 {
+			return types.NewErr("int overflow converting %v", float64(d))
+		}
+		return types.Int(f)
+	}
+}
+
+// SetOperations adds functions that treat lists as sets:
+//
+//	intersects(list(T), list(T)) -> bool  // true if any element of the first list is in the second
+//	subset(list(T), list(T)) -> bool      // true if every element of the first list is in the second
+//	unique(list(T)) -> bool               // true if no element appears more than once
+//
+// The lists must have elements of the same type, such as two lists of
+// strings; the type checker rejects lists of different types. Elements are
+// compared with CEL equality (==), so numbers of different types, in lists
+// of dyn, are equal if they have the same value. An empty list intersects no list, is a
+// subset of every list, and is unique.
+func SetOperations() CelOption {
+	t := celgo.TypeParamType("T")
+	list := celgo.ListType(t)
+	return WithExtensions(
+		celgo.Function("intersects",
+			celgo.Overload("intersects_list_list", []*celgo.Type{list, list}, celgo.BoolType,
+				celgo.BinaryBinding(intersects))),
+		celgo.Function("subset",
+			celgo.Overload("subset_list_list", []*celgo.Type{list, list}, celgo.BoolType,
+				celgo.BinaryBinding(subset))),
+		celgo.Function("unique",
+			celgo.Overload("unique_list", []*celgo.Type{list}, celgo.BoolType,
+				celgo.UnaryBinding(unique))),
+	)
+}
+
+// intersects reports whether any element of a is in b
+func intersects(a, b ref.Val) ref.Val {
+	la, ok := a.(traits.Lister)
+	if !ok {
+		return types.MaybeNoSuchOverloadErr(a)
+	}
+	lb, ok := b.(traits.Lister)
+	if !ok {
+		return types.MaybeNoSuchOverloadErr(b)
+	}
+	set := newValueSet(lb)
+	for it := la.Iterator(); it.HasNext() == types.True; {
+		if set.contains(it.Next()) {
+			return types.True
+		}
+	}
+	return types.False
+}
+
+// subset reports whether every element of a is in b
+func subset(a, b ref.Val) ref.Val {
+	la, ok := a.(traits.Lister)
+	if !ok {
+		return types.MaybeNoSuchOverloadErr(a)
+	}
+	lb, ok := b.(traits.Lister)
+	if !ok {
+		return types.MaybeNoSuchOverloadErr(b)
+	}
+	set := newValueSet(lb)
+	for it := la.Iterator(); it.HasNext() == types.True; {
+		if !set.contains(it.Next()) {
+			return types.False
+		}
+	}
+	return types.True
+}
+
+// unique reports whether no element of the list appears more than once
+func unique(v ref.Val) ref.Val {
+	l, ok := v.(traits.Lister)
+	if !ok {
+		return types.MaybeNoSuchOverloadErr(v)
+	}
+	set := valueSet{keys: map[interface{}]bool{}}
+	for it := l.Iterator(); it.HasNext() == types.True; {
+		el := it.Next()
+		if set.contains(el) {
+			return types.False
+		}
+		set.add(el)
+	}
+	return types.True
+}
+
+// valueSet is a set of CEL values. Strings, ints, uints, doubles and bools
+// are looked up in a map; other values, such as lists and messages, are
+// compared one by one with CEL equality.
+type valueSet struct {
+	keys   map[interface{}]bool
+	others []ref.Val
+}
+
+// newValueSet returns a set of the elements of the list
+func newValueSet(l traits.Lister) valueSet {
+	s := valueSet{keys: map[interface{}]bool{}}
+	for it := l.Iterator(); it.HasNext() == types.True; {
+		s.add(it.Next())
+	}
+	return s
+}
+
+func (s *valueSet) add(v ref.Val) {
+	if k, ok := setKey(v); ok {
+		s.keys[k] = true
+		return
+	}
+	s.others = append(s.others, v)
+}
+
+func (s *valueSet) contains(v ref.Val) bool {
+	if k, ok := setKey(v); ok {
+		return s.keys[k]
+	}
+	for _, o := range s.others {
+		if o.Equal(v) == types.True {
+			return true
+		}
+	}
+	return false
+}
+
+// setKey returns the key to use for the value in a valueSet's map, and
+// whether the value can be looked up in the map.
+//
+// CEL considers numbers of different types equal if they have the same
+// value, such as 1, 1u and 1.0, so numbers are keyed by their value: as an
+// int64 if they are whole numbers in its range, as a uint64 if they are
+// whole numbers above it, and as a float64 otherwise. CEL converts ints to
+// doubles to compare them, so ints beyond 2^53 may equal a double that is
+// not exactly the same number; those are keyed by their exact value.
+func setKey(v ref.Val) (interface{}, bool) {
+	switch k := v.Value().(type) {
+	case string, int64, bool:
+		return k, true
+	case uint64:
+		if k <= math.MaxInt64 {
+			return int64(k), true
+		}
+		return k, true
+	case float64:
+		if k == math.Trunc(k) {
+			// -2^63 is the smallest int; 2^63 is one more than the largest,
+			// and 2^64 one more than the largest uint
+			switch {
+			case k >= -9223372036854775808.0 && k < 9223372036854775808.0:
+				return int64(k), true
+			case k >= 0 && k < 18446744073709551616.0:
+				return uint64(k), true
+			}
+		}
+		return k, true
+	default:
+		return nil, false
+	}
+}
+
+// DefaultTimeZone sets the time zone used by the timestamp functions
+// getFullYear, getMonth, getDayOfYear, getDayOfMonth, getDate, getDayOfWeek,
+// getHours, getMinutes, getSeconds and getMilliseconds when the expression
+// does not specify a time zone. Without this option, CEL uses UTC.
+//
+// A time zone given in the expression, such as
+// student.enrollment_date.getDayOfWeek("America/New_York"), takes precedence.
+// The default only applies where the type checker knows the value is a
+// timestamp; values of type dyn use UTC.
+func DefaultTimeZone(loc *time.Location) CelOption {
+	return WithExtensions(celgo.Lib(timeZoneLib{loc: loc}))
+}
+
+// timeZoneLib replaces the implementations of the timestamp functions without
+// a time zone argument with ones that use the time zone
+type timeZoneLib struct {
+	loc *time.Location
+}
+
+func (timeZoneLib) CompileOptions() []celgo.EnvOption {
+	return nil
+}
+
+func (l timeZoneLib) ProgramOptions() []celgo.ProgramOption {
+	parts := map[string]func(time.Time) int{
+		overloads.TimestampToYear:                func(t time.Time) int { return t.Year() },
+		overloads.TimestampToMonth:               func(t time.Time) int { return int(t.Month()) - 1 },
+		overloads.TimestampToDayOfYear:           func(t time.Time) int { return t.YearDay() - 1 },
+		overloads.TimestampToDayOfMonthZeroBased: func(t time.Time) int { return t.Day() - 1 },
+		overloads.TimestampToDayOfMonthOneBased:  func(t time.Time) int { return t.Day() },
+		overloads.TimestampToDayOfWeek:           func(t time.Time) int { return int(t.Weekday()) },
+		overloads.TimestampToHours:               func(t time.Time) int { return t.Hour() },
+		overloads.TimestampToMinutes:             func(t time.Time) int { return t.Minute() },
+		overloads.TimestampToSeconds:             func(t time.Time) int { return t.Second() },
+		overloads.TimestampToMilliseconds:        func(t time.Time) int { return t.Nanosecond() / 1000000 },
+	}
+
+	fns := make([]*functions.Overload, 0, len(parts))
+	for id, part := range parts {
+		part := part
+		fns = append(fns, &functions.Overload{
+			Operator: id,
+			Unary: func(v ref.Val) ref.Val {
+				ts, ok := v.(types.Timestamp)
+				if !ok {
+					return types.MaybeNoSuchOverloadErr(v)
+				}
+				return types.Int(part(ts.Time.In(l.loc)))
+			},
+		})
+	}
+	return []celgo.ProgramOption{celgo.Functions(fns...)}
+}
+
+// RegexExtensions adds a function that extracts a named group from the first
+// match of a regular expression:
+//
+//	capture(string, string, string) -> string  // capture(input, regex, groupName)
+//
+// For example, capture(email, "@(?P<domain>.+)$", "domain") is the domain of
+// an email address. The result is "" if the input doesn't match. The regex
+// uses Go's regexp syntax, like CEL's matches function.
+//
+// A regex given as a string literal is compiled once, when the expression is
+// compiled, and an invalid regex or a missing group is a compilation error.
+// Other regexes are compiled when the expression is evaluated, and cached by
+// pattern; an invalid regex is then an evaluation error.
+func RegexExtensions() CelOption {
+	cache := &regexCache{regexes: map[string]*regexp.Regexp{}}
+	return func(e *Evaluator) {
+		WithExtensions(
+			celgo.Function("capture",
+				celgo.Overload("capture_string_string_string",
+					[]*celgo.Type{celgo.StringType, celgo.StringType, celgo.StringType}, celgo.StringType,
+					celgo.FunctionBinding(func(args ...ref.Val) ref.Val {
+						pattern, ok := args[1].(types.String)
+						if !ok {
+							return types.MaybeNoSuchOverloadErr(args[1])
+						}
+						re, err := cache.compile(string(pattern))
+						if err != nil {
+							return types.NewErr("capture: %v", err)
+						}
+						return capture(re, args[0], args[2])
+					}))),
+		)(e)
+		e.programOptions = append(e.programOptions, celgo.CustomDecorator(
+			interpreter.CompileRegexConstants(&interpreter.RegexOptimization{
+				Function:   "capture",
+				RegexIndex: 1,
+				Factory: func(call interpreter.InterpretableCall, pattern string) (interpreter.InterpretableCall, error) {
+					re, err := cache.compile(pattern)
+					if err != nil {
+						return nil, fmt.Errorf("capture: %w", err)
+					}
+					// A literal group name can be checked now as well
+					if g, ok := call.Args()[2].(interpreter.InterpretableConst); ok {
+						if name, ok := g.Value().(types.String); ok && re.SubexpIndex(string(name)) < 0 {
+							return nil, fmt.Errorf("capture: regex %q has no group named %q", pattern, string(name))
+						}
+					}
+					return interpreter.NewCall(call.ID(), call.Function(), call.OverloadID(), call.Args(),
+						func(args ...ref.Val) ref.Val {
+							return capture(re, args[0], args[2])
+						}), nil
+				},
+			})))
+	}
+}
+
+// capture returns the named group of the first match of the regex in the
+// input, or "" if the input doesn't match
+func capture(re *regexp.Regexp, input, group ref.Val) ref.Val {
+	in, ok := input.(types.String)
+	if !ok {
+		return types.MaybeNoSuchOverloadErr(input)
+	}
+	name, ok := group.(types.String)
+	if !ok {
+		return types.MaybeNoSuchOverloadErr(group)
+	}
+	i := re.SubexpIndex(string(name))
+	if i < 0 {
+		return types.NewErr("capture: regex %q has no group named %q", re.String(), string(name))
+	}
+	m := re.FindStringSubmatch(string(in))
+	if m == nil {
+		return types.String("")
+	}
+	return types.String(m[i])
+}
+
+// maxCachedRegexes is the number of compiled regexes a regexCache holds
+// before it is emptied
+const maxCachedRegexes = 1000
+
+// regexCache holds compiled regexes by pattern. It is safe for concurrent use.
+type regexCache struct {
+	mu      sync.Mutex
+	regexes map[string]*regexp.Regexp
+}
+
+// compile returns the compiled regex for the pattern, compiling it if it's
+// not in the cache
+func (c *regexCache) compile(pattern string) (*regexp.Regexp, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if re, ok := c.regexes[pattern]; ok {
+		return re, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if len(c.regexes) >= maxCachedRegexes {
+		c.regexes = map[string]*regexp.Regexp{}
+	}
+	c.regexes[pattern] = re
+	return re, nil
+}
+
+// contextVar is the hidden variable holding the context passed to the
+// functions added with ContextFunction
+const contextVar = "__indigo_context__"
+
+// ContextFunction adds a function that receives the context passed to
+// indigo.Engine.Eval, so it can read request-scoped values that are not part
+// of the rule data, such as a tenant ID or a trace ID. The function is called
+// in expressions with the argument types, as name(arg1, arg2, ...), and must
+// return a value of the result type. For example:
+//
+//	cel.ContextFunction("tenant", nil, celgo.StringType,
+//		func(ctx context.Context, args ...ref.Val) ref.Val {
+//			id, _ := ctx.Value(tenantKey{}).(string)
+//			return types.String(id)
+//		})
+//
+// The context is that of the Eval call; functions evaluated with the
+// indigo.PartialEval option, or called directly through Evaluate, get a
+// background context. The function may be called concurrently, from the
+// goroutines of different Eval calls and of parallel evaluation, each with
+// its own context, so it must be safe for concurrent use. With the
+// indigo.PerRuleTimeout option, the function may still be running after Eval
+// has returned; the context is cancelled when the timeout expires.
+// Results cached by indigo.WithResultCache don't depend on the context, so
+// don't use the cache with functions whose results do.
+func ContextFunction(name string, argTypes []*celgo.Type, resultType *celgo.Type,
+	fn func(ctx context.Context, args ...ref.Val) ref.Val) CelOption {
+	return func(e *Evaluator) {
+		if !e.contextFunctions {
+			e.envOptions = append(e.envOptions, celgo.Variable(contextVar, celgo.DynType))
+			e.contextFunctions = true
+		}
+
+		// The expression calls name(args); the macro adds the context as the
+		// first argument
+		expand := func(eh parser.ExprHelper, _ *gexpr.Expr, args []*gexpr.Expr) (*gexpr.Expr, *common.Error) {
+			return eh.GlobalCall(name, append([]*gexpr.Expr{eh.Ident(contextVar)}, args...)...), nil
+		}
+
+		e.envOptions = append(e.envOptions,
+			celgo.Macros(parser.NewGlobalMacro(name, len(argTypes), expand)),
+			celgo.Function(name,
+				celgo.Overload(name+"_context", append([]*celgo.Type{celgo.DynType}, argTypes...), resultType,
+					celgo.FunctionBinding(func(args ...ref.Val) ref.Val {
+						c, ok := args[0].(contextValue)
+						if !ok {
+							return types.NewErr("%s: no context", name)
+						}
+						return fn(c.ctx, args[1:]...)
+					}))))
+	}
+}
+
+// withContext returns the data with the context under the variable read by
+// the functions added with ContextFunction, if there are any
+func (e *Evaluator) withContext(ctx context.Context, data map[string]interface{}) map[string]interface{} {
+	if !e.contextFunctions {
+		return data
+	}
+	withContext := make(map[string]interface{}, len(data)+1)
+	for k, v := range data {
+		withContext[k] = v
+	}
+	withContext[contextVar] = contextValue{ctx: ctx}
+	return withContext
+}
+
+// contextType is the CEL type of the context passed to ContextFunction functions
+var contextType = types.NewTypeValue("indigo.context")
+
+// contextValue is the CEL value of the context passed to ContextFunction
+// functions. It can't be converted or compared.
+type contextValue struct {
+	ctx context.Context
+}
+
+func (c contextValue) ConvertToNative(typeDesc reflect.Type) (interface{}, error) {
+	return nil, fmt.Errorf("context can't be converted to %v", typeDesc)
+}
+
+func (c contextValue) ConvertToType(typeVal ref.Type) ref.Val {
+	return types.NewErr("context can't be converted to %v", typeVal)
+}
+
+func (c contextValue) Equal(other ref.Val) ref.Val {
+	return types.MaybeNoSuchOverloadErr(other)
+}
+
+func (c contextValue) Type() ref.Type {
+	return contextType
+}
+
+func (c contextValue) Value() interface{} {
+	return c.ctx
+}
@@ -0,0 +1,109 @@
+package cel
+
+// This file contains functions that inspect a compiled CEL expression, giving
+// the Indigo user information about the expression without evaluating it.
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/ezachrisen/indigo"
+	celgo "github.com/google/cel-go/cel"
+)
+
+// ReferencedVariables compiles the expression and returns the sorted names of
+// the schema elements the expression refers to. Names that are not in the
+// schema, such as functions, enum constants and comprehension variables, are
+// not included. If the FixedSchema or FixedSchemas option is set, names are
+// checked against the evaluator's schema.
+func (e *Evaluator) ReferencedVariables(expr string, s indigo.Schema) ([]string, error) {
+
+	if expr == "" {
+		return nil, nil
+	}
+
+	env, err := e.env(s)
+	if err != nil {
+		return nil, err
+	}
+
+	_, c, err := e.check(env, expr)
+	if err != nil {
+		return nil, err
+	}
+
+	checked, err := celgo.AstToCheckedExpr(c)
+	if err != nil {
+		return nil, fmt.Errorf("converting checked AST: %w", err)
+	}
+
+	s = e.schema(s)
+
+	// Aliases are reported under the element's name
+	declared := make(map[string]string, len(s.Elements))
+	for _, d := range s.Elements {
+		declared[d.Name] = d.Name
+		if d.Alias != "" {
+			declared[d.Alias] = d.Name
+		}
+	}
+
+	// The reference map contains one entry per identifier resolved by
+	// the type checker, including identifiers inside comprehensions.
+	found := map[string]bool{}
+	for _, ref := range checked.GetReferenceMap() {
+		if n, ok := declared[ref.GetName()]; ok {
+			found[n] = true
+		}
+	}
+
+	names := make([]string, 0, len(found))
+	for n := range found {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// EvaluateSubexpression evaluates the expression and returns the value of the
+// sub-expression with the CEL expression ID. If the expression was compiled
+// with diagnostics, the compiled program is reused; otherwise the expression is
+// compiled again with evaluation state tracking turned on.
+func (e *Evaluator) EvaluateSubexpression(data map[string]interface{}, expr string, s indigo.Schema,
+	evalData interface{}, id int64) (interface{}, error) {
+
+	if expr == "" {
+		return nil, fmt.Errorf("expression is empty")
+	}
+
+	// The AST is only stored if the program tracks evaluation state
+	program, ok := evalData.(celProgram)
+	if !ok || program.ast == nil {
+		env, err := e.env(s)
+		if err != nil {
+			return nil, err
+		}
+		_, c, err := e.check(env, expr)
+		if err != nil {
+			return nil, err
+		}
+		program.program, err = env.Program(c, celgo.EvalOptions(celgo.OptTrackState))
+		if err != nil {
+			return nil, fmt.Errorf("generating program: %w", err)
+		}
+	}
+
+	_, details, err := program.program.Eval(withAliases(data, e.schema(s)))
+
+	// Sub-expressions evaluated before an error are still available
+	if details != nil && details.State() != nil {
+		if v, ok := details.State().Value(id); ok {
+			return v.Value(), nil
+		}
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("evaluating rule: %w", err)
+	}
+	return nil, fmt.Errorf("sub-expression %d was not evaluated", id)
+}
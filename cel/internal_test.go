@@ -1,12 +1,15 @@
 package cel
 
 import (
+	"math"
 	"testing"
 
 	"github.com/ezachrisen/indigo"
+	"github.com/ezachrisen/indigo/testdata/school"
 	celgo "github.com/google/cel-go/cel"
 	"github.com/matryer/is"
 	gexpr "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+	"google.golang.org/protobuf/reflect/protoreflect"
 )
 
 // Test converting between CEL and Indigo types, and whether expected
@@ -268,3 +271,49 @@ func TestNils(t *testing.T) {
 	is.True(err != nil)
 
 }
+
+// Test that the files declaring the messages of a message's fields are
+// collected
+func TestProtoFiles(t *testing.T) {
+	is := is.New(t)
+
+	seen := map[protoreflect.FullName]bool{}
+	files := protoFiles((&school.Student{}).ProtoReflect().Descriptor(), seen)
+
+	paths := map[string]int{}
+	for _, f := range files {
+		paths[f.(protoreflect.FileDescriptor).Path()]++
+	}
+	is.True(paths["student.proto"] > 0)
+	is.True(paths["google/protobuf/timestamp.proto"] > 0) // Student.enrollment_date
+	is.True(seen["testdata.school.Student.Suspension"])   // a nested message used by a field
+
+	// Messages already seen are skipped
+	is.Equal(len(protoFiles((&school.Student{}).ProtoReflect().Descriptor(), seen)), 0)
+}
+
+// Test that no value is suggested for comparisons that no value passes,
+// rather than one that wrapped around
+func TestSuggestValue(t *testing.T) {
+	is := is.New(t)
+
+	cases := []struct {
+		op   string
+		c    *gexpr.Constant
+		want interface{}
+		ok   bool
+	}{
+		{"_>_", &gexpr.Constant{ConstantKind: &gexpr.Constant_Int64Value{Int64Value: 1}}, int64(2), true},
+		{"_>_", &gexpr.Constant{ConstantKind: &gexpr.Constant_Int64Value{Int64Value: math.MaxInt64}}, nil, false},
+		{"_<_", &gexpr.Constant{ConstantKind: &gexpr.Constant_Int64Value{Int64Value: math.MinInt64}}, nil, false},
+		{"_>=_", &gexpr.Constant{ConstantKind: &gexpr.Constant_Int64Value{Int64Value: math.MaxInt64}}, int64(math.MaxInt64), true},
+		{"_>_", &gexpr.Constant{ConstantKind: &gexpr.Constant_Uint64Value{Uint64Value: 1}}, uint64(2), true},
+		{"_>_", &gexpr.Constant{ConstantKind: &gexpr.Constant_Uint64Value{Uint64Value: math.MaxUint64}}, nil, false},
+		{"_<_", &gexpr.Constant{ConstantKind: &gexpr.Constant_Uint64Value{Uint64Value: 0}}, nil, false},
+	}
+	for _, c := range cases {
+		v, ok := suggestValue(c.op, c.c)
+		is.Equal(ok, c.ok)
+		is.Equal(v, c.want)
+	}
+}
@@ -0,0 +1,66 @@
+package cel
+
+// This file contains the type provider used by the RequireSetFields option.
+
+import (
+	"fmt"
+
+	celgo "github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+)
+
+// unsetField starts the error message for selecting an unset field. CEL
+// doesn't keep wrapped errors, so the evaluator recognizes the error by the
+// message; see missingData.
+const unsetField = "unset field"
+
+// presenceTypeProvider returns an environment option that replaces the
+// environment's type provider with a presenceRegistry. Each environment gets
+// its own registry.
+func presenceTypeProvider() celgo.EnvOption {
+	return func(env *celgo.Env) (*celgo.Env, error) {
+		reg, err := types.NewRegistry()
+		if err != nil {
+			return nil, err
+		}
+		env, err = celgo.CustomTypeAdapter(reg)(env)
+		if err != nil {
+			return nil, err
+		}
+		return celgo.CustomTypeProvider(&presenceRegistry{TypeRegistry: reg})(env)
+	}
+}
+
+// presenceRegistry is a type registry whose protocol buffer fields return an
+// error when selected, if they are not set
+type presenceRegistry struct {
+	ref.TypeRegistry
+}
+
+// FindFieldType returns the field type from the registry, with a getter that
+// fails if the field is not set. The presence test, used by has(), is
+// unchanged.
+func (p *presenceRegistry) FindFieldType(messageType, fieldName string) (*ref.FieldType, bool) {
+	ft, found := p.TypeRegistry.FindFieldType(messageType, fieldName)
+	if !found || ft.IsSet == nil || ft.GetFrom == nil {
+		return ft, found
+	}
+
+	isSet, getFrom := ft.IsSet, ft.GetFrom
+	return &ref.FieldType{
+		Type:  ft.Type,
+		IsSet: isSet,
+		GetFrom: func(target any) (any, error) {
+			if !isSet(target) {
+				return nil, fmt.Errorf("%s %s of %s", unsetField, fieldName, messageType)
+			}
+			return getFrom(target)
+		},
+	}, true
+}
+
+// Copy returns a copy of the registry that also checks field presence
+func (p *presenceRegistry) Copy() ref.TypeRegistry {
+	return &presenceRegistry{TypeRegistry: p.TypeRegistry.Copy()}
+}
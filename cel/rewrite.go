@@ -0,0 +1,122 @@
+package cel
+
+// This file contains functions that rewrite rule expressions, to help migrate
+// stored rules when functions or fields are renamed.
+
+import (
+	"fmt"
+
+	"github.com/ezachrisen/indigo"
+	celgo "github.com/google/cel-go/cel"
+	gexpr "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+)
+
+// RewriteKind is the kind of change made by a RewriteRule
+type RewriteKind int
+
+const (
+	// RenameFunction renames calls to a function, including receiver-style
+	// calls such as x.from()
+	RenameFunction RewriteKind = iota
+
+	// RenameField renames selections of a field, such as student.from
+	RenameField
+)
+
+// RewriteRule describes a change to make to an expression.
+type RewriteRule struct {
+	Kind RewriteKind
+	From string // the name of the function or field to rename
+	To   string // the new name
+}
+
+// Rewrite parses the expression, applies the rewrite rules, and returns the
+// rewritten expression. The expression is not type-checked, so it may refer
+// to functions and fields that no longer exist; use Rewrite to migrate
+// stored rules before compiling them.
+//
+// The rewritten expression is produced from the parsed expression, so
+// formatting, such as whitespace and redundant parentheses, is not preserved.
+func (e *Evaluator) Rewrite(expr string, rules []RewriteRule) (string, error) {
+
+	if expr == "" {
+		return "", nil
+	}
+
+	// Macro call tracking lets the unparser print macros as written,
+	// instead of the comprehensions they expand to
+	opts := append([]celgo.EnvOption{celgo.EnableMacroCallTracking()}, e.envOptions...)
+	env, err := celEnv(indigo.Schema{}, false, opts...)
+	if err != nil {
+		return "", err
+	}
+
+	ast, iss := env.Parse(expr)
+	if iss != nil && iss.Err() != nil {
+		return "", issuesError("parsing rule", iss)
+	}
+
+	for _, r := range rules {
+		if r.From == "" || r.To == "" {
+			return "", fmt.Errorf("rewrite rule %v: from and to are required", r)
+		}
+	}
+
+	rewrite(ast.Expr(), rules)
+	// Macros, such as all() and exists(), are printed from the macro call
+	// recorded in the source info, so they must be rewritten too
+	for _, m := range ast.SourceInfo().GetMacroCalls() {
+		rewrite(m, rules)
+	}
+
+	out, err := celgo.AstToString(ast)
+	if err != nil {
+		return "", fmt.Errorf("unparsing rule: %w", err)
+	}
+	return out, nil
+}
+
+// rewrite applies the rewrite rules to the expression and its sub-expressions
+func rewrite(ex *gexpr.Expr, rules []RewriteRule) {
+	if ex == nil {
+		return
+	}
+
+	switch x := ex.GetExprKind().(type) {
+	case *gexpr.Expr_CallExpr:
+		for _, r := range rules {
+			if r.Kind == RenameFunction && x.CallExpr.GetFunction() == r.From {
+				x.CallExpr.Function = r.To
+				break
+			}
+		}
+		rewrite(x.CallExpr.GetTarget(), rules)
+		for _, a := range x.CallExpr.GetArgs() {
+			rewrite(a, rules)
+		}
+	case *gexpr.Expr_SelectExpr:
+		for _, r := range rules {
+			if r.Kind == RenameField && x.SelectExpr.GetField() == r.From {
+				x.SelectExpr.Field = r.To
+				break
+			}
+		}
+		rewrite(x.SelectExpr.GetOperand(), rules)
+	case *gexpr.Expr_ListExpr:
+		for _, el := range x.ListExpr.GetElements() {
+			rewrite(el, rules)
+		}
+	case *gexpr.Expr_StructExpr:
+		for _, en := range x.StructExpr.GetEntries() {
+			rewrite(en.GetMapKey(), rules)
+			rewrite(en.GetValue(), rules)
+		}
+	case *gexpr.Expr_ComprehensionExpr:
+		c := x.ComprehensionExpr
+		rewrite(c.GetIterRange(), rules)
+		rewrite(c.GetAccuInit(), rules)
+		rewrite(c.GetLoopCondition(), rules)
+		rewrite(c.GetLoopStep(), rules)
+		rewrite(c.GetResult(), rules)
+	}
+}
@@ -0,0 +1,134 @@
+package cel
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/ezachrisen/indigo"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// maxSuggestionDistance is the largest number of edits, ignoring case,
+// between a misspelled name and a name suggested in its place
+const maxSuggestionDistance = 2
+
+var (
+	undeclaredReference = regexp.MustCompile(`^undeclared reference to '([^']+)'`)
+	undefinedField      = regexp.MustCompile(`^undefined field '([^']+)'`)
+)
+
+// withSuggestions adds "did you mean X?" to the issues in err reporting an
+// undeclared variable or an undefined proto field, if a schema element or a
+// field of a proto message in the schema has a similar name. Other errors are
+// returned unchanged.
+func withSuggestions(err error, s indigo.Schema) error {
+	var ie *indigo.IssuesError
+	if !errors.As(err, &ie) {
+		return err
+	}
+
+	vars := make([]string, 0, len(s.Elements))
+	for _, el := range s.Elements {
+		vars = append(vars, el.Name)
+		if el.Alias != "" {
+			vars = append(vars, el.Alias)
+		}
+	}
+	fields := schemaFields(s)
+
+	x := &indigo.IssuesError{
+		Stage:  ie.Stage,
+		Issues: make([]indigo.Issue, len(ie.Issues)),
+	}
+	for n, i := range ie.Issues {
+		var suggestion string
+		if m := undeclaredReference.FindStringSubmatch(i.Message); m != nil {
+			suggestion = closest(m[1], vars)
+		} else if m := undefinedField.FindStringSubmatch(i.Message); m != nil {
+			suggestion = closest(m[1], fields)
+		}
+		if suggestion != "" {
+			i.Message = fmt.Sprintf("%s; did you mean %s?", i.Message, suggestion)
+		}
+		x.Issues[n] = i
+	}
+	return x
+}
+
+// schemaFields returns the names of the fields of the proto messages in the
+// schema, including the fields of nested messages, in sorted order
+func schemaFields(s indigo.Schema) []string {
+	names := map[string]bool{}
+	seen := map[protoreflect.FullName]bool{}
+	var walk func(md protoreflect.MessageDescriptor)
+	walk = func(md protoreflect.MessageDescriptor) {
+		if seen[md.FullName()] {
+			return
+		}
+		seen[md.FullName()] = true
+		fds := md.Fields()
+		for i := 0; i < fds.Len(); i++ {
+			fd := fds.Get(i)
+			names[string(fd.Name())] = true
+			if fd.Message() != nil {
+				walk(fd.Message())
+			}
+		}
+	}
+
+	for _, el := range s.Elements {
+		if p, ok := el.Type.(indigo.Proto); ok && p.Message != nil {
+			walk(p.Message.ProtoReflect().Descriptor())
+		}
+	}
+
+	list := make([]string, 0, len(names))
+	for n := range names {
+		list = append(list, n)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// closest returns the candidate closest to name, ignoring case, or "" if
+// none is within maxSuggestionDistance edits. Ties go to the candidate that
+// sorts first.
+func closest(name string, candidates []string) string {
+	best, bestDist := "", maxSuggestionDistance+1
+	for _, c := range candidates {
+		if c == name {
+			continue
+		}
+		d := levenshtein(strings.ToLower(name), strings.ToLower(c))
+		if d < bestDist || (d == bestDist && c < best) {
+			best, bestDist = c, d
+		}
+	}
+	return best
+}
+
+// levenshtein returns the number of single-character insertions, deletions
+// and substitutions needed to change a into b
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(rb)]
+}
@@ -0,0 +1,37 @@
+package cel
+
+import (
+	"time"
+
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Time converts a Go time to a protocol buffer timestamp, for use in the data
+// passed to Eval or in proto messages:
+//
+//	data := map[string]interface{}{
+//		"now": cel.Time(time.Now()),
+//	}
+//
+// The time zone is not kept; timestamps are in UTC.
+func Time(t time.Time) *timestamppb.Timestamp {
+	return timestamppb.New(t)
+}
+
+// Dur converts a Go duration to a protocol buffer duration
+func Dur(d time.Duration) *durationpb.Duration {
+	return durationpb.New(d)
+}
+
+// GoTime converts a protocol buffer timestamp, such as a timestamp field of a
+// message, to a Go time in UTC. A nil timestamp is the Unix epoch.
+func GoTime(ts *timestamppb.Timestamp) time.Time {
+	return ts.AsTime()
+}
+
+// GoDur converts a protocol buffer duration to a Go duration. A nil duration
+// is 0; durations outside the range of time.Duration are clamped to it.
+func GoDur(d *durationpb.Duration) time.Duration {
+	return d.AsDuration()
+}
@@ -0,0 +1,145 @@
+package cel
+
+// This file contains functions that convert between indigo.Type values and
+// the names CEL uses for types, such as double and list(string).
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ezachrisen/indigo"
+)
+
+// CELTypeName returns the name CEL uses for the type that the evaluator
+// declares for the Indigo type: int, double, string, bool,
+// google.protobuf.Timestamp, google.protobuf.Duration, dyn for indigo.Any,
+// list(T), map(K, V) and the full name of protocol buffer messages, such as
+// testdata.school.Student. These are the names returned by CEL's type()
+// function.
+func CELTypeName(t indigo.Type) (string, error) {
+	switch v := t.(type) {
+	case indigo.String:
+		return "string", nil
+	case indigo.Int:
+		return "int", nil
+	case indigo.Float:
+		return "double", nil
+	case indigo.Bool:
+		return "bool", nil
+	case indigo.Duration:
+		return "google.protobuf.Duration", nil
+	case indigo.Timestamp:
+		return "google.protobuf.Timestamp", nil
+	case indigo.Any:
+		return "dyn", nil
+	case indigo.List:
+		val, err := CELTypeName(v.ValueType)
+		if err != nil {
+			return "", fmt.Errorf("value of %v list: %w", v.ValueType, err)
+		}
+		return "list(" + val + ")", nil
+	case indigo.Map:
+		key, err := CELTypeName(v.KeyType)
+		if err != nil {
+			return "", fmt.Errorf("key of %v map: %w", v.KeyType, err)
+		}
+		val, err := CELTypeName(v.ValueType)
+		if err != nil {
+			return "", fmt.Errorf("value of %v map: %w", v.ValueType, err)
+		}
+		return "map(" + key + ", " + val + ")", nil
+	case indigo.Proto:
+		n, err := v.ProtoFullName()
+		if err != nil {
+			return "", err
+		}
+		return n, nil
+	default:
+		return "", fmt.Errorf("unknown indigo type %s", t)
+	}
+}
+
+// IndigoTypeFromCEL returns the Indigo type for the CEL type name, the
+// inverse of CELTypeName. The short names CEL's type checker uses for
+// timestamps and durations, timestamp and duration, are also accepted.
+// Protocol buffer messages must be in the global protocol buffer registry.
+// CEL types without an Indigo equivalent, such as uint and bytes, are errors.
+func IndigoTypeFromCEL(name string) (indigo.Type, error) {
+	name = strings.TrimSpace(name)
+
+	if inner, ok := typeParams(name, "list"); ok {
+		val, err := IndigoTypeFromCEL(inner)
+		if err != nil {
+			return nil, fmt.Errorf("value of %s: %w", name, err)
+		}
+		return indigo.List{ValueType: val}, nil
+	}
+
+	if inner, ok := typeParams(name, "map"); ok {
+		k, v, ok := splitTypeParams(inner)
+		if !ok {
+			return nil, fmt.Errorf("map type %s must have a key and a value type", name)
+		}
+		key, err := IndigoTypeFromCEL(k)
+		if err != nil {
+			return nil, fmt.Errorf("key of %s: %w", name, err)
+		}
+		val, err := IndigoTypeFromCEL(v)
+		if err != nil {
+			return nil, fmt.Errorf("value of %s: %w", name, err)
+		}
+		return indigo.Map{KeyType: key, ValueType: val}, nil
+	}
+
+	switch name {
+	case "string":
+		return indigo.String{}, nil
+	case "int":
+		return indigo.Int{}, nil
+	case "double":
+		return indigo.Float{}, nil
+	case "bool":
+		return indigo.Bool{}, nil
+	case "google.protobuf.Duration", "duration":
+		return indigo.Duration{}, nil
+	case "google.protobuf.Timestamp", "timestamp":
+		return indigo.Timestamp{}, nil
+	case "dyn":
+		return indigo.Any{}, nil
+	}
+
+	// Message names are qualified by their package
+	if strings.Contains(name, ".") && !strings.ContainsAny(name, "(), ") {
+		return indigo.ParseType(fmt.Sprintf("proto(%s)", name))
+	}
+	return nil, fmt.Errorf("unsupported CEL type %q", name)
+}
+
+// typeParams returns the parameters of a parameterized type name, such as
+// "string" for list(string)
+func typeParams(name, typ string) (string, bool) {
+	inner, ok := strings.CutPrefix(name, typ+"(")
+	if !ok || !strings.HasSuffix(inner, ")") {
+		return "", false
+	}
+	return strings.TrimSuffix(inner, ")"), true
+}
+
+// splitTypeParams splits the parameters of a map type at the comma that is
+// not inside the parameters of a nested type
+func splitTypeParams(params string) (string, string, bool) {
+	depth := 0
+	for i, c := range params {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				return params[:i], params[i+1:], true
+			}
+		}
+	}
+	return "", "", false
+}
@@ -0,0 +1,95 @@
+package indigo
+
+import (
+	"fmt"
+	"sort"
+)
+
+// CompositeEvaluator is an ExpressionCompilerEvaluator that lets the rules in a
+// tree use different expression languages. Each evaluator is registered under
+// a tag, and the engine compiles and evaluates a rule with the evaluator named
+// by the rule's Evaluator field. Rules without a tag use the primary evaluator.
+//
+//	c := indigo.NewCompositeEvaluator(cel.NewEvaluator())
+//	c.Register("go", myPredicateEvaluator)
+//	e := indigo.NewEngine(c)
+//
+// Register all evaluators before compiling rules; Register is not safe to
+// call while the engine is compiling or evaluating rules.
+//
+// The optional interfaces, such as ExpressionInspector and PartialEvaluator,
+// are available for a rule if its evaluator implements them.
+type CompositeEvaluator struct {
+	primary ExpressionCompilerEvaluator
+	tagged  map[string]ExpressionCompilerEvaluator
+}
+
+// NewCompositeEvaluator creates a CompositeEvaluator that uses primary for
+// rules without an evaluator tag.
+func NewCompositeEvaluator(primary ExpressionCompilerEvaluator) *CompositeEvaluator {
+	return &CompositeEvaluator{
+		primary: primary,
+		tagged:  map[string]ExpressionCompilerEvaluator{},
+	}
+}
+
+// Register adds an evaluator for the rules whose Evaluator field is tag,
+// replacing any evaluator previously registered under the tag.
+func (c *CompositeEvaluator) Register(tag string, e ExpressionCompilerEvaluator) {
+	c.tagged[tag] = e
+}
+
+// Tags returns the tags of the registered evaluators, in sorted order
+func (c *CompositeEvaluator) Tags() []string {
+	tags := make([]string, 0, len(c.tagged))
+	for t := range c.tagged {
+		tags = append(tags, t)
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// Compile compiles the expression with the primary evaluator
+func (c *CompositeEvaluator) Compile(expr string, s Schema, resultType Type, collectDiagnostics, dryRun bool) (interface{}, error) {
+	return c.primary.Compile(expr, s, resultType, collectDiagnostics, dryRun)
+}
+
+// Evaluate evaluates the expression with the primary evaluator
+func (c *CompositeEvaluator) Evaluate(data map[string]interface{}, expr string, s Schema,
+	self interface{}, evalData interface{}, resultType Type, returnDiagnostics bool) (interface{}, *Diagnostics, error) {
+	return c.primary.Evaluate(data, expr, s, self, evalData, resultType, returnDiagnostics)
+}
+
+// BeginCompile begins a compile session with the primary and registered
+// evaluators that implement SessionCompiler, and returns a function ending
+// all of them
+func (c *CompositeEvaluator) BeginCompile() (end func()) {
+	var ends []func()
+	begin := func(ev ExpressionCompilerEvaluator) {
+		if sc, ok := ev.(SessionCompiler); ok {
+			ends = append(ends, sc.BeginCompile())
+		}
+	}
+	begin(c.primary)
+	for _, ev := range c.tagged {
+		begin(ev)
+	}
+	return func() {
+		for _, end := range ends {
+			end()
+		}
+	}
+}
+
+// evaluatorFor returns the evaluator registered under the tag, or the primary
+// evaluator if the tag is blank
+func (c *CompositeEvaluator) evaluatorFor(tag string) (ExpressionCompilerEvaluator, error) {
+	if tag == "" {
+		return c.primary, nil
+	}
+	ev, ok := c.tagged[tag]
+	if !ok {
+		return nil, fmt.Errorf("no evaluator registered for tag %q", tag)
+	}
+	return ev, nil
+}
@@ -2,6 +2,7 @@ package indigo
 
 import (
 	"fmt"
+	"io"
 	"sort"
 	"strings"
 
@@ -33,6 +34,7 @@ const (
 // Diagnostics is a nested set of nodes, with 1 root node per rule evaluated.
 // The children represent elements of the expression evaluated.
 type Diagnostics struct {
+	ID        int64  // the evaluator's identifier for the part of the expression; see DefaultEngine.EvalSubexpr
 	Expr      string // the part of the rule expression evaluated
 	Interface interface{}
 	Source    ValueSource   // where the value came from: input data, or evaluted by the engine
@@ -42,6 +44,36 @@ type Diagnostics struct {
 	Children  []Diagnostics // one child per sub-expression. Each Evaluator may produce different results.
 }
 
+// Step is the value of one part of a rule expression, such as a variable,
+// a constant or the result of an operator
+type Step struct {
+	ID    int64       // the evaluator's identifier for the part of the expression
+	Expr  string      // the part of the rule expression evaluated
+	Value interface{} // the value of the part of the expression
+}
+
+// Steps returns the values of the parts of the expression in the order they
+// were evaluated: the operands of an operator come before the operator.
+// Parts the evaluator skipped, such as the right-hand side of a
+// short-circuited &&, are not included.
+func (d *Diagnostics) Steps() []Step {
+	if d == nil {
+		return nil
+	}
+	var steps []Step
+	var walk func(n Diagnostics)
+	walk = func(n Diagnostics) {
+		for _, c := range n.Children {
+			walk(c)
+		}
+		if n.Expr != "" {
+			steps = append(steps, Step{ID: n.ID, Expr: n.Expr, Value: n.Interface})
+		}
+	}
+	walk(*d)
+	return steps
+}
+
 // String produces an ASCII table with human-readable diagnostics.
 func (d *Diagnostics) String() string {
 	if d == nil {
@@ -71,8 +103,104 @@ func (d *Diagnostics) String() string {
 	return tw.Render()
 }
 
+// DiagnosticOption is a functional option to control the format of the
+// report written by DiagnosticsReportTo.
+type DiagnosticOption func(o *diagnosticOptions)
+
+type diagnosticOptions struct {
+	compact bool
+}
+
+// CompactDiagnostics writes one line per rule instead of the full report: the
+// rule ID indented by its depth in the tree, the outcome, the value of the
+// expression, the error if any, and the values of the parts of the
+// expression if diagnostics were returned. The input data, if provided, is
+// written on the last line. Use it to log diagnostics.
+func CompactDiagnostics() DiagnosticOption {
+	return func(o *diagnosticOptions) {
+		o.compact = true
+	}
+}
+
+// DiagnosticsReportTo writes the report produced by DiagnosticsReport to w,
+// or the compact form if the CompactDiagnostics option is given. It returns
+// the first error returned by w.
+func DiagnosticsReportTo(w io.Writer, u *Result, data map[string]interface{}, opts ...DiagnosticOption) error {
+	o := diagnosticOptions{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if !o.compact {
+		_, err := io.WriteString(w, DiagnosticsReport(u, data))
+		return err
+	}
+
+	if u == nil {
+		_, err := io.WriteString(w, "no Result provided\n")
+		return err
+	}
+
+	if err := compactDiagnostics(w, u, 0); err != nil {
+		return err
+	}
+
+	if data != nil {
+		keys := make([]string, 0, len(data))
+		for k := range data {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		fields := make([]string, 0, len(keys))
+		for _, k := range keys {
+			fields = append(fields, fmt.Sprintf("%s=%v", k, data[k]))
+		}
+		if _, err := fmt.Fprintf(w, "input: %s\n", strings.Join(fields, " ")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compactDiagnostics writes one line for the result and each of its
+// descendants, in the order the child rules are evaluated
+func compactDiagnostics(w io.Writer, u *Result, n int) error {
+	s := strings.Builder{}
+	s.WriteString(strings.Repeat("  ", n))
+	if u.Rule != nil {
+		s.WriteString(u.Rule.ID)
+	} else {
+		s.WriteString("(no rule)")
+	}
+	s.WriteString(" ")
+	s.WriteString(u.State.String())
+	fmt.Fprintf(&s, " value=%v", u.Value)
+	if u.Error != nil {
+		fmt.Fprintf(&s, " error=%q", u.Error.Error())
+	}
+	if steps := u.Diagnostics.Steps(); len(steps) > 0 {
+		parts := make([]string, 0, len(steps))
+		for _, st := range steps {
+			parts = append(parts, fmt.Sprintf("%s=%v", st.Expr, st.Value))
+		}
+		fmt.Fprintf(&s, " steps=[%s]", strings.Join(parts, "; "))
+	}
+	s.WriteString("\n")
+	if _, err := io.WriteString(w, s.String()); err != nil {
+		return err
+	}
+
+	for _, c := range u.childResults() {
+		if err := compactDiagnostics(w, c, n+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // DiagnosticsReport produces an ASCII report of the input rules, input data,
 // the evaluation diagnostics and the results.
+// Use DiagnosticsReportTo to write the report to an io.Writer.
 func DiagnosticsReport(u *Result, data map[string]interface{}) string {
 
 	// b := box.New(box.Config{Px: 2, Py: 1, Type: "Double", Color: "Cyan", TitlePos: "Top", ContentAlign: "Left"})
@@ -0,0 +1,160 @@
+package indigo
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+)
+
+// ChangeType is the kind of change made to a rule, see RuleChange.
+type ChangeType int
+
+const (
+	// RuleAdded means that the rule is only in the new rule tree.
+	RuleAdded ChangeType = iota
+
+	// RuleRemoved means that the rule is only in the old rule tree.
+	RuleRemoved
+
+	// RuleModified means that the rule is in both rule trees, with
+	// different definitions.
+	RuleModified
+)
+
+// RuleChange describes a difference between two rule trees found by DiffRules.
+type RuleChange struct {
+	// The ID of the rule
+	ID string `json:"id"`
+
+	// The IDs of the rule's ancestors, starting with the root of the tree
+	Ancestors []string `json:"ancestors,omitempty"`
+
+	Type ChangeType `json:"type"`
+
+	// For modified rules, the names of the Rule fields that changed, such
+	// as "Expr", "Schema" and "EvalOptions"
+	Fields []string `json:"fields,omitempty"`
+}
+
+// DiffRules compares the definitions of two rule trees and returns the
+// rules that were added, removed or modified. Child rules are matched by
+// their key in the parent's Rules map; the roots are always matched. If a
+// rule is added or removed, its descendants are not listed separately.
+// A modified rule is only listed if its own fields changed, not its
+// children's. The changes are listed depth-first, with child rules in order
+// of their keys.
+//
+// The fields compared are those that define the rule: the expression,
+// result type, schema, evaluator, outputs, message, shard condition, order,
+// priority, result key, effective times, allowed fields, annotations and the
+// EvalOptions that can be serialized. Self, Meta and the compiled programs
+// are not compared.
+func DiffRules(old, new *Rule) []RuleChange {
+	var changes []RuleChange
+	diffRules(old, new, nil, &changes)
+	return changes
+}
+
+// diffRules adds the differences between the rules and their children to
+// changes. The ancestors are the IDs of the rules' ancestors in the new tree,
+// or in the old tree for removed rules.
+func diffRules(old, new *Rule, ancestors []string, changes *[]RuleChange) {
+	switch {
+	case old == nil && new == nil:
+		return
+	case old == nil:
+		*changes = append(*changes, RuleChange{ID: new.ID, Ancestors: ancestors, Type: RuleAdded})
+		return
+	case new == nil:
+		*changes = append(*changes, RuleChange{ID: old.ID, Ancestors: ancestors, Type: RuleRemoved})
+		return
+	}
+
+	if fields := changedFields(old, new); len(fields) > 0 {
+		*changes = append(*changes, RuleChange{ID: new.ID, Ancestors: ancestors, Type: RuleModified, Fields: fields})
+	}
+
+	keys := new.sortedChildKeys()
+	for _, k := range old.sortedChildKeys() {
+		if _, ok := new.Rules[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	children := append(ancestors[:len(ancestors):len(ancestors)], new.ID)
+	for _, k := range keys {
+		diffRules(old.Rules[k], new.Rules[k], children, changes)
+	}
+}
+
+// changedFields returns the names of the fields defining the rule that
+// differ between the rules
+func changedFields(old, new *Rule) []string {
+	var fields []string
+	add := func(name string, changed bool) {
+		if changed {
+			fields = append(fields, name)
+		}
+	}
+
+	add("ID", old.ID != new.ID)
+	add("Expr", old.Expr != new.Expr)
+	add("ResultType", fmt.Sprintf("%v", old.ResultType) != fmt.Sprintf("%v", new.ResultType))
+	add("Schema", !sameSchema(old.Schema, new.Schema))
+	add("Evaluator", old.Evaluator != new.Evaluator)
+	add("Outputs", !sameMap(old.Outputs, new.Outputs))
+	add("Message", old.Message != new.Message)
+	add("ShardCondition", old.ShardCondition != new.ShardCondition)
+	add("Order", !sameSlice(old.Order, new.Order))
+	add("Priority", old.Priority != new.Priority)
+	add("ResultKey", old.ResultKey != new.ResultKey)
+	add("EffectiveFrom", !sameTime(old.EffectiveFrom, new.EffectiveFrom))
+	add("EffectiveTo", !sameTime(old.EffectiveTo, new.EffectiveTo))
+	// A nil list allows all fields, and an empty one none
+	add("AllowedFields", (old.AllowedFields == nil) != (new.AllowedFields == nil) || !sameSlice(old.AllowedFields, new.AllowedFields))
+	add("Annotations", !sameMap(old.Annotations, new.Annotations))
+
+	// The fields that can't be serialized, such as SortFunc, are excluded
+	// from the JSON encoding, like in Hash
+	ob, _ := json.Marshal(old.EvalOptions)
+	nb, _ := json.Marshal(new.EvalOptions)
+	add("EvalOptions", string(ob) != string(nb))
+	return fields
+}
+
+// sameSchema reports whether the schemas have the same ID and elements
+func sameSchema(a, b Schema) bool {
+	if a.ID != b.ID || len(a.Elements) != len(b.Elements) {
+		return false
+	}
+	for i := range a.Elements {
+		x, y := a.Elements[i], b.Elements[i]
+		if x.Name != y.Name || x.Alias != y.Alias || fmt.Sprintf("%v", x.Type) != fmt.Sprintf("%v", y.Type) {
+			return false
+		}
+	}
+	return true
+}
+
+// sameMap reports whether the maps have the same entries; nil and empty
+// maps are the same
+func sameMap(a, b map[string]string) bool {
+	return len(a) == len(b) && (len(a) == 0 || reflect.DeepEqual(a, b))
+}
+
+// sameSlice reports whether the slices have the same elements; nil and
+// empty slices are the same
+func sameSlice(a, b []string) bool {
+	return len(a) == len(b) && (len(a) == 0 || reflect.DeepEqual(a, b))
+}
+
+// sameTime reports whether the times are both nil or the same instant
+func sameTime(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
@@ -0,0 +1,140 @@
+package indigo
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// GenerateDocs produces Markdown documentation of the rule and its children,
+// suitable for a wiki. Each rule is documented with its ID, expression, result
+// type, evaluation options and annotations. Schemas with an ID are
+// documented once, at the end; schemas without an ID are documented with the
+// rule that uses them. Child rules are documented in ID order.
+func GenerateDocs(r *Rule) (string, error) {
+	if r == nil {
+		return "", fmt.Errorf("rule is nil")
+	}
+
+	s := strings.Builder{}
+	schemas := map[string]Schema{}
+	if err := ruleDocs(&s, r, 1, schemas); err != nil {
+		return "", err
+	}
+
+	if len(schemas) > 0 {
+		s.WriteString("# Schemas\n\n")
+		ids := make([]string, 0, len(schemas))
+		for id := range schemas {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			sc := schemas[id]
+			s.WriteString(fmt.Sprintf("## Schema `%s`\n\n", id))
+			schemaDocs(&s, sc)
+		}
+	}
+	return s.String(), nil
+}
+
+// ruleDocs writes the documentation for the rule and its children, collecting
+// the schemas with IDs
+func ruleDocs(s *strings.Builder, r *Rule, level int, schemas map[string]Schema) error {
+	if r == nil {
+		return fmt.Errorf("rule is nil")
+	}
+
+	// Markdown has 6 heading levels
+	if level > 6 {
+		level = 6
+	}
+	s.WriteString(fmt.Sprintf("%s Rule `%s`\n\n", strings.Repeat("#", level), r.ID))
+
+	if r.Expr == "" {
+		s.WriteString("Expression: (none)\n\n")
+	} else {
+		s.WriteString("Expression:\n\n```\n")
+		s.WriteString(r.Expr)
+		s.WriteString("\n```\n\n")
+	}
+
+	s.WriteString(fmt.Sprintf("Result type: `%v`\n\n", defaultResultType(r)))
+
+	switch {
+	case r.Schema.ID != "":
+		s.WriteString(fmt.Sprintf("Schema: `%s`\n\n", r.Schema.ID))
+		schemas[r.Schema.ID] = r.Schema
+	case len(r.Schema.Elements) > 0:
+		s.WriteString("Schema:\n\n")
+		schemaDocs(s, r.Schema)
+	}
+
+	if opts := optionNames(r.EvalOptions); len(opts) > 0 {
+		s.WriteString("Options: " + strings.Join(opts, ", ") + "\n\n")
+	}
+
+	if len(r.Annotations) > 0 {
+		keys := make([]string, 0, len(r.Annotations))
+		for k := range r.Annotations {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		s.WriteString("| Annotation | Value |\n")
+		s.WriteString("|---|---|\n")
+		for _, k := range keys {
+			s.WriteString(fmt.Sprintf("| %s | %s |\n", markdownCell(k), markdownCell(r.Annotations[k])))
+		}
+		s.WriteString("\n")
+	}
+
+	for _, c := range r.sortChildRules(SortRulesAlpha, true) {
+		if err := ruleDocs(s, c, level+1, schemas); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// schemaDocs writes a table of the schema's elements
+func schemaDocs(s *strings.Builder, sc Schema) {
+	if sc.Name != "" {
+		s.WriteString(sc.Name + "\n\n")
+	}
+	if sc.Description != "" {
+		s.WriteString(sc.Description + "\n\n")
+	}
+	s.WriteString("| Element | Type | Description |\n")
+	s.WriteString("|---|---|---|\n")
+	for _, e := range sc.Elements {
+		s.WriteString(fmt.Sprintf("| %s | `%v` | %s |\n", markdownCell(e.Name), e.Type, markdownCell(e.Description)))
+	}
+	s.WriteString("\n")
+}
+
+// optionNames returns the names of the boolean evaluation options that are set
+func optionNames(o EvalOptions) []string {
+	names := []string{}
+	for _, x := range []struct {
+		name string
+		set  bool
+	}{
+		{"TrueIfAny", o.TrueIfAny},
+		{"StopIfParentNegative", o.StopIfParentNegative},
+		{"StopFirstPositiveChild", o.StopFirstPositiveChild},
+		{"StopFirstNegativeChild", o.StopFirstNegativeChild},
+		{"DiscardPass", o.DiscardPass},
+	} {
+		if x.set {
+			names = append(names, x.name)
+		}
+	}
+	return names
+}
+
+// markdownCell escapes text for use in a Markdown table cell
+func markdownCell(t string) string {
+	t = strings.ReplaceAll(t, "|", `\|`)
+	return strings.ReplaceAll(t, "\n", " ")
+}
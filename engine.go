@@ -2,7 +2,15 @@ package indigo
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 // Compiler is the interface that wraps the Compile method.
@@ -29,14 +37,66 @@ type Engine interface {
 // DefaultEngine provides an implementation of the Indigo Engine interface
 // to evaluate rules locally.
 type DefaultEngine struct {
-	e ExpressionCompilerEvaluator
+	e        ExpressionCompilerEvaluator
+	observer Observer
+	defaults *EvalOptions  // see WithDefaultEvalOptions
+	sem      chan struct{} // see WithMaxGlobalGoroutines
 }
 
+// EngineOption is a functional option for configuring the DefaultEngine.
+type EngineOption func(e *DefaultEngine)
+
 // NewEngine initializes and returns a DefaultEngine.
-func NewEngine(e ExpressionCompilerEvaluator) *DefaultEngine {
-	return &DefaultEngine{
+func NewEngine(e ExpressionCompilerEvaluator, opts ...EngineOption) *DefaultEngine {
+	engine := &DefaultEngine{
 		e: e,
 	}
+	for _, o := range opts {
+		o(engine)
+	}
+	return engine
+}
+
+// WithObserver sets an Observer that the engine notifies as it compiles and
+// evaluates rules.
+func WithObserver(obs Observer) EngineOption {
+	return func(e *DefaultEngine) {
+		e.observer = obs
+	}
+}
+
+// WithDefaultEvalOptions sets the evaluation options used for all rules, as
+// the base for the options set on each rule and passed to Eval. The options
+// set on a rule take precedence over the defaults, and the options passed to
+// Eval take precedence over both. Since only the options set on a rule (those
+// that are not the zero value) replace the defaults, a rule can't turn off an
+// option enabled by default; pass an option to Eval instead. TrueIfAny and
+// PassFunc are only used if set on the rule, not as defaults.
+func WithDefaultEvalOptions(o EvalOptions) EngineOption {
+	return func(e *DefaultEngine) {
+		e.defaults = &o
+	}
+}
+
+// WithMaxGlobalGoroutines limits the number of goroutines the engine starts
+// to evaluate child rules in parallel (see EvalOptions.ParallelOrdered and
+// EvalOptions.ParallelSubtrees) to n in total, shared by nested parallel
+// rules and by concurrent calls to Eval. Without the limit, each parallel
+// rule starts its own goroutines, so the number of goroutines multiplies
+// with nested parallel rules. When no goroutine is available, the child
+// rules are evaluated sequentially by the goroutine evaluating the parent
+// rule. A goroutine waiting for the child rules of a nested parallel rule
+// keeps its place in the limit. With a limit of 0, no goroutines are started,
+// so all child rules are evaluated sequentially; a negative limit means no
+// limit, as without the option.
+func WithMaxGlobalGoroutines(n int) EngineOption {
+	return func(e *DefaultEngine) {
+		if n < 0 {
+			e.sem = nil
+			return
+		}
+		e.sem = make(chan struct{}, n)
+	}
 }
 
 // Eval evaluates the expression of the rule and its children. It uses the evaluation
@@ -50,16 +110,159 @@ func (e *DefaultEngine) Eval(ctx context.Context, r *Rule,
 		return nil, err
 	}
 
-	o := r.EvalOptions
-	applyEvaluatorOptions(&o, opts...)
+	o := e.evalOptions(r, opts...)
+
+	s := &evalState{
+		maxEvaluations: o.MaxEvaluations,
+		maxDepth:       o.MaxDepth,
+		subtrees:       o.ParallelSubtrees,
+		now:            o.EvaluationTime,
+		stopOnFailure:  o.StopOnFirstFailure,
+	}
+	if s.now.IsZero() {
+		s.now = time.Now()
+	}
+
+	if !r.EffectiveAt(s.now) {
+		return nil, fmt.Errorf("rule %s: %w", r.ID, ErrNotEffective)
+	}
+
+	// Both give the rules their own copy of the data map
+	switch {
+	case o.Seed != nil:
+		var err error
+		if d, err = withSeed(d, *o.Seed); err != nil {
+			return nil, fmt.Errorf("rule %s: %w", r.ID, err)
+		}
+	case o.ImmutableData:
+		d = copyData(d)
+	}
+	return e.eval(ctx, r, d, s, 1, opts...)
+}
+
+// EvalWith evaluates the rule like Eval, with exprOverride in place of the
+// rule's expression, such as to see what a proposed change to the expression
+// would do. The override is compiled with the rule's schema and evaluator
+// each time EvalWith is called; the rule, including its compiled program, is
+// not changed, so EvalWith may be called concurrently with Eval. The child
+// rules are evaluated as compiled. The result's Rule is a copy of the rule
+// with the overridden expression.
+func (e *DefaultEngine) EvalWith(ctx context.Context, r *Rule, exprOverride string,
+	d map[string]interface{}, opts ...EvalOption) (*Result, error) {
+
+	if err := validateEvalArguments(r, e, d); err != nil {
+		return nil, err
+	}
+
+	ev, err := e.evaluator(r)
+	if err != nil {
+		return nil, fmt.Errorf("rule %s: %w", r.ID, err)
+	}
+
+	o := e.evalOptions(r, opts...)
+	w := *r
+	w.Expr = exprOverride
+	w.hash = "" // the ResultCache must not use the original rule's results
+	w.Program, err = ev.Compile(w.Expr, w.Schema, defaultResultType(&w), o.ReturnDiagnostics, false)
+	if err == nil {
+		err = checkAllowedFields(ev, &w)
+	}
+	if err != nil {
+		return nil, newCompileError(&w, err)
+	}
+	return e.Eval(ctx, &w, d, opts...)
+}
+
+// evalState holds the state shared by all rules evaluated in a single call
+// to Eval
+type evalState struct {
+	maxEvaluations int       // see EvalOptions.MaxEvaluations
+	maxDepth       int       // see EvalOptions.MaxDepth
+	subtrees       int       // see EvalOptions.ParallelSubtrees
+	evaluations    int64     // the number of rules evaluated so far; updated atomically
+	now            time.Time // see EvalOptions.EvaluationTime
+	stopOnFailure  bool      // see EvalOptions.StopOnFirstFailure
+}
+
+// eval evaluates the rule and its children recursively. The depth is the
+// level of the rule in the tree being evaluated; the rule passed to Eval is
+// at depth 1.
+func (e *DefaultEngine) eval(ctx context.Context, r *Rule,
+	d map[string]interface{}, s *evalState, depth int, opts ...EvalOption) (*Result, error) {
+
+	if err := validateEvalArguments(r, e, d); err != nil {
+		return nil, err
+	}
+
+	if s.maxDepth > 0 && depth > s.maxDepth {
+		return nil, fmt.Errorf("rule %s: %w", r.ID, ErrMaxDepthExceeded)
+	}
+
+	if n := atomic.AddInt64(&s.evaluations, 1); s.maxEvaluations > 0 && n > int64(s.maxEvaluations) {
+		return nil, fmt.Errorf("rule %s: %w", r.ID, ErrEvaluationBudgetExceeded)
+	}
+
+	var start time.Time
+	if e.observer != nil {
+		start = time.Now()
+	}
+
+	o := e.evalOptions(r, opts...)
+	d = withDefaults(r.Schema, d)
+	d = withNow(r.Schema, d, o.InjectNow)
 	setSelfKey(r, d)
 
 	//	fmt.Println("Rule ID", r.ID, "return diags?", o.ReturnDiagnostics)
 
-	val, diagnostics, err := e.e.Evaluate(d, r.Expr, r.Schema, r.Self, r.Program, defaultResultType(r), o.ReturnDiagnostics)
+	var val interface{}
+	var diagnostics *Diagnostics
+	var err error
+	unknown := false
+	ev, err := e.evaluator(r)
 	if err != nil {
 		return nil, fmt.Errorf("rule %s: %w", r.ID, err)
 	}
+	if o.BeforeRule != nil {
+		o.BeforeRule(ctx, r, d)
+	}
+	if len(o.PartialEval) > 0 {
+		pe, ok := ev.(PartialEvaluator)
+		if !ok {
+			return nil, fmt.Errorf("rule %s: evaluator %T does not support partial evaluation", r.ID, ev)
+		}
+		val, unknown, diagnostics, err = pe.EvaluatePartial(d, r.Expr, r.Schema, r.Self, r.Program, defaultResultType(r), o.ReturnDiagnostics, o.PartialEval)
+	} else {
+		val, diagnostics, err = e.evaluate(ctx, ev, r, d, o)
+	}
+
+	// The evaluation was abandoned because the context was cancelled
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	var outputs map[string]interface{}
+	if err == nil && !unknown && len(r.Outputs) > 0 {
+		outputs, err = e.evalOutputs(ctx, ev, r, d)
+	}
+
+	missingData := false
+	var evalErr error // the error collected in the result, see EvalOptions.CollectErrors
+	if err != nil {
+		switch {
+		case o.UnknownOnMissingData && errors.Is(err, ErrMissingData):
+			unknown = true
+			missingData = true
+		default:
+			err = evalError(r, err, o)
+			if e.observer != nil {
+				e.observer.OnEvalError(r.ID, err)
+			}
+			if !o.CollectErrors && !(o.EvaluateChildrenOnParentError && len(r.Rules) > 0) {
+				return nil, err
+			}
+			evalErr = err
+		}
+	}
 
 	//	fmt.Println("Rule ID", r.ID, "diagnostics: ", diagnostics)
 
@@ -68,8 +271,17 @@ func (e *DefaultEngine) Eval(ctx context.Context, r *Rule,
 		ExpressionPass: true,                                   // default boolean result
 		Results:        make(map[string]*Result, len(r.Rules)), // TODO: consider how large to make it
 		Value:          val,
+		Outputs:        outputs,
 		Diagnostics:    diagnostics,
 		EvalOptions:    o,
+		EvalCount:      1,
+		Error:          evalErr,
+	}
+
+	// The data map is shared with the rule's siblings, which change the
+	// "self" key, so the result gets its own copy
+	if o.ReturnDiagnostics && o.CaptureData {
+		u.Data = copyData(d)
 	}
 
 	// If the evaluation returned a boolean, set the Result's value,
@@ -78,130 +290,1053 @@ func (e *DefaultEngine) Eval(ctx context.Context, r *Rule,
 		u.ExpressionPass = pass
 	}
 
+	// An expression whose outcome is unknown, or whose evaluation failed,
+	// did not pass
+	if unknown || evalErr != nil {
+		u.ExpressionPass = false
+	}
+
 	// By default, the rule's pass/fail is determined by the pass/fail of the
 	// expression. If the rule has child rules, we'll iterate through them next
 	// and change the rule's pass/fail (but not expresion pass/fail) if any child
 	// rules are negative.
 	u.Pass = u.ExpressionPass
+	u.State = stateOf(u.ExpressionPass, unknown)
+	u.missingData = missingData
 
 	// We've been asked not to evaluate child rules if this rule failed.
-	if o.StopIfParentNegative && !u.ExpressionPass {
+	// The child rules of a rule whose evaluation failed are not evaluated,
+	// unless EvaluateChildrenOnParentError is set.
+	// With StopOnFirstFailure, the first failed rule ends the evaluation.
+	failFast := s.stopOnFailure && u.State == StateFail
+	if failFast {
+		u.FirstFailure = r.ID
+	}
+	if (o.StopIfParentNegative && !u.ExpressionPass && !unknown) || (evalErr != nil && !o.EvaluateChildrenOnParentError) || failFast {
+		if err := e.setMessage(ctx, ev, r, d, u, o); err != nil {
+			return nil, err
+		}
+		if e.observer != nil {
+			e.observer.OnRuleEvaluated(r.ID, u.Pass, time.Since(start))
+		}
 		return u, nil
 	}
 
-	// count the number of failed and passed children
+	// count the number of failed, passed and unknown children
 	var failCount int
 	var passCount int
+	var unknownCount int
+
+	// All the child results, including discarded ones, for the PassFunc
+	var children map[string]*Result
+	if r.EvalOptions.PassFunc != nil {
+		children = make(map[string]*Result, len(r.Rules))
+	}
+
+	// Make the rule's value available to the child rules, without changing
+	// the data seen by the rule's siblings
+	cd := d
+	if r.ResultKey != "" && len(r.Rules) > 0 {
+		cd = overlay(d, r.ResultKey, val)
+	}
+
+	childRules := effectiveRules(r.sortChildRules(o.SortFunc, o.overrideSort), s.now)
+	childRules, err = e.shardRules(ctx, childRules, cd)
+	if err != nil {
+		return nil, err
+	}
+
+	// In parallel mode, all the child rules are evaluated up front, and the
+	// results are processed below in order, as if evaluated sequentially.
+	// ParallelSubtrees applies to the child rules of the rule passed to Eval.
+	var parallel []parallelResult
+	p := o.ParallelOrdered
+	if depth == 1 && s.subtrees > 0 {
+		p = ParallelConfig{BatchSize: 1, MaxParallel: s.subtrees}
+	}
+	if p.MaxParallel > 0 && len(childRules) >= p.MinSize && len(childRules) > 1 {
+		// Sort a copy, since the list may be the rule's cached list of
+		// child rules
+		if o.SortFunc == nil && len(r.Order) == 0 {
+			childRules = append([]*Rule(nil), childRules...)
+			sort.Slice(childRules, func(i, j int) bool {
+				return SortRulesAlpha(childRules, i, j)
+			})
+		}
+		parallel = e.evalParallel(ctx, childRules, cd, s, depth+1, p, opts...)
+	}
+
+done: // break out of inner switch
+	for i, cr := range childRules {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		default:
+			if o.ReturnDiagnostics {
+				u.RulesEvaluated = append(u.RulesEvaluated, cr)
+			}
+
+			var result *Result
+			var err error
+			if parallel != nil {
+				result, err = parallel[i].u, parallel[i].err
+			} else {
+				result, err = e.eval(ctx, cr, cd, s, depth+1, opts...)
+			}
+			if err != nil {
+				return nil, err
+			}
+			u.EvalCount += result.EvalCount
+			u.EvalParallelCount += result.EvalParallelCount
+			if parallel != nil {
+				u.EvalParallelCount++
+			}
+			if children != nil {
+				children[cr.ID] = result
+			}
+
+			// If the child rule failed, either due to its own expression evaluation
+			// or its children, we have encountered a failure, and we'll count it
+			// The reason to keep this count, rather than look at the child results,
+			// is that we may be discarding passes or failures.
+			childState := result.State
+			if childState == StateUnknown {
+				switch o.UnknownChildren {
+				case UnknownIsPass:
+					childState = StatePass
+				case UnknownIsFail:
+					childState = StateFail
+				}
+			}
+			switch childState {
+			case StatePass:
+				passCount++
+			case StateFail:
+				failCount++
+			case StateUnknown:
+				unknownCount++
+			}
+
+			// Decide if we should return the child rule's result or not
+			keep := false
+			switch result.Pass {
+			case true:
+				if o.DiscardPass == false {
+					keep = true
+				}
+			case false:
+				switch o.DiscardFail {
+				case KeepAll:
+					keep = true
+				case Discard:
+				case DiscardOnlyIfExpressionFailed:
+					if result.ExpressionPass == true {
+						keep = true
+					}
+				}
+			}
+
+			if keep && (o.MaxChildResults <= 0 || len(u.Results) < o.MaxChildResults) {
+				u.Results[cr.ID] = result
+			}
+
+			if o.StopFirstPositiveChild && childState == StatePass {
+				break done
+			}
+
+			if o.StopFirstNegativeChild && childState == StateFail {
+				break done
+			}
+
+			if result.FirstFailure != "" {
+				u.FirstFailure = result.FirstFailure
+				break done
+			}
+		}
+	}
+
+	// Based on the results of the child rules, determine the result of the parent rule
+	switch {
+	case r.EvalOptions.PassFunc != nil:
+		u.State = StateFail
+		if r.EvalOptions.PassFunc(u, children) {
+			u.State = StatePass
+		}
+	case r.EvalOptions.TrueIfAny:
+		if u.State != StateFail {
+			// If none of the child rules passed AND the parent's expression passed, the rule
+			// shouldn't pass. If none passed, but some are unknown, the rule is unknown.
+			// Children that are not effective, or not in the shard, don't count
+			hasChildren := len(childRules) > 0
+			switch {
+			case !hasChildren || passCount > 0:
+			case unknownCount > 0:
+				u.State = StateUnknown
+			default:
+				u.State = StateFail
+			}
+		}
+	default:
+		// If one or more of child rules failed, we will fail also, regardless of the parent rule's result
+		// If none failed, but some are unknown, the rule is unknown unless it already failed
+		switch {
+		case failCount > 0:
+			u.State = StateFail
+		case unknownCount > 0 && u.State == StatePass:
+			u.State = StateUnknown
+		}
+	}
+	u.Pass = u.State == StatePass
+
+	// A rule can fail without any of its evaluated children failing, such as
+	// with a PassFunc
+	if s.stopOnFailure && u.State == StateFail && u.FirstFailure == "" {
+		u.FirstFailure = r.ID
+	}
+
+	if err := e.setMessage(ctx, ev, r, d, u, o); err != nil {
+		return nil, err
+	}
+
+	if e.observer != nil {
+		e.observer.OnRuleEvaluated(r.ID, u.Pass, time.Since(start))
+	}
+	return u, nil
+}
+
+// evaluate evaluates the rule's expression with the evaluator, using the
+// ResultCache if one is set
+func (e *DefaultEngine) evaluate(ctx context.Context, ev ExpressionEvaluator, r *Rule, d map[string]interface{}, o EvalOptions) (interface{}, *Diagnostics, error) {
+	c := o.ResultCache
+	if c == nil {
+		return callEvaluator(ctx, ev, r, d, o)
+	}
+
+	k, ok := c.key(r, d, o.ReturnDiagnostics)
+	if ok {
+		if v, found := c.get(k); found {
+			return v.val, v.diagnostics, nil
+		}
+	}
+	val, diagnostics, err := callEvaluator(ctx, ev, r, d, o)
+	if ok && err == nil {
+		c.put(k, resultCacheEntry{val: val, diagnostics: diagnostics})
+	}
+	return val, diagnostics, err
+}
+
+// callEvaluator evaluates the rule's expression with the evaluator. With the
+// PerRuleTimeout option, the evaluation is abandoned if it doesn't finish
+// before the timeout or the cancellation of the context, since evaluators
+// can't be interrupted.
+func callEvaluator(ctx context.Context, ev ExpressionEvaluator, r *Rule, d map[string]interface{}, o EvalOptions) (interface{}, *Diagnostics, error) {
+	if o.PerRuleTimeout <= 0 {
+		return evaluateContext(ctx, ev, d, r.Expr, r.Schema, r.Self, r.Program, defaultResultType(r), o.ReturnDiagnostics)
+	}
+
+	type evaluation struct {
+		val         interface{}
+		diagnostics *Diagnostics
+		err         error
+	}
+
+	// An abandoned evaluation may still be running while the engine changes
+	// the data for other rules, or the rule is changed, so it gets its own
+	// copy of the data and the rule's fields
+	d = copyData(d)
+	expr, schema, self, prg, rt := r.Expr, r.Schema, r.Self, r.Program, defaultResultType(r)
+	rctx, cancel := context.WithTimeout(ctx, o.PerRuleTimeout)
+	defer cancel()
+	done := make(chan evaluation, 1)
+	go func() {
+		val, diagnostics, err := evaluateContext(rctx, ev, d, expr, schema, self, prg, rt, o.ReturnDiagnostics)
+		done <- evaluation{val: val, diagnostics: diagnostics, err: err}
+	}()
+
+	select {
+	case x := <-done:
+		return x.val, x.diagnostics, x.err
+	case <-rctx.Done():
+		if err := ctx.Err(); err != nil {
+			return nil, nil, err
+		}
+		return nil, nil, fmt.Errorf("%w after %s", ErrRuleTimeout, o.PerRuleTimeout)
+	}
+}
+
+// evaluateContext evaluates the expression with the evaluator, passing it
+// the context if the evaluator is a ContextEvaluator
+func evaluateContext(ctx context.Context, ev ExpressionEvaluator, d map[string]interface{}, expr string, s Schema,
+	self interface{}, prg interface{}, rt Type, returnDiagnostics bool) (interface{}, *Diagnostics, error) {
+	if ce, ok := ev.(ContextEvaluator); ok {
+		return ce.EvaluateContext(ctx, d, expr, s, self, prg, rt, returnDiagnostics)
+	}
+	return ev.Evaluate(d, expr, s, self, prg, rt, returnDiagnostics)
+}
+
+// evalError adds the rule's ID to an error evaluating the rule, and, with the
+// VerboseErrors option, the rule's schema ID and expression
+func evalError(r *Rule, err error, o EvalOptions) error {
+	if o.VerboseErrors {
+		return fmt.Errorf("rule %s (schema %q, expression %q): %w", r.ID, r.Schema.ID, r.Expr, err)
+	}
+	return fmt.Errorf("rule %s: %w", r.ID, err)
+}
+
+// setMessage evaluates the rule's Message expression if the rule failed, and
+// stores the message in the result. An error evaluating the message is
+// returned, or, with the CollectErrors option, recorded in the result.
+func (e *DefaultEngine) setMessage(ctx context.Context, ev ExpressionEvaluator, r *Rule, d map[string]interface{}, u *Result, o EvalOptions) error {
+	if r.Message == "" || u.State != StateFail || u.Error != nil {
+		return nil
+	}
+	// The child rules replace or remove the self key in the data, so restore
+	// this rule's self
+	setSelfKey(r, d)
+	msg, err := evalMessage(ctx, ev, r, d)
+	if err != nil {
+		err = evalError(r, err, o)
+		if e.observer != nil {
+			e.observer.OnEvalError(r.ID, err)
+		}
+		if !o.CollectErrors {
+			return err
+		}
+		u.Error = err
+		return nil
+	}
+	u.Message = msg
+	return nil
+}
+
+// shardRules returns the rules whose ShardCondition is true for the data,
+// and the rules without a condition, keeping their order
+func (e *DefaultEngine) shardRules(ctx context.Context, rules []*Rule, d map[string]interface{}) ([]*Rule, error) {
+	var list []*Rule // only copied if a rule must be skipped
+	for i, r := range rules {
+		in, err := e.inShard(ctx, r, d)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case in && list != nil:
+			list = append(list, r)
+		case !in && list == nil:
+			list = append(make([]*Rule, 0, len(rules)), rules[:i]...)
+		}
+	}
+	if list == nil {
+		return rules, nil
+	}
+	return list, nil
+}
+
+// inShard evaluates the rule's ShardCondition with the rule's evaluator
+func (e *DefaultEngine) inShard(ctx context.Context, r *Rule, d map[string]interface{}) (bool, error) {
+	if r == nil || r.ShardCondition == "" {
+		return true, nil
+	}
+	ev, err := e.evaluator(r)
+	if err != nil {
+		return false, fmt.Errorf("rule %s: %w", r.ID, err)
+	}
+	val, _, err := evaluateContext(ctx, ev, d, r.ShardCondition, r.Schema, r.Self, r.shardProgram, Bool{}, false)
+	if err != nil {
+		return false, fmt.Errorf("rule %s: shard condition: %w", r.ID, err)
+	}
+	in, ok := val.(bool)
+	if !ok {
+		return false, fmt.Errorf("rule %s: shard condition: expected a bool, got %T", r.ID, val)
+	}
+	return in, nil
+}
+
+// effectiveRules returns the rules that are effective at the time, keeping
+// their order
+func effectiveRules(rules []*Rule, t time.Time) []*Rule {
+	for i, r := range rules {
+		if r == nil || r.EffectiveAt(t) {
+			continue
+		}
+		// Only copy the list if a rule must be skipped
+		list := append([]*Rule{}, rules[:i]...)
+		for _, r := range rules[i+1:] {
+			if r == nil || r.EffectiveAt(t) {
+				list = append(list, r)
+			}
+		}
+		return list
+	}
+	return rules
+}
+
+// parallelResult is the result of evaluating a child rule in parallel mode
+type parallelResult struct {
+	u   *Result
+	err error
+}
+
+// evalParallel evaluates the rules concurrently, in batches of p.BatchSize
+// rules, using at most p.MaxParallel goroutines, and within the engine's
+// goroutine limit, if set, and returns the results in the order of the
+// rules. Each rule is evaluated with its own copy of the data. A panic
+// evaluating a rule is returned as the rule's error. After the first error,
+// the rules not yet evaluated are abandoned and get the same error.
+// The depth is the level of the rules in the tree being evaluated.
+func (e *DefaultEngine) evalParallel(ctx context.Context, rules []*Rule, d map[string]interface{},
+	s *evalState, depth int, p ParallelConfig, opts ...EvalOption) []parallelResult {
+
+	results := make([]parallelResult, len(rules))
+
+	// The first error, such as ErrEvaluationBudgetExceeded, ends the
+	// evaluation, so the rules not yet evaluated are abandoned
+	parent := ctx
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	batchSize := p.BatchSize
+	if batchSize <= 0 {
+		batchSize = 1
+	}
+
+	evalRule := func(i int) {
+		// A panic in a worker would crash the program, so it is returned as
+		// the rule's error
+		defer func() {
+			if p := recover(); p != nil {
+				results[i].u, results[i].err = nil, fmt.Errorf("rule %s: %w: %v", rules[i].ID, ErrEvaluationPanic, p)
+				cancel(results[i].err)
+			}
+		}()
+		if err := ctx.Err(); err != nil {
+			results[i].err = err
+			return
+		}
+		results[i].u, results[i].err = e.eval(ctx, rules[i], copyData(d), s, depth, opts...)
+		if results[i].err != nil {
+			cancel(results[i].err)
+		}
+	}
+
+	workers := p.MaxParallel
+	if e.sem != nil {
+		// Don't hold places the batches can't use
+		workers = e.acquire(min(p.MaxParallel, (len(rules)+batchSize-1)/batchSize))
+		if workers == 0 {
+			for i := range rules {
+				evalRule(i)
+			}
+			return abandoned(parent, ctx, results)
+		}
+	}
+
+	batches := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if e.sem != nil {
+				defer func() { <-e.sem }()
+			}
+			for start := range batches {
+				end := start + batchSize
+				if end > len(rules) {
+					end = len(rules)
+				}
+				for i := start; i < end; i++ {
+					evalRule(i)
+				}
+			}
+		}()
+	}
+
+	for start := 0; start < len(rules); start += batchSize {
+		batches <- start
+	}
+	close(batches)
+	wg.Wait()
+	return abandoned(parent, ctx, results)
+}
+
+// abandoned gives the rules abandoned by evalParallel because evaluating
+// another rule failed the error that ended the evaluation, rather than the
+// cancellation of ctx, the context derived from parent
+func abandoned(parent, ctx context.Context, results []parallelResult) []parallelResult {
+	cause := context.Cause(ctx)
+	if parent.Err() != nil || cause == nil || cause == context.Canceled {
+		return results
+	}
+	for i := range results {
+		if errors.Is(results[i].err, context.Canceled) {
+			results[i].err = cause
+		}
+	}
+	return results
+}
+
+// acquire takes up to n places in the engine's goroutine limit, without
+// waiting, and returns the number taken
+func (e *DefaultEngine) acquire(n int) int {
+	for i := 0; i < n; i++ {
+		select {
+		case e.sem <- struct{}{}:
+		default:
+			return i
+		}
+	}
+	return n
+}
+
+// EvalValue evaluates the rule's expression and returns its value, such as
+// the float computed by a rule calculating a risk factor. Child rules, and
+// the rule's outputs and message, are not evaluated. If the rule has not
+// been compiled, its expression is compiled first, and the compiled program
+// stored in the rule; don't call EvalValue concurrently on an uncompiled rule.
+// The evaluation options that apply to a single expression, such as Seed,
+// ImmutableData and WithResultCache, are used.
+func (e *DefaultEngine) EvalValue(ctx context.Context, r *Rule, d map[string]interface{}, opts ...EvalOption) (interface{}, error) {
+	if err := validateEvalArguments(r, e, d); err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	ev, err := e.evaluator(r)
+	if err != nil {
+		return nil, fmt.Errorf("rule %s: %w", r.ID, err)
+	}
+
+	if r.Program == nil && r.Expr != "" {
+		prg, err := ev.Compile(r.Expr, r.Schema, defaultResultType(r), false, false)
+		if err != nil {
+			return nil, newCompileError(r, err)
+		}
+		r.Program = prg
+	}
+
+	o := e.evalOptions(r, opts...)
+	if d, err = ruleData(r, d, o); err != nil {
+		return nil, err
+	}
+
+	o.ReturnDiagnostics = false
+	val, _, err := e.evaluate(ctx, ev, r, d, o)
+	if err != nil {
+		return nil, evalError(r, err, o)
+	}
+	return val, nil
+}
+
+// EvalSubexpr evaluates the rule's expression and returns the value of the
+// part of the expression identified by exprID. Child rules are not evaluated.
+// Use diagnostics to find the ID of the part of the expression you're
+// interested in; see Diagnostics.ID.
+// The evaluator provided to the engine must implement the SubexpressionEvaluator
+// interface.
+func (e *DefaultEngine) EvalSubexpr(r *Rule, d map[string]interface{}, exprID int64) (interface{}, error) {
+	if err := validateEvalArguments(r, e, d); err != nil {
+		return nil, err
+	}
+
+	ev, err := e.evaluator(r)
+	if err != nil {
+		return nil, fmt.Errorf("rule %s: %w", r.ID, err)
+	}
+
+	se, ok := ev.(SubexpressionEvaluator)
+	if !ok {
+		return nil, fmt.Errorf("evaluator %T does not support evaluating sub-expressions", ev)
+	}
+
+	setSelfKey(r, d)
+
+	val, err := se.EvaluateSubexpression(d, r.Expr, r.Schema, r.Program, exprID)
+	if err != nil {
+		return nil, fmt.Errorf("rule %s: %w", r.ID, err)
+	}
+	return val, nil
+}
+
+// Counterfactual evaluates the rule's expression and suggests the input
+// values that would make a failing expression pass, such as the GPA a student
+// needs for the rule "student.GPA >= 3.6" to pass. The result maps input names
+// to suggested values, and is empty if the expression passes or no suggestion
+// can be made. Child rules are not considered. The data is prepared as in
+// Eval, with the schema's defaults and the Seed and InjectNow options.
+// The evaluator provided to the engine must implement the CounterfactualEvaluator
+// interface.
+func (e *DefaultEngine) Counterfactual(r *Rule, d map[string]interface{}, opts ...EvalOption) (map[string]interface{}, error) {
+	if err := validateEvalArguments(r, e, d); err != nil {
+		return nil, err
+	}
+
+	ev, err := e.evaluator(r)
+	if err != nil {
+		return nil, fmt.Errorf("rule %s: %w", r.ID, err)
+	}
+
+	ce, ok := ev.(CounterfactualEvaluator)
+	if !ok {
+		return nil, fmt.Errorf("evaluator %T does not support counterfactuals", ev)
+	}
+
+	if d, err = ruleData(r, d, e.evalOptions(r, opts...)); err != nil {
+		return nil, err
+	}
+
+	m, err := ce.Counterfactual(d, r.Expr, r.Schema)
+	if err != nil {
+		return nil, fmt.Errorf("rule %s: %w", r.ID, err)
+	}
+	return m, nil
+}
+
+// Compile uses the Evaluator's compile method to check the rule and its children,
+// returning any validation errors. Stores a compiled version of the rule in the
+// rule.Program field (if the compiler returns a program).
+// All rules in the tree are compiled, even if some fail; the error returned
+// joins a *CompileError for each rule that failed.
+func (e *DefaultEngine) Compile(r *Rule, opts ...CompilationOption) error {
+	return e.CompileContext(context.Background(), r, opts...)
+}
+
+// CompileContext is like Compile, but stops compiling when the context is
+// cancelled, and returns the context's error. The context is checked
+// before each rule is compiled; rules compiled before the cancellation keep
+// their compiled programs, and the remaining rules are not compiled.
+func (e *DefaultEngine) CompileContext(ctx context.Context, r *Rule, opts ...CompilationOption) error {
+	if err := validateCompileArguments(r, e); err != nil {
+		return err
+	}
+
+	o := compileOptions{}
+	applyCompilerOptions(&o, opts...)
+
+	if sc, ok := e.e.(SessionCompiler); ok {
+		end := sc.BeginCompile()
+		defer end()
+	}
+
+	errs := e.compile(ctx, r, o)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return errors.Join(errs...)
+}
+
+// CompileParallel is like Compile, but compiles the rules in the tree
+// concurrently, using at most maxWorkers goroutines. Each rule's expressions
+// are compiled independently of the other rules, so the compiled rules are
+// the same as those compiled by Compile. Like Compile, CompileParallel
+// returns the errors for all rules that failed to compile. The evaluator,
+// and the engine's Observer, must be safe for concurrent use.
+func (e *DefaultEngine) CompileParallel(r *Rule, maxWorkers int, opts ...CompilationOption) error {
+	if err := validateCompileArguments(r, e); err != nil {
+		return err
+	}
+
+	o := compileOptions{}
+	applyCompilerOptions(&o, opts...)
+
+	if sc, ok := e.e.(SessionCompiler); ok {
+		end := sc.BeginCompile()
+		defer end()
+	}
+
+	// The rules in the tree, with parents before their children. A rule
+	// shared by several parents is listed once, so that two workers don't
+	// compile it at the same time.
+	var rules []*Rule
+	var errs []error
+	seen := map[*Rule]bool{}
+	var walk func(r *Rule)
+	walk = func(r *Rule) {
+		if seen[r] {
+			return
+		}
+		seen[r] = true
+		rules = append(rules, r)
+		for k, cr := range r.Rules {
+			if cr == nil {
+				errs = append(errs, fmt.Errorf("rule %s: child rule %s is nil", r.ID, k))
+				continue
+			}
+			walk(cr)
+		}
+	}
+	walk(r)
+
+	if maxWorkers < 1 {
+		maxWorkers = 1
+	}
+	ruleErrs := make([][]error, len(rules))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < min(maxWorkers, len(rules)); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				ruleErrs[i] = e.compileRule(rules[i], o)
+			}
+		}()
+	}
+	for i := range rules {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	// The child rules are sorted, and the rules hashed, once all the rules
+	// are compiled, children first, as by compile
+	for i := len(rules) - 1; i >= 0; i-- {
+		finishCompile(rules[i], o)
+	}
+
+	for _, re := range ruleErrs {
+		errs = append(errs, re...)
+	}
+	return errors.Join(errs...)
+}
+
+// compile compiles the rule and its children, returning the errors for all
+// rules that failed
+func (e *DefaultEngine) compile(ctx context.Context, r *Rule, o compileOptions) []error {
+	if r == nil {
+		return []error{fmt.Errorf("rule is nil")}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return []error{err}
+	}
+
+	errs := e.compileRule(r, o)
+
+	for _, cr := range r.Rules {
+		if ctx.Err() != nil {
+			break
+		}
+		errs = append(errs, e.compile(ctx, cr, o)...)
+	}
+
+	finishCompile(r, o)
+	return errs
+}
+
+// finishCompile sorts the rule's child rules and stores the rule's hash,
+// after the rule and its children are compiled
+func finishCompile(r *Rule, o compileOptions) {
+	r.sortedRules = r.sortChildRules(r.EvalOptions.SortFunc, true)
+	if !o.dryRun {
+		r.hash = r.Hash()
+	}
+}
+
+// compileRule compiles the rule's expressions, but not its child rules,
+// returning the errors for the rule
+func (e *DefaultEngine) compileRule(r *Rule, o compileOptions) []error {
+	var errs []error
+
+	resultType := r.ResultType
+	if resultType == nil {
+		resultType = Bool{}
+	}
+
+	ev, err := e.evaluator(r)
+	if err != nil {
+		if e.observer != nil {
+			e.observer.OnCompile(r.ID, err)
+		}
+		return []error{newCompileError(r, err)}
+	}
+
+	prg, err := ev.Compile(r.Expr, r.Schema, resultType, o.collectDiagnostics, o.dryRun)
+	if err == nil {
+		err = checkAllowedFields(ev, r)
+	}
+	if err == nil {
+		err = checkDefaults(r.Schema)
+	}
+	if e.observer != nil {
+		e.observer.OnCompile(r.ID, err)
+	}
+	switch {
+	case err != nil:
+		errs = append(errs, newCompileError(r, err))
+	case !o.dryRun:
+		r.Program = prg
+	}
+
+	if err := compileOutputs(ev, r, o); err != nil {
+		errs = append(errs, newCompileError(r, err))
+	}
+
+	if err := compileMessage(ev, r, o); err != nil {
+		errs = append(errs, newCompileError(r, err))
+	}
+
+	if err := compileShardCondition(ev, r, o); err != nil {
+		errs = append(errs, newCompileError(r, err))
+	}
+	return errs
+}
+
+// compileOutputs compiles the rule's Outputs expressions with the rule's
+// evaluator, in order of name, and stores the compiled versions in the rule.
+// The expressions may produce values of any type.
+func compileOutputs(ev ExpressionCompiler, r *Rule, o compileOptions) error {
+	if len(r.Outputs) == 0 {
+		r.outputPrograms = nil
+		return nil
+	}
+
+	names := make([]string, 0, len(r.Outputs))
+	for name := range r.Outputs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	programs := make(map[string]interface{}, len(names))
+	for _, name := range names {
+		prg, err := ev.Compile(r.Outputs[name], r.Schema, Any{}, false, o.dryRun)
+		if err != nil {
+			return fmt.Errorf("output %s: %w", name, err)
+		}
+		programs[name] = prg
+	}
+	if !o.dryRun {
+		r.outputPrograms = programs
+	}
+	return nil
+}
+
+// compileMessage compiles the rule's Message expression with the rule's
+// evaluator, and stores the compiled version in the rule
+func compileMessage(ev ExpressionCompiler, r *Rule, o compileOptions) error {
+	if r.Message == "" {
+		r.messageProgram = nil
+		return nil
+	}
+	prg, err := ev.Compile(r.Message, r.Schema, String{}, false, o.dryRun)
+	if err != nil {
+		return fmt.Errorf("message: %w", err)
+	}
+	if !o.dryRun {
+		r.messageProgram = prg
+	}
+	return nil
+}
+
+// compileShardCondition compiles the rule's ShardCondition expression with
+// the rule's evaluator and stores the compiled version in the rule
+func compileShardCondition(ev ExpressionCompiler, r *Rule, o compileOptions) error {
+	if r.ShardCondition == "" {
+		r.shardProgram = nil
+		return nil
+	}
+	prg, err := ev.Compile(r.ShardCondition, r.Schema, Bool{}, false, o.dryRun)
+	if err != nil {
+		return fmt.Errorf("shard condition: %w", err)
+	}
+	if !o.dryRun {
+		r.shardProgram = prg
+	}
+	return nil
+}
+
+// evalMessage evaluates the rule's Message expression with the rule's
+// evaluator
+func evalMessage(ctx context.Context, ev ExpressionEvaluator, r *Rule, d map[string]interface{}) (string, error) {
+	val, _, err := evaluateContext(ctx, ev, d, r.Message, r.Schema, r.Self, r.messageProgram, String{}, false)
+	if err != nil {
+		return "", fmt.Errorf("message: %w", err)
+	}
+	msg, ok := val.(string)
+	if !ok {
+		return "", fmt.Errorf("message: expected a string, got %T", val)
+	}
+	return msg, nil
+}
+
+// evalOutputs evaluates the rule's Outputs expressions with the rule's
+// evaluator and returns their values by name
+func (e *DefaultEngine) evalOutputs(ctx context.Context, ev ExpressionEvaluator, r *Rule, d map[string]interface{}) (map[string]interface{}, error) {
+	outputs := make(map[string]interface{}, len(r.Outputs))
+	for name, expr := range r.Outputs {
+		val, _, err := evaluateContext(ctx, ev, d, expr, r.Schema, r.Self, r.outputPrograms[name], Any{}, false)
+		if err != nil {
+			return nil, fmt.Errorf("output %s: %w", name, err)
+		}
+		outputs[name] = val
+	}
+	return outputs, nil
+}
 
-done: // break out of inner switch
-	for _, cr := range r.sortChildRules(o.SortFunc, o.overrideSort) {
-		select {
-		case <-ctx.Done():
-			return nil, ctx.Err()
-		default:
-			if o.ReturnDiagnostics {
-				u.RulesEvaluated = append(u.RulesEvaluated, cr)
-			}
+// ReferencedVariables returns the sorted names of the schema elements
+// referenced by the rule's expressions: Expr, Message, ShardCondition and
+// the Outputs expressions. Child rules are not included.
+// The evaluator provided to the engine must implement the ExpressionInspector
+// interface.
+func (e *DefaultEngine) ReferencedVariables(r *Rule) ([]string, error) {
+	if err := validateCompileArguments(r, e); err != nil {
+		return nil, err
+	}
 
-			result, err := e.Eval(ctx, cr, d, opts...)
-			if err != nil {
-				return nil, err
-			}
+	ev, err := e.evaluator(r)
+	if err != nil {
+		return nil, fmt.Errorf("rule %s: %w", r.ID, err)
+	}
 
-			// If the child rule failed, either due to its own expression evaluation
-			// or its children, we have encountered a failure, and we'll count it
-			// The reason to keep this count, rather than look at the child results,
-			// is that we may be discarding passes or failures.
-			switch result.Pass {
-			case true:
-				passCount++
-			case false:
-				failCount++
-			}
+	ei, ok := ev.(ExpressionInspector)
+	if !ok {
+		return nil, fmt.Errorf("evaluator %T does not support inspecting expressions", ev)
+	}
 
-			// Decide if we should return the child rule's result or not
-			switch result.Pass {
-			case true:
-				if o.DiscardPass == false {
-					u.Results[cr.ID] = result
-				}
-			case false:
-				switch o.DiscardFail {
-				case KeepAll:
-					u.Results[cr.ID] = result
-				case Discard:
-				case DiscardOnlyIfExpressionFailed:
-					if result.ExpressionPass == true {
-						u.Results[cr.ID] = result
-					}
-				}
-			}
+	used := map[string]bool{}
+	if err := referencedVariables(ei, r, used); err != nil {
+		return nil, err
+	}
 
-			if o.StopFirstPositiveChild && result.Pass {
-				break done
-			}
+	names := make([]string, 0, len(used))
+	for n := range used {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names, nil
+}
 
-			if o.StopFirstNegativeChild && !result.Pass {
-				break done
-			}
-		}
+// referencedVariables adds the schema elements referenced by the rule's
+// expressions to used
+func referencedVariables(ei ExpressionInspector, r *Rule, used map[string]bool) error {
+	exprs := []string{r.Expr, r.Message, r.ShardCondition}
+	for _, o := range r.Outputs {
+		exprs = append(exprs, o)
 	}
 
-	// Based on the results of the child rules, determine the result of the parent rule
-	switch r.EvalOptions.TrueIfAny {
-	case true:
-		if u.ExpressionPass {
-			// If none of the child rules passed AND the parent's expression passed, the rule
-			// shouldn't pass
-			hasChildren := len(r.Rules) > 0
-			if hasChildren && passCount == 0 {
-				u.Pass = false
-			}
+	for _, expr := range exprs {
+		names, err := ei.ReferencedVariables(expr, r.Schema)
+		if err != nil {
+			return fmt.Errorf("rule %s: %w", r.ID, err)
 		}
-	case false:
-		// If one or more of child rules failed, we will fail also, regardless of the parent rule's result
-		if failCount > 0 {
-			u.Pass = false
+		for _, n := range names {
+			used[n] = true
 		}
 	}
-
-	return u, nil
+	return nil
 }
 
-// Compile uses the Evaluator's compile method to check the rule and its children,
-// returning any validation errors. Stores a compiled version of the rule in the
-// rule.Program field (if the compiler returns a program).
-func (e *DefaultEngine) Compile(r *Rule, opts ...CompilationOption) error {
+// UnusedSchemaElements returns the sorted names of the schema elements
+// declared by rules in the tree that no expression in the tree refers to,
+// including the rules' Message, ShardCondition and Outputs expressions.
+// An element is used if any rule
+// refers to it, even if another rule declaring it does not.
+// The evaluator provided to the engine must implement the ExpressionInspector
+// interface.
+func (e *DefaultEngine) UnusedSchemaElements(r *Rule) ([]string, error) {
 	if err := validateCompileArguments(r, e); err != nil {
-		return err
+		return nil, err
 	}
 
-	o := compileOptions{}
-	applyCompilerOptions(&o, opts...)
+	declared := map[string]bool{}
+	used := map[string]bool{}
+	if err := e.collectReferences(r, declared, used); err != nil {
+		return nil, err
+	}
 
-	resultType := r.ResultType
-	if resultType == nil {
-		resultType = Bool{}
+	var unused []string
+	for n := range declared {
+		if !used[n] {
+			unused = append(unused, n)
+		}
+	}
+	sort.Strings(unused)
+	return unused, nil
+}
+
+// collectReferences adds the schema elements declared by the rule and its
+// children to declared, and the ones their expressions refer to to used
+func (e *DefaultEngine) collectReferences(r *Rule, declared, used map[string]bool) error {
+	for _, d := range r.Schema.Elements {
+		declared[d.Name] = true
 	}
 
-	prg, err := e.e.Compile(r.Expr, r.Schema, resultType, o.collectDiagnostics, o.dryRun)
+	ev, err := e.evaluator(r)
 	if err != nil {
 		return fmt.Errorf("rule %s: %w", r.ID, err)
 	}
 
-	if !o.dryRun {
-		r.Program = prg
+	ei, ok := ev.(ExpressionInspector)
+	if !ok {
+		return fmt.Errorf("evaluator %T does not support inspecting expressions", ev)
 	}
 
-	for _, cr := range r.Rules {
-		err := e.Compile(cr, opts...)
-		if err != nil {
+	if err := referencedVariables(ei, r, used); err != nil {
+		return err
+	}
+
+	for _, c := range r.Rules {
+		if err := e.collectReferences(c, declared, used); err != nil {
 			return err
 		}
 	}
+	return nil
+}
 
-	r.sortedRules = r.sortChildRules(r.EvalOptions.SortFunc, true)
+// CheckExpression compiles the expression with the schema, without a rule,
+// and returns a *CompileError describing the problems found, or nil if the
+// expression is valid. If the result type is nil, the expression must
+// produce a boolean, as for rules. The compiled program is discarded.
+// Use it to validate expressions as they are edited.
+func (e *DefaultEngine) CheckExpression(expr string, s Schema, resultType Type) error {
+	if e == nil || e.e == nil {
+		return fmt.Errorf("evaluator is nil")
+	}
+
+	r := &Rule{Expr: expr, Schema: s, ResultType: resultType}
+	ev, err := e.evaluator(r)
+	if err != nil {
+		return newCompileError(r, err)
+	}
+
+	_, err = ev.Compile(expr, s, defaultResultType(r), false, true)
+	if err == nil {
+		err = checkDefaults(s)
+	}
+	if err != nil {
+		return newCompileError(r, err)
+	}
+	return nil
+}
+
+// checkAllowedFields returns an error if the rule's expression refers to
+// schema elements not in the rule's AllowedFields
+func checkAllowedFields(ev ExpressionCompiler, r *Rule) error {
+	if r.AllowedFields == nil {
+		return nil
+	}
+
+	ei, ok := ev.(ExpressionInspector)
+	if !ok {
+		return fmt.Errorf("evaluator %T does not support inspecting expressions, required by AllowedFields", ev)
+	}
 
+	names, err := ei.ReferencedVariables(r.Expr, r.Schema)
+	if err != nil {
+		return err
+	}
+
+	allowed := make(map[string]bool, len(r.AllowedFields))
+	for _, f := range r.AllowedFields {
+		allowed[f] = true
+	}
+
+	for _, n := range names {
+		if !allowed[n] {
+			return fmt.Errorf("expression refers to %s, which is not in the rule's allowed fields", n)
+		}
+	}
 	return nil
 }
 
@@ -247,8 +1382,21 @@ type EvalOptions struct {
 	// the parent rule itself is true.
 	// Setting TrueIfAny changes this behvior so that the parent rule is true if at least one of its child rules
 	// are true, and the parent rule itself is true.
+	// Only the value set on the rule is used, not an engine default (see
+	// WithDefaultEvalOptions).
 	TrueIfAny bool `json:"true_if_any"`
 
+	// PassFunc determines whether a parent rule passes, given the result of
+	// the parent rule and the results of all its evaluated child rules,
+	// including those discarded from the parent's results. When the parent
+	// is called, self.Pass is the outcome of its own expression.
+	// If set, PassFunc takes precedence over TrueIfAny and the default rule
+	// that all child rules must pass. Like TrueIfAny, only the value set on
+	// the rule is used, not an engine default or the value passed as an
+	// option to Eval.
+	// Use case: quorums ("at least 2 of 3 child rules") or weighted scores.
+	PassFunc func(self *Result, children map[string]*Result) bool `json:"-"`
+
 	// StopIfParentNegative prevents the evaluation of child rules if the parent's expression is false.
 	// Use case: apply a "global" rule to all the child rules.
 	StopIfParentNegative bool `json:"stop_if_parent_negative"`
@@ -271,11 +1419,176 @@ type EvalOptions struct {
 	// Default: all rules are returned
 	DiscardFail FailAction
 
+	// The maximum number of child results to keep. Child rules are still
+	// evaluated, and their pass/fail still determines the parent's, but only
+	// the first MaxChildResults results not discarded by DiscardPass or
+	// DiscardFail are returned. Use with SortFunc to return the "top N" child rules.
+	// Default: 0, meaning all results are returned
+	MaxChildResults int `json:"max_child_results"`
+
+	// The maximum number of rules to evaluate in a single call to Eval.
+	// If evaluating the rule tree requires more evaluations, Eval
+	// stops and returns ErrEvaluationBudgetExceeded.
+	// The limit applies to the whole evaluation, so only the value set on
+	// the rule passed to Eval, or passed as an option to Eval, is used.
+	// Default: 0, meaning no limit
+	MaxEvaluations int `json:"max_evaluations"`
+
+	// The maximum depth of the rule tree to evaluate, where the rule passed
+	// to Eval is at depth 1. If the rule tree is deeper, Eval stops and
+	// returns ErrMaxDepthExceeded, without evaluating the rules below the
+	// limit. Like MaxEvaluations, only the value set on the rule passed to
+	// Eval, or passed as an option to Eval, is used.
+	// Default: 0, meaning no limit
+	MaxDepth int `json:"max_depth"`
+
+	// The number of goroutines EvalBatch uses to evaluate data items
+	// concurrently. Not used by Eval.
+	// Default: 0, meaning items are evaluated one at a time
+	BatchWorkers int `json:"-"`
+
+	// A seed for custom functions that use randomness, such as sampling.
+	// If set, the seed is made available to the expressions of all the rules
+	// in the evaluation in the input data, with the reserved key name "seed".
+	// The schema must declare it as an Int. If the data passed to Eval
+	// already has a "seed" value, Eval returns an error. Custom functions
+	// taking the seed as an argument give the same outcome for the same seed.
+	// Like MaxEvaluations, only the value set on the rule passed to Eval, or
+	// passed as an option to Eval, is used.
+	// Default: nil, meaning no seed is provided
+	Seed *int64 `json:"seed,omitempty"`
+
+	// Never modify the data passed to Eval. By default, the engine sets and
+	// removes the "self" key in the data map while evaluating rules with
+	// Self set, to avoid copying the map for each rule; a "self" key in the
+	// caller's data may therefore be changed or removed. With this option,
+	// Eval makes one shallow copy of the data before evaluating the rules.
+	// The values in the map are not copied.
+	// Like MaxEvaluations, only the value set on the rule passed to Eval, or
+	// passed as an option to Eval, is used.
+	// Default: false
+	ImmutableData bool `json:"immutable_data"`
+
+	// Cache the values of the rules' expressions; see ResultCache.
+	// Default: nil, meaning values are not cached
+	ResultCache *ResultCache `json:"-"`
+
+	// The time used to decide whether rules are effective; see
+	// Rule.EffectiveFrom and Rule.EffectiveTo. Child rules that are not
+	// effective at the evaluation time are skipped: they are not evaluated,
+	// and are omitted from the results. Like MaxEvaluations, only the value
+	// set on the rule passed to Eval, or passed as an option to Eval, is used.
+	// Default: the time Eval is called
+	EvaluationTime time.Time `json:"-"`
+
+	// The current time, made available to the rules whose schema declares a
+	// Timestamp element named "now", if the data has no "now" value. The time
+	// is passed as a protocol buffer timestamp. Every rule in the tree sees the
+	// same time, and callers don't have to add it to the data.
+	// Default: "now" is not added
+	InjectNow time.Time `json:"-"`
+
+	// Evaluate child rules concurrently, while keeping the outcome the same
+	// as sequential evaluation. All child rules are evaluated, then the
+	// results are processed in order (see Rule.Order and SortFunc; if
+	// neither is set, in order of rule ID), applying StopFirstPositiveChild
+	// and StopFirstNegativeChild as if the child rules had been evaluated
+	// one at a time. Results after the stopping point are discarded.
+	// The evaluator must be safe for concurrent use.
+	// Default: child rules are evaluated sequentially
+	ParallelOrdered ParallelConfig `json:"parallel_ordered"`
+
+	// Evaluate the subtree of each child rule of the rule passed to Eval in
+	// its own goroutine, using at most this many goroutines. The rules within
+	// a subtree are evaluated sequentially, unless ParallelOrdered is also
+	// set. Like ParallelOrdered, the outcome is the same as sequential
+	// evaluation, and the evaluator must be safe for concurrent use.
+	// Only the value set on the rule passed to Eval, or passed as an option
+	// to Eval, is used.
+	// Default: 0, meaning subtrees are evaluated sequentially
+	ParallelSubtrees int `json:"parallel_subtrees"`
+
+	// Stop the whole evaluation as soon as any rule fails, and report the
+	// failed rule's ID in Result.FirstFailure. Unlike StopFirstNegativeChild,
+	// which stops evaluating the failed rule's siblings, no further rules are
+	// evaluated anywhere in the tree: the child rules of the failed rule are
+	// skipped, and each of its ancestors stops evaluating its child rules.
+	// Eval returns the partial results. Rules are processed in evaluation
+	// order, so with parallel evaluation the reported rule is the same as
+	// with sequential evaluation. Like MaxEvaluations, only the value set on
+	// the rule passed to Eval, or passed as an option to Eval, is used.
+	// Default: false
+	StopOnFirstFailure bool `json:"stop_on_first_failure"`
+
+	// Record errors evaluating a rule's expression in the rule's Result.Error,
+	// and continue evaluating the other rules, instead of stopping the
+	// evaluation and returning the error. A rule whose evaluation failed does
+	// not pass, and its child rules are not evaluated (see
+	// EvaluateChildrenOnParentError). Errors that stop the
+	// whole evaluation, such as ErrEvaluationBudgetExceeded or a cancelled
+	// context, are still returned by Eval.
+	// Default: Eval returns the first error
+	CollectErrors bool `json:"collect_errors"`
+
+	// The longest time to wait for the evaluator to evaluate a rule's
+	// expression. A rule that takes longer fails with an error wrapping
+	// ErrRuleTimeout; with CollectErrors, the error is recorded in the rule's
+	// Result.Error and the other rules are evaluated. Evaluators can't be
+	// interrupted, so the evaluation of a rule that timed out continues in the
+	// background until the evaluator returns, and the evaluator must be safe
+	// for concurrent use. Each rule gets its own copy of the data map, at
+	// some cost.
+	// Default: 0, meaning no timeout
+	PerRuleTimeout time.Duration `json:"per_rule_timeout"`
+
+	// Include the rule's expression and schema ID in errors evaluating the
+	// rule, to make them easier to act on. Since the expressions may reveal
+	// how decisions are made, the errors only include the rule ID by default.
+	// Default: false
+	VerboseErrors bool `json:"verbose_errors"`
+
+	// Evaluate the child rules of a rule whose expression failed to evaluate,
+	// for rules that only group independent child rules. The error is
+	// recorded in the rule's Result.Error, as with CollectErrors, even if
+	// CollectErrors is not set, and the rule does not pass. Errors evaluating
+	// rules without child rules are handled as usual.
+	// Default: the child rules are not evaluated
+	EvaluateChildrenOnParentError bool `json:"evaluate_children_on_parent_error"`
+
+	// Treat a rule whose expression refers to data missing from the input as
+	// having an unknown outcome, rather than returning an error. The rule's
+	// Result.State is StateUnknown and Pass is false. The evaluator must report
+	// missing data by returning an error wrapping ErrMissingData.
+	// Default: missing data is an error
+	UnknownOnMissingData bool `json:"unknown_on_missing_data"`
+
+	// Evaluate the rules with the named inputs treated as not yet known, such
+	// as "student" or "student.gpa". A rule whose expression depends on an
+	// unknown input has an unknown outcome: its Result.State is StateUnknown
+	// and Pass is false. A rule whose outcome doesn't depend on the unknown
+	// inputs, such as "false && student.gpa > 3.0", is evaluated as usual.
+	// Child rules with an unknown outcome affect the parent rule as set by
+	// UnknownChildren. The evaluator must implement PartialEvaluator.
+	// Default: all inputs are known
+	PartialEval []string `json:"partial_eval,omitempty"`
+
+	// Decide how child rules with an unknown outcome affect the parent rule.
+	// Default: a parent rule with unknown children, and no children that
+	// decide its outcome, is unknown.
+	UnknownChildren UnknownAction `json:"unknown_children"`
+
 	// Include diagnostic information with the results.
 	// To enable this option, you must first turn on diagnostic
 	// collection at the engine level with the CollectDiagnostics EngineOption.
 	ReturnDiagnostics bool `json:"return_diagnostics"`
 
+	// Record the data each rule was evaluated with in Result.Data, together
+	// with the diagnostics. The data seen by a child rule can differ from the
+	// data passed to Eval: it includes the rule's Self under the "self" key
+	// and the values of its ancestors' ResultKeys, and schema defaults for
+	// missing elements. Only used if ReturnDiagnostics is set.
+	CaptureData bool `json:"capture_data"`
+
 	// Specify the function used to sort the child rules before evaluation.
 	// Useful in scenarios where you are asking the engine to stop evaluating
 	// after either the first negative or first positive child in order to
@@ -287,6 +1600,15 @@ type EvalOptions struct {
 	// Default: No sort
 	SortFunc func(rules []*Rule, i, j int) bool `json:"-"`
 
+	// BeforeRule is called with the rule and the input data right before the
+	// rule's expression is evaluated, for every rule evaluated, in evaluation
+	// order. It is called synchronously, so a slow callback slows down the
+	// evaluation. With ParallelOrdered or ParallelSubtrees, it is called
+	// from several goroutines at once and must be safe for concurrent use.
+	// The callback must not modify the data.
+	// Use case: audit logging of the rules executed and their inputs.
+	BeforeRule func(ctx context.Context, r *Rule, d map[string]interface{}) `json:"-"`
+
 	// this special field is updated by the SortFunc option. It is necessary
 	// because we need to know if the local rule-specific sort funtion
 	// is being overriden by the a global option.
@@ -317,6 +1639,36 @@ const (
 	DiscardOnlyIfExpressionFailed
 )
 
+// UnknownAction is used to tell Indigo how to treat child rules whose
+// outcome is unknown when determining the outcome of the parent rule.
+type UnknownAction int
+
+const (
+	// UnknownIsUnknown means that unknown child rules make the parent
+	// rule unknown, unless the outcome of the parent is decided by other
+	// child rules (for example, a failed child rule).
+	UnknownIsUnknown UnknownAction = iota
+
+	// UnknownIsPass means that unknown child rules count as passed.
+	UnknownIsPass
+
+	// UnknownIsFail means that unknown child rules count as failed.
+	UnknownIsFail
+)
+
+// ParallelConfig specifies how child rules are evaluated concurrently.
+// See EvalOptions.ParallelOrdered.
+type ParallelConfig struct {
+	// The minimum number of child rules a rule must have for its child rules
+	// to be evaluated concurrently
+	MinSize int `json:"min_size"`
+	// The number of child rules evaluated by a goroutine at a time
+	BatchSize int `json:"batch_size"`
+	// The maximum number of goroutines evaluating the child rules of a rule;
+	// 0 disables parallel evaluation
+	MaxParallel int `json:"max_parallel"`
+}
+
 // EvalOption is a functional option for specifying how evaluations behave.
 type EvalOption func(f *EvalOptions)
 
@@ -329,6 +1681,14 @@ func ReturnDiagnostics(b bool) EvalOption {
 	}
 }
 
+// CaptureData specifies that the data each rule was evaluated with should be
+// returned with the diagnostics. See EvalOptions.CaptureData.
+func CaptureData(b bool) EvalOption {
+	return func(f *EvalOptions) {
+		f.CaptureData = b
+	}
+}
+
 // SortFunc specifies the function used to sort child rules before evaluation.
 // Sorting is only performed if the evaluation order of the child rules is important (i.e.,
 // if an option such as StopFirstNegativeChild is set).
@@ -353,6 +1713,174 @@ func DiscardPass(b bool) EvalOption {
 	}
 }
 
+// MaxChildResults specifies the maximum number of child results to return
+// for each parent rule. A value of 0 or less returns all results.
+func MaxChildResults(n int) EvalOption {
+	return func(f *EvalOptions) {
+		f.MaxChildResults = n
+	}
+}
+
+// MaxEvaluations limits the number of rules evaluated in a single call to Eval.
+// A value of 0 or less means no limit.
+func MaxEvaluations(n int) EvalOption {
+	return func(f *EvalOptions) {
+		f.MaxEvaluations = n
+	}
+}
+
+// MaxDepth limits the depth of the rule tree evaluated in a single call to
+// Eval. A value of 0 or less means no limit.
+func MaxDepth(n int) EvalOption {
+	return func(f *EvalOptions) {
+		f.MaxDepth = n
+	}
+}
+
+// ImmutableData guarantees that Eval does not modify the data map passed to
+// it, at the cost of copying the map once per evaluation.
+func ImmutableData(b bool) EvalOption {
+	return func(f *EvalOptions) {
+		f.ImmutableData = b
+	}
+}
+
+// WithResultCache caches the values of the rules' expressions in the cache,
+// and uses the cached values when the rules are evaluated again with the
+// same data. See ResultCache.
+func WithResultCache(c *ResultCache) EvalOption {
+	return func(f *EvalOptions) {
+		f.ResultCache = c
+	}
+}
+
+// EvaluateChildrenOnParentError evaluates the child rules of rules whose
+// expressions fail to evaluate. See EvalOptions.EvaluateChildrenOnParentError.
+func EvaluateChildrenOnParentError(b bool) EvalOption {
+	return func(f *EvalOptions) {
+		f.EvaluateChildrenOnParentError = b
+	}
+}
+
+// StopOnFirstFailure stops the evaluation of the whole rule tree when a rule
+// fails. See EvalOptions.StopOnFirstFailure.
+func StopOnFirstFailure(b bool) EvalOption {
+	return func(f *EvalOptions) {
+		f.StopOnFirstFailure = b
+	}
+}
+
+// PerRuleTimeout limits the time the evaluator may take to evaluate each
+// rule's expression. See EvalOptions.PerRuleTimeout.
+func PerRuleTimeout(d time.Duration) EvalOption {
+	return func(f *EvalOptions) {
+		f.PerRuleTimeout = d
+	}
+}
+
+// VerboseErrors includes the rules' expressions and schema IDs in evaluation
+// errors. See EvalOptions.VerboseErrors.
+func VerboseErrors(b bool) EvalOption {
+	return func(f *EvalOptions) {
+		f.VerboseErrors = b
+	}
+}
+
+// EvaluationTime sets the time used to decide whether rules are effective.
+// See Rule.EffectiveFrom and Rule.EffectiveTo.
+func EvaluationTime(t time.Time) EvalOption {
+	return func(f *EvalOptions) {
+		f.EvaluationTime = t
+	}
+}
+
+// InjectNow provides the time as "now" to rules whose schema declares it,
+// if the data doesn't. See EvalOptions.InjectNow.
+func InjectNow(t time.Time) EvalOption {
+	return func(f *EvalOptions) {
+		f.InjectNow = t
+	}
+}
+
+// BatchWorkers specifies the number of goroutines EvalBatch uses to
+// evaluate data items concurrently.
+func BatchWorkers(n int) EvalOption {
+	return func(f *EvalOptions) {
+		f.BatchWorkers = n
+	}
+}
+
+// ParallelRecords specifies the number of goroutines EvalRecords uses to
+// evaluate the records concurrently. It is the same as BatchWorkers.
+func ParallelRecords(n int) EvalOption {
+	return BatchWorkers(n)
+}
+
+// WithSeed provides a seed to custom functions that use randomness, making
+// their outcome reproducible. The seed is added to the data under the
+// reserved key "seed", which the data must not already have. See
+// EvalOptions.Seed.
+func WithSeed(seed int64) EvalOption {
+	return func(f *EvalOptions) {
+		f.Seed = &seed
+	}
+}
+
+// ParallelOrdered evaluates the child rules of rules with at least minSize
+// children concurrently, in batches of batchSize, using at most maxParallel
+// goroutines per rule, while keeping the outcome the same as sequential
+// evaluation. See EvalOptions.ParallelOrdered.
+func ParallelOrdered(minSize, batchSize, maxParallel int) EvalOption {
+	return func(f *EvalOptions) {
+		f.ParallelOrdered = ParallelConfig{
+			MinSize:     minSize,
+			BatchSize:   batchSize,
+			MaxParallel: maxParallel,
+		}
+	}
+}
+
+// ParallelSubtrees evaluates the subtrees of the child rules of the rule
+// passed to Eval concurrently, using at most maxParallel goroutines.
+// See EvalOptions.ParallelSubtrees.
+func ParallelSubtrees(maxParallel int) EvalOption {
+	return func(f *EvalOptions) {
+		f.ParallelSubtrees = maxParallel
+	}
+}
+
+// CollectErrors specifies whether errors evaluating rules are recorded in
+// the rules' results, instead of stopping the evaluation.
+func CollectErrors(b bool) EvalOption {
+	return func(f *EvalOptions) {
+		f.CollectErrors = b
+	}
+}
+
+// UnknownOnMissingData specifies whether a rule referring to missing data
+// has an unknown outcome instead of returning an error.
+func UnknownOnMissingData(b bool) EvalOption {
+	return func(f *EvalOptions) {
+		f.UnknownOnMissingData = b
+	}
+}
+
+// PartialEval evaluates the rules with the named inputs treated as not yet
+// known. See EvalOptions.PartialEval.
+func PartialEval(unknownVars ...string) EvalOption {
+	return func(f *EvalOptions) {
+		f.PartialEval = unknownVars
+	}
+}
+
+// UnknownChildren specifies how child rules with an unknown outcome
+// affect the parent rule.
+func UnknownChildren(a UnknownAction) EvalOption {
+	return func(f *EvalOptions) {
+		f.UnknownChildren = a
+	}
+}
+
 // StopIfParentNegative prevents the evaluation of child rules if the
 // parent rule itself is negative.
 func StopIfParentNegative(b bool) EvalOption {
@@ -377,6 +1905,14 @@ func StopFirstPositiveChild(b bool) EvalOption {
 	}
 }
 
+// BeforeRule sets a function called right before each rule's expression is
+// evaluated. See EvalOptions.BeforeRule.
+func BeforeRule(f func(ctx context.Context, r *Rule, d map[string]interface{})) EvalOption {
+	return func(o *EvalOptions) {
+		o.BeforeRule = f
+	}
+}
+
 // See the EvalOptions struct for documentation.
 func applyEvaluatorOptions(o *EvalOptions, opts ...EvalOption) {
 	for _, opt := range opts {
@@ -384,6 +1920,55 @@ func applyEvaluatorOptions(o *EvalOptions, opts ...EvalOption) {
 	}
 }
 
+// evalOptions returns the options for evaluating the rule: the engine's
+// default options, replaced by the options set on the rule, and then by the
+// options passed to Eval
+func (e *DefaultEngine) evalOptions(r *Rule, opts ...EvalOption) EvalOptions {
+	o := r.EvalOptions
+	if e.defaults != nil {
+		o = mergeEvalOptions(*e.defaults, r.EvalOptions)
+		// How the child rules decide the outcome is part of the rule, so
+		// the defaults don't apply to TrueIfAny and PassFunc
+		o.TrueIfAny, o.PassFunc = r.EvalOptions.TrueIfAny, r.EvalOptions.PassFunc
+	}
+	applyEvaluatorOptions(&o, opts...)
+	return o
+}
+
+// mergeEvalOptions returns the base options with the exported fields that are
+// set in o (not the zero value) replaced by the values in o
+func mergeEvalOptions(base, o EvalOptions) EvalOptions {
+	bv := reflect.ValueOf(&base).Elem()
+	ov := reflect.ValueOf(o)
+	for i := 0; i < ov.NumField(); i++ {
+		if f := ov.Field(i); ov.Type().Field(i).IsExported() && !f.IsZero() {
+			bv.Field(i).Set(f)
+		}
+	}
+	// The child rules were sorted by the rule's own SortFunc when compiled,
+	// so a default SortFunc must be applied when evaluating, like a SortFunc
+	// passed to Eval
+	if o.SortFunc == nil && base.SortFunc != nil {
+		base.overrideSort = true
+	}
+	return base
+}
+
+// evaluator returns the evaluator for the rule: the evaluator registered under
+// the rule's Evaluator tag if the engine uses a CompositeEvaluator, otherwise
+// the engine's evaluator. Tagged rules require a CompositeEvaluator.
+func (e *DefaultEngine) evaluator(r *Rule) (ExpressionCompilerEvaluator, error) {
+	c, ok := e.e.(*CompositeEvaluator)
+	switch {
+	case ok:
+		return c.evaluatorFor(r.Evaluator)
+	case r.Evaluator != "":
+		return nil, fmt.Errorf("evaluator tag %q requires a CompositeEvaluator", r.Evaluator)
+	default:
+		return e.e, nil
+	}
+}
+
 // validateEvalArguments checks the input parameters to engine.Eval
 func validateEvalArguments(r *Rule, e *DefaultEngine, d map[string]interface{}) error {
 
@@ -401,6 +1986,97 @@ func validateEvalArguments(r *Rule, e *DefaultEngine, d map[string]interface{})
 	}
 }
 
+// checkDefaults returns an error if the default value of a schema element
+// is not assignable to the element's type
+func checkDefaults(s Schema) error {
+	for i := range s.Elements {
+		if err := s.Elements[i].checkDefault(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// withDefaults returns the data with the default values of the schema elements
+// missing from the data. If no defaults are needed, the data is returned as is,
+// otherwise a copy is returned, leaving the caller's data unchanged.
+func withDefaults(s Schema, d map[string]interface{}) map[string]interface{} {
+	var c map[string]interface{}
+	for _, el := range s.Elements {
+		if el.Default == nil {
+			continue
+		}
+		if _, ok := d[el.Name]; ok {
+			continue
+		}
+		if c == nil {
+			c = copyData(d)
+		}
+		c[el.Name] = el.Default
+	}
+	if c == nil {
+		return d
+	}
+	return c
+}
+
+// withNow returns the data with the time under the "now" key, as a protocol
+// buffer timestamp, if the schema declares it as a Timestamp and the data
+// has no value for it. The data is copied if the time is added.
+func withNow(s Schema, d map[string]interface{}, t time.Time) map[string]interface{} {
+	if t.IsZero() {
+		return d
+	}
+	if _, ok := d[nowKey]; ok {
+		return d
+	}
+	for _, el := range s.Elements {
+		if _, ok := el.Type.(Timestamp); ok && el.Name == nowKey {
+			return overlay(d, nowKey, timestamppb.New(t))
+		}
+	}
+	return d
+}
+
+// ruleData returns the data for evaluating the rule on its own, as in
+// EvalValue: with the seed, or copied if ImmutableData is set, and with the
+// schema's defaults, "now" and the rule's self
+func ruleData(r *Rule, d map[string]interface{}, o EvalOptions) (map[string]interface{}, error) {
+	switch {
+	case o.Seed != nil:
+		var err error
+		if d, err = withSeed(d, *o.Seed); err != nil {
+			return nil, fmt.Errorf("rule %s: %w", r.ID, err)
+		}
+	case o.ImmutableData:
+		d = copyData(d)
+	}
+	d = withDefaults(r.Schema, d)
+	d = withNow(r.Schema, d, o.InjectNow)
+	setSelfKey(r, d)
+	return d, nil
+}
+
+// withSeed returns a copy of the data with the seed under the reserved key
+// "seed". A value for the key in the data is an error, rather than being
+// replaced by the seed.
+func withSeed(d map[string]interface{}, seed int64) (map[string]interface{}, error) {
+	if _, ok := d[seedKey]; ok {
+		return nil, fmt.Errorf("the data has a value for %q, the key reserved for the seed", seedKey)
+	}
+	return overlay(d, seedKey, seed), nil
+}
+
+// overlay returns a copy of the data with the value added under the key
+func overlay(d map[string]interface{}, key string, value interface{}) map[string]interface{} {
+	c := make(map[string]interface{}, len(d)+1)
+	for k, v := range d {
+		c[k] = v
+	}
+	c[key] = value
+	return c
+}
+
 func setSelfKey(r *Rule, d map[string]interface{}) {
 	if d == nil {
 		return
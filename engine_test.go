@@ -6,7 +6,10 @@ import (
 	"errors"
 	"fmt"
 	"reflect"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -216,6 +219,359 @@ func TestSelf(t *testing.T) {
 	is.Equal(result.Results["D"].Results["d1"].ExpressionPass, false) // d1 should not inherit D's self
 }
 
+// Test that the ImmutableData option leaves the caller's data unchanged
+func TestImmutableData(t *testing.T) {
+	is := is.New(t)
+
+	r := &indigo.Rule{
+		ID:   "root",
+		Expr: `true`,
+		Rules: map[string]*indigo.Rule{
+			"child": {ID: "child", Expr: `self`, Self: 22},
+		},
+	}
+
+	e := indigo.NewEngine(newMockEvaluator())
+	is.NoErr(e.Compile(r))
+
+	// By default, the engine sets 'self' in the caller's map
+	d := map[string]interface{}{"a": 1}
+	_, err := e.Eval(context.Background(), r, d)
+	is.NoErr(err)
+	is.Equal(d["self"], 22)
+
+	d = map[string]interface{}{"a": 1, "self": "mine"}
+	before := fmt.Sprintf("%#v", d)
+	u, err := e.Eval(context.Background(), r, d, indigo.ImmutableData(true))
+	is.NoErr(err)
+	is.Equal(u.Results["child"].Value, 22) // the child still sees its own self
+	is.Equal(fmt.Sprintf("%#v", d), before)
+}
+
+func TestDefaultEvalOptions(t *testing.T) {
+	is := is.New(t)
+
+	r := &indigo.Rule{
+		ID:   "root",
+		Expr: `true`,
+		Rules: map[string]*indigo.Rule{
+			"a": {ID: "a", Expr: `true`},
+			"b": {ID: "b", Expr: `true`},
+			"c": {ID: "c", Expr: `true`},
+			"d": {ID: "d", Expr: `true`},
+			"x": {ID: "x", Expr: `false`},
+		},
+	}
+
+	e := indigo.NewEngine(newMockEvaluator(), indigo.WithDefaultEvalOptions(indigo.EvalOptions{
+		DiscardFail:     indigo.Discard,
+		MaxChildResults: 1,
+	}))
+	is.NoErr(e.Compile(r))
+
+	// Engine defaults
+	u, err := e.Eval(context.Background(), r, map[string]interface{}{})
+	is.NoErr(err)
+	is.Equal(len(u.Results), 1)
+	is.Equal(u.EvalOptions.DiscardFail, indigo.Discard)
+
+	// The rule's options take precedence over the defaults; the other
+	// defaults still apply
+	r.EvalOptions.MaxChildResults = 2
+	u, err = e.Eval(context.Background(), r, map[string]interface{}{})
+	is.NoErr(err)
+	is.Equal(len(u.Results), 2)
+	is.Equal(u.EvalOptions.DiscardFail, indigo.Discard)
+
+	// The options passed to Eval take precedence over both
+	u, err = e.Eval(context.Background(), r, map[string]interface{}{},
+		indigo.MaxChildResults(0), indigo.DiscardFail(indigo.KeepAll))
+	is.NoErr(err)
+	is.Equal(len(u.Results), 5)
+	is.True(!u.Pass)
+
+	// The rule's options are not changed
+	is.Equal(r.EvalOptions, indigo.EvalOptions{MaxChildResults: 2})
+
+	// Without defaults, only the rule's options are used
+	e = indigo.NewEngine(newMockEvaluator())
+	is.NoErr(e.Compile(r))
+	u, err = e.Eval(context.Background(), r, map[string]interface{}{})
+	is.NoErr(err)
+	is.Equal(len(u.Results), 2)
+	is.Equal(u.EvalOptions.DiscardFail, indigo.KeepAll)
+
+	// TrueIfAny is only used if set on the rule: with a default TrueIfAny,
+	// a rule without it still requires all its children to pass
+	e = indigo.NewEngine(newMockEvaluator(), indigo.WithDefaultEvalOptions(indigo.EvalOptions{TrueIfAny: true}))
+	is.NoErr(e.Compile(r))
+	u, err = e.Eval(context.Background(), r, map[string]interface{}{})
+	is.NoErr(err)
+	is.True(!u.Pass)
+	is.True(!u.EvalOptions.TrueIfAny)
+
+	r.EvalOptions.TrueIfAny = true
+	u, err = e.Eval(context.Background(), r, map[string]interface{}{})
+	is.NoErr(err)
+	is.True(u.Pass)
+}
+
+func TestStopOnFirstFailure(t *testing.T) {
+	is := is.New(t)
+
+	r := makeRule()
+	e := indigo.NewEngine(newMockEvaluator())
+	is.NoErr(e.Compile(r))
+	d := map[string]interface{}{}
+	alpha := indigo.SortFunc(indigo.SortRulesAlpha)
+
+	// Without the option, the whole tree is evaluated
+	u, err := e.Eval(context.Background(), r, d, alpha)
+	is.NoErr(err)
+	is.Equal(u.FirstFailure, "")
+	is.Equal(u.EvalCount, r.Size())
+
+	// B's expression fails, so its children and siblings are skipped
+	u, err = e.Eval(context.Background(), r, d, alpha, indigo.StopOnFirstFailure(true))
+	is.NoErr(err)
+	is.True(!u.Pass)
+	is.Equal(u.FirstFailure, "B")
+	is.Equal(u.EvalCount, 2)
+	is.Equal(len(u.Results), 1)
+	is.Equal(u.Results["B"].FirstFailure, "B")
+	is.Equal(len(u.Results["B"].Results), 0)
+
+	// With B passing, its second child is the first failure
+	r.Rules["B"].Expr = `true`
+	is.NoErr(e.Compile(r))
+	u, err = e.Eval(context.Background(), r, d, alpha, indigo.StopOnFirstFailure(true))
+	is.NoErr(err)
+	is.Equal(u.FirstFailure, "b2")
+	is.Equal(u.EvalCount, 4) // rule1, B, b1, b2
+	is.Equal(len(u.Results), 1)
+	is.Equal(len(u.Results["B"].Results), 2)
+	is.True(!u.Results["B"].Pass)
+
+	j, err := u.ToJSON()
+	is.NoErr(err)
+	is.True(strings.Contains(string(j), `"first_failure":"b2"`))
+
+	// The option can be set on the rule passed to Eval
+	r.EvalOptions.StopOnFirstFailure = true
+	r.Expr = `false`
+	is.NoErr(e.Compile(r))
+	u, err = e.Eval(context.Background(), r, d, alpha)
+	is.NoErr(err)
+	is.Equal(u.FirstFailure, "rule1")
+	is.Equal(u.EvalCount, 1)
+
+	// Parallel evaluation reports the same rule
+	r.Expr = `true`
+	e = indigo.NewEngine(&concurrencyEvaluator{})
+	is.NoErr(e.Compile(r))
+	u, err = e.Eval(context.Background(), r, d, alpha, indigo.ParallelOrdered(0, 1, 4))
+	is.NoErr(err)
+	is.Equal(u.FirstFailure, "b2")
+}
+
+// Test selecting the passing rule with the highest priority
+func TestSortRulesPriority(t *testing.T) {
+	is := is.New(t)
+
+	r := &indigo.Rule{
+		ID:   "discount",
+		Expr: `true`,
+		Rules: map[string]*indigo.Rule{
+			"student":  {ID: "student", Expr: `true`, Priority: 10},
+			"senior":   {ID: "senior", Expr: `false`, Priority: 20},
+			"employee": {ID: "employee", Expr: `true`, Priority: 30},
+			"veteran":  {ID: "veteran", Expr: `true`, Priority: 30},
+			"default":  {ID: "default", Expr: `true`},
+		},
+		EvalOptions: indigo.EvalOptions{
+			SortFunc:               indigo.SortRulesPriority,
+			StopFirstPositiveChild: true,
+			DiscardFail:            indigo.Discard,
+		},
+	}
+
+	e := indigo.NewEngine(newMockEvaluator())
+	is.NoErr(e.Compile(r))
+
+	var evaluated []string
+	before := indigo.BeforeRule(func(ctx context.Context, r *indigo.Rule, d map[string]interface{}) {
+		evaluated = append(evaluated, r.ID)
+	})
+
+	// Rules with the same priority are sorted by ID
+	u, err := e.Eval(context.Background(), r, map[string]interface{}{}, before)
+	is.NoErr(err)
+	is.Equal(evaluated, []string{"discount", "employee"})
+	is.Equal(len(u.Results), 1)
+	is.True(u.Results["employee"].Pass)
+
+	// The failing rule with a higher priority is skipped over
+	r.Rules["employee"].Expr = `false`
+	r.Rules["veteran"].Expr = `false`
+	evaluated = nil
+	u, err = e.Eval(context.Background(), r, map[string]interface{}{}, before)
+	is.NoErr(err)
+	is.Equal(evaluated, []string{"discount", "employee", "veteran", "senior", "student"})
+	is.Equal(len(u.Results), 1)
+	is.True(u.Results["student"].Pass)
+
+	// The priority is part of the rule's definition
+	h := r.Hash()
+	r.Rules["default"].Priority = 1
+	is.True(r.Hash() != h)
+}
+
+// Test that the data seen by each rule is returned with the diagnostics
+func TestCaptureData(t *testing.T) {
+	is := is.New(t)
+
+	r := &indigo.Rule{
+		ID:        "root",
+		Expr:      `true`,
+		ResultKey: "root_value",
+		Rules: map[string]*indigo.Rule{
+			"a": {ID: "a", Expr: `self`, Self: true},
+			"b": {ID: "b", Expr: `true`},
+		},
+	}
+
+	e := indigo.NewEngine(newMockEvaluator())
+	is.NoErr(e.Compile(r, indigo.CollectDiagnostics(true)))
+	d := map[string]interface{}{"x": 1}
+
+	u, err := e.Eval(context.Background(), r, d, indigo.ReturnDiagnostics(true), indigo.CaptureData(true))
+	is.NoErr(err)
+	is.Equal(u.Data, map[string]interface{}{"x": 1})
+	is.Equal(u.Results["a"].Data, map[string]interface{}{"x": 1, "self": true, "root_value": true})
+	is.Equal(u.Results["b"].Data, map[string]interface{}{"x": 1, "root_value": true})
+	is.Equal(d, map[string]interface{}{"x": 1})
+
+	// Only with diagnostics
+	u, err = e.Eval(context.Background(), r, d, indigo.CaptureData(true))
+	is.NoErr(err)
+	is.Equal(u.Results["a"].Data, nil)
+
+	u, err = e.Eval(context.Background(), r, d, indigo.ReturnDiagnostics(true))
+	is.NoErr(err)
+	is.Equal(u.Results["a"].Data, nil)
+}
+
+func TestBeforeRule(t *testing.T) {
+	is := is.New(t)
+
+	r := makeRule()
+	e := indigo.NewEngine(newMockEvaluator())
+	is.NoErr(e.Compile(r))
+	d := map[string]interface{}{"x": 1}
+
+	// The rules in the order they are evaluated, with children sorted by ID
+	var want []string
+	var walk func(r *indigo.Rule)
+	walk = func(r *indigo.Rule) {
+		want = append(want, r.ID)
+		ids := make([]string, 0, len(r.Rules))
+		for id := range r.Rules {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			walk(r.Rules[id])
+		}
+	}
+	walk(r)
+
+	var got []string
+	before := indigo.BeforeRule(func(ctx context.Context, r *indigo.Rule, d map[string]interface{}) {
+		is.Equal(d["x"], 1)
+		got = append(got, r.ID)
+	})
+	u, err := e.Eval(context.Background(), r, d, indigo.SortFunc(indigo.SortRulesAlpha), before)
+	is.NoErr(err)
+	is.Equal(got, want)
+	is.Equal(len(got), u.EvalCount)
+
+	// In parallel mode, the callback is called once per rule, in any order
+	var mu sync.Mutex
+	seen := map[string]int{}
+	before = indigo.BeforeRule(func(ctx context.Context, r *indigo.Rule, d map[string]interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		seen[r.ID]++
+	})
+	e = indigo.NewEngine(&concurrencyEvaluator{})
+	is.NoErr(e.Compile(r))
+	_, err = e.Eval(context.Background(), r, d, indigo.ParallelSubtrees(4), before)
+	is.NoErr(err)
+	is.Equal(len(seen), len(want))
+	for _, id := range want {
+		is.Equal(seen[id], 1)
+	}
+}
+
+func TestEvaluateChildrenOnParentError(t *testing.T) {
+	is := is.New(t)
+
+	r := &indigo.Rule{
+		ID:   "root",
+		Expr: `true`,
+		Rules: map[string]*indigo.Rule{
+			"group": {
+				ID:   "group",
+				Expr: `missing`, // the mock evaluator returns an error
+				Rules: map[string]*indigo.Rule{
+					"a": {ID: "a", Expr: `true`},
+					"b": {ID: "b", Expr: `false`},
+					"c": {ID: "c", Expr: `missing`},
+				},
+			},
+		},
+	}
+
+	e := indigo.NewEngine(newMockEvaluator())
+	is.NoErr(e.Compile(r))
+	d := map[string]interface{}{}
+
+	// By default, the error stops the evaluation
+	_, err := e.Eval(context.Background(), r, d)
+	is.True(errors.Is(err, indigo.ErrMissingData))
+
+	// With CollectErrors, the children of the rule are skipped
+	u, err := e.Eval(context.Background(), r, d, indigo.CollectErrors(true))
+	is.NoErr(err)
+	is.True(u.Results["group"].Error != nil)
+	is.Equal(len(u.Results["group"].Results), 0)
+
+	// The parent records the error, and the children are evaluated
+	u, err = e.Eval(context.Background(), r, d, indigo.CollectErrors(true), indigo.EvaluateChildrenOnParentError(true))
+	is.NoErr(err)
+	g := u.Results["group"]
+	is.True(errors.Is(g.Error, indigo.ErrMissingData))
+	is.True(!g.Pass)
+	is.True(!g.ExpressionPass)
+	is.Equal(len(g.Results), 3)
+	is.True(g.Results["a"].Pass)
+	is.True(!g.Results["b"].Pass)
+	is.True(g.Results["c"].Error != nil)
+	is.Equal(u.EvalCount, 5)
+
+	// Without CollectErrors, the parent's error is still recorded, but an
+	// error in a rule without children stops the evaluation
+	_, err = e.Eval(context.Background(), r, d, indigo.EvaluateChildrenOnParentError(true))
+	is.True(err != nil)
+	is.True(strings.HasPrefix(err.Error(), "rule c:"))
+
+	delete(r.Rules["group"].Rules, "c")
+	u, err = e.Eval(context.Background(), r, d, indigo.EvaluateChildrenOnParentError(true))
+	is.NoErr(err)
+	is.True(u.Results["group"].Error != nil)
+	is.Equal(len(u.Results["group"].Results), 2)
+}
+
 // Test that the engine checks for nil data and rule
 func TestNilDataOrRule(t *testing.T) {
 	is := is.New(t)
@@ -1158,3 +1514,1275 @@ func TestTimeout(t *testing.T) {
 	_, err := e.Eval(ctx, r, map[string]interface{}{})
 	is.True(errors.Is(err, context.DeadlineExceeded))
 }
+
+// slowEvaluator takes the time given by an expression such as "slow 50ms" to
+// evaluate it, and is true. Other expressions are true if they are "true".
+type slowEvaluator struct{}
+
+func (slowEvaluator) Compile(expr string, s indigo.Schema, resultType indigo.Type, collectDiagnostics, dryRun bool) (interface{}, error) {
+	return nil, nil
+}
+
+func (slowEvaluator) Evaluate(data map[string]interface{}, expr string, s indigo.Schema, self interface{}, prog interface{}, resultType indigo.Type, returnDiagnostics bool) (interface{}, *indigo.Diagnostics, error) {
+	if d, ok := strings.CutPrefix(expr, "slow "); ok {
+		delay, err := time.ParseDuration(d)
+		if err != nil {
+			return nil, nil, err
+		}
+		time.Sleep(delay)
+		return true, nil, nil
+	}
+	return expr == "true", nil, nil
+}
+
+func TestPerRuleTimeout(t *testing.T) {
+	is := is.New(t)
+
+	r := &indigo.Rule{
+		ID:   "root",
+		Expr: `true`,
+		Rules: map[string]*indigo.Rule{
+			"a":    {ID: "a", Expr: `true`},
+			"slow": {ID: "slow", Expr: `slow 500ms`},
+			"z":    {ID: "z", Expr: `true`},
+		},
+	}
+
+	e := indigo.NewEngine(slowEvaluator{})
+	is.NoErr(e.Compile(r))
+	d := map[string]interface{}{}
+
+	// The slow rule fails, and the others are evaluated
+	start := time.Now()
+	u, err := e.Eval(context.Background(), r, d, indigo.PerRuleTimeout(20*time.Millisecond), indigo.CollectErrors(true))
+	is.NoErr(err)
+	is.True(time.Since(start) < 400*time.Millisecond)
+	is.True(errors.Is(u.Results["slow"].Error, indigo.ErrRuleTimeout))
+	is.True(!u.Results["slow"].Pass)
+	is.True(u.Results["a"].Pass)
+	is.True(u.Results["z"].Pass)
+	is.True(!u.Pass)
+
+	// Without CollectErrors, Eval returns the error
+	_, err = e.Eval(context.Background(), r, d, indigo.PerRuleTimeout(20*time.Millisecond))
+	is.True(errors.Is(err, indigo.ErrRuleTimeout))
+	is.True(strings.Contains(err.Error(), "rule slow:"))
+
+	// Rules finishing in time are not affected
+	r.Rules["slow"].Expr = `slow 1ms`
+	u, err = e.Eval(context.Background(), r, d, indigo.PerRuleTimeout(time.Second))
+	is.NoErr(err)
+	is.True(u.Pass)
+
+	// Cancelling the context still stops the whole evaluation
+	r.Rules["slow"].Expr = `slow 500ms`
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = e.Eval(ctx, r, d, indigo.PerRuleTimeout(time.Second), indigo.CollectErrors(true))
+	is.True(errors.Is(err, context.DeadlineExceeded))
+}
+
+// cancellingObserver cancels the context after n rules are compiled
+type cancellingObserver struct {
+	countingObserver
+	n      int
+	cancel context.CancelFunc
+}
+
+func (c *cancellingObserver) OnCompile(ruleID string, err error) {
+	c.countingObserver.OnCompile(ruleID, err)
+	if c.compiled == c.n {
+		c.cancel()
+	}
+}
+
+// Test that compilation stops when the context is cancelled
+func TestCompileContext(t *testing.T) {
+	is := is.New(t)
+
+	r := makeParallelRule(100)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	obs := &cancellingObserver{n: 10, cancel: cancel}
+	e := indigo.NewEngine(newMockEvaluator(), indigo.WithObserver(obs))
+	err := e.CompileContext(ctx, r)
+	is.True(errors.Is(err, context.Canceled))
+	is.Equal(obs.compiled, 10)
+
+	compiled := 0
+	for _, cr := range r.Rules {
+		if cr.Program != nil {
+			compiled++
+		}
+	}
+	is.Equal(compiled, 9) // the root is the first rule compiled
+
+	// The same rule compiles with a context that isn't cancelled
+	is.NoErr(e.CompileContext(context.Background(), r))
+}
+
+// Test that only the first child results in sort order are returned, while the
+// parent's result still reflects all children
+func TestMaxChildResults(t *testing.T) {
+	is := is.New(t)
+
+	e := indigo.NewEngine(newMockEvaluator())
+	r := indigo.NewRule("root", "true")
+	for i := 0; i < 20; i++ {
+		id := fmt.Sprintf("child%02d", i)
+		r.Rules[id] = indigo.NewRule(id, "true")
+	}
+	// the last child in sort order fails
+	r.Rules["child19"].Expr = "false"
+
+	err := e.Compile(r)
+	is.NoErr(err)
+
+	result, err := e.Eval(context.Background(), r, map[string]interface{}{},
+		indigo.SortFunc(indigo.SortRulesAlpha), indigo.MaxChildResults(5))
+	is.NoErr(err)
+	is.Equal(len(result.Results), 5)
+	for i := 0; i < 5; i++ {
+		_, ok := result.Results[fmt.Sprintf("child%02d", i)]
+		is.True(ok) // expected the first 5 children in sort order
+	}
+	is.True(!result.Pass) // child19 failed, even though it's not in the results
+
+	// Discarded results do not count towards the maximum
+	result, err = e.Eval(context.Background(), r, map[string]interface{}{},
+		indigo.SortFunc(indigo.SortRulesAlphaDesc), indigo.MaxChildResults(5), indigo.DiscardFail(indigo.Discard))
+	is.NoErr(err)
+	is.Equal(len(result.Results), 5)
+	_, ok := result.Results["child14"]
+	is.True(ok)
+	_, ok = result.Results["child19"]
+	is.True(!ok)
+
+	// No maximum
+	result, err = e.Eval(context.Background(), r, map[string]interface{}{})
+	is.NoErr(err)
+	is.Equal(len(result.Results), 20)
+}
+
+// Test that evaluation stops when the evaluation budget is exceeded
+func TestMaxEvaluations(t *testing.T) {
+	is := is.New(t)
+
+	m := newMockEvaluator()
+	e := indigo.NewEngine(m)
+	r := makeRule() // 16 rules
+	err := e.Compile(r)
+	is.NoErr(err)
+
+	_, err = e.Eval(context.Background(), r, map[string]interface{}{}, indigo.MaxEvaluations(10))
+	is.True(errors.Is(err, indigo.ErrEvaluationBudgetExceeded))
+	is.Equal(m.evalCount, 10) // no evaluations after the budget was used
+
+	m.evalCount = 0
+	result, err := e.Eval(context.Background(), r, map[string]interface{}{}, indigo.MaxEvaluations(16))
+	is.NoErr(err)
+	is.Equal(m.evalCount, 16)
+	is.Equal(result.EvalCount, 16)
+	is.Equal(result.Results["B"].EvalCount, 7)
+
+	// The budget set on the root rule applies to the whole tree
+	r.EvalOptions.MaxEvaluations = 3
+	_, err = e.Eval(context.Background(), r, map[string]interface{}{})
+	is.True(errors.Is(err, indigo.ErrEvaluationBudgetExceeded))
+}
+
+// failEvaluator counts the expressions evaluated, and fails the expression
+// "fail"
+type failEvaluator struct {
+	concurrencyEvaluator
+	calls int64
+}
+
+func (f *failEvaluator) Evaluate(data map[string]interface{}, expr string, s indigo.Schema, self interface{}, prog interface{}, resultType indigo.Type, returnDiagnostics bool) (interface{}, *indigo.Diagnostics, error) {
+	atomic.AddInt64(&f.calls, 1)
+	if expr == "fail" {
+		return nil, nil, fmt.Errorf("evaluation failed")
+	}
+	return f.concurrencyEvaluator.Evaluate(data, expr, s, self, prog, resultType, returnDiagnostics)
+}
+
+// Test that in parallel mode, the remaining rules are abandoned once the
+// evaluation budget is exceeded, or a rule fails with an error
+func TestMaxEvaluationsParallel(t *testing.T) {
+	is := is.New(t)
+
+	r := &indigo.Rule{ID: "root", Expr: "true", Rules: map[string]*indigo.Rule{}}
+	for i := 0; i < 20; i++ {
+		c := &indigo.Rule{ID: fmt.Sprintf("c%02d", i), Expr: "true"}
+		r.Rules[c.ID] = c
+	}
+
+	f := &failEvaluator{}
+	e := indigo.NewEngine(f)
+	is.NoErr(e.Compile(r))
+
+	for _, o := range []indigo.EvalOption{indigo.ParallelOrdered(2, 1, 2), indigo.ParallelSubtrees(2)} {
+		atomic.StoreInt64(&f.calls, 0)
+		_, err := e.Eval(context.Background(), r, map[string]interface{}{}, o, indigo.MaxEvaluations(5))
+		is.True(errors.Is(err, indigo.ErrEvaluationBudgetExceeded)) // not the cancellation of the other rules
+		is.True(atomic.LoadInt64(&f.calls) <= 5)
+	}
+
+	r.Rules["c00"].Expr = "fail"
+	for _, o := range []indigo.EvalOption{indigo.ParallelOrdered(2, 1, 2), indigo.ParallelSubtrees(2)} {
+		atomic.StoreInt64(&f.calls, 0)
+		_, err := e.Eval(context.Background(), r, map[string]interface{}{}, o)
+		is.True(err != nil)
+		is.True(strings.Contains(err.Error(), "evaluation failed"))
+		is.True(!errors.Is(err, context.Canceled))
+		is.True(atomic.LoadInt64(&f.calls) < 21) // the rules after the error were not evaluated
+	}
+}
+
+// makeChain returns a linear chain of n rules, each the only child of the
+// previous one, all with the expression "true"
+func makeChain(n int) *indigo.Rule {
+	var r *indigo.Rule
+	for i := n; i > 0; i-- {
+		id := fmt.Sprintf("level%d", i)
+		cr := &indigo.Rule{ID: id, Expr: "true", Rules: map[string]*indigo.Rule{}}
+		if r != nil {
+			cr.Rules[r.ID] = r
+		}
+		r = cr
+	}
+	return r
+}
+
+// Test that evaluation stops at the maximum depth
+func TestMaxDepth(t *testing.T) {
+	is := is.New(t)
+
+	m := newMockEvaluator()
+	e := indigo.NewEngine(m)
+	r := makeChain(10)
+	is.NoErr(e.Compile(r))
+	is.Equal(r.Depth(), 10)
+
+	_, err := e.Eval(context.Background(), r, map[string]interface{}{}, indigo.MaxDepth(5))
+	is.True(errors.Is(err, indigo.ErrMaxDepthExceeded))
+	is.Equal(err.Error(), "rule level6: maximum rule depth exceeded")
+	is.Equal(m.evalCount, 5) // no evaluations below the limit
+
+	u, err := e.Eval(context.Background(), r, map[string]interface{}{}, indigo.MaxDepth(10))
+	is.NoErr(err)
+	is.Equal(u.EvalCount, 10)
+
+	// The limit set on the root rule applies to the whole tree
+	r.EvalOptions.MaxDepth = 3
+	_, err = e.Eval(context.Background(), r, map[string]interface{}{})
+	is.True(errors.Is(err, indigo.ErrMaxDepthExceeded))
+
+	// Rules evaluated in parallel count their depth too; the mock evaluator
+	// is not safe for concurrent use
+	root := &indigo.Rule{ID: "root", Expr: "true", Rules: map[string]*indigo.Rule{}}
+	for i := 0; i < 4; i++ {
+		c := makeChain(i + 1)
+		c.ID = fmt.Sprintf("chain%d", i)
+		root.Rules[c.ID] = c
+	}
+	ce := indigo.NewEngine(cel.NewEvaluator())
+	is.NoErr(ce.Compile(root))
+
+	_, err = ce.Eval(context.Background(), root, map[string]interface{}{}, indigo.MaxDepth(4), indigo.ParallelOrdered(1, 1, 4))
+	is.True(errors.Is(err, indigo.ErrMaxDepthExceeded))
+
+	u, err = ce.Eval(context.Background(), root, map[string]interface{}{}, indigo.MaxDepth(5), indigo.ParallelOrdered(1, 1, 4))
+	is.NoErr(err)
+	is.Equal(u.EvalCount, 11)
+}
+
+// Test the SLO metrics computed from a result tree
+func TestSLOMetrics(t *testing.T) {
+	is := is.New(t)
+
+	e := indigo.NewEngine(newMockEvaluator())
+	r := makeRule()
+	is.NoErr(e.Compile(r))
+
+	u, err := e.Eval(context.Background(), r, map[string]interface{}{})
+	is.NoErr(err)
+
+	m := u.SLOMetrics()
+	is.Equal(m.TotalRules, 16)
+	is.Equal(m.Results, 16)
+	is.Equal(m.Passed, 7)
+	is.Equal(m.PassRate, 7.0/16.0)
+	is.Equal(m.ErrorCount, 0)
+	is.Equal(m.MaxDepth, 4)
+
+	// Discarded results are evaluated, but not in the result tree;
+	// rules with missing data are counted as errors
+	r.Rules["E"].Rules["e1"].Expr = "missing"
+	u, err = e.Eval(context.Background(), r, map[string]interface{}{},
+		indigo.DiscardPass(true), indigo.UnknownOnMissingData(true))
+	is.NoErr(err)
+
+	m = u.SLOMetrics()
+	is.Equal(m.TotalRules, 16)
+	is.Equal(m.Results, 10)
+	is.Equal(m.Passed, 0)
+	is.Equal(m.PassRate, 0.0)
+	is.Equal(m.ErrorCount, 1)
+	is.Equal(m.MaxDepth, 4)
+
+	// The rules evaluated in parallel are counted; the other metrics don't
+	// depend on whether the rules were evaluated in parallel
+	e = indigo.NewEngine(&concurrencyEvaluator{})
+	r = makeRule()
+	is.NoErr(e.Compile(r))
+	u, err = e.Eval(context.Background(), r, map[string]interface{}{})
+	is.NoErr(err)
+	seq := u.SLOMetrics()
+	is.Equal(seq.ParallelRules, 0)
+	is.Equal(seq.ParallelRate, 0.0)
+
+	cases := []struct {
+		opt      indigo.EvalOption
+		parallel int
+	}{
+		{indigo.ParallelOrdered(2, 1, 4), 15},      // all the rules below the root rule
+		{indigo.ParallelSubtrees(4), len(r.Rules)}, // only the root rule's children
+	}
+	for _, c := range cases {
+		u, err = e.Eval(context.Background(), r, map[string]interface{}{}, c.opt)
+		is.NoErr(err)
+		m := u.SLOMetrics()
+		is.Equal(m.ParallelRules, c.parallel)
+		is.Equal(m.ParallelRate, float64(c.parallel)/16.0)
+		m.ParallelRules, m.ParallelRate = 0, 0
+		is.Equal(m, seq)
+	}
+}
+
+// Test that a PassFunc decides whether the parent rule passes
+func TestPassFunc(t *testing.T) {
+	is := is.New(t)
+
+	e := indigo.NewEngine(newMockEvaluator())
+
+	quorum := func(self *indigo.Result, children map[string]*indigo.Result) bool {
+		n := 0
+		for _, c := range children {
+			if c.Pass {
+				n++
+			}
+		}
+		return self.Pass && n >= 2
+	}
+
+	r := &indigo.Rule{
+		ID:          "quorum",
+		Expr:        "true",
+		EvalOptions: indigo.EvalOptions{PassFunc: quorum, TrueIfAny: true},
+		Rules: map[string]*indigo.Rule{
+			"a": {ID: "a", Expr: "true"},
+			"b": {ID: "b", Expr: "true"},
+			"c": {ID: "c", Expr: "false"},
+		},
+	}
+	is.NoErr(e.Compile(r))
+
+	u, err := e.Eval(context.Background(), r, map[string]interface{}{})
+	is.NoErr(err)
+	is.True(u.Pass) // 2 of 3, although one child failed
+
+	// The PassFunc sees the discarded results too
+	u, err = e.Eval(context.Background(), r, map[string]interface{}{}, indigo.DiscardPass(true))
+	is.NoErr(err)
+	is.True(u.Pass)
+	is.Equal(len(u.Results), 1)
+
+	r.Rules["b"].Expr = "false"
+	u, err = e.Eval(context.Background(), r, map[string]interface{}{})
+	is.NoErr(err)
+	is.True(!u.Pass) // only 1 of 3; the PassFunc takes precedence over TrueIfAny
+	is.Equal(u.State, indigo.StateFail)
+
+	// Weighted: pass if the weights of the passing children add up to 0.5 or more
+	weighted := func(self *indigo.Result, children map[string]*indigo.Result) bool {
+		var sum float64
+		for _, c := range children {
+			if c.Pass {
+				sum += c.Rule.Meta.(float64)
+			}
+		}
+		return sum >= 0.5
+	}
+
+	r = &indigo.Rule{
+		ID:          "weighted",
+		EvalOptions: indigo.EvalOptions{PassFunc: weighted},
+		Rules: map[string]*indigo.Rule{
+			"a": {ID: "a", Expr: "true", Meta: 0.2},
+			"b": {ID: "b", Expr: "false", Meta: 0.5},
+			"c": {ID: "c", Expr: "true", Meta: 0.3},
+		},
+	}
+	is.NoErr(e.Compile(r))
+
+	u, err = e.Eval(context.Background(), r, map[string]interface{}{})
+	is.NoErr(err)
+	is.True(u.Pass) // 0.2 + 0.3
+
+	r.Rules["c"].Expr = "false"
+	u, err = e.Eval(context.Background(), r, map[string]interface{}{})
+	is.NoErr(err)
+	is.True(!u.Pass) // 0.2
+}
+
+// countingObserver counts the calls made by the engine
+type countingObserver struct {
+	mu        sync.Mutex
+	evaluated map[string]int
+	passed    int
+	errors    int
+	compiled  int
+}
+
+func (c *countingObserver) OnRuleEvaluated(ruleID string, pass bool, d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.evaluated[ruleID]++
+	if pass {
+		c.passed++
+	}
+}
+
+func (c *countingObserver) OnEvalError(ruleID string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.errors++
+}
+
+func (c *countingObserver) OnCompile(ruleID string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.compiled++
+}
+
+// Test that the observer is notified of every rule compiled and evaluated
+func TestObserver(t *testing.T) {
+	is := is.New(t)
+
+	obs := &countingObserver{evaluated: map[string]int{}}
+	e := indigo.NewEngine(newMockEvaluator(), indigo.WithObserver(obs))
+	r := makeRule()
+	is.NoErr(e.Compile(r))
+	is.Equal(obs.compiled, 16)
+
+	_, err := e.Eval(context.Background(), r, map[string]interface{}{})
+	is.NoErr(err)
+	is.Equal(len(obs.evaluated), 16)
+	is.Equal(obs.evaluated["rule1"], 1)
+	is.Equal(obs.passed, 7)
+	is.Equal(obs.errors, 0)
+
+	// Concurrent evaluations; the mock evaluator is not safe for concurrent use
+	ce := indigo.NewEngine(cel.NewEvaluator(), indigo.WithObserver(obs))
+	is.NoErr(ce.Compile(r))
+	data := make([]map[string]interface{}, 10)
+	for i := range data {
+		data[i] = map[string]interface{}{}
+	}
+	err = ce.EvalBatch(context.Background(), r, data, func(int, *indigo.Result, error) {}, indigo.BatchWorkers(4))
+	is.NoErr(err)
+	is.Equal(obs.evaluated["b4-1"], 11)
+	is.Equal(obs.passed, 77)
+
+	r.Rules["B"].Expr = "missing"
+	_, err = e.Eval(context.Background(), r, map[string]interface{}{})
+	is.True(err != nil)
+	is.Equal(obs.errors, 1)
+}
+
+// makeParallelRule returns a rule with n child rules; child rule cNN passes
+// if x is divisible by NN
+func makeParallelRule(n int) *indigo.Rule {
+	schema := indigo.Schema{Elements: []indigo.DataElement{{Name: "x", Type: indigo.Int{}}}}
+	r := &indigo.Rule{ID: "root", Schema: schema, Rules: map[string]*indigo.Rule{}}
+	for i := 1; i <= n; i++ {
+		id := fmt.Sprintf("c%02d", i)
+		r.Rules[id] = &indigo.Rule{ID: id, Schema: schema, Expr: fmt.Sprintf("x %% %d == 0", i)}
+	}
+	return r
+}
+
+// Test that parallel evaluation selects the same first positive or negative
+// child as sequential evaluation in sorted order
+func TestParallelOrdered(t *testing.T) {
+	is := is.New(t)
+
+	e := indigo.NewEngine(cel.NewEvaluator())
+	r := makeParallelRule(40)
+	is.NoErr(e.Compile(r))
+
+	ids := func(u *indigo.Result) []string {
+		list := []string{}
+		for _, c := range u.Flat()[1:] {
+			list = append(list, c.Rule.ID)
+		}
+		return list
+	}
+
+	for _, x := range []int{7, 12, 30, 37} {
+		data := map[string]interface{}{"x": x}
+		for _, stop := range []indigo.EvalOption{indigo.StopFirstPositiveChild(true), indigo.StopFirstNegativeChild(true)} {
+			seq, err := e.Eval(context.Background(), r, data, stop, indigo.SortFunc(indigo.SortRulesAlpha))
+			is.NoErr(err)
+
+			par, err := e.Eval(context.Background(), r, data, stop, indigo.ParallelOrdered(10, 3, 4))
+			is.NoErr(err)
+
+			is.Equal(ids(par), ids(seq))
+			is.Equal(par.Pass, seq.Pass)
+			is.Equal(par.EvalCount, seq.EvalCount) // work after the stopping point is discarded
+		}
+
+		// Without stopping, all the results are the same
+		seq, err := e.Eval(context.Background(), r, data)
+		is.NoErr(err)
+		par, err := e.Eval(context.Background(), r, data, indigo.ParallelOrdered(10, 3, 4))
+		is.NoErr(err)
+		is.Equal(len(par.Results), 40)
+		for id, c := range seq.Results {
+			is.Equal(par.Results[id].Pass, c.Pass)
+		}
+	}
+
+	// Rules with fewer than minSize children are evaluated sequentially
+	par, err := e.Eval(context.Background(), r, map[string]interface{}{"x": 2}, indigo.ParallelOrdered(41, 3, 4))
+	is.NoErr(err)
+	is.Equal(len(par.Results), 40)
+}
+
+// Test that the first passing leaf is selected by rule ID
+func TestFirstPass(t *testing.T) {
+	is := is.New(t)
+
+	anyOf := indigo.EvalOptions{TrueIfAny: true}
+	r := &indigo.Rule{
+		ID:          "table",
+		Expr:        "true",
+		EvalOptions: anyOf,
+		Rules: map[string]*indigo.Rule{
+			"tier_a": {ID: "tier_a", Expr: "false"},
+			"tier_b": {
+				ID:          "tier_b",
+				Expr:        "true",
+				EvalOptions: anyOf,
+				Rules: map[string]*indigo.Rule{
+					"b1": {ID: "b1", Expr: "false"},
+					"b2": {ID: "b2", Expr: "true"},
+					"b3": {ID: "b3", Expr: "true"},
+				},
+			},
+			"tier_c": {ID: "tier_c", Expr: "true"},
+		},
+	}
+
+	e := indigo.NewEngine(newMockEvaluator())
+	is.NoErr(e.Compile(r))
+
+	for i := 0; i < 20; i++ {
+		u, err := e.Eval(context.Background(), r, map[string]interface{}{})
+		is.NoErr(err)
+
+		leaf, path := u.FirstPass()
+		is.Equal(leaf.Rule.ID, "b2")
+		ids := []string{}
+		for _, p := range path {
+			ids = append(ids, p.Rule.ID)
+		}
+		is.Equal(ids, []string{"table", "tier_b", "b2"})
+	}
+
+	// A failing branch is not followed, even if it has passing children
+	r.Rules["tier_b"].Expr = "false"
+	u, err := e.Eval(context.Background(), r, map[string]interface{}{})
+	is.NoErr(err)
+	leaf, path := u.FirstPass()
+	is.Equal(leaf.Rule.ID, "tier_c")
+	is.Equal(len(path), 2)
+
+	r.Rules["tier_c"].Expr = "false"
+	u, err = e.Eval(context.Background(), r, map[string]interface{}{})
+	is.NoErr(err)
+	leaf, path = u.FirstPass()
+	is.True(leaf == nil)
+	is.True(path == nil)
+}
+
+// Test evaluating a rule tree where some rules use the CEL evaluator and
+// others the mock evaluator
+func TestCompositeEvaluator(t *testing.T) {
+	is := is.New(t)
+
+	m := newMockEvaluator()
+	c := indigo.NewCompositeEvaluator(cel.NewEvaluator())
+	c.Register("mock", m)
+	is.Equal(c.Tags(), []string{"mock"})
+
+	schema := indigo.Schema{
+		Elements: []indigo.DataElement{
+			{Name: "x", Type: indigo.Int{}},
+		},
+	}
+
+	r := &indigo.Rule{
+		ID:     "root",
+		Expr:   `x > 1`,
+		Schema: schema,
+		Rules: map[string]*indigo.Rule{
+			"cel": {
+				ID:     "cel",
+				Expr:   `x < 10`,
+				Schema: schema,
+			},
+			"mock_pass": {
+				ID:        "mock_pass",
+				Expr:      `true`,
+				Evaluator: "mock",
+			},
+			"mock_fail": {
+				ID:        "mock_fail",
+				Expr:      `not a CEL expression`,
+				Evaluator: "mock",
+			},
+		},
+	}
+
+	e := indigo.NewEngine(c)
+	err := e.Compile(r)
+	is.NoErr(err)
+
+	u, err := e.Eval(context.Background(), r, map[string]interface{}{"x": 5})
+	is.NoErr(err)
+	is.True(u.ExpressionPass)
+	is.True(u.Results["cel"].ExpressionPass)
+	is.True(u.Results["mock_pass"].ExpressionPass)
+	is.True(!u.Results["mock_fail"].ExpressionPass)
+	is.Equal(m.evalCount, 2) // only the tagged rules are evaluated by the mock
+
+	// A tag without a registered evaluator fails to compile
+	r.Rules["unknown"] = &indigo.Rule{
+		ID:        "unknown",
+		Expr:      `true`,
+		Evaluator: "python",
+	}
+	err = e.Compile(r)
+	is.True(err != nil)
+	ce := indigo.CompileErrors(err)
+	is.Equal(len(ce), 1)
+	is.Equal(ce[0].RuleID, "unknown")
+
+	// Tagged rules require a CompositeEvaluator
+	err = indigo.NewEngine(cel.NewEvaluator()).Compile(r.Rules["mock_pass"])
+	is.True(err != nil)
+}
+
+// Test that rules outside their effective window are skipped
+func TestEffectiveWindow(t *testing.T) {
+	is := is.New(t)
+
+	day := func(d int) *time.Time {
+		t := time.Date(2024, time.January, d, 0, 0, 0, 0, time.UTC)
+		return &t
+	}
+
+	r := &indigo.Rule{
+		ID:   "root",
+		Expr: `true`,
+		Rules: map[string]*indigo.Rule{
+			"always":  {ID: "always", Expr: `true`},
+			"current": {ID: "current", Expr: `true`, EffectiveFrom: day(1), EffectiveTo: day(31)},
+			"expired": {ID: "expired", Expr: `false`, EffectiveTo: day(10)},
+			"future":  {ID: "future", Expr: `false`, EffectiveFrom: day(20)},
+			"started": {ID: "started", Expr: `true`, EffectiveFrom: day(15)},
+		},
+	}
+
+	m := newMockEvaluator()
+	e := indigo.NewEngine(m)
+	err := e.Compile(r)
+	is.NoErr(err)
+
+	cases := []struct {
+		at   *time.Time
+		want []string
+		pass bool
+	}{
+		{at: day(5), want: []string{"always", "current", "expired"}, pass: false},
+		{at: day(10), want: []string{"always", "current"}, pass: true}, // EffectiveTo is exclusive
+		{at: day(15), want: []string{"always", "current", "started"}, pass: true},
+		{at: day(20), want: []string{"always", "current", "future", "started"}, pass: false}, // EffectiveFrom is inclusive
+		{at: day(31), want: []string{"always", "future", "started"}, pass: false},
+	}
+
+	for _, c := range cases {
+		m.Reset()
+		u, err := e.Eval(context.Background(), r, map[string]interface{}{}, indigo.EvaluationTime(*c.at))
+		is.NoErr(err)
+		got := []string{}
+		for _, cr := range u.Flat()[1:] {
+			got = append(got, cr.Rule.ID)
+		}
+		is.Equal(got, c.want)
+		is.Equal(u.Pass, c.pass)
+		is.Equal(u.EvalCount, len(c.want)+1)
+	}
+
+	// Without the option, the current time is used
+	u, err := e.Eval(context.Background(), r, map[string]interface{}{})
+	is.NoErr(err)
+	is.Equal(len(u.Results), 3) // always, future, started
+	is.True(r.Rules["started"].EffectiveAt(time.Now()))
+
+	// The rule passed to Eval must be effective
+	_, err = e.Eval(context.Background(), r.Rules["expired"], map[string]interface{}{}, indigo.EvaluationTime(*day(15)))
+	is.True(errors.Is(err, indigo.ErrNotEffective))
+}
+
+func TestShardCondition(t *testing.T) {
+	is := is.New(t)
+
+	r := &indigo.Rule{
+		ID:   "root",
+		Expr: `true`,
+		Rules: map[string]*indigo.Rule{
+			"central": {
+				ID:             "central",
+				Expr:           `true`,
+				ShardCondition: `true`,
+				Rules: map[string]*indigo.Rule{
+					"c1": {ID: "c1", Expr: `true`},
+				},
+			},
+			"north": {
+				ID:             "north",
+				Expr:           `true`,
+				ShardCondition: `false`,
+				Rules: map[string]*indigo.Rule{
+					"n1": {ID: "n1", Expr: `true`},
+					"n2": {ID: "n2", Expr: `true`},
+				},
+			},
+			"any": {ID: "any", Expr: `false`},
+		},
+	}
+
+	e := indigo.NewEngine(newMockEvaluator())
+	is.NoErr(e.Compile(r))
+
+	var evaluated []string
+	before := indigo.BeforeRule(func(ctx context.Context, r *indigo.Rule, d map[string]interface{}) {
+		evaluated = append(evaluated, r.ID)
+	})
+
+	u, err := e.Eval(context.Background(), r, map[string]interface{}{}, indigo.SortFunc(indigo.SortRulesAlpha), before)
+	is.NoErr(err)
+	is.Equal(evaluated, []string{"root", "any", "central", "c1"})
+	is.Equal(u.EvalCount, 4)
+	is.Equal(len(u.Results), 2)
+	is.True(u.Results["north"] == nil)
+	is.True(!u.Pass) // "any" failed
+
+	// The skipped shard doesn't count as a failure
+	delete(r.Rules, "any")
+	u, err = e.Eval(context.Background(), r, map[string]interface{}{})
+	is.NoErr(err)
+	is.True(u.Pass)
+
+	// The rules not in the shard are skipped in parallel mode too
+	pe := indigo.NewEngine(&concurrencyEvaluator{})
+	is.NoErr(pe.Compile(r))
+	for _, o := range []indigo.EvalOption{indigo.ParallelOrdered(2, 1, 2), indigo.ParallelSubtrees(2)} {
+		u, err = pe.Eval(context.Background(), r, map[string]interface{}{}, o)
+		is.NoErr(err)
+		is.Equal(u.EvalCount, 3) // root, central and c1
+		is.True(u.Results["north"] == nil)
+		is.True(u.Pass)
+	}
+
+	// The condition of the rule passed to Eval is not used
+	u, err = e.Eval(context.Background(), r.Rules["north"], map[string]interface{}{})
+	is.NoErr(err)
+	is.Equal(len(u.Results), 2)
+
+	// The condition is part of the rule's definition
+	r2 := &indigo.Rule{ID: "north", ShardCondition: `true`}
+	is.True(r2.Hash() != (&indigo.Rule{ID: "north"}).Hash())
+}
+
+// Test that the child rules that are not effective, or not in the shard,
+// are skipped in parallel mode, like in sequential mode
+func TestParallelSkippedChildren(t *testing.T) {
+	is := is.New(t)
+
+	past := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+	r := &indigo.Rule{
+		ID:   "root",
+		Expr: "true",
+		Rules: map[string]*indigo.Rule{
+			"a":       {ID: "a", Expr: "true"},
+			"b":       {ID: "b", Expr: "true"},
+			"expired": {ID: "expired", Expr: "false", EffectiveTo: &past},
+			"north": {ID: "north", Expr: "false", ShardCondition: "false",
+				Rules: map[string]*indigo.Rule{
+					"n1": {ID: "n1", Expr: "false"},
+				}},
+		},
+	}
+
+	e := indigo.NewEngine(&concurrencyEvaluator{})
+	is.NoErr(e.Compile(r))
+
+	cases := map[string][]indigo.EvalOption{
+		"sequential": nil,
+		"ordered":    {indigo.ParallelOrdered(2, 1, 1)},
+		"subtrees":   {indigo.ParallelSubtrees(2)},
+	}
+	for _, opts := range cases {
+		u, err := e.Eval(context.Background(), r, map[string]interface{}{}, opts...)
+		is.NoErr(err)
+		is.Equal(len(u.Results), 2) // a and b
+		is.True(u.Results["expired"] == nil)
+		is.True(u.Results["north"] == nil)
+		is.Equal(u.EvalCount, 3)
+		is.True(u.Pass)
+	}
+
+	// Under TrueIfAny, a rule whose children were all skipped passes, like
+	// a rule without children
+	r = &indigo.Rule{
+		ID:          "root",
+		Expr:        "true",
+		EvalOptions: indigo.EvalOptions{TrueIfAny: true},
+		Rules: map[string]*indigo.Rule{
+			"expired": {ID: "expired", Expr: "false", EffectiveTo: &past},
+			"north":   {ID: "north", Expr: "false", ShardCondition: "false"},
+		},
+	}
+	is.NoErr(e.Compile(r))
+	for _, opts := range cases {
+		u, err := e.Eval(context.Background(), r, map[string]interface{}{}, opts...)
+		is.NoErr(err)
+		is.Equal(len(u.Results), 0)
+		is.True(u.Pass)
+	}
+}
+
+// concurrencyEvaluator records the largest number of expressions evaluated
+// at the same time. Expressions are true if they are "true".
+type concurrencyEvaluator struct {
+	active    int64
+	maxActive int64
+}
+
+func (c *concurrencyEvaluator) Compile(expr string, s indigo.Schema, resultType indigo.Type, collectDiagnostics, dryRun bool) (interface{}, error) {
+	return nil, nil
+}
+
+func (c *concurrencyEvaluator) Evaluate(data map[string]interface{}, expr string, s indigo.Schema, self interface{}, prog interface{}, resultType indigo.Type, returnDiagnostics bool) (interface{}, *indigo.Diagnostics, error) {
+	n := atomic.AddInt64(&c.active, 1)
+	defer atomic.AddInt64(&c.active, -1)
+	for {
+		m := atomic.LoadInt64(&c.maxActive)
+		if n <= m || atomic.CompareAndSwapInt64(&c.maxActive, m, n) {
+			break
+		}
+	}
+	time.Sleep(2 * time.Millisecond)
+	return expr == "true", nil, nil
+}
+
+// panicEvaluator panics when evaluating the expression "panic"
+type panicEvaluator struct {
+	concurrencyEvaluator
+}
+
+func (p *panicEvaluator) Evaluate(data map[string]interface{}, expr string, s indigo.Schema, self interface{}, prog interface{}, resultType indigo.Type, returnDiagnostics bool) (interface{}, *indigo.Diagnostics, error) {
+	if expr == "panic" {
+		panic("evaluator failed")
+	}
+	return p.concurrencyEvaluator.Evaluate(data, expr, s, self, prog, resultType, returnDiagnostics)
+}
+
+// Test that a panic in a goroutine evaluating rules in parallel is returned
+// by Eval as an error
+func TestParallelPanic(t *testing.T) {
+	is := is.New(t)
+
+	r := &indigo.Rule{
+		ID:   "root",
+		Expr: "true",
+		Rules: map[string]*indigo.Rule{
+			"a": {ID: "a", Expr: "true"},
+			"b": {ID: "b", Expr: "true", Rules: map[string]*indigo.Rule{
+				"b1": {ID: "b1", Expr: "panic"},
+			}},
+			"c": {ID: "c", Expr: "true"},
+		},
+	}
+
+	e := indigo.NewEngine(&panicEvaluator{})
+	is.NoErr(e.Compile(r))
+
+	for _, o := range []indigo.EvalOption{indigo.ParallelOrdered(2, 1, 3), indigo.ParallelSubtrees(3)} {
+		_, err := e.Eval(context.Background(), r, map[string]interface{}{}, o)
+		is.True(errors.Is(err, indigo.ErrEvaluationPanic))
+		is.True(strings.Contains(err.Error(), "evaluator failed"))
+	}
+
+	// A panic in a callback is recovered too
+	r.Rules["b"].Rules["b1"].Expr = "true"
+	before := indigo.BeforeRule(func(ctx context.Context, r *indigo.Rule, d map[string]interface{}) {
+		if r.ID == "c" {
+			panic("callback failed")
+		}
+	})
+	_, err := e.Eval(context.Background(), r, map[string]interface{}{}, indigo.ParallelSubtrees(3), before)
+	is.True(errors.Is(err, indigo.ErrEvaluationPanic))
+}
+
+// Test that nested parallel rules stay within the engine's goroutine limit
+func TestMaxGlobalGoroutines(t *testing.T) {
+	is := is.New(t)
+
+	// 4 groups of 4 rules, each evaluated in parallel
+	r := &indigo.Rule{ID: "root", Expr: "true", Rules: map[string]*indigo.Rule{}}
+	for i := 0; i < 4; i++ {
+		g := &indigo.Rule{ID: fmt.Sprintf("g%d", i), Expr: "true", Rules: map[string]*indigo.Rule{}}
+		for j := 0; j < 4; j++ {
+			c := &indigo.Rule{ID: fmt.Sprintf("g%d-%d", i, j), Expr: "true"}
+			g.Rules[c.ID] = c
+		}
+		r.Rules[g.ID] = g
+	}
+	parallel := indigo.ParallelOrdered(2, 1, 4)
+
+	ce := &concurrencyEvaluator{}
+	e := indigo.NewEngine(ce)
+	is.NoErr(e.Compile(r))
+	u, err := e.Eval(context.Background(), r, map[string]interface{}{}, parallel)
+	is.NoErr(err)
+	is.True(u.Pass)
+	is.True(ce.maxActive > 3) // the nested rules multiply the goroutines
+
+	ce = &concurrencyEvaluator{}
+	e = indigo.NewEngine(ce, indigo.WithMaxGlobalGoroutines(3))
+	is.NoErr(e.Compile(r))
+	for i := 0; i < 5; i++ {
+		u, err = e.Eval(context.Background(), r, map[string]interface{}{}, parallel)
+		is.NoErr(err)
+		is.True(u.Pass)
+		is.Equal(u.EvalCount, 21)
+	}
+	is.True(ce.maxActive > 1)
+	is.True(ce.maxActive <= 3)
+
+	// Without places available, the rules are evaluated sequentially
+	ce = &concurrencyEvaluator{}
+	e = indigo.NewEngine(ce, indigo.WithMaxGlobalGoroutines(0))
+	is.NoErr(e.Compile(r))
+	u, err = e.Eval(context.Background(), r, map[string]interface{}{}, parallel)
+	is.NoErr(err)
+	is.Equal(u.EvalCount, 21)
+	is.Equal(ce.maxActive, int64(1))
+
+	// A negative limit is no limit
+	ce = &concurrencyEvaluator{}
+	e = indigo.NewEngine(ce, indigo.WithMaxGlobalGoroutines(-1))
+	is.NoErr(e.Compile(r))
+	u, err = e.Eval(context.Background(), r, map[string]interface{}{}, parallel)
+	is.NoErr(err)
+	is.Equal(u.EvalCount, 21)
+	is.True(ce.maxActive > 3)
+}
+
+// makeDeepRule returns a rule with width child rules, each the top of a
+// chain of depth rules. The last rule in the chain of child sNN fails if
+// NN is in fail.
+func makeDeepRule(width, depth int, fail ...int) *indigo.Rule {
+	root := &indigo.Rule{ID: "root", Expr: "true", Rules: map[string]*indigo.Rule{}}
+	for i := 0; i < width; i++ {
+		id := fmt.Sprintf("s%02d", i)
+		parent := root
+		for j := 0; j < depth; j++ {
+			r := &indigo.Rule{ID: fmt.Sprintf("%s-%d", id, j), Expr: "true", Rules: map[string]*indigo.Rule{}}
+			if j == 0 {
+				r.ID = id
+			}
+			parent.Rules[r.ID] = r
+			parent = r
+		}
+		for _, f := range fail {
+			if f == i {
+				parent.Expr = "false"
+			}
+		}
+	}
+	return root
+}
+
+// Make sure that compiling in parallel gives the same rules as compiling
+// sequentially
+func TestCompileParallel(t *testing.T) {
+	is := is.New(t)
+
+	// Unsorted child rules are in map order, which varies
+	sorted := func() *indigo.Rule {
+		r := makeRule()
+		var sort func(r *indigo.Rule)
+		sort = func(r *indigo.Rule) {
+			r.EvalOptions.SortFunc = indigo.SortRulesAlpha
+			for _, c := range r.Rules {
+				sort(c)
+			}
+		}
+		sort(r)
+		return r
+	}
+
+	seq, par := sorted(), sorted()
+	e := indigo.NewEngine(newMockEvaluator())
+	is.NoErr(e.Compile(seq, indigo.CollectDiagnostics(true)))
+	is.NoErr(e.CompileParallel(par, 4, indigo.CollectDiagnostics(true)))
+
+	var walk func(a, b *indigo.Rule)
+	walk = func(a, b *indigo.Rule) {
+		is.True(b.Program != nil)
+		is.Equal(a.Program, b.Program)
+		is.Equal(a.Hash(), b.Hash())
+		for id, c := range a.Rules {
+			walk(c, b.Rules[id])
+		}
+	}
+	walk(seq, par)
+	is.Equal(par.Uncompiled(), []string(nil))
+
+	// The child rules are sorted as by Compile
+	ps, err := e.Plan(seq)
+	is.NoErr(err)
+	pp, err := e.Plan(par)
+	is.NoErr(err)
+	is.Equal(ps.RuleIDs(), pp.RuleIDs())
+
+	us, err := e.Eval(context.Background(), seq, map[string]interface{}{})
+	is.NoErr(err)
+	up, err := e.Eval(context.Background(), par, map[string]interface{}{})
+	is.NoErr(err)
+	is.Equal(us.Pass, up.Pass)
+	is.Equal(us.Render(), up.Render())
+
+	// Errors are returned for all the rules that failed
+	par.Rules["B"].Evaluator = "x"
+	par.Rules["D"].Evaluator = "x"
+	err = e.CompileParallel(par, 0)
+	is.Equal(len(indigo.CompileErrors(err)), 2)
+
+	// A rule shared by two parents is compiled once
+	shared := &indigo.Rule{ID: "shared", Expr: "true"}
+	r := &indigo.Rule{ID: "root", Expr: "true", Rules: map[string]*indigo.Rule{
+		"a": {ID: "a", Expr: "true", Rules: map[string]*indigo.Rule{"shared": shared}},
+		"b": {ID: "b", Expr: "true", Rules: map[string]*indigo.Rule{"shared": shared}},
+	}}
+	is.NoErr(e.CompileParallel(r, 4))
+	is.True(shared.Program != nil)
+
+	// A nil child rule is reported with its parent and key
+	r.Rules["b"].Rules["missing"] = nil
+	err = e.CompileParallel(r, 4)
+	is.Equal(err.Error(), "rule b: child rule missing is nil")
+}
+
+// Test that subtrees are evaluated concurrently, with the same results as
+// sequential evaluation
+func TestParallelSubtrees(t *testing.T) {
+	is := is.New(t)
+
+	ce := &concurrencyEvaluator{}
+	e := indigo.NewEngine(ce)
+	r := makeDeepRule(6, 5, 2, 4)
+	is.NoErr(e.Compile(r))
+
+	seq, err := e.Eval(context.Background(), r, map[string]interface{}{})
+	is.NoErr(err)
+	is.Equal(ce.maxActive, int64(1))
+
+	par, err := e.Eval(context.Background(), r, map[string]interface{}{}, indigo.ParallelSubtrees(3))
+	is.NoErr(err)
+	is.True(ce.maxActive > 1)
+	is.True(ce.maxActive <= 3)
+
+	is.Equal(par.Pass, seq.Pass)
+	is.True(!par.Pass)
+	is.Equal(par.EvalCount, 31)
+	is.Equal(len(par.Flat()), len(seq.Flat()))
+	for _, id := range []string{"s00", "s01", "s02", "s03", "s04", "s05"} {
+		is.Equal(par.Results[id].Pass, seq.Results[id].Pass)
+	}
+	is.True(!par.Results["s02"].Pass)
+	is.True(par.Results["s03"].Pass)
+
+	// Stopping at the first negative child gives the same outcome
+	seq, err = e.Eval(context.Background(), r, map[string]interface{}{}, indigo.StopFirstNegativeChild(true), indigo.SortFunc(indigo.SortRulesAlpha))
+	is.NoErr(err)
+	par, err = e.Eval(context.Background(), r, map[string]interface{}{}, indigo.StopFirstNegativeChild(true), indigo.ParallelSubtrees(3))
+	is.NoErr(err)
+	is.Equal(len(par.Results), len(seq.Results))
+	is.Equal(par.EvalCount, seq.EvalCount)
+}
+
+// Test that cached values are used when a rule is evaluated again with the
+// same data
+func TestResultCache(t *testing.T) {
+	is := is.New(t)
+
+	m := newMockEvaluator()
+	e := indigo.NewEngine(m)
+	r := &indigo.Rule{ID: "single", Expr: `true`}
+	is.NoErr(e.Compile(r))
+
+	c := indigo.NewResultCache()
+	d := map[string]interface{}{"a": 1}
+	for i := 0; i < 2; i++ {
+		u, err := e.Eval(context.Background(), r, d, indigo.WithResultCache(c))
+		is.NoErr(err)
+		is.True(u.Pass)
+	}
+	is.Equal(m.evalCount, 1)
+	is.Equal(c.Len(), 1)
+	hits, misses := c.Stats()
+	is.Equal(hits, 1)
+	is.Equal(misses, 1)
+
+	// Different data is evaluated
+	_, err := e.Eval(context.Background(), r, map[string]interface{}{"a": 2}, indigo.WithResultCache(c))
+	is.NoErr(err)
+	is.Equal(m.evalCount, 2)
+
+	// So is a changed rule, once recompiled
+	r.Expr = `false`
+	is.NoErr(e.Compile(r))
+	u, err := e.Eval(context.Background(), r, d, indigo.WithResultCache(c))
+	is.NoErr(err)
+	is.True(!u.Pass)
+	is.Equal(m.evalCount, 3)
+
+	// Every rule in a tree is cached, with the same results as without a cache
+	tree := makeRule()
+	is.NoErr(e.Compile(tree))
+	want, err := e.Eval(context.Background(), tree, d)
+	is.NoErr(err)
+	c = indigo.NewResultCache()
+	n := m.evalCount
+	_, err = e.Eval(context.Background(), tree, d, indigo.WithResultCache(c))
+	is.NoErr(err)
+	is.Equal(m.evalCount-n, 16)
+	n = m.evalCount
+	got, err := e.Eval(context.Background(), tree, d, indigo.WithResultCache(c))
+	is.NoErr(err)
+	is.Equal(m.evalCount, n)
+	is.Equal(len(got.Flat()), len(want.Flat()))
+	for i, u := range got.Flat() {
+		is.Equal(u.Rule.ID, want.Flat()[i].Rule.ID)
+		is.Equal(u.Pass, want.Flat()[i].Pass)
+	}
+
+	// Values that encode the same way, but that CEL treats differently, are
+	// cached separately
+	ce := indigo.NewEngine(cel.NewEvaluator())
+	half := &indigo.Rule{
+		ID:     "half",
+		Schema: indigo.Schema{Elements: []indigo.DataElement{{Name: "x", Type: indigo.Float{}}}},
+		Expr:   `x + 0.5 > 1.0`,
+	}
+	is.NoErr(ce.Compile(half))
+	c = indigo.NewResultCache()
+	u, err = ce.Eval(context.Background(), half, map[string]interface{}{"x": float64(1)}, indigo.WithResultCache(c))
+	is.NoErr(err)
+	is.True(u.Pass)
+	_, err = ce.Eval(context.Background(), half, map[string]interface{}{"x": int64(1)}, indigo.WithResultCache(c))
+	is.True(err != nil) // an int is not a double
+	is.Equal(c.Len(), 1)
+
+	// Data that can't be hashed unambiguously is evaluated, but not cached
+	type opaque struct{ n int }
+	n = m.evalCount
+	for _, x := range []interface{}{opaque{1}, opaque{2}} {
+		_, err = e.Eval(context.Background(), r, map[string]interface{}{"a": x}, indigo.WithResultCache(c))
+		is.NoErr(err)
+	}
+	is.Equal(m.evalCount-n, 2)
+	is.Equal(c.Len(), 1)
+}
+
+// Test that a cache can be shared by concurrent evaluations
+func TestResultCacheParallel(t *testing.T) {
+	is := is.New(t)
+
+	e := indigo.NewEngine(cel.NewEvaluator())
+	r := makeParallelRule(20)
+	is.NoErr(e.Compile(r))
+
+	c := indigo.NewResultCache()
+	data := make([]map[string]interface{}, 8)
+	for i := range data {
+		data[i] = map[string]interface{}{"x": 12}
+	}
+	err := e.EvalBatch(context.Background(), r, data, func(_ int, u *indigo.Result, err error) {
+		is.NoErr(err)
+		is.Equal(len(u.Results), 20)
+		is.True(u.Results["c06"].Pass)
+		is.True(!u.Results["c05"].Pass)
+	}, indigo.BatchWorkers(4), indigo.ParallelOrdered(1, 2, 4), indigo.WithResultCache(c))
+	is.NoErr(err)
+	is.Equal(c.Len(), 21)
+	hits, misses := c.Stats()
+	is.Equal(hits+misses, 8*21)
+}
+
+// Test attaching annotations to results while walking the result tree
+func TestResultAnnotations(t *testing.T) {
+	is := is.New(t)
+
+	e := indigo.NewEngine(newMockEvaluator())
+	r := makeRule()
+	is.NoErr(e.Compile(r))
+
+	u, err := e.Eval(context.Background(), r, map[string]interface{}{})
+	is.NoErr(err)
+
+	_, ok := u.GetAnnotation("action")
+	is.True(!ok)
+
+	for _, c := range u.Flat() {
+		if c.Pass {
+			c.SetAnnotation("action", "approve")
+		} else {
+			c.SetAnnotation("action", "review")
+		}
+	}
+	u.SetAnnotation("reviewer", 42)
+	u.SetAnnotation("reviewer", 43)
+
+	for _, c := range u.Flat() {
+		v, ok := c.GetAnnotation("action")
+		is.True(ok)
+		is.Equal(v == "approve", c.Pass)
+	}
+	v, ok := u.GetAnnotation("reviewer")
+	is.True(ok)
+	is.Equal(v, 43)
+
+	var nilResult *indigo.Result
+	_, ok = nilResult.GetAnnotation("action")
+	is.True(!ok)
+}
@@ -0,0 +1,158 @@
+package indigo
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrEvaluationBudgetExceeded is returned by Eval when evaluating the rule
+// tree requires more rule evaluations than allowed by the MaxEvaluations option.
+var ErrEvaluationBudgetExceeded = errors.New("evaluation budget exceeded")
+
+// ErrMaxDepthExceeded is returned by Eval when the rule tree is deeper than
+// allowed by the MaxDepth option.
+var ErrMaxDepthExceeded = errors.New("maximum rule depth exceeded")
+
+// ErrNotEffective is returned by Eval when the rule passed to Eval is not
+// effective at the evaluation time. See Rule.EffectiveFrom and the
+// EvaluationTime option.
+var ErrNotEffective = errors.New("rule not effective at evaluation time")
+
+// ErrRuleTimeout is wrapped by the error recorded for a rule whose
+// expression took longer to evaluate than allowed by the PerRuleTimeout option.
+var ErrRuleTimeout = errors.New("rule evaluation timed out")
+
+// ErrEvaluationPanic is wrapped by the error returned by Eval when evaluating
+// a rule in parallel mode panicked, such as in an evaluator or a callback.
+// Since the panic happened in a goroutine started by the engine, the caller
+// of Eval could not recover it.
+var ErrEvaluationPanic = errors.New("panic evaluating rule")
+
+// ErrMissingData is wrapped by errors returned by an ExpressionEvaluator when
+// the expression refers to data that is not in the input, such as a variable
+// or map key. See the UnknownOnMissingData option.
+var ErrMissingData = errors.New("missing data")
+
+// ErrCostLimitExceeded is wrapped by errors returned by an ExpressionEvaluator
+// when evaluating an expression costs more than the evaluator allows.
+var ErrCostLimitExceeded = errors.New("cost limit exceeded")
+
+// Issue describes a problem found in a rule expression, at a specific
+// position in the expression source.
+type Issue struct {
+	Line    int    // the 1-based line number in the expression source
+	Col     int    // the 1-based column number in the expression source
+	Message string // a description of the problem
+}
+
+// String returns the issue in the format line:col: message
+func (i Issue) String() string {
+	return fmt.Sprintf("%d:%d: %s", i.Line, i.Col, i.Message)
+}
+
+// IssuesError is returned by an ExpressionCompiler when it can attribute
+// problems in the expression to positions in the expression source.
+// The engine uses the positions to apply a rule's SourceOffset.
+type IssuesError struct {
+	// The compilation step that failed, such as "parsing rule"
+	Stage string
+	// The problems found
+	Issues []Issue
+}
+
+// Error returns the stage followed by one line per issue
+func (e *IssuesError) Error() string {
+	s := strings.Builder{}
+	s.WriteString(e.Stage)
+	s.WriteString(":")
+	for _, i := range e.Issues {
+		s.WriteString("\nERROR: ")
+		s.WriteString(i.String())
+	}
+	return s.String()
+}
+
+// withOffset returns a copy of the error with the positions of the issues moved
+// by the source offset. The column offset only applies to issues on the first
+// line of the expression, since only the first line is indented by the
+// position of the expression in the enclosing document.
+func (e *IssuesError) withOffset(o SourceOffset) *IssuesError {
+	x := &IssuesError{
+		Stage:  e.Stage,
+		Issues: make([]Issue, len(e.Issues)),
+	}
+	for n, i := range e.Issues {
+		if i.Line == 1 {
+			i.Col += o.Col
+		}
+		i.Line += o.Line
+		x.Issues[n] = i
+	}
+	return x
+}
+
+// CompileError is returned by the engine when a rule fails to compile.
+// If the rule tree has several rules that fail to compile, the engine returns
+// the errors joined by errors.Join; use errors.As to find the first
+// CompileError, or CompileErrors to get all of them.
+type CompileError struct {
+	// The ID of the rule that failed to compile; empty for expressions
+	// checked with CheckExpression
+	RuleID string
+	// The problems found, with positions relative to the rule's SourceOffset.
+	// Empty if the evaluator does not report positions.
+	Issues []Issue
+	// The error returned by the evaluator
+	Err error
+}
+
+// Error returns the rule ID followed by the evaluator's error, or only the
+// evaluator's error if there is no rule, see DefaultEngine.CheckExpression
+func (e *CompileError) Error() string {
+	if e.RuleID == "" {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("rule %s: %v", e.RuleID, e.Err)
+}
+
+// Unwrap returns the error returned by the evaluator
+func (e *CompileError) Unwrap() error {
+	return e.Err
+}
+
+// newCompileError creates a CompileError for the error returned by the
+// evaluator when compiling the rule, applying the rule's SourceOffset to the
+// positions of the issues found.
+func newCompileError(r *Rule, err error) *CompileError {
+	ce := &CompileError{
+		RuleID: r.ID,
+		Err:    err,
+	}
+	var ie *IssuesError
+	if errors.As(err, &ie) {
+		if r.SourceOffset != (SourceOffset{}) {
+			ie = ie.withOffset(r.SourceOffset)
+			ce.Err = ie
+		}
+		ce.Issues = ie.Issues
+	}
+	return ce
+}
+
+// CompileErrors returns all the CompileErrors in err, including errors joined
+// by errors.Join and errors wrapped with fmt.Errorf.
+func CompileErrors(err error) []*CompileError {
+	list := []*CompileError{}
+	switch x := err.(type) {
+	case *CompileError:
+		list = append(list, x)
+	case interface{ Unwrap() []error }:
+		for _, e := range x.Unwrap() {
+			list = append(list, CompileErrors(e)...)
+		}
+	case interface{ Unwrap() error }:
+		list = append(list, CompileErrors(x.Unwrap())...)
+	}
+	return list
+}
@@ -1,5 +1,7 @@
 package indigo
 
+import "context"
+
 // ExpressionEvaluator is the interface that wraps the Evaluate method.
 // Evaluate tests the rule expression against the data.
 // Returns the result of the evaluation and a string containing diagnostic information.
@@ -11,6 +13,17 @@ type ExpressionEvaluator interface {
 		self interface{}, evalData interface{}, resultType Type, returnDiagnostics bool) (interface{}, *Diagnostics, error)
 }
 
+// ContextEvaluator is the interface that wraps the EvaluateContext method.
+// EvaluateContext is like Evaluate, with the context passed to Eval, so the
+// evaluator can make request-scoped values, such as a tenant ID, available to
+// the functions called by the expression. The engine calls EvaluateContext
+// instead of Evaluate if the evaluator implements it.
+// Evaluators are not required to implement this interface.
+type ContextEvaluator interface {
+	EvaluateContext(ctx context.Context, data map[string]interface{}, expr string, s Schema,
+		self interface{}, evalData interface{}, resultType Type, returnDiagnostics bool) (interface{}, *Diagnostics, error)
+}
+
 // ExpressionCompiler is the interface that wraps the Compile method.
 // Compile pre-processes the expression, returning a compiled version.
 // The Indigo Compiler will store the compiled version, later providing it back to the
@@ -30,3 +43,53 @@ type ExpressionCompilerEvaluator interface {
 	ExpressionCompiler
 	ExpressionEvaluator
 }
+
+// ExpressionInspector is the interface that wraps the ReferencedVariables method.
+// ReferencedVariables returns the names of the schema elements the expression
+// refers to.
+// Evaluators are not required to implement this interface.
+type ExpressionInspector interface {
+	ReferencedVariables(expr string, s Schema) ([]string, error)
+}
+
+// SubexpressionEvaluator is the interface that wraps the EvaluateSubexpression method.
+// EvaluateSubexpression evaluates the expression against the data and returns
+// the value of the part of the expression identified by id. The identifiers
+// are specific to the evaluator, and are reported in the ID field of Diagnostics.
+// Evaluators are not required to implement this interface.
+type SubexpressionEvaluator interface {
+	EvaluateSubexpression(data map[string]interface{}, expr string, s Schema,
+		evalData interface{}, id int64) (interface{}, error)
+}
+
+// CounterfactualEvaluator is the interface that wraps the Counterfactual method.
+// Counterfactual evaluates the expression against the data and suggests
+// changes to the input values that would make the expression true. The result
+// maps input names to suggested values.
+// Evaluators are not required to implement this interface.
+type CounterfactualEvaluator interface {
+	Counterfactual(data map[string]interface{}, expr string, s Schema) (map[string]interface{}, error)
+}
+
+// PartialEvaluator is the interface that wraps the EvaluatePartial method.
+// EvaluatePartial is like Evaluate, but treats the inputs named in unknowns as
+// not yet known. An unknown may name a schema element, such as "student", or
+// a field of one, such as "student.gpa". If the result of the expression
+// depends on an unknown input, EvaluatePartial returns unknown = true and a
+// nil value; otherwise it returns the value, as Evaluate does.
+// Evaluators are not required to implement this interface.
+type PartialEvaluator interface {
+	EvaluatePartial(data map[string]interface{}, expr string, s Schema, self interface{},
+		evalData interface{}, resultType Type, returnDiagnostics bool, unknowns []string) (value interface{}, unknown bool, d *Diagnostics, err error)
+}
+
+// SessionCompiler is the interface that wraps the BeginCompile method.
+// The engine calls BeginCompile before compiling a rule tree, and the
+// function it returns after the last rule is compiled. Evaluators use the
+// session to share work between the rules of the tree, such as building the
+// environment for a schema once for all the rules using it. Sessions may
+// overlap if rule trees are compiled concurrently.
+// Evaluators are not required to implement this interface.
+type SessionCompiler interface {
+	BeginCompile() (end func())
+}
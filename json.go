@@ -0,0 +1,157 @@
+package indigo
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// EvalJSON evaluates the rule against data in a JSON object. The values in
+// the object are converted to the types of the schema elements with the same
+// names in the rule's schema:
+//
+//   - Int: a JSON number without a fraction, converted to int64
+//   - Float: a JSON number, converted to float64
+//   - Duration: a string in the format accepted by time.ParseDuration
+//   - Timestamp: a string in RFC 3339 format
+//   - Proto: an object in the protobuf JSON format, converted to a message
+//     of the schema's message type
+//   - List and Map: arrays and objects, with the elements converted to the
+//     list's or map's value type; map keys must be strings
+//
+// Values that don't match the schema type are an error. A null value for a
+// schema element is left out of the data, so the rule sees it as missing;
+// null elements of lists and maps are an error. Values whose keys are not in
+// the schema, or have the Any type, are converted as by encoding/json, which
+// converts numbers to float64 and null to nil.
+// Only the schema of the rule passed to EvalJSON is used, so child rules
+// should use the same schema.
+func (e *DefaultEngine) EvalJSON(ctx context.Context, r *Rule, jsonData []byte, opts ...EvalOption) (*Result, error) {
+	if r == nil {
+		return nil, fmt.Errorf("rule is nil")
+	}
+
+	d, err := decodeJSON(jsonData, r.Schema)
+	if err != nil {
+		return nil, fmt.Errorf("decoding JSON data: %w", err)
+	}
+	return e.Eval(ctx, r, d, opts...)
+}
+
+// decodeJSON decodes the JSON object, converting the values to the types
+// of the schema elements
+func decodeJSON(b []byte, s Schema) (map[string]interface{}, error) {
+	raw := map[string]json.RawMessage{}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, err
+	}
+
+	types := make(map[string]Type, len(s.Elements))
+	for _, el := range s.Elements {
+		types[el.Name] = el.Type
+	}
+
+	d := make(map[string]interface{}, len(raw))
+	for k, v := range raw {
+		if _, ok := types[k].(Any); types[k] != nil && !ok && isNull(v) {
+			continue
+		}
+		val, err := decodeJSONValue(v, types[k])
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %w", k, err)
+		}
+		d[k] = val
+	}
+	return d, nil
+}
+
+// isNull reports whether the JSON value is null
+func isNull(b json.RawMessage) bool {
+	return string(bytes.TrimSpace(b)) == "null"
+}
+
+// decodeJSONValue decodes the JSON value to a Go value of the Indigo type
+func decodeJSONValue(b json.RawMessage, t Type) (interface{}, error) {
+	// Decoding null would produce the zero value of the type, data that
+	// was never sent
+	if _, ok := t.(Any); t != nil && !ok && isNull(b) {
+		return nil, fmt.Errorf("null is not a valid %v", t)
+	}
+
+	switch x := t.(type) {
+	case Int:
+		var v int64
+		err := json.Unmarshal(b, &v)
+		return v, err
+	case Float:
+		var v float64
+		err := json.Unmarshal(b, &v)
+		return v, err
+	case String:
+		var v string
+		err := json.Unmarshal(b, &v)
+		return v, err
+	case Bool:
+		var v bool
+		err := json.Unmarshal(b, &v)
+		return v, err
+	case Duration:
+		var v string
+		if err := json.Unmarshal(b, &v); err != nil {
+			return nil, err
+		}
+		return time.ParseDuration(v)
+	case Timestamp:
+		var v string
+		if err := json.Unmarshal(b, &v); err != nil {
+			return nil, err
+		}
+		return time.Parse(time.RFC3339, v)
+	case Proto:
+		if x.Message == nil {
+			return nil, fmt.Errorf("indigo.Proto.Message is nil")
+		}
+		m := x.Message.ProtoReflect().New().Interface()
+		err := protojson.Unmarshal(b, m)
+		return m, err
+	case List:
+		var raw []json.RawMessage
+		if err := json.Unmarshal(b, &raw); err != nil {
+			return nil, err
+		}
+		list := make([]interface{}, 0, len(raw))
+		for i, r := range raw {
+			v, err := decodeJSONValue(r, x.ValueType)
+			if err != nil {
+				return nil, fmt.Errorf("element %d: %w", i, err)
+			}
+			list = append(list, v)
+		}
+		return list, nil
+	case Map:
+		if _, ok := x.KeyType.(String); !ok {
+			return nil, fmt.Errorf("map keys must be strings, not %v", x.KeyType)
+		}
+		var raw map[string]json.RawMessage
+		if err := json.Unmarshal(b, &raw); err != nil {
+			return nil, err
+		}
+		m := make(map[string]interface{}, len(raw))
+		for k, r := range raw {
+			v, err := decodeJSONValue(r, x.ValueType)
+			if err != nil {
+				return nil, fmt.Errorf("key %s: %w", k, err)
+			}
+			m[k] = v
+		}
+		return m, nil
+	default:
+		var v interface{}
+		err := json.Unmarshal(b, &v)
+		return v, err
+	}
+}
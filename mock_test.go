@@ -19,6 +19,8 @@ type mockEvaluator struct {
 	// Introduce an artificial delay in evaluating the expression.
 	// Used for testing the engine's context cancelation functionality.
 	evalDelay time.Duration
+	// The number of times Evaluate has been called
+	evalCount int
 }
 
 type program struct {
@@ -43,6 +45,7 @@ func (m *mockEvaluator) Compile(expr string, s indigo.Schema, resultType indigo.
 func (m *mockEvaluator) Evaluate(data map[string]interface{}, expr string, s indigo.Schema, self interface{}, prog interface{}, resultType indigo.Type, returnDiagnostics bool) (interface{}, *indigo.Diagnostics, error) {
 	//	m.rulesTested = append(m.rulesTested, r.ID)
 	time.Sleep(m.evalDelay)
+	m.evalCount++
 	prg := program{}
 
 	p, ok := prog.(program)
@@ -68,6 +71,10 @@ func (m *mockEvaluator) Evaluate(data map[string]interface{}, expr string, s ind
 		return true, diagnostics, nil
 	}
 
+	if expr == `missing` {
+		return nil, diagnostics, fmt.Errorf("no such attribute: %w", indigo.ErrMissingData)
+	}
+
 	if expr == `self` && self != nil {
 		return self, diagnostics, nil
 		// return indigo.Value{
@@ -0,0 +1,26 @@
+package indigo
+
+import "time"
+
+// Observer is notified by the DefaultEngine as it compiles and evaluates
+// rules. Use it to export metrics, such as evaluation counts, durations and
+// errors, without changing the engine. Set the observer with the WithObserver
+// option to NewEngine.
+//
+// The engine calls the observer synchronously, so the methods should return
+// quickly. The engine may call the methods from multiple goroutines at the
+// same time, for example when EvalBatch uses several workers, so
+// implementations must be safe for concurrent use.
+type Observer interface {
+	// OnRuleEvaluated is called after a rule and its child rules have been
+	// evaluated, with the outcome of the rule and the time taken to evaluate
+	// the rule, including its child rules.
+	OnRuleEvaluated(ruleID string, pass bool, d time.Duration)
+
+	// OnEvalError is called when evaluating a rule's expression fails.
+	OnEvalError(ruleID string, err error)
+
+	// OnCompile is called after a rule has been compiled, with the error if
+	// compilation failed. Child rules are compiled and reported separately.
+	OnCompile(ruleID string, err error)
+}
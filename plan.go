@@ -0,0 +1,126 @@
+package indigo
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/jedib0t/go-pretty/v6/text"
+)
+
+// EvalPlan lists the rules the engine may evaluate, in the order it would
+// evaluate them. The plan is made without evaluating any expressions, so
+// the outcome of each rule is unknown. All reachable rules are listed, and
+// notes on each step show where evaluation options may cause the engine to
+// skip the remaining child rules.
+type EvalPlan struct {
+	Steps []PlanStep
+}
+
+// PlanStep is the planned evaluation of a single rule.
+type PlanStep struct {
+	// The ID of the rule that would be evaluated
+	RuleID string
+
+	// The depth of the rule in the rule tree; the root rule has depth 0
+	Depth int
+
+	// Descriptions of the options that may stop the evaluation of
+	// the rule's children
+	Notes []string
+}
+
+// Plan walks the rule tree and returns the evaluation plan, taking into
+// account the evaluation options set on each rule and the options passed to
+// Plan, which override the rules' options as in Eval.
+// The rule must be compiled before planning, since the evaluation order of
+// child rules is determined at compile time.
+func (e *DefaultEngine) Plan(r *Rule, opts ...EvalOption) (*EvalPlan, error) {
+	if e == nil {
+		return nil, fmt.Errorf("engine is nil")
+	}
+
+	p := &EvalPlan{}
+	if err := p.add(e, r, 0, opts...); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// RuleIDs returns the IDs of the rules in the plan, in evaluation order.
+func (p *EvalPlan) RuleIDs() []string {
+	ids := make([]string, 0, len(p.Steps))
+	for _, s := range p.Steps {
+		ids = append(ids, s.RuleID)
+	}
+	return ids
+}
+
+// String produces a table of the rules in the plan and the notes for each.
+func (p *EvalPlan) String() string {
+	tw := table.NewWriter()
+	tw.SetTitle("\nINDIGO EVALUATION PLAN\n")
+	tw.AppendHeader(table.Row{"Rule", "Notes"})
+	for _, s := range p.Steps {
+		tw.AppendRow(table.Row{
+			fmt.Sprintf("%s%s", strings.Repeat("  ", s.Depth), s.RuleID),
+			strings.Join(s.Notes, "\n"),
+		})
+	}
+	style := table.StyleLight
+	style.Format.Header = text.FormatDefault
+	tw.SetStyle(style)
+	return tw.Render()
+}
+
+// add appends the planned evaluation of the rule and its children to the plan
+func (p *EvalPlan) add(e *DefaultEngine, r *Rule, depth int, opts ...EvalOption) error {
+	if r == nil {
+		return fmt.Errorf("rule is nil")
+	}
+
+	o := e.evalOptions(r, opts...)
+
+	step := PlanStep{
+		RuleID: r.ID,
+		Depth:  depth,
+	}
+
+	if len(r.Rules) > 0 {
+		if o.StopIfParentNegative {
+			step.Notes = append(step.Notes, "child rules are skipped if the expression is false")
+		}
+		if o.StopFirstPositiveChild {
+			step.Notes = append(step.Notes, "stops after the first positive child")
+		}
+		if o.StopFirstNegativeChild {
+			step.Notes = append(step.Notes, "stops after the first negative child")
+		}
+		if (o.StopFirstPositiveChild || o.StopFirstNegativeChild) && o.SortFunc == nil && unordered(r) > 1 {
+			step.Notes = append(step.Notes, "child evaluation order is unspecified")
+		}
+	}
+
+	p.Steps = append(p.Steps, step)
+
+	for _, cr := range r.sortChildRules(o.SortFunc, o.overrideSort) {
+		if err := p.add(e, cr, depth+1, opts...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unordered returns the number of the rule's child rules that are not listed
+// in its Order
+func unordered(r *Rule) int {
+	n := len(r.Rules)
+	listed := make(map[string]bool, len(r.Order))
+	for _, id := range r.Order {
+		if _, ok := r.Rules[id]; ok && !listed[id] {
+			listed[id] = true
+			n--
+		}
+	}
+	return n
+}
@@ -0,0 +1,135 @@
+package indigo_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/ezachrisen/indigo"
+	"github.com/matryer/is"
+)
+
+// Test that the plan lists all reachable rules in evaluation order
+func TestPlanAlphaSort(t *testing.T) {
+	is := is.New(t)
+
+	e := indigo.NewEngine(newMockEvaluator())
+	r := makeRule()
+	err := e.Compile(r)
+	is.NoErr(err)
+
+	p, err := e.Plan(r, indigo.SortFunc(indigo.SortRulesAlpha))
+	is.NoErr(err)
+
+	expectedOrder := []string{
+		"rule1",
+		"B", "b1", "b2", "b3", "b4", "b4-1", "b4-2",
+		"D", "d1", "d2", "d3",
+		"E", "e1", "e2", "e3",
+	}
+	is.True(reflect.DeepEqual(expectedOrder, p.RuleIDs()))
+
+	for _, s := range p.Steps {
+		is.Equal(len(s.Notes), 0) // no short-circuit options set
+	}
+
+	is.Equal(p.Steps[0].Depth, 0)
+	is.Equal(p.Steps[1].Depth, 1)
+	is.Equal(p.Steps[5].Depth, 2)
+	is.Equal(p.Steps[6].Depth, 3)
+}
+
+// Test that the plan notes where short-circuit options apply
+func TestPlanNotes(t *testing.T) {
+	is := is.New(t)
+
+	e := indigo.NewEngine(newMockEvaluator())
+
+	cases := []struct {
+		opts      []indigo.EvalOption
+		local     func(r *indigo.Rule) // options set on the rules
+		wantNotes map[string][]string
+	}{
+		{
+			opts: []indigo.EvalOption{indigo.StopIfParentNegative(true)},
+			wantNotes: map[string][]string{
+				"rule1": {"child rules are skipped if the expression is false"},
+				"B":     {"child rules are skipped if the expression is false"},
+				"b4":    {"child rules are skipped if the expression is false"},
+				"D":     {"child rules are skipped if the expression is false"},
+				"E":     {"child rules are skipped if the expression is false"},
+			},
+		},
+		{
+			opts: []indigo.EvalOption{indigo.StopFirstPositiveChild(true), indigo.SortFunc(indigo.SortRulesAlpha)},
+			wantNotes: map[string][]string{
+				"rule1": {"stops after the first positive child"},
+				"B":     {"stops after the first positive child"},
+				"b4":    {"stops after the first positive child"},
+				"D":     {"stops after the first positive child"},
+				"E":     {"stops after the first positive child"},
+			},
+		},
+		{
+			local: func(r *indigo.Rule) {
+				r.Rules["B"].EvalOptions.StopFirstNegativeChild = true
+			},
+			wantNotes: map[string][]string{
+				"B": {"stops after the first negative child", "child evaluation order is unspecified"},
+			},
+		},
+		{
+			// The Order decides the order of the children it lists
+			local: func(r *indigo.Rule) {
+				r.Rules["B"].EvalOptions.StopFirstNegativeChild = true
+				r.Rules["B"].Order = []string{"b4", "b3", "b2"}
+			},
+			wantNotes: map[string][]string{
+				"B": {"stops after the first negative child"},
+			},
+		},
+		{
+			local: func(r *indigo.Rule) {
+				r.Rules["B"].EvalOptions.StopFirstNegativeChild = true
+				r.Rules["B"].Order = []string{"b4", "b4", "x"}
+			},
+			wantNotes: map[string][]string{
+				"B": {"stops after the first negative child", "child evaluation order is unspecified"},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		r := makeRule()
+		if c.local != nil {
+			c.local(r)
+		}
+		err := e.Compile(r)
+		is.NoErr(err)
+
+		p, err := e.Plan(r, c.opts...)
+		is.NoErr(err)
+		is.Equal(len(p.Steps), 16) // all rules are reachable
+
+		for _, s := range p.Steps {
+			want := c.wantNotes[s.RuleID]
+			is.Equal(len(s.Notes), len(want))
+			if len(want) > 0 {
+				is.True(reflect.DeepEqual(s.Notes, want))
+			}
+		}
+	}
+}
+
+// Test that a plan is not produced for a nil rule
+func TestPlanNilRule(t *testing.T) {
+	is := is.New(t)
+
+	e := indigo.NewEngine(newMockEvaluator())
+	_, err := e.Plan(nil)
+	is.True(err != nil)
+
+	r := makeRule()
+	r.Rules["B"].Rules["oops"] = nil
+	_, err = e.Plan(r)
+	is.True(err != nil)
+}
@@ -0,0 +1,78 @@
+package indigo
+
+import (
+	"context"
+	"fmt"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// EvalProto evaluates the rule like Eval, with the fields of the message as
+// the data. Each field is available to the expressions at the top level,
+// under its proto field name, so with a school.Student message, an
+// expression can refer to gpa rather than student.gpa. The rule's schema
+// must declare the fields used, with the Indigo type of the field: enums are
+// declared as Int, and fields holding messages as Proto, Timestamp or
+// Duration. Unset fields have their default values, as in proto3.
+func (e *DefaultEngine) EvalProto(ctx context.Context, r *Rule, msg proto.Message, opts ...EvalOption) (*Result, error) {
+	if msg == nil {
+		return nil, fmt.Errorf("message is nil")
+	}
+	return e.Eval(ctx, r, protoData(msg.ProtoReflect()), opts...)
+}
+
+// protoData returns the values of the fields of the message by field name
+func protoData(m protoreflect.Message) map[string]interface{} {
+	fds := m.Descriptor().Fields()
+	d := make(map[string]interface{}, fds.Len())
+	for i := 0; i < fds.Len(); i++ {
+		fd := fds.Get(i)
+		d[string(fd.Name())] = protoValue(fd, m.Get(fd))
+	}
+	return d
+}
+
+// protoValue converts the value of the field to a value the evaluator can use
+func protoValue(fd protoreflect.FieldDescriptor, v protoreflect.Value) interface{} {
+	switch {
+	case fd.IsList():
+		l := v.List()
+		list := make([]interface{}, l.Len())
+		for i := range list {
+			list[i] = protoScalar(fd, l.Get(i))
+		}
+		return list
+	case fd.IsMap():
+		m := v.Map()
+		if fd.MapKey().Kind() == protoreflect.StringKind {
+			strs := make(map[string]interface{}, m.Len())
+			m.Range(func(k protoreflect.MapKey, v protoreflect.Value) bool {
+				strs[k.String()] = protoScalar(fd.MapValue(), v)
+				return true
+			})
+			return strs
+		}
+		others := make(map[interface{}]interface{}, m.Len())
+		m.Range(func(k protoreflect.MapKey, v protoreflect.Value) bool {
+			others[k.Interface()] = protoScalar(fd.MapValue(), v)
+			return true
+		})
+		return others
+	default:
+		return protoScalar(fd, v)
+	}
+}
+
+// protoScalar converts a single value of the field: enums become int64 and
+// messages proto.Message; other values are the Go values of the field
+func protoScalar(fd protoreflect.FieldDescriptor, v protoreflect.Value) interface{} {
+	switch fd.Kind() {
+	case protoreflect.EnumKind:
+		return int64(v.Enum())
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		return v.Message().Interface()
+	default:
+		return v.Interface()
+	}
+}
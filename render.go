@@ -0,0 +1,131 @@
+package indigo
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/jedib0t/go-pretty/v6/text"
+)
+
+// RenderOption is a functional option to control how Result.Render
+// formats the results.
+type RenderOption func(o *renderOptions)
+
+type renderOptions struct {
+	columns []string
+	plain   bool
+}
+
+// Columns selects the columns to include in the table, in the order given.
+// The column names are:
+//
+//	Rule, Pass, ExprPass, Children, Value, Diagnostics, TrueIfAny,
+//	StopIfParentNegative, StopFirstPositiveChild, StopFirstNegativeChild,
+//	DiscardPass, DiscardFail
+//
+// Unknown names are ignored. By default, all columns are included.
+func Columns(names ...string) RenderOption {
+	return func(o *renderOptions) {
+		o.columns = names
+	}
+}
+
+// Plain renders the table without borders or box-drawing characters, with
+// the columns separated by spaces.
+func Plain() RenderOption {
+	return func(o *renderOptions) {
+		o.plain = true
+	}
+}
+
+// resultColumn is a column in the table produced by Result.Render
+type resultColumn struct {
+	name   string               // the name used in the Columns option
+	header string               // the column header
+	value  func(*Result) string // the value of the column for a result
+}
+
+// resultColumns lists all the columns, in the default order
+var resultColumns = []resultColumn{
+	{"Rule", "\nRule", func(u *Result) string { return u.Rule.ID }},
+	{"Pass", "Pass/\nFail", func(u *Result) string { return u.State.String() }},
+	{"ExprPass", "Expr.\nPass/\nFail", func(u *Result) string { return boolString(u.ExpressionPass) }},
+	{"Children", "Chil-\ndren", func(u *Result) string { return fmt.Sprintf("%d", len(u.Results)) }},
+	{"Value", "Output\nValue", func(u *Result) string { return u.ValueString() }},
+	{"Diagnostics", "Diagnostics\nAvailable?", func(u *Result) string { return trueFalse(fmt.Sprintf("%t", u.Diagnostics != nil)) }},
+	{"TrueIfAny", "True\nIf Any?", func(u *Result) string { return trueFalse(fmt.Sprintf("%t", u.EvalOptions.TrueIfAny)) }},
+	{"StopIfParentNegative", "Stop If\nParent Neg.", func(u *Result) string {
+		return trueFalse(fmt.Sprintf("%t", u.EvalOptions.StopIfParentNegative))
+	}},
+	{"StopFirstPositiveChild", "Stop First\nPos. Child", func(u *Result) string {
+		return trueFalse(fmt.Sprintf("%t", u.EvalOptions.StopFirstPositiveChild))
+	}},
+	{"StopFirstNegativeChild", "Stop First\nNeg. Child", func(u *Result) string {
+		return trueFalse(fmt.Sprintf("%t", u.EvalOptions.StopFirstNegativeChild))
+	}},
+	{"DiscardPass", "Discard\nPass", func(u *Result) string { return trueFalse(fmt.Sprintf("%t", u.EvalOptions.DiscardPass)) }},
+	{"DiscardFail", "Discard\nFail", func(u *Result) string { return trueFalse(fmt.Sprintf("%d", u.EvalOptions.DiscardFail)) }},
+}
+
+// Render produces a table of the rules (including child rules) executed and
+// the result of the evaluation. Child results are listed in the order the
+// child rules are evaluated (see Flat). Use the options to choose the columns
+// and the style of the table.
+func (u *Result) Render(opts ...RenderOption) string {
+	o := renderOptions{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	cols := resultColumns
+	if o.columns != nil {
+		cols = []resultColumn{}
+		for _, name := range o.columns {
+			for _, c := range resultColumns {
+				if c.name == name {
+					cols = append(cols, c)
+				}
+			}
+		}
+	}
+
+	tw := table.NewWriter()
+	tw.SetTitle("\nINDIGO RESULTS\n")
+	header := table.Row{}
+	for _, c := range cols {
+		header = append(header, c.header)
+	}
+	tw.AppendHeader(header)
+	for _, r := range u.renderRows(cols, 0) {
+		tw.AppendRow(r)
+	}
+
+	style := table.StyleLight
+	if o.plain {
+		style = table.StyleDefault
+		style.Options = table.OptionsNoBordersAndSeparators
+	}
+	style.Format.Header = text.FormatDefault
+	tw.SetStyle(style)
+	return tw.Render()
+}
+
+// renderRows returns the rows for the result and its children, with the
+// rule IDs indented by the depth n of the result in the tree
+func (u *Result) renderRows(cols []resultColumn, n int) []table.Row {
+	row := table.Row{}
+	for _, c := range cols {
+		v := c.value(u)
+		if c.name == "Rule" {
+			v = strings.Repeat("  ", n) + v
+		}
+		row = append(row, v)
+	}
+
+	rows := []table.Row{row}
+	for _, c := range u.childResults() {
+		rows = append(rows, c.renderRows(cols, n+1)...)
+	}
+	return rows
+}
@@ -0,0 +1,60 @@
+package indigo_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/ezachrisen/indigo"
+	"github.com/matryer/is"
+)
+
+// Test rendering the results with selected columns and without borders
+func TestRender(t *testing.T) {
+	is := is.New(t)
+
+	r := makeRule()
+	e := indigo.NewEngine(newMockEvaluator())
+	is.NoErr(e.Compile(r))
+
+	u, err := e.Eval(context.Background(), r, map[string]interface{}{})
+	is.NoErr(err)
+
+	out := u.Render(indigo.Columns("Rule", "Pass", "Value"), indigo.Plain())
+	lines := []string{}
+	for _, l := range strings.Split(out, "\n") {
+		if l = strings.TrimSpace(l); l != "" {
+			lines = append(lines, strings.Join(strings.Fields(l), " "))
+		}
+	}
+
+	is.Equal(lines, []string{
+		"INDIGO RESULTS",
+		"Pass/ Output",
+		"Rule Fail Value",
+		"rule1 FAIL true",
+		"B FAIL false",
+		"b1 PASS true",
+		"b2 FAIL false",
+		"b3 PASS true",
+		"b4 FAIL false",
+		"b4-1 PASS true",
+		"b4-2 FAIL false",
+		"D FAIL true",
+		"d1 PASS true",
+		"d2 FAIL false",
+		"d3 PASS true",
+		"E FAIL false",
+		"e1 PASS true",
+		"e2 FAIL false",
+		"e3 PASS true",
+	})
+	is.True(strings.Contains(out, "\n       b4-1 ")) // child rules are indented
+	is.True(!strings.ContainsAny(out, "│─┌"))
+
+	// String renders all columns, with borders
+	full := u.String()
+	is.Equal(full, u.Render())
+	is.True(strings.Contains(full, "Discard"))
+	is.True(strings.Contains(full, "│"))
+}
@@ -1,11 +1,18 @@
 package indigo
 
 import (
+	"encoding/json"
 	"fmt"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/jedib0t/go-pretty/v6/table"
 	"github.com/jedib0t/go-pretty/v6/text"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 // Result of evaluating a rule.
@@ -20,6 +27,13 @@ type Result struct {
 	// true for Pass to be true.
 	Pass bool
 
+	// The outcome of the rule: passed, failed or unknown.
+	// The outcome is unknown if the rule, or a child rule that decides
+	// the outcome, refers to missing data and the UnknownOnMissingData
+	// option is set, or depends on an input marked unknown with the
+	// PartialEval option. Pass is true only if State is StatePass.
+	State ResultState
+
 	// Whether evaluating the rule expression yielded a TRUE logical value.
 	// The default is TRUE.
 	// The result will not be affected by the results of the child rules.
@@ -31,12 +45,40 @@ type Result struct {
 	// This value is never affected by child rules.
 	Value interface{}
 
+	// The values of the rule's Outputs expressions, by name.
+	// Nil if the rule has no outputs, or the outcome of the rule is unknown.
+	Outputs map[string]interface{}
+
+	// The value of the rule's Message expression, explaining why the rule
+	// failed. Empty if the rule has no Message expression, or did not fail.
+	Message string
+
 	// Results of evaluating the child rules.
 	Results map[string]*Result
 
+	// The ID of the rule whose failure stopped the evaluation, if the
+	// StopOnFirstFailure option is set: this rule, or a rule below it.
+	// Empty if no rule failed, or the option is not set.
+	FirstFailure string
+
+	// The number of rules evaluated to produce this result: the rule itself
+	// and all child rules evaluated, including those whose results were discarded.
+	EvalCount int
+
+	// The number of the rules counted in EvalCount that were evaluated
+	// concurrently with their sibling rules, in parallel mode (see
+	// ParallelOrdered and ParallelSubtrees)
+	EvalParallelCount int
+
 	// Diagnostic data; only available if you turn on diagnostics for the evaluation
 	Diagnostics *Diagnostics
 
+	// The data the rule was evaluated with, including the rule's Self and
+	// the values of its ancestors' ResultKeys. Only available if you turn on
+	// diagnostics and the CaptureData option for the evaluation. The map is
+	// a shallow copy: the values are shared with the data passed to Eval.
+	Data map[string]interface{}
+
 	// The evaluation options used
 	EvalOptions EvalOptions
 
@@ -46,66 +88,255 @@ type Result struct {
 	// If we're discarding failed/passed rules, they will not be in the results,
 	// and will not show up in diagnostics, but they will be in this list.
 	RulesEvaluated []*Rule
+
+	// The error evaluating the rule's expression. Only set if the
+	// CollectErrors option is set; otherwise Eval returns the error.
+	Error error
+
+	// Whether the evaluator reported missing data, making the outcome of
+	// the expression unknown
+	missingData bool
+
+	// Values attached to the result by the caller, see SetAnnotation
+	annotations map[string]interface{}
 }
 
-// String produces a list of rules (including child rules) executed and the result of the evaluation.
-func (u *Result) String() string {
+// ResultState is the outcome of evaluating a rule.
+type ResultState int
 
-	tw := table.NewWriter()
-	tw.SetTitle("\nINDIGO RESULTS\n")
-	tw.AppendHeader(table.Row{"\nRule", "Pass/\nFail", "Expr.\nPass/\nFail", "Chil-\ndren", "Output\nValue", "Diagnostics\nAvailable?", "True\nIf Any?",
-		"Stop If\nParent Neg.", "Stop First\nPos. Child", "Stop First\nNeg. Child", "Discard\nPass", "Discard\nFail"})
-	rows := u.resultsToRows(0)
+const (
+	// StateFail means the rule did not pass
+	StateFail ResultState = iota
 
-	for _, r := range rows {
-		tw.AppendRow(r)
+	// StatePass means the rule passed
+	StatePass
+
+	// StateUnknown means the outcome of the rule could not be determined,
+	// because the rule referred to missing or unknown data
+	StateUnknown
+)
+
+// String returns PASS, FAIL or UNKNOWN
+func (s ResultState) String() string {
+	switch s {
+	case StatePass:
+		return "PASS"
+	case StateFail:
+		return "FAIL"
+	case StateUnknown:
+		return "UNKNOWN"
+	default:
+		return fmt.Sprintf("ResultState(%d)", int(s))
 	}
-	style := table.StyleLight
-	style.Format.Header = text.FormatDefault
-	tw.SetStyle(style)
-	return tw.Render()
 }
 
-func boolString(b bool) string {
-	switch b {
-	case true:
-		return "PASS"
+// stateOf returns the state of an expression
+func stateOf(pass, unknown bool) ResultState {
+	switch {
+	case unknown:
+		return StateUnknown
+	case pass:
+		return StatePass
 	default:
-		return "FAIL"
+		return StateFail
 	}
 }
 
-// resultsToRows transforms the Results data to a list of resultsToRows
-// for inclusion in a table.Writer table.
-func (u *Result) resultsToRows(n int) []table.Row {
-	rows := []table.Row{}
-	indent := strings.Repeat("  ", n)
+// Flat returns the result and the results of its descendants as a list, in
+// depth-first order. The results of child rules are listed in the order the
+// child rules are evaluated (see Rule.Order and EvalOptions.SortFunc), or in
+// order of rule ID if the evaluation order is not specified.
+func (u *Result) Flat() []*Result {
+	if u == nil {
+		return nil
+	}
+	list := []*Result{u}
+	for _, c := range u.childResults() {
+		list = append(list, c.Flat()...)
+	}
+	return list
+}
 
-	diag := false
-	if u.Diagnostics != nil {
-		diag = true
+// FlatWhere returns an iterator over the results listed by Flat for which
+// match returns true, in the same order, without building the list. The
+// iterator has the type of iter.Seq[*Result], so with Go 1.23 or later, use
+// it in a for loop:
+//
+//	for c := range u.FlatWhere(func(c *Result) bool { return c.Pass }) {
+//		...
+//	}
+//
+// If match is nil, all the results are returned.
+func (u *Result) FlatWhere(match func(*Result) bool) func(yield func(*Result) bool) {
+	return func(yield func(*Result) bool) {
+		u.flatWhere(match, yield)
 	}
+}
 
-	row := table.Row{
-		fmt.Sprintf("%s%s", indent, u.Rule.ID),
-		boolString(u.Pass),
-		boolString(u.ExpressionPass),
-		fmt.Sprintf("%d", len(u.Results)),
-		fmt.Sprintf("%v", u.Value),
-		trueFalse(fmt.Sprintf("%t", diag)),
-		trueFalse(fmt.Sprintf("%t", u.EvalOptions.TrueIfAny)),
-		trueFalse(fmt.Sprintf("%t", u.EvalOptions.StopIfParentNegative)),
-		trueFalse(fmt.Sprintf("%t", u.EvalOptions.StopFirstPositiveChild)),
-		trueFalse(fmt.Sprintf("%t", u.EvalOptions.StopFirstNegativeChild)),
-		trueFalse(fmt.Sprintf("%t", u.EvalOptions.DiscardPass)),
-		trueFalse(fmt.Sprintf("%d", u.EvalOptions.DiscardFail)),
+// flatWhere calls yield for the matching results, and returns false if yield
+// did, ending the iteration
+func (u *Result) flatWhere(match func(*Result) bool, yield func(*Result) bool) bool {
+	if u == nil {
+		return true
+	}
+	if (match == nil || match(u)) && !yield(u) {
+		return false
 	}
+	for _, c := range u.childResults() {
+		if !c.flatWhere(match, yield) {
+			return false
+		}
+	}
+	return true
+}
 
-	rows = append(rows, row)
-	for _, cd := range u.Results {
-		rows = append(rows, cd.resultsToRows(n+1)...)
+// childResults returns the child results in the order the child rules are
+// evaluated, or in order of rule ID if the evaluation order is not specified
+func (u *Result) childResults() []*Result {
+	list := make([]*Result, 0, len(u.Results))
+	if u.Rule == nil {
+		for _, c := range u.Results {
+			list = append(list, c)
+		}
+		return list
+	}
+	fn := u.EvalOptions.SortFunc
+	if fn == nil {
+		fn = SortRulesAlpha
+	}
+	for _, cr := range u.Rule.sortChildRules(fn, true) {
+		if cr == nil {
+			continue
+		}
+		if c, ok := u.Results[cr.ID]; ok {
+			list = append(list, c)
+		}
+	}
+	return list
+}
+
+// FirstPass returns the first passing leaf result in the result tree, and the
+// path to it: the results from this result down to and including the leaf.
+// Only passing results are followed, and the child results of a rule are
+// searched in order of rule ID, so the selection is deterministic. A leaf is a
+// result without child results. If no passing leaf is found, FirstPass
+// returns nil, nil.
+// Use FirstPass to find the "winning" rule of a decision table.
+func (u *Result) FirstPass() (leaf *Result, path []*Result) {
+	if u == nil || !u.Pass {
+		return nil, nil
+	}
+
+	if len(u.Results) == 0 {
+		return u, []*Result{u}
+	}
+
+	ids := make([]string, 0, len(u.Results))
+	for id := range u.Results {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		if leaf, path := u.Results[id].FirstPass(); leaf != nil {
+			return leaf, append([]*Result{u}, path...)
+		}
+	}
+	return nil, nil
+}
+
+// SetAnnotation attaches a value to the result under the key, replacing any
+// value already attached under the key. Use annotations to record decisions
+// made while walking the results, such as the action to take for a rule, and
+// read them later with GetAnnotation. Annotations are not used by the engine.
+// SetAnnotation is not safe for concurrent use.
+func (u *Result) SetAnnotation(key string, v interface{}) {
+	if u.annotations == nil {
+		u.annotations = map[string]interface{}{}
+	}
+	u.annotations[key] = v
+}
+
+// GetAnnotation returns the value attached to the result under the key, and
+// whether there is one. See SetAnnotation.
+func (u *Result) GetAnnotation(key string) (interface{}, bool) {
+	if u == nil {
+		return nil, false
+	}
+	v, ok := u.annotations[key]
+	return v, ok
+}
+
+// AsList returns the value of the rule's expression as a list, and whether
+// the value is a list. The CEL evaluator returns lists as []interface{}.
+func (u *Result) AsList() ([]interface{}, bool) {
+	if u == nil {
+		return nil, false
+	}
+	l, ok := u.Value.([]interface{})
+	return l, ok
+}
+
+// AsMap returns the value of the rule's expression as a map, and whether the
+// value is a map with string keys. The CEL evaluator returns maps with
+// string keys as map[string]interface{}.
+func (u *Result) AsMap() (map[string]interface{}, bool) {
+	if u == nil {
+		return nil, false
+	}
+	m, ok := u.Value.(map[string]interface{})
+	return m, ok
+}
+
+// ValueString returns the value of the rule's expression formatted for
+// display according to the rule's ResultType: durations in Go's
+// time.Duration format, such as "72h0m0s", and timestamps in RFC 3339
+// format. Values of other types are formatted with %v.
+func (u *Result) ValueString() string {
+	if u == nil {
+		return ""
+	}
+	var t Type
+	if u.Rule != nil {
+		t = u.Rule.ResultType
+	}
+	return formatValue(u.Value, t)
+}
+
+// formatValue formats the value for display according to its declared type
+func formatValue(v interface{}, t Type) string {
+	switch t.(type) {
+	case Duration:
+		switch d := v.(type) {
+		case time.Duration:
+			return d.String()
+		case *durationpb.Duration:
+			return d.AsDuration().String()
+		}
+	case Timestamp:
+		switch ts := v.(type) {
+		case time.Time:
+			return ts.Format(time.RFC3339)
+		case *timestamppb.Timestamp:
+			return ts.AsTime().Format(time.RFC3339)
+		}
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+// String produces a list of rules (including child rules) executed and the result of the evaluation.
+// It is the same as Render with no options.
+func (u *Result) String() string {
+	return u.Render()
+}
+
+func boolString(b bool) string {
+	switch b {
+	case true:
+		return "PASS"
+	default:
+		return "FAIL"
 	}
-	return rows
 }
 
 func trueFalse(t string) string {
@@ -136,6 +367,66 @@ func (u *Result) Summary() string {
 	return tw.Render()
 }
 
+// ResultSummary counts the outcomes of the rules in a result tree; see
+// Result.Counts.
+type ResultSummary struct {
+	// The number of results in the tree, including the root
+	Total int
+	// The number of results that passed, failed and whose outcome is unknown
+	Passed  int
+	Failed  int
+	Unknown int
+	// The number of results that passed and failed, by the rule's Meta,
+	// formatted with %v. Rules without Meta are not included.
+	Categories map[string]CategoryCounts
+}
+
+// CategoryCounts is the number of results in a category that passed and failed
+type CategoryCounts struct {
+	Pass int
+	Fail int
+}
+
+// Counts walks the result tree and counts the outcomes of the rules.
+// Only the results in the tree are counted: rules whose results were
+// discarded, such as with DiscardPass, are not. See EvalCount for the number
+// of rules evaluated.
+func (u *Result) Counts() ResultSummary {
+	sum := ResultSummary{Categories: map[string]CategoryCounts{}}
+	u.count(&sum)
+	return sum
+}
+
+// count adds the result and its children to the summary
+func (u *Result) count(sum *ResultSummary) {
+	if u == nil {
+		return
+	}
+	sum.Total++
+	switch u.State {
+	case StatePass:
+		sum.Passed++
+	case StateFail:
+		sum.Failed++
+	default:
+		sum.Unknown++
+	}
+	if u.Rule != nil && u.Rule.Meta != nil {
+		k := fmt.Sprintf("%v", u.Rule.Meta)
+		c := sum.Categories[k]
+		switch u.State {
+		case StatePass:
+			c.Pass++
+		case StateFail:
+			c.Fail++
+		}
+		sum.Categories[k] = c
+	}
+	for _, c := range u.Results {
+		c.count(sum)
+	}
+}
+
 // summaryResultsToRows transforms the Results data to a list of resultsToRows
 // for inclusion in a table.Writer table.
 func (u *Result) summaryResultsToRows(n int) []table.Row {
@@ -144,9 +435,9 @@ func (u *Result) summaryResultsToRows(n int) []table.Row {
 
 	row := table.Row{
 		fmt.Sprintf("%s%s", indent, u.Rule.ID),
-		boolString(u.Pass),
+		u.State.String(),
 		boolString(u.ExpressionPass),
-		fmt.Sprintf("%v", u.Value),
+		u.ValueString(),
 	}
 
 	rows = append(rows, row)
@@ -155,3 +446,152 @@ func (u *Result) summaryResultsToRows(n int) []table.Row {
 	}
 	return rows
 }
+
+// ToJSON returns a JSON representation of the result and its child results.
+// The shape of the JSON is stable:
+//
+//	{
+//	  "rule_id": "rule1",
+//	  "pass": true,
+//	  "expression_pass": true,
+//	  "value": {"type": "bool", "value": true},
+//	  "eval_count": 2,
+//	  "results": {
+//	    "child1": { ... }
+//	  }
+//	}
+//
+// The value's type is one of null, bool, int, uint, float, string, duration,
+// timestamp, proto(<full message name>), or any. Protocol buffer messages are
+// encoded with protojson, durations as strings in Go's time.Duration format,
+// and timestamps as RFC 3339 strings. Values of other types are encoded with
+// encoding/json if possible, otherwise as the fmt %v string.
+// The "results" key is omitted if there are no child results.
+func (u *Result) ToJSON() ([]byte, error) {
+	j, err := u.toJSON()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(j)
+}
+
+// resultJSON is the JSON representation of a Result
+type resultJSON struct {
+	RuleID         string                 `json:"rule_id"`
+	Pass           bool                   `json:"pass"`
+	ExpressionPass bool                   `json:"expression_pass"`
+	Value          valueJSON              `json:"value"`
+	EvalCount      int                    `json:"eval_count"`
+	EvalParallel   int                    `json:"eval_parallel_count,omitempty"`
+	Error          string                 `json:"error,omitempty"`
+	Message        string                 `json:"message,omitempty"`
+	FirstFailure   string                 `json:"first_failure,omitempty"`
+	Outputs        map[string]valueJSON   `json:"outputs,omitempty"`
+	Results        map[string]*resultJSON `json:"results,omitempty"`
+}
+
+// valueJSON is the JSON representation of a Result's value
+type valueJSON struct {
+	Type  string          `json:"type"`
+	Value json.RawMessage `json:"value"`
+}
+
+// toJSON converts the result and its children to their JSON representation
+func (u *Result) toJSON() (*resultJSON, error) {
+	if u == nil {
+		return nil, fmt.Errorf("result is nil")
+	}
+
+	j := &resultJSON{
+		Pass:           u.Pass,
+		ExpressionPass: u.ExpressionPass,
+		EvalCount:      u.EvalCount,
+		EvalParallel:   u.EvalParallelCount,
+		Message:        u.Message,
+		FirstFailure:   u.FirstFailure,
+	}
+	if u.Error != nil {
+		j.Error = u.Error.Error()
+	}
+	if u.Rule != nil {
+		j.RuleID = u.Rule.ID
+	}
+
+	v, err := valueToJSON(u.Value)
+	if err != nil {
+		return nil, fmt.Errorf("rule %s: %w", j.RuleID, err)
+	}
+	j.Value = v
+
+	if len(u.Outputs) > 0 {
+		j.Outputs = make(map[string]valueJSON, len(u.Outputs))
+		for k, v := range u.Outputs {
+			vj, err := valueToJSON(v)
+			if err != nil {
+				return nil, fmt.Errorf("output %s: %w", k, err)
+			}
+			j.Outputs[k] = vj
+		}
+	}
+
+	if len(u.Results) > 0 {
+		j.Results = make(map[string]*resultJSON, len(u.Results))
+		for k, c := range u.Results {
+			cj, err := c.toJSON()
+			if err != nil {
+				return nil, err
+			}
+			j.Results[k] = cj
+		}
+	}
+	return j, nil
+}
+
+// valueToJSON converts a value to its JSON representation, tagged with its type
+func valueToJSON(v interface{}) (valueJSON, error) {
+	var typ string
+	var x interface{}
+
+	switch t := v.(type) {
+	case nil:
+		return valueJSON{Type: "null", Value: json.RawMessage("null")}, nil
+	case bool:
+		typ, x = "bool", t
+	case int, int8, int16, int32, int64:
+		typ, x = "int", t
+	case uint, uint8, uint16, uint32, uint64:
+		typ, x = "uint", t
+	case float32, float64:
+		typ, x = "float", t
+	case string:
+		typ, x = "string", t
+	case time.Duration:
+		typ, x = "duration", t.String()
+	case *durationpb.Duration:
+		typ, x = "duration", t.AsDuration().String()
+	case time.Time:
+		typ, x = "timestamp", t.Format(time.RFC3339Nano)
+	case *timestamppb.Timestamp:
+		typ, x = "timestamp", t.AsTime().Format(time.RFC3339Nano)
+	case proto.Message:
+		b, err := protojson.Marshal(t)
+		if err != nil {
+			return valueJSON{}, fmt.Errorf("marshaling %T: %w", t, err)
+		}
+		return valueJSON{
+			Type:  fmt.Sprintf("proto(%s)", t.ProtoReflect().Descriptor().FullName()),
+			Value: b,
+		}, nil
+	default:
+		typ, x = "any", t
+	}
+
+	b, err := json.Marshal(x)
+	if err != nil {
+		b, err = json.Marshal(fmt.Sprintf("%v", x))
+		if err != nil {
+			return valueJSON{}, err
+		}
+	}
+	return valueJSON{Type: typ, Value: b}, nil
+}
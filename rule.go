@@ -1,9 +1,13 @@
 package indigo
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/jedib0t/go-pretty/v6/table"
 	"github.com/jedib0t/go-pretty/v6/text"
@@ -57,25 +61,118 @@ type Rule struct {
 	// Some implementations of Evaluator require a schema.
 	Schema Schema `json:"schema,omitempty"`
 
+	// The tag of the evaluator for the rule's expression, when the engine
+	// uses a CompositeEvaluator. (optional)
+	// If blank, the CompositeEvaluator's primary evaluator is used.
+	Evaluator string `json:"evaluator,omitempty"`
+
 	// A reference to an object whose values can be used in the rule expression.
 	// Add the corresponding object in the data with the reserved key name selfKey
 	// (see constants).
+	// Self may be any value the evaluator supports, including a protocol
+	// buffer message; declare "self" in the schema with the type of the value.
 	// Child rules do not inherit the self value.
 	Self interface{} `json:"-"`
 
 	// A set of child rules.
 	Rules map[string]*Rule `json:"rules,omitempty"`
 
+	// The IDs of the child rules in the order they should be evaluated and
+	// presented in results. (optional)
+	// Child rules in the list are evaluated first, in the order listed,
+	// followed by the child rules not in the list, in the order given by the
+	// EvalOptions.SortFunc. Unlike SortFunc, the order is not changed by
+	// options passed to Eval.
+	Order []string `json:"order,omitempty"`
+
+	// The priority of the rule among its siblings, used by the
+	// SortRulesPriority sort function to evaluate the rules with the highest
+	// priority first. (optional)
+	Priority int `json:"priority,omitempty"`
+
+	// The name under which the rule's value is made available to its
+	// descendants. (optional)
+	// If set, the descendants are evaluated with a copy of the input data
+	// that includes the value of the rule's expression under this key. The
+	// input data itself is not modified, and the rule's siblings do not see
+	// the value. The schemas of the descendants must declare the key.
+	ResultKey string `json:"result_key,omitempty"`
+
+	// Named expressions computing additional values, such as
+	// {"risk": "student.gpa < 2.0 ? 0.8 : 0.1"}. The expressions are
+	// compiled and evaluated with the rule's schema and data, and their values
+	// are returned in Result.Outputs. They may produce values of any type.
+	Outputs map[string]string `json:"outputs,omitempty"`
+
+	// An expression producing a human-readable reason for the rule's
+	// failure, such as `"GPA too low: " + string(student.gpa)`. (optional)
+	// The expression is compiled with the rule's schema and must produce a
+	// string. It is only evaluated if the rule fails, and its value is
+	// returned in Result.Message.
+	Message string `json:"message,omitempty"`
+
+	// An expression deciding whether the rule and its descendants apply to
+	// the data, such as `school == "Central"`. (optional)
+	// The condition is compiled with the rule's schema and must produce a
+	// boolean. Before a rule's child rules are evaluated, the conditions of
+	// the child rules are evaluated; a child rule whose condition is false
+	// is skipped with its descendants, as if it were not in the tree. Unlike
+	// StopIfParentNegative, the skipped rule is not evaluated and is not in
+	// the results. The condition of the rule passed to Eval is not used.
+	ShardCondition string `json:"shard_condition,omitempty"`
+
 	// Reference to intermediate compilation / evaluation data.
 	Program interface{} `json:"-"`
 
+	// The compiled versions of the Outputs expressions, by name
+	outputPrograms map[string]interface{}
+
+	// The compiled version of the Message expression
+	messageProgram interface{}
+
+	// The compiled version of the ShardCondition expression
+	shardProgram interface{}
+
+	// The hash of the rule when it was compiled, see Hash and ResultCache
+	hash string
+
 	// A reference to any object.
 	// Not used by the rules engine.
 	Meta interface{} `json:"-"`
 
+	// Structured, user-defined information about the rule, such as its
+	// owner or a description. Not used by the rules engine, but included in
+	// the documentation produced by GenerateDocs.
+	Annotations map[string]string `json:"annotations,omitempty"`
+
+	// The names of the schema elements the expression may refer to. (optional)
+	// If set, compilation fails if the expression refers to a schema element
+	// not in the list. Use it to prevent rule authors from accessing data
+	// they should not see. If nil, the expression may refer to any element.
+	// The evaluator must implement the ExpressionInspector interface.
+	AllowedFields []string `json:"allowed_fields,omitempty"`
+
+	// The time the rule takes effect. (optional)
+	// A rule is only evaluated if the evaluation time is at or after
+	// EffectiveFrom; see the EvaluationTime option. Child rules that are not
+	// yet effective are skipped, as if they were not in the tree.
+	// If nil, the rule has been effective forever.
+	EffectiveFrom *time.Time `json:"effective_from,omitempty"`
+
+	// The time the rule stops being effective. (optional)
+	// A rule is only evaluated if the evaluation time is before EffectiveTo.
+	// If nil, the rule is effective forever.
+	EffectiveTo *time.Time `json:"effective_to,omitempty"`
+
 	// Options determining how the child rules should be handled.
 	EvalOptions EvalOptions `json:"eval_options"`
 
+	// The position of the expression in an enclosing document, such as a
+	// rules file edited by a user. (optional)
+	// If set, the positions in compilation errors are reported relative to the
+	// enclosing document instead of the expression.
+	SourceOffset SourceOffset `json:"source_offset"`
+
 	// sortedRules contains a list of child rules, sorted by the
 	// EvalOptions.SortFunc. During rule evaluation, the rules are evaluated in
 	// the order they appear in this list. The sorted list is calculated at
@@ -84,10 +181,27 @@ type Rule struct {
 	sortedRules []*Rule
 }
 
+// SourceOffset is the position where a rule expression starts in an enclosing
+// document.
+// Line is the number of lines preceding the expression, and Col is the number of
+// characters preceding the expression on its first line.
+type SourceOffset struct {
+	Line int `json:"line"`
+	Col  int `json:"col"`
+}
+
 const (
 	// If the rule includes a Self object, it will be made available in the input
 	// data with this key name.
 	selfKey = "self"
+
+	// If the evaluation has a seed (see the WithSeed option), it will be made
+	// available in the input data with this key name.
+	seedKey = "seed"
+
+	// If the evaluation has a current time (see the InjectNow option), it will
+	// be made available in the input data with this key name.
+	nowKey = "now"
 )
 
 // NewRule initializes a rule with the ID and rule expression.
@@ -100,6 +214,26 @@ func NewRule(id string, expr string) *Rule {
 	}
 }
 
+// UniqueChildID returns an ID for a new child rule of parent that does not
+// collide with the IDs of the existing child rules: base if it's not taken,
+// otherwise base followed by the smallest numeric suffix that is free, such as
+// "default_1". Use it when adding rules to a tree programmatically.
+// The ID is not reserved; add the child rule before calling UniqueChildID again.
+func UniqueChildID(parent *Rule, base string) string {
+	if parent == nil {
+		return base
+	}
+	if _, ok := parent.Rules[base]; !ok {
+		return base
+	}
+	for n := 1; ; n++ {
+		id := fmt.Sprintf("%s_%d", base, n)
+		if _, ok := parent.Rules[id]; !ok {
+			return id
+		}
+	}
+}
+
 // ApplyToRule applies the function f to the rule r and its children recursively.
 func ApplyToRule(r *Rule, f func(r *Rule) error) error {
 	err := f(r)
@@ -115,6 +249,249 @@ func ApplyToRule(r *Rule, f func(r *Rule) error) error {
 	return nil
 }
 
+// clone returns a copy of the rule and its children. The copies share the
+// Self, Meta and Program references with the original rules, but not the maps
+// of child rules, so children can be added to or removed from the copy
+// without affecting the original.
+// The copy must be compiled before it is evaluated.
+func (r *Rule) clone() (*Rule, error) {
+	if r == nil {
+		return nil, fmt.Errorf("rule is nil")
+	}
+
+	c := *r
+	c.sortedRules = nil
+	if r.Rules != nil {
+		c.Rules = make(map[string]*Rule, len(r.Rules))
+		for k, cr := range r.Rules {
+			ccr, err := cr.clone()
+			if err != nil {
+				return nil, err
+			}
+			c.Rules[k] = ccr
+		}
+	}
+	return &c, nil
+}
+
+// Validate checks the rule and its descendants for structural problems that
+// would make the rule tree invalid, independently of the expressions and the
+// evaluator. It reports:
+//
+//   - rules with a blank ID
+//   - nil child rules
+//   - child rules whose ID is different from their key in the parent's
+//     Rules map, which allows two children with the same ID
+//   - rules that are their own descendants
+//   - IDs in Order that are not child rules
+//
+// All problems found are returned, joined by errors.Join.
+// Problems with the expressions, such as an expression whose type doesn't
+// match the ResultType, are reported by the evaluator during compilation.
+func (r *Rule) Validate() error {
+	if r == nil {
+		return fmt.Errorf("rule is nil")
+	}
+	return errors.Join(r.validate(r.ID, map[*Rule]bool{})...)
+}
+
+// validate checks the rule and its descendants. The path is the list of rule
+// IDs leading to this rule, and ancestors holds the rules on the path.
+func (r *Rule) validate(path string, ancestors map[*Rule]bool) []error {
+	var errs []error
+
+	if r.ID == "" {
+		errs = append(errs, fmt.Errorf("rule %s: blank rule ID", path))
+	}
+
+	ancestors[r] = true
+	defer delete(ancestors, r)
+
+	for _, id := range r.Order {
+		if _, ok := r.Rules[id]; !ok {
+			errs = append(errs, fmt.Errorf("rule %s: order refers to unknown child rule %s", path, id))
+		}
+	}
+
+	for _, k := range r.sortedChildKeys() {
+		cr := r.Rules[k]
+		cp := path + "/" + k
+		switch {
+		case cr == nil:
+			errs = append(errs, fmt.Errorf("rule %s: child rule is nil", cp))
+			continue
+		case ancestors[cr]:
+			errs = append(errs, fmt.Errorf("rule %s: rule %s is its own descendant", cp, cr.ID))
+			continue
+		case cr.ID != "" && cr.ID != k:
+			errs = append(errs, fmt.Errorf("rule %s: child rule ID %s does not match its key %s", cp, cr.ID, k))
+		}
+		errs = append(errs, cr.validate(cp, ancestors)...)
+	}
+	return errs
+}
+
+// sortedChildKeys returns the keys of the child rules in alphabetical order
+func (r *Rule) sortedChildKeys() []string {
+	keys := make([]string, 0, len(r.Rules))
+	for k := range r.Rules {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Size returns the number of rules in the rule tree: the rule itself and
+// all its descendants.
+func (r *Rule) Size() int {
+	if r == nil {
+		return 0
+	}
+	n := 1
+	for _, c := range r.Rules {
+		n += c.Size()
+	}
+	return n
+}
+
+// Depth returns the number of levels in the rule tree. A rule without
+// child rules has a depth of 1.
+func (r *Rule) Depth() int {
+	if r == nil {
+		return 0
+	}
+	max := 0
+	for _, c := range r.Rules {
+		if d := c.Depth(); d > max {
+			max = d
+		}
+	}
+	return max + 1
+}
+
+// EffectiveAt reports whether the rule is effective at the time: t is at or
+// after EffectiveFrom, and before EffectiveTo. Nil bounds are open-ended.
+func (r *Rule) EffectiveAt(t time.Time) bool {
+	if r.EffectiveFrom != nil && t.Before(*r.EffectiveFrom) {
+		return false
+	}
+	if r.EffectiveTo != nil && !t.Before(*r.EffectiveTo) {
+		return false
+	}
+	return true
+}
+
+// FindByMeta returns the rules in the rule tree, including the rule itself,
+// whose Meta matches. The rules are listed depth-first, with child rules in
+// order of rule ID.
+func (r *Rule) FindByMeta(match func(meta interface{}) bool) []*Rule {
+	if r == nil || match == nil {
+		return nil
+	}
+	var found []*Rule
+	if match(r.Meta) {
+		found = append(found, r)
+	}
+	for _, k := range r.sortedChildKeys() {
+		found = append(found, r.Rules[k].FindByMeta(match)...)
+	}
+	return found
+}
+
+// Leaves returns the rules in the rule tree without child rules, including
+// the rule itself if it has none. The rules are listed depth-first, with
+// child rules in order of rule ID.
+func (r *Rule) Leaves() []*Rule {
+	if r == nil {
+		return nil
+	}
+	if len(r.Rules) == 0 {
+		return []*Rule{r}
+	}
+	var leaves []*Rule
+	for _, k := range r.sortedChildKeys() {
+		leaves = append(leaves, r.Rules[k].Leaves()...)
+	}
+	return leaves
+}
+
+// FindRule returns the first rule in the rule tree, including the rule
+// itself, with the ID, and the rule's ancestors, starting with r. Rules are
+// searched depth-first, with child rules in order of rule ID, so if rules in
+// different parts of the tree share the ID, the same rule is always found.
+// FindRule returns nil if no rule has the ID.
+func (r *Rule) FindRule(id string) (rule *Rule, ancestors []*Rule) {
+	paths := r.findRules(id, nil, true)
+	if len(paths) == 0 {
+		return nil, nil
+	}
+	p := paths[0]
+	return p[len(p)-1], p[:len(p)-1]
+}
+
+// FindAllRules returns the path to each rule in the rule tree, including the
+// rule itself, with the ID. A path lists the rules from r to the rule with
+// the ID, which is last. The paths are in the order FindRule searches the
+// rules, so the first path leads to the rule found by FindRule.
+func (r *Rule) FindAllRules(id string) [][]*Rule {
+	return r.findRules(id, nil, false)
+}
+
+// findRules returns the paths to the rules with the ID in the tree below
+// the path, stopping at the first one if first is set
+func (r *Rule) findRules(id string, path []*Rule, first bool) [][]*Rule {
+	if r == nil {
+		return nil
+	}
+	path = append(path[:len(path):len(path)], r)
+	var found [][]*Rule
+	if r.ID == id {
+		found = append(found, path)
+		if first {
+			return found
+		}
+	}
+	for _, k := range r.sortedChildKeys() {
+		found = append(found, r.Rules[k].findRules(id, path, first)...)
+		if first && len(found) > 0 {
+			return found
+		}
+	}
+	return found
+}
+
+// Hash returns a hash of the content of the rule and its children, in hex.
+// The hash covers the rule IDs, expressions, result types, evaluator tags,
+// schemas (the element names, types, aliases and defaults), outputs,
+// messages, priorities, shard conditions, child orders, result keys,
+// effective times, allowed fields and the serializable EvalOptions.
+// Program, Meta, Self and Annotations are not included. Rules with the same
+// content have the same hash, so use it to decide whether a rule must be
+// recompiled, or whether cached results are still valid.
+func (r *Rule) Hash() string {
+	h := sha256.New()
+	writeRule(h, r, true)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Uncompiled returns the IDs of the rules in the rule tree, including the
+// rule itself, that have an expression but no compiled Program. After a
+// successful Compile the list is empty, if the evaluator produces programs.
+// The rules are listed depth-first, with child rules in order of rule ID.
+func (r *Rule) Uncompiled() []string {
+	if r == nil {
+		return nil
+	}
+	var ids []string
+	if r.Expr != "" && r.Program == nil {
+		ids = append(ids, r.ID)
+	}
+	for _, k := range r.sortedChildKeys() {
+		ids = append(ids, r.Rules[k].Uncompiled()...)
+	}
+	return ids
+}
+
 // String returns a list of all the rules in hierarchy, with
 // child rules sorted in evaluation order.
 func (r *Rule) String() string {
@@ -201,6 +578,10 @@ func (r *Rule) sortChildRules(fn func(rules []*Rule, i, j int) bool, force bool)
 		})
 	}
 
+	if len(r.Order) > 0 {
+		keys = r.applyOrder(keys)
+	}
+
 	/*
 		if len(keys) > 0 {
 		fmt.Printf("  sorted: ")
@@ -215,6 +596,39 @@ func (r *Rule) sortChildRules(fn func(rules []*Rule, i, j int) bool, force bool)
 	return keys
 }
 
+// applyOrder moves the rules listed in the rule's Order to the front of the
+// list, in the order listed, keeping the order of the remaining rules
+func (r *Rule) applyOrder(rules []*Rule) []*Rule {
+	position := make(map[string]int, len(r.Order))
+	for i, id := range r.Order {
+		if _, ok := position[id]; !ok {
+			position[id] = i
+		}
+	}
+
+	ordered := make([]*Rule, len(r.Order))
+	rest := make([]*Rule, 0, len(rules))
+	for _, cr := range rules {
+		if cr == nil {
+			rest = append(rest, cr)
+			continue
+		}
+		if i, ok := position[cr.ID]; ok && ordered[i] == nil {
+			ordered[i] = cr
+		} else {
+			rest = append(rest, cr)
+		}
+	}
+
+	list := make([]*Rule, 0, len(rules))
+	for _, cr := range ordered {
+		if cr != nil {
+			list = append(list, cr)
+		}
+	}
+	return append(list, rest...)
+}
+
 // SortRulesAlpha will sort rules alphabetically by their rule ID
 func SortRulesAlpha(rules []*Rule, i, j int) bool {
 	return rules[i].ID < rules[j].ID
@@ -225,6 +639,17 @@ func SortRulesAlphaDesc(rules []*Rule, i, j int) bool {
 	return rules[i].ID > rules[j].ID
 }
 
+// SortRulesPriority will sort rules by their Priority, highest first, and
+// rules with the same priority alphabetically by their rule ID, so the order
+// is always the same. Combined with StopFirstPositiveChild, it selects the
+// passing rule with the highest priority.
+func SortRulesPriority(rules []*Rule, i, j int) bool {
+	if rules[i].Priority != rules[j].Priority {
+		return rules[i].Priority > rules[j].Priority
+	}
+	return rules[i].ID < rules[j].ID
+}
+
 /*
 // sortChildKeys sorts the IDs of the child rules according to the
 // SortFunc set in evaluation options. If no SortFunc is set, the evaluation
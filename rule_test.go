@@ -1,7 +1,9 @@
 package indigo_test
 
 import (
+	"context"
 	"testing"
+	"time"
 
 	"github.com/ezachrisen/indigo"
 	"github.com/matryer/is"
@@ -16,3 +18,313 @@ func TestNew(t *testing.T) {
 	is.True(r.ID == "blah")
 	is.True(len(r.Schema.Elements) == 0)
 }
+
+func TestValidate(t *testing.T) {
+	is := is.New(t)
+
+	is.NoErr(makeRule().Validate())
+
+	cases := map[string]struct {
+		change func(r *indigo.Rule)
+		want   string
+	}{
+		"blank ID": {
+			change: func(r *indigo.Rule) { r.Rules["B"].Rules["b1"].ID = "" },
+			want:   "rule rule1/B/b1: blank rule ID",
+		},
+		"nil child": {
+			change: func(r *indigo.Rule) { r.Rules["E"].Rules["e4"] = nil },
+			want:   "rule rule1/E/e4: child rule is nil",
+		},
+		"duplicate ID": {
+			change: func(r *indigo.Rule) { r.Rules["D"].Rules["d2"].ID = "d1" },
+			want:   "rule rule1/D/d2: child rule ID d1 does not match its key d2",
+		},
+		"own descendant": {
+			change: func(r *indigo.Rule) { r.Rules["B"].Rules["b4"].Rules["B"] = r.Rules["B"] },
+			want:   "rule rule1/B/b4/B: rule B is its own descendant",
+		},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			is := is.New(t)
+			r := makeRule()
+			c.change(r)
+			err := r.Validate()
+			is.True(err != nil)
+			is.Equal(err.Error(), c.want)
+		})
+	}
+
+	// All problems are reported
+	r := makeRule()
+	r.ID = ""
+	r.Rules["E"].Rules["e4"] = nil
+	r.Rules["D"].Rules["d2"].ID = "d1"
+	err := r.Validate()
+	is.True(err != nil)
+	is.Equal(len(err.(interface{ Unwrap() []error }).Unwrap()), 3)
+}
+
+// Test that child rules are evaluated and presented in the rule's Order
+func TestOrder(t *testing.T) {
+	is := is.New(t)
+
+	r := makeRule()
+	r.Order = []string{"E", "B"} // D is not listed, so it is last
+	r.Rules["B"].Order = []string{"b4", "b3", "b2", "b1"}
+	r.Rules["B"].Rules["b4"].Order = []string{"b4-1", "b4-2"}
+	r.Rules["E"].Order = []string{"e3", "e1", "e2"}
+	r.Rules["D"].EvalOptions.SortFunc = indigo.SortRulesAlphaDesc
+	is.NoErr(r.Validate())
+
+	e := indigo.NewEngine(newMockEvaluator())
+	is.NoErr(e.Compile(r))
+
+	u, err := e.Eval(context.Background(), r, map[string]interface{}{}, indigo.ReturnDiagnostics(true))
+	is.NoErr(err)
+
+	ids := []string{}
+	for _, c := range u.Flat() {
+		ids = append(ids, c.Rule.ID)
+	}
+	is.Equal(ids, []string{"rule1", "E", "e3", "e1", "e2", "B", "b4", "b4-1", "b4-2", "b3", "b2", "b1", "D", "d3", "d2", "d1"})
+
+	evaluated := []string{}
+	for _, cr := range u.Results["B"].RulesEvaluated {
+		evaluated = append(evaluated, cr.ID)
+	}
+	is.Equal(evaluated, []string{"b4", "b3", "b2", "b1"})
+
+	r.Order = append(r.Order, "X")
+	is.Equal(r.Validate().Error(), "rule rule1: order refers to unknown child rule X")
+}
+
+func TestSizeAndDepth(t *testing.T) {
+	is := is.New(t)
+
+	r := makeRule()
+	is.Equal(r.Size(), 16)
+	is.Equal(r.Depth(), 4)
+
+	is.Equal(r.Rules["E"].Size(), 4)
+	is.Equal(r.Rules["E"].Depth(), 2)
+
+	leaf := r.Rules["B"].Rules["b4"].Rules["b4-1"]
+	is.Equal(leaf.Size(), 1)
+	is.Equal(leaf.Depth(), 1)
+
+	var nilRule *indigo.Rule
+	is.Equal(nilRule.Size(), 0)
+	is.Equal(nilRule.Depth(), 0)
+}
+
+func TestLeaves(t *testing.T) {
+	is := is.New(t)
+
+	ids := func(rules []*indigo.Rule) []string {
+		list := []string{}
+		for _, r := range rules {
+			list = append(list, r.ID)
+		}
+		return list
+	}
+
+	r := makeRule()
+	is.Equal(ids(r.Leaves()), []string{"b1", "b2", "b3", "b4-1", "b4-2", "d1", "d2", "d3", "e1", "e2", "e3"})
+	is.Equal(ids(r.Rules["B"].Leaves()), []string{"b1", "b2", "b3", "b4-1", "b4-2"})
+
+	leaf := r.Rules["D"].Rules["d1"]
+	is.Equal(ids(leaf.Leaves()), []string{"d1"})
+
+	// A rule whose child rules were removed is a leaf
+	r.Rules["E"].Rules = map[string]*indigo.Rule{}
+	is.Equal(ids(r.Leaves()), []string{"b1", "b2", "b3", "b4-1", "b4-2", "d1", "d2", "d3", "E"})
+
+	var nilRule *indigo.Rule
+	is.Equal(len(nilRule.Leaves()), 0)
+}
+
+func TestFindByMeta(t *testing.T) {
+	is := is.New(t)
+
+	r := makeRule()
+	r.Rules["B"].Rules["b4"].Rules["b4-2"].Meta = "audit"
+	r.Rules["D"].Meta = "audit"
+	r.Rules["D"].Rules["d1"].Meta = 42
+	r.Rules["E"].Rules["e2"].Meta = "audit"
+
+	ids := func(rules []*indigo.Rule) []string {
+		list := []string{}
+		for _, r := range rules {
+			list = append(list, r.ID)
+		}
+		return list
+	}
+
+	audit := r.FindByMeta(func(meta interface{}) bool { return meta == "audit" })
+	is.Equal(ids(audit), []string{"b4-2", "D", "e2"})
+
+	untagged := r.FindByMeta(func(meta interface{}) bool { return meta == nil })
+	is.Equal(len(untagged), 12)
+	is.Equal(untagged[0].ID, "rule1")
+
+	none := r.FindByMeta(func(meta interface{}) bool { return meta == "missing" })
+	is.Equal(len(none), 0)
+}
+
+func TestFindRule(t *testing.T) {
+	is := is.New(t)
+
+	r := makeRule()
+	// The same ID in two subtrees
+	r.Rules["B"].Rules["b4"].Rules["dup"] = &indigo.Rule{ID: "dup", Expr: `true`}
+	r.Rules["E"].Rules["dup"] = &indigo.Rule{ID: "dup", Expr: `false`}
+
+	ids := func(rules []*indigo.Rule) []string {
+		list := []string{}
+		for _, r := range rules {
+			list = append(list, r.ID)
+		}
+		return list
+	}
+
+	for i := 0; i < 20; i++ {
+		x, ancestors := r.FindRule("dup")
+		is.Equal(x, r.Rules["B"].Rules["b4"].Rules["dup"])
+		is.Equal(ids(ancestors), []string{"rule1", "B", "b4"})
+	}
+
+	all := r.FindAllRules("dup")
+	is.Equal(len(all), 2)
+	is.Equal(ids(all[0]), []string{"rule1", "B", "b4", "dup"})
+	is.Equal(ids(all[1]), []string{"rule1", "E", "dup"})
+	is.Equal(all[1][2], r.Rules["E"].Rules["dup"])
+
+	x, ancestors := r.FindRule("rule1")
+	is.Equal(x, r)
+	is.Equal(len(ancestors), 0)
+
+	x, _ = r.FindRule("missing")
+	is.True(x == nil)
+	is.Equal(len(r.FindAllRules("missing")), 0)
+}
+
+func TestUncompiled(t *testing.T) {
+	is := is.New(t)
+
+	r := makeRule()
+	r.Rules["D"].Expr = ""
+
+	want := []string{}
+	for _, x := range r.FindByMeta(func(interface{}) bool { return true }) {
+		if x.Expr != "" {
+			want = append(want, x.ID)
+		}
+	}
+	is.True(len(want) > 0)
+	is.Equal(r.Uncompiled(), want)
+
+	e := indigo.NewEngine(newMockEvaluator())
+	is.NoErr(e.Compile(r))
+	is.Equal(len(r.Uncompiled()), 0)
+
+	// A rule added after compilation is reported
+	r.Rules["B"].Rules["new"] = &indigo.Rule{ID: "new", Expr: `true`}
+	is.Equal(r.Uncompiled(), []string{"new"})
+}
+
+func TestHash(t *testing.T) {
+	is := is.New(t)
+
+	r1 := makeRule()
+	r2 := makeRule()
+	is.Equal(r1.Hash(), r2.Hash())
+	is.Equal(len(r1.Hash()), 64)
+
+	// Program, Meta and Self are not included
+	e := indigo.NewEngine(newMockEvaluator())
+	is.NoErr(e.Compile(r2))
+	r2.Meta = "changed"
+	r2.Rules["B"].Self = 42
+	is.Equal(r1.Hash(), r2.Hash())
+
+	// Changing an expression anywhere in the tree changes the hash
+	r2.Rules["B"].Rules["b4"].Rules["b4-2"].Expr = "something else"
+	is.True(r1.Hash() != r2.Hash())
+
+	// So does changing a schema element
+	r2 = makeRule()
+	r2.Schema.Elements = append(r2.Schema.Elements, indigo.DataElement{Name: "x", Type: indigo.Int{}})
+	is.True(r1.Hash() != r2.Hash())
+
+	r3 := makeRule()
+	r3.Schema.Elements = append(r3.Schema.Elements, indigo.DataElement{Name: "x", Type: indigo.Float{}})
+	is.True(r3.Hash() != r2.Hash())
+
+	// And the result type and the evaluation options
+	r2 = makeRule()
+	r2.ResultType = indigo.Int{}
+	is.True(r1.Hash() != r2.Hash())
+
+	r2 = makeRule()
+	r2.Rules["D"].EvalOptions.StopFirstPositiveChild = true
+	is.True(r1.Hash() != r2.Hash())
+
+	// And the other fields that change how the rules are evaluated
+	now := time.Now()
+	changes := map[string]func(r *indigo.Rule){
+		"order":     func(r *indigo.Rule) { r.Order = []string{"D", "B"} },
+		"resultkey": func(r *indigo.Rule) { r.ResultKey = "x" },
+		"from":      func(r *indigo.Rule) { r.EffectiveFrom = &now },
+		"to":        func(r *indigo.Rule) { r.EffectiveTo = &now },
+		"allowed":   func(r *indigo.Rule) { r.AllowedFields = []string{} },
+		"default": func(r *indigo.Rule) {
+			r.Schema.Elements = append(r.Schema.Elements, indigo.DataElement{Name: "x", Type: indigo.Int{}, Default: 1})
+		},
+	}
+	r3 = makeRule()
+	r3.Schema.Elements = append(r3.Schema.Elements, indigo.DataElement{Name: "x", Type: indigo.Int{}})
+	for name, change := range changes {
+		r2 = makeRule()
+		change(r2)
+		is.True(r1.Hash() != r2.Hash()) // the changed field is hashed
+		if name == "default" {
+			is.True(r3.Hash() != r2.Hash())
+		}
+	}
+
+	// Only the allow-list distinguishes between a nil and an empty list
+	r2 = makeRule()
+	r2.Order = []string{}
+	is.Equal(r1.Hash(), r2.Hash())
+}
+
+func TestUniqueChildID(t *testing.T) {
+	is := is.New(t)
+
+	r := indigo.NewRule("root", "")
+	is.Equal(indigo.UniqueChildID(r, "default"), "default")
+
+	for i := 0; i < 3; i++ {
+		id := indigo.UniqueChildID(r, "default")
+		r.Rules[id] = indigo.NewRule(id, "")
+	}
+	is.Equal(len(r.Rules), 3)
+	is.True(r.Rules["default"] != nil)
+	is.True(r.Rules["default_1"] != nil)
+	is.True(r.Rules["default_2"] != nil)
+
+	// Gaps are filled first
+	delete(r.Rules, "default_1")
+	is.Equal(indigo.UniqueChildID(r, "default"), "default_1")
+
+	// A suffixed name already in use is skipped
+	r.Rules["x"] = indigo.NewRule("x", "")
+	r.Rules["x_1"] = indigo.NewRule("x_1", "")
+	is.Equal(indigo.UniqueChildID(r, "x"), "x_2")
+
+	is.Equal(indigo.UniqueChildID(nil, "a"), "a")
+	is.Equal(indigo.UniqueChildID(&indigo.Rule{ID: "no_children"}, "a"), "a")
+}
@@ -2,11 +2,15 @@ package indigo
 
 import (
 	"fmt"
+	"reflect"
 	"strings"
+	"time"
 
 	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/reflect/protoreflect"
 	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 // Schema defines the variable names and their data types used in a
@@ -41,6 +45,38 @@ func (s *Schema) String() string {
 	return x.String()
 }
 
+// Merge returns a schema with the elements of the schema followed by the
+// elements of the other schemas, in order. Elements with the same name and
+// type are included once, as first seen; Merge returns an error if elements
+// with the same name have different types. The ID, name, description and
+// meta of the schema are kept; if the schema has no ID, the first ID found in
+// the other schemas is used.
+// Use Merge to compose schemas from reusable fragments.
+func (s Schema) Merge(others ...Schema) (Schema, error) {
+	m := s
+	m.Elements = make([]DataElement, 0, len(s.Elements))
+	seen := map[string]DataElement{}
+
+	for _, o := range append([]Schema{s}, others...) {
+		if m.ID == "" {
+			m.ID = o.ID
+		}
+		for _, el := range o.Elements {
+			prev, ok := seen[el.Name]
+			if !ok {
+				seen[el.Name] = el
+				m.Elements = append(m.Elements, el)
+				continue
+			}
+			if TypeString(prev.Type) != TypeString(el.Type) {
+				return Schema{}, fmt.Errorf("schema %s: element %s has type %s, and type %s in another schema",
+					o.ID, el.Name, TypeString(el.Type), TypeString(prev.Type))
+			}
+		}
+	}
+	return m, nil
+}
+
 // DataElement defines a named variable in a schema
 type DataElement struct {
 	// Short, user-friendly name of the variable. This is the name
@@ -55,10 +91,23 @@ type DataElement struct {
 
 	// Optional description of the type.
 	Description string `json:"description"`
+
+	// Optional value to use when the data passed to Eval does not have a
+	// value for the element. The value must be assignable to the Type;
+	// Compile returns an error if it isn't. If nil, the element has no default.
+	Default interface{} `json:"-"`
+
+	// Optional alternative name for the variable, such as "enrolled" for
+	// an element named "student.EnrollmentDate". Rules may use either name;
+	// the data passed to Eval only needs a value under Name.
+	Alias string `json:"alias,omitempty"`
 }
 
 // String returns a human-readable representation of the element
 func (e *DataElement) String() string {
+	if e.Alias != "" {
+		return fmt.Sprintf("  %s (%s) alias %s", e.Name, e.Type, e.Alias)
+	}
 	return fmt.Sprintf("  %s (%s)", e.Name, e.Type)
 }
 
@@ -150,25 +199,101 @@ func (p Proto) String() string {
 func (t List) String() string { return fmt.Sprintf("[]%v", t.ValueType) }
 func (t Map) String() string  { return fmt.Sprintf("map[%s]%s", t.KeyType, t.ValueType) }
 
+// checkDefault returns an error if the element's default value is not
+// assignable to the element's type
+func (e *DataElement) checkDefault() error {
+	if e.Default == nil {
+		return nil
+	}
+	if !assignable(e.Type, e.Default) {
+		return fmt.Errorf("default value %v (%T) for %s is not assignable to %v", e.Default, e.Default, e.Name, e.Type)
+	}
+	return nil
+}
+
+// assignable reports whether the value can be used as a value of the type
+func assignable(t Type, v interface{}) bool {
+	switch x := t.(type) {
+	case nil, Any:
+		return true
+	case Proto:
+		m, ok := v.(proto.Message)
+		if !ok || x.Message == nil {
+			return false
+		}
+		return m.ProtoReflect().Descriptor().FullName() == x.Message.ProtoReflect().Descriptor().FullName()
+	case Duration:
+		switch v.(type) {
+		case time.Duration, *durationpb.Duration:
+			return true
+		}
+		return false
+	case Timestamp:
+		switch v.(type) {
+		case time.Time, *timestamppb.Timestamp:
+			return true
+		}
+		return false
+	}
+
+	rv := reflect.ValueOf(v)
+	switch x := t.(type) {
+	case String:
+		return rv.Kind() == reflect.String
+	case Bool:
+		return rv.Kind() == reflect.Bool
+	case Int:
+		switch rv.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return true
+		}
+		return false
+	case Float:
+		return rv.Kind() == reflect.Float32 || rv.Kind() == reflect.Float64
+	case List:
+		if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+			return false
+		}
+		for i := 0; i < rv.Len(); i++ {
+			if !assignable(x.ValueType, rv.Index(i).Interface()) {
+				return false
+			}
+		}
+		return true
+	case Map:
+		if rv.Kind() != reflect.Map {
+			return false
+		}
+		iter := rv.MapRange()
+		for iter.Next() {
+			if !assignable(x.KeyType, iter.Key().Interface()) || !assignable(x.ValueType, iter.Value().Interface()) {
+				return false
+			}
+		}
+		return true
+	default:
+		return false
+	}
+}
+
 // ParseType parses a string that represents an Indigo type and returns the type.
 // The primitive types are their lower-case names (string, int, duration, etc.)
-// Maps and lists look like Go maps and slices: map[string]float and []string.
+// Maps and lists look like Go maps and slices: map[string]float and []string,
+// and may be nested: map[string][]int.
 // Proto types look like this: proto(protoname)
 // Before parsing types, protocol buffer types must be available in the global
 // protocol buffer registry, either by importing at compile time or registering them
 // separately from a descriptor file at run time. ParseType returns an error if a
 // protocol buffer type is missing.
+// TypeString produces the string that ParseType parses.
 func ParseType(t string) (Type, error) {
 
-	if strings.Contains(t, "map") {
+	switch {
+	case strings.HasPrefix(t, "map"):
 		return parseMap(t)
-	}
-
-	if strings.Contains(t, "[]") {
+	case strings.HasPrefix(t, "[]"):
 		return parseList(t)
-	}
-
-	if strings.Contains(t, "proto(") {
+	case strings.HasPrefix(t, "proto("):
 		return parseProto(t)
 	}
 
@@ -192,24 +317,60 @@ func ParseType(t string) (Type, error) {
 	}
 }
 
+// TypeString returns the name of the type in the format parsed by ParseType,
+// such that ParseType(TypeString(t)) returns a type equal to t.
+// Use it to store types, for example when saving a schema to a database.
+func TypeString(t Type) string {
+	switch x := t.(type) {
+	case nil:
+		return "any"
+	case List:
+		return "[]" + TypeString(x.ValueType)
+	case Map:
+		return "map[" + TypeString(x.KeyType) + "]" + TypeString(x.ValueType)
+	case Proto:
+		name, err := x.ProtoFullName()
+		if err != nil {
+			return "proto()"
+		}
+		return "proto(" + name + ")"
+	default:
+		return t.String()
+	}
+}
+
 // parseMap parses a string and returns an Indigo map type.
 // The string must in the format map[<keytype]<valuetype>.
 // Example: map[string]int
 func parseMap(t string) (Type, error) {
 
-	var keyTypeName string
-	var valueTypeName string
+	if !strings.HasPrefix(t, "map[") {
+		return Any{}, fmt.Errorf("bad map specification: %s", t)
+	}
 
-	t = strings.ReplaceAll(t, "[", " ")
-	t = strings.ReplaceAll(t, "]", " ")
+	// Find the bracket closing the key type, which may itself contain brackets
+	depth := 0
+	end := -1
+	for i := len("map"); i < len(t) && end == -1; i++ {
+		switch t[i] {
+		case '[':
+			depth++
+		case ']':
+			depth--
+			if depth == 0 {
+				end = i
+			}
+		}
+	}
 
-	n, err := fmt.Sscanf(t, "map %s %s", &keyTypeName, &valueTypeName)
-	if err != nil {
-		return Any{}, err
+	if end == -1 {
+		return Any{}, fmt.Errorf("bad map specification: %s", t)
 	}
 
-	if n < 2 {
-		return Any{}, fmt.Errorf("wanted 2 items parsed, got %d", n)
+	keyTypeName := t[len("map["):end]
+	valueTypeName := t[end+1:]
+	if keyTypeName == "" || valueTypeName == "" {
+		return Any{}, fmt.Errorf("bad map specification: %s", t)
 	}
 
 	keyType, err := ParseType(keyTypeName)
@@ -232,10 +393,9 @@ func parseMap(t string) (Type, error) {
 // The string must be in the format []<valuetype>
 // Example: []string
 func parseList(t string) (Type, error) {
-	var valueTypeName string
-	_, err := fmt.Sscanf(t, "[]%s", &valueTypeName)
-	if err != nil {
-		return Any{}, err
+	valueTypeName := strings.TrimPrefix(t, "[]")
+	if valueTypeName == "" {
+		return Any{}, fmt.Errorf("bad list specification: %s", t)
 	}
 	valueType, err := ParseType(valueTypeName)
 	if err != nil {
@@ -254,7 +414,7 @@ func parseProto(t string) (Type, error) {
 	startParen := strings.Index(t, "(")
 	endParen := strings.Index(t, ")")
 
-	if startParen == -1 || endParen == -1 || startParen > endParen || endParen > len(t) || endParen-startParen == 1 {
+	if startParen == -1 || endParen == -1 || startParen > endParen || endParen != len(t)-1 || endParen-startParen == 1 {
 		return Any{}, fmt.Errorf("bad proto specification")
 	}
 
@@ -142,3 +142,81 @@ func TestParser(t *testing.T) {
 		}
 	}
 }
+
+// Test that every type survives a round trip through TypeString and ParseType
+func TestTypeStringRoundTrip(t *testing.T) {
+	is := is.New(t)
+
+	cases := map[string]indigo.Type{
+		"string":                         indigo.String{},
+		"int":                            indigo.Int{},
+		"float":                          indigo.Float{},
+		"bool":                           indigo.Bool{},
+		"duration":                       indigo.Duration{},
+		"timestamp":                      indigo.Timestamp{},
+		"any":                            indigo.Any{},
+		"proto(testdata.school.Student)": indigo.Proto{Message: &school.Student{}},
+		"[]string":                       indigo.List{ValueType: indigo.String{}},
+		"[][]int":                        indigo.List{ValueType: indigo.List{ValueType: indigo.Int{}}},
+		"map[string]int":                 indigo.Map{KeyType: indigo.String{}, ValueType: indigo.Int{}},
+		"map[string][]float":             indigo.Map{KeyType: indigo.String{}, ValueType: indigo.List{ValueType: indigo.Float{}}},
+		"[]map[int]timestamp":            indigo.List{ValueType: indigo.Map{KeyType: indigo.Int{}, ValueType: indigo.Timestamp{}}},
+		"map[string]map[string]bool": indigo.Map{
+			KeyType:   indigo.String{},
+			ValueType: indigo.Map{KeyType: indigo.String{}, ValueType: indigo.Bool{}},
+		},
+		"[]proto(testdata.school.Student)": indigo.List{ValueType: indigo.Proto{Message: &school.Student{}}},
+	}
+
+	for name, typ := range cases {
+		is.Equal(indigo.TypeString(typ), name)
+		parsed, err := indigo.ParseType(indigo.TypeString(typ))
+		is.NoErr(err)
+		is.True(reflect.DeepEqual(parsed, typ)) // round trip
+	}
+
+	for _, bad := range []string{"map[string", "[]map[]int", "proto(testdata.school.Student)x", "list[string]"} {
+		_, err := indigo.ParseType(bad)
+		is.True(err != nil)
+	}
+}
+
+func TestSchemaMerge(t *testing.T) {
+	is := is.New(t)
+
+	common := indigo.Schema{
+		ID: "common",
+		Elements: []indigo.DataElement{
+			{Name: "now", Type: indigo.Timestamp{}},
+			{Name: "self", Type: indigo.Proto{Message: &school.Student{}}},
+		},
+	}
+
+	education := indigo.Schema{
+		Name: "education",
+		Elements: []indigo.DataElement{
+			{Name: "student", Type: indigo.Proto{Message: &school.Student{}}},
+			{Name: "now", Type: indigo.Timestamp{}},
+		},
+	}
+
+	s, err := education.Merge(common)
+	is.NoErr(err)
+	is.Equal(s.ID, "common") // education has no ID
+	is.Equal(s.Name, "education")
+
+	names := []string{}
+	for _, el := range s.Elements {
+		names = append(names, el.Name)
+	}
+	is.Equal(names, []string{"student", "now", "self"})
+	is.Equal(len(education.Elements), 2) // the schema is unchanged
+
+	conflicting := indigo.Schema{
+		ID:       "conflicting",
+		Elements: []indigo.DataElement{{Name: "now", Type: indigo.String{}}},
+	}
+	_, err = s.Merge(conflicting)
+	is.True(err != nil)
+	is.Equal(err.Error(), "schema conflicting: element now has type string, and type timestamp in another schema")
+}
@@ -0,0 +1,78 @@
+package indigo
+
+// SLOMetrics summarizes an evaluation for service-level monitoring.
+// See Result.SLOMetrics.
+//
+// The metrics are computed from the result tree. In parallel mode (see
+// ParallelOrdered and ParallelSubtrees), the child rules are evaluated before
+// their results are processed, so with options that stop processing early,
+// such as StopFirstPositiveChild, rules whose results were not processed
+// were still evaluated but are not counted in TotalRules or ParallelRules.
+type SLOMetrics struct {
+	// The number of rules evaluated, including rules whose results were
+	// discarded (see Result.EvalCount)
+	TotalRules int
+
+	// The number of the rules counted in TotalRules that were evaluated
+	// concurrently with their sibling rules (see Result.EvalParallelCount)
+	ParallelRules int
+
+	// ParallelRules divided by TotalRules; 0 if no rules were evaluated
+	ParallelRate float64
+
+	// The number of results in the result tree. Less than TotalRules if
+	// results were discarded.
+	Results int
+
+	// The number of results in the result tree that passed
+	Passed int
+
+	// Passed divided by Results; 0 if there are no results
+	PassRate float64
+
+	// The number of results in the result tree whose evaluation failed, but
+	// did not stop the evaluation. These are the rules with an unknown
+	// outcome due to missing data (see the UnknownOnMissingData option), and
+	// the rules with a collected error (see the CollectErrors option).
+	ErrorCount int
+
+	// The depth of the deepest result in the result tree; the result itself
+	// is at depth 1
+	MaxDepth int
+}
+
+// SLOMetrics computes the SLOMetrics for the result tree.
+func (u *Result) SLOMetrics() SLOMetrics {
+	m := SLOMetrics{}
+	if u == nil {
+		return m
+	}
+
+	m.TotalRules = u.EvalCount
+	m.ParallelRules = u.EvalParallelCount
+	if m.TotalRules > 0 {
+		m.ParallelRate = float64(m.ParallelRules) / float64(m.TotalRules)
+	}
+	u.sloMetrics(&m, 1)
+	if m.Results > 0 {
+		m.PassRate = float64(m.Passed) / float64(m.Results)
+	}
+	return m
+}
+
+// sloMetrics adds the result and its children to the metrics
+func (u *Result) sloMetrics(m *SLOMetrics, depth int) {
+	m.Results++
+	if u.Pass {
+		m.Passed++
+	}
+	if u.missingData || u.Error != nil {
+		m.ErrorCount++
+	}
+	if depth > m.MaxDepth {
+		m.MaxDepth = depth
+	}
+	for _, c := range u.Results {
+		c.sloMetrics(m, depth+1)
+	}
+}
@@ -0,0 +1,185 @@
+package indigo
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// TenantEngine compiles and evaluates rules for multiple tenants, keeping
+// the rule sets of the tenants isolated from each other.
+//
+// When a rule is compiled for a tenant, the engine compiles a copy of the rule
+// tree and stores it with the tenant. The rule passed to Compile is not modified,
+// so the same rule can be compiled for several tenants, each with its own
+// schema. Rules are evaluated by tenant and rule ID.
+//
+// The expression evaluator is shared by all tenants. Do not use evaluator
+// options that override the rule's schema (such as cel.FixedSchema) if tenants
+// have different schemas.
+//
+// A TenantEngine is safe for concurrent use.
+type TenantEngine struct {
+	e ExpressionCompilerEvaluator
+
+	mu      sync.Mutex
+	tenants map[string]*tenant
+	now     func() time.Time // see WithTenantClock
+}
+
+// TenantEngineOption is a functional option for configuring the TenantEngine.
+type TenantEngineOption func(t *TenantEngine)
+
+// WithTenantClock sets the function the engine uses to get the current time
+// when recording when a tenant was last used, and when evicting inactive
+// tenants. The default is time.Now.
+func WithTenantClock(now func() time.Time) TenantEngineOption {
+	return func(t *TenantEngine) {
+		t.now = now
+	}
+}
+
+// tenant holds the schema and compiled rules for one tenant
+type tenant struct {
+	schema   *Schema
+	rules    map[string]*Rule
+	lastUsed time.Time
+}
+
+// NewTenantEngine initializes and returns a TenantEngine.
+func NewTenantEngine(e ExpressionCompilerEvaluator, opts ...TenantEngineOption) *TenantEngine {
+	t := &TenantEngine{
+		e:       e,
+		tenants: map[string]*tenant{},
+		now:     time.Now,
+	}
+	for _, o := range opts {
+		o(t)
+	}
+	return t
+}
+
+// SetSchema sets the schema for the tenant. Rules compiled for the tenant
+// after the schema is set use the tenant's schema instead of their own.
+// Rules already compiled for the tenant must be compiled again to use the schema.
+func (t *TenantEngine) SetSchema(tenantID string, s Schema) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.tenant(tenantID).schema = &s
+}
+
+// Compile compiles a copy of the rule tree for the tenant, replacing any
+// rule previously compiled for the tenant with the same ID.
+// If compilation fails, the tenant's previously compiled rule is kept.
+func (t *TenantEngine) Compile(tenantID string, r *Rule, opts ...CompilationOption) error {
+	if r == nil {
+		return fmt.Errorf("rule is nil")
+	}
+
+	t.mu.Lock()
+	tn := t.tenant(tenantID)
+	schema := tn.schema
+	t.mu.Unlock()
+
+	c, err := r.clone()
+	if err != nil {
+		return err
+	}
+
+	if schema != nil {
+		_ = ApplyToRule(c, func(r *Rule) error {
+			r.Schema = *schema
+			return nil
+		})
+	}
+
+	if err := NewEngine(t.e).Compile(c, opts...); err != nil {
+		return fmt.Errorf("tenant %s: %w", tenantID, err)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	// The tenant may have been evicted while we compiled
+	tn = t.tenant(tenantID)
+	tn.rules[c.ID] = c
+	return nil
+}
+
+// Eval evaluates the tenant's compiled rule with the ID against the data.
+// See DefaultEngine.Eval.
+func (t *TenantEngine) Eval(ctx context.Context, tenantID, ruleID string,
+	d map[string]interface{}, opts ...EvalOption) (*Result, error) {
+
+	t.mu.Lock()
+	tn, ok := t.tenants[tenantID]
+	var r *Rule
+	if ok {
+		tn.lastUsed = t.now()
+		r = tn.rules[ruleID]
+	}
+	t.mu.Unlock()
+
+	switch {
+	case !ok:
+		return nil, fmt.Errorf("tenant %s not found", tenantID)
+	case r == nil:
+		return nil, fmt.Errorf("tenant %s: rule %s not found", tenantID, ruleID)
+	}
+
+	u, err := NewEngine(t.e).Eval(ctx, r, d, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("tenant %s: %w", tenantID, err)
+	}
+	return u, nil
+}
+
+// Remove deletes the tenant's schema and compiled rules.
+func (t *TenantEngine) Remove(tenantID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.tenants, tenantID)
+}
+
+// EvictInactive removes the tenants that have not compiled or evaluated rules
+// within the maxIdle duration, and returns their IDs.
+func (t *TenantEngine) EvictInactive(maxIdle time.Duration) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	evicted := []string{}
+	for id, tn := range t.tenants {
+		if now.Sub(tn.lastUsed) > maxIdle {
+			delete(t.tenants, id)
+			evicted = append(evicted, id)
+		}
+	}
+	return evicted
+}
+
+// Tenants returns the IDs of the tenants known to the engine.
+func (t *TenantEngine) Tenants() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ids := make([]string, 0, len(t.tenants))
+	for id := range t.tenants {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// tenant returns the tenant with the ID, creating it if it doesn't exist,
+// and marks it as used. The caller must hold the lock.
+func (t *TenantEngine) tenant(tenantID string) *tenant {
+	tn, ok := t.tenants[tenantID]
+	if !ok {
+		tn = &tenant{
+			rules: map[string]*Rule{},
+		}
+		t.tenants[tenantID] = tn
+	}
+	tn.lastUsed = t.now()
+	return tn
+}
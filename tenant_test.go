@@ -0,0 +1,85 @@
+package indigo_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ezachrisen/indigo"
+	"github.com/ezachrisen/indigo/cel"
+	"github.com/matryer/is"
+)
+
+// Test that the same rule compiled for two tenants with different schemas
+// is evaluated correctly for each tenant
+func TestTenantEngine(t *testing.T) {
+	is := is.New(t)
+
+	te := indigo.NewTenantEngine(cel.NewEvaluator())
+	te.SetSchema("acme", indigo.Schema{
+		Elements: []indigo.DataElement{{Name: "x", Type: indigo.Int{}}},
+	})
+	te.SetSchema("globex", indigo.Schema{
+		Elements: []indigo.DataElement{{Name: "x", Type: indigo.Float{}}},
+	})
+
+	r := indigo.NewRule("root", "")
+	r.Rules["big"] = indigo.NewRule("big", "x > 5")
+
+	is.NoErr(te.Compile("acme", r))
+	is.True(te.Compile("globex", r) != nil) // 5 is an int, x is a float
+
+	r.Rules["big"].Expr = "x > 5.0"
+	is.NoErr(te.Compile("globex", r))
+	is.True(r.Rules["big"].Program == nil) // the caller's rule is not compiled
+
+	u, err := te.Eval(context.Background(), "acme", "root", map[string]interface{}{"x": 6})
+	is.NoErr(err)
+	is.True(u.Results["big"].ExpressionPass)
+
+	u, err = te.Eval(context.Background(), "globex", "root", map[string]interface{}{"x": 4.5})
+	is.NoErr(err)
+	is.True(!u.Results["big"].ExpressionPass)
+
+	// acme still uses its own compiled copy of the rule
+	is.Equal(u.Rule.Rules["big"].Expr, "x > 5.0")
+	u, err = te.Eval(context.Background(), "acme", "root", map[string]interface{}{"x": 6})
+	is.NoErr(err)
+	is.Equal(u.Rule.Rules["big"].Expr, "x > 5")
+
+	_, err = te.Eval(context.Background(), "initech", "root", map[string]interface{}{"x": 6})
+	is.True(err != nil) // unknown tenant
+
+	_, err = te.Eval(context.Background(), "acme", "nope", map[string]interface{}{"x": 6})
+	is.True(err != nil) // unknown rule
+}
+
+// Test that tenants that have not been used are evicted
+func TestTenantEngineEviction(t *testing.T) {
+	is := is.New(t)
+
+	now := time.Date(2024, time.January, 1, 12, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+
+	te := indigo.NewTenantEngine(newMockEvaluator(), indigo.WithTenantClock(clock))
+	is.NoErr(te.Compile("a", makeRule()))
+	now = now.Add(20 * time.Minute)
+	is.NoErr(te.Compile("b", makeRule()))
+	now = now.Add(10 * time.Minute)
+
+	is.Equal(len(te.EvictInactive(30*time.Minute)), 0) // a was used 30 minutes ago
+	is.Equal(len(te.Tenants()), 2)
+
+	evicted := te.EvictInactive(10 * time.Minute)
+	is.Equal(evicted, []string{"a"})
+	is.Equal(te.Tenants(), []string{"b"})
+
+	_, err := te.Eval(context.Background(), "a", "rule1", map[string]interface{}{})
+	is.True(err != nil) // tenant a was evicted
+
+	_, err = te.Eval(context.Background(), "b", "rule1", map[string]interface{}{})
+	is.NoErr(err)
+
+	te.Remove("b")
+	is.Equal(len(te.Tenants()), 0)
+}
@@ -0,0 +1,296 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.35.2
+// 	protoc        v3.19.3
+// source: contact.proto
+
+package school
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	anypb "google.golang.org/protobuf/types/known/anypb"
+	reflect "reflect"
+	sync "sync"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type Contact struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Name string `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	// Types that are assignable to Method:
+	//	*Contact_Email
+	//	*Contact_Phone
+	Method  isContact_Method `protobuf_oneof:"method"`
+	Details *anypb.Any       `protobuf:"bytes,4,opt,name=details,proto3" json:"details,omitempty"`
+}
+
+func (x *Contact) Reset() {
+	*x = Contact{}
+	mi := &file_contact_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Contact) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Contact) ProtoMessage() {}
+
+func (x *Contact) ProtoReflect() protoreflect.Message {
+	mi := &file_contact_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Contact.ProtoReflect.Descriptor instead.
+func (*Contact) Descriptor() ([]byte, []int) {
+	return file_contact_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *Contact) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (m *Contact) GetMethod() isContact_Method {
+	if m != nil {
+		return m.Method
+	}
+	return nil
+}
+
+func (x *Contact) GetEmail() *EmailContact {
+	if x, ok := x.GetMethod().(*Contact_Email); ok {
+		return x.Email
+	}
+	return nil
+}
+
+func (x *Contact) GetPhone() *PhoneContact {
+	if x, ok := x.GetMethod().(*Contact_Phone); ok {
+		return x.Phone
+	}
+	return nil
+}
+
+func (x *Contact) GetDetails() *anypb.Any {
+	if x != nil {
+		return x.Details
+	}
+	return nil
+}
+
+type isContact_Method interface {
+	isContact_Method()
+}
+
+type Contact_Email struct {
+	Email *EmailContact `protobuf:"bytes,2,opt,name=email,proto3,oneof"`
+}
+
+type Contact_Phone struct {
+	Phone *PhoneContact `protobuf:"bytes,3,opt,name=phone,proto3,oneof"`
+}
+
+func (*Contact_Email) isContact_Method() {}
+
+func (*Contact_Phone) isContact_Method() {}
+
+type EmailContact struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Address string `protobuf:"bytes,1,opt,name=address,proto3" json:"address,omitempty"`
+}
+
+func (x *EmailContact) Reset() {
+	*x = EmailContact{}
+	mi := &file_contact_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *EmailContact) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*EmailContact) ProtoMessage() {}
+
+func (x *EmailContact) ProtoReflect() protoreflect.Message {
+	mi := &file_contact_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use EmailContact.ProtoReflect.Descriptor instead.
+func (*EmailContact) Descriptor() ([]byte, []int) {
+	return file_contact_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *EmailContact) GetAddress() string {
+	if x != nil {
+		return x.Address
+	}
+	return ""
+}
+
+type PhoneContact struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Number string `protobuf:"bytes,1,opt,name=number,proto3" json:"number,omitempty"`
+}
+
+func (x *PhoneContact) Reset() {
+	*x = PhoneContact{}
+	mi := &file_contact_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *PhoneContact) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PhoneContact) ProtoMessage() {}
+
+func (x *PhoneContact) ProtoReflect() protoreflect.Message {
+	mi := &file_contact_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PhoneContact.ProtoReflect.Descriptor instead.
+func (*PhoneContact) Descriptor() ([]byte, []int) {
+	return file_contact_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *PhoneContact) GetNumber() string {
+	if x != nil {
+		return x.Number
+	}
+	return ""
+}
+
+var File_contact_proto protoreflect.FileDescriptor
+
+var file_contact_proto_rawDesc = []byte{
+	0x0a, 0x0d, 0x63, 0x6f, 0x6e, 0x74, 0x61, 0x63, 0x74, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x12,
+	0x0f, 0x74, 0x65, 0x73, 0x74, 0x64, 0x61, 0x74, 0x61, 0x2e, 0x73, 0x63, 0x68, 0x6f, 0x6f, 0x6c,
+	0x1a, 0x19, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2f, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75,
+	0x66, 0x2f, 0x61, 0x6e, 0x79, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x22, 0xc5, 0x01, 0x0a, 0x07,
+	0x43, 0x6f, 0x6e, 0x74, 0x61, 0x63, 0x74, 0x12, 0x12, 0x0a, 0x04, 0x6e, 0x61, 0x6d, 0x65, 0x18,
+	0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x6e, 0x61, 0x6d, 0x65, 0x12, 0x35, 0x0a, 0x05, 0x65,
+	0x6d, 0x61, 0x69, 0x6c, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x1d, 0x2e, 0x74, 0x65, 0x73,
+	0x74, 0x64, 0x61, 0x74, 0x61, 0x2e, 0x73, 0x63, 0x68, 0x6f, 0x6f, 0x6c, 0x2e, 0x45, 0x6d, 0x61,
+	0x69, 0x6c, 0x43, 0x6f, 0x6e, 0x74, 0x61, 0x63, 0x74, 0x48, 0x00, 0x52, 0x05, 0x65, 0x6d, 0x61,
+	0x69, 0x6c, 0x12, 0x35, 0x0a, 0x05, 0x70, 0x68, 0x6f, 0x6e, 0x65, 0x18, 0x03, 0x20, 0x01, 0x28,
+	0x0b, 0x32, 0x1d, 0x2e, 0x74, 0x65, 0x73, 0x74, 0x64, 0x61, 0x74, 0x61, 0x2e, 0x73, 0x63, 0x68,
+	0x6f, 0x6f, 0x6c, 0x2e, 0x50, 0x68, 0x6f, 0x6e, 0x65, 0x43, 0x6f, 0x6e, 0x74, 0x61, 0x63, 0x74,
+	0x48, 0x00, 0x52, 0x05, 0x70, 0x68, 0x6f, 0x6e, 0x65, 0x12, 0x2e, 0x0a, 0x07, 0x64, 0x65, 0x74,
+	0x61, 0x69, 0x6c, 0x73, 0x18, 0x04, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x14, 0x2e, 0x67, 0x6f, 0x6f,
+	0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e, 0x41, 0x6e, 0x79,
+	0x52, 0x07, 0x64, 0x65, 0x74, 0x61, 0x69, 0x6c, 0x73, 0x42, 0x08, 0x0a, 0x06, 0x6d, 0x65, 0x74,
+	0x68, 0x6f, 0x64, 0x22, 0x28, 0x0a, 0x0c, 0x45, 0x6d, 0x61, 0x69, 0x6c, 0x43, 0x6f, 0x6e, 0x74,
+	0x61, 0x63, 0x74, 0x12, 0x18, 0x0a, 0x07, 0x61, 0x64, 0x64, 0x72, 0x65, 0x73, 0x73, 0x18, 0x01,
+	0x20, 0x01, 0x28, 0x09, 0x52, 0x07, 0x61, 0x64, 0x64, 0x72, 0x65, 0x73, 0x73, 0x22, 0x26, 0x0a,
+	0x0c, 0x50, 0x68, 0x6f, 0x6e, 0x65, 0x43, 0x6f, 0x6e, 0x74, 0x61, 0x63, 0x74, 0x12, 0x16, 0x0a,
+	0x06, 0x6e, 0x75, 0x6d, 0x62, 0x65, 0x72, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x06, 0x6e,
+	0x75, 0x6d, 0x62, 0x65, 0x72, 0x42, 0x35, 0x5a, 0x33, 0x67, 0x69, 0x74, 0x68, 0x75, 0x62, 0x2e,
+	0x63, 0x6f, 0x6d, 0x2f, 0x65, 0x7a, 0x61, 0x63, 0x68, 0x72, 0x69, 0x73, 0x65, 0x6e, 0x2f, 0x69,
+	0x6e, 0x64, 0x69, 0x67, 0x6f, 0x2f, 0x74, 0x65, 0x73, 0x74, 0x64, 0x61, 0x74, 0x61, 0x2f, 0x73,
+	0x63, 0x68, 0x6f, 0x6f, 0x6c, 0x3b, 0x73, 0x63, 0x68, 0x6f, 0x6f, 0x6c, 0x62, 0x06, 0x70, 0x72,
+	0x6f, 0x74, 0x6f, 0x33,
+}
+
+var (
+	file_contact_proto_rawDescOnce sync.Once
+	file_contact_proto_rawDescData = file_contact_proto_rawDesc
+)
+
+func file_contact_proto_rawDescGZIP() []byte {
+	file_contact_proto_rawDescOnce.Do(func() {
+		file_contact_proto_rawDescData = protoimpl.X.CompressGZIP(file_contact_proto_rawDescData)
+	})
+	return file_contact_proto_rawDescData
+}
+
+var file_contact_proto_msgTypes = make([]protoimpl.MessageInfo, 3)
+var file_contact_proto_goTypes = []any{
+	(*Contact)(nil),      // 0: testdata.school.Contact
+	(*EmailContact)(nil), // 1: testdata.school.EmailContact
+	(*PhoneContact)(nil), // 2: testdata.school.PhoneContact
+	(*anypb.Any)(nil),    // 3: google.protobuf.Any
+}
+var file_contact_proto_depIdxs = []int32{
+	1, // 0: testdata.school.Contact.email:type_name -> testdata.school.EmailContact
+	2, // 1: testdata.school.Contact.phone:type_name -> testdata.school.PhoneContact
+	3, // 2: testdata.school.Contact.details:type_name -> google.protobuf.Any
+	3, // [3:3] is the sub-list for method output_type
+	3, // [3:3] is the sub-list for method input_type
+	3, // [3:3] is the sub-list for extension type_name
+	3, // [3:3] is the sub-list for extension extendee
+	0, // [0:3] is the sub-list for field type_name
+}
+
+func init() { file_contact_proto_init() }
+func file_contact_proto_init() {
+	if File_contact_proto != nil {
+		return
+	}
+	file_contact_proto_msgTypes[0].OneofWrappers = []any{
+		(*Contact_Email)(nil),
+		(*Contact_Phone)(nil),
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: file_contact_proto_rawDesc,
+			NumEnums:      0,
+			NumMessages:   3,
+			NumExtensions: 0,
+			NumServices:   0,
+		},
+		GoTypes:           file_contact_proto_goTypes,
+		DependencyIndexes: file_contact_proto_depIdxs,
+		MessageInfos:      file_contact_proto_msgTypes,
+	}.Build()
+	File_contact_proto = out.File
+	file_contact_proto_rawDesc = nil
+	file_contact_proto_goTypes = nil
+	file_contact_proto_depIdxs = nil
+}